@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
 )
 
 var Endianness = binary.LittleEndian
@@ -15,9 +18,37 @@ var Endianness = binary.LittleEndian
 const (
 	//http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L398
 	MAX_AUDIT_MESSAGE_LENGTH = 8970
+	MAX_RECONNECT_BACKOFF    = time.Second * 30       // Upper bound on the wait between reconnect attempts
+	REQUEST_TIMEOUT          = time.Second            // How long to wait for the kernel to reply to a request
+	RELEASE_RECEIVE_TIMEOUT  = time.Millisecond * 100 // How long Receive waits for more messages once we were released
+	AUDIT_GET                = 1000                   // Get the kernel audit status
+	AUDIT_SET                = 1001                   // Set the kernel audit status
+	AUDIT_NLGRP_READLOG      = 1                      // Multicast group the kernel sends a copy of every event to, since 3.16
 )
 
-//TODO: this should live in a marshaller
+// Selects which fields of an AUDIT_SET payload the kernel should apply
+const (
+	AUDIT_STATUS_ENABLED       = 0x01
+	AUDIT_STATUS_FAILURE       = 0x02
+	AUDIT_STATUS_PID           = 0x04
+	AUDIT_STATUS_RATE_LIMIT    = 0x08
+	AUDIT_STATUS_BACKLOG_LIMIT = 0x10
+)
+
+// Values for the failure field, what the kernel does when it can not deliver an event
+const (
+	AUDIT_FAIL_SILENT = 0
+	AUDIT_FAIL_PRINTK = 1
+	AUDIT_FAIL_PANIC  = 2
+)
+
+// Returned by Receive once reconnecting has failed too many times in a row
+var ErrReconnectFailed = errors.New("Gave up reconnecting to the netlink socket")
+
+// Returned by Receive once the client was released and every message left on the socket was received
+var ErrReleased = errors.New("Released the netlink socket and received every message left on it")
+
+// TODO: this should live in a marshaller
 type AuditStatusPayload struct {
 	Mask            uint32
 	Enabled         uint32
@@ -31,56 +62,189 @@ type AuditStatusPayload struct {
 	BacklogWaitTime uint32
 }
 
-//An alias to give the header a similar name here
+// An alias to give the header a similar name here
 type NetlinkPacket syscall.NlMsghdr
 
+// How the netlink socket is set up, the zero value is a plain socket with the system default receive buffer
+type NetlinkOptions struct {
+	ReceiveBuffer      int           // Receive buffer size in bytes, 0 for the system default
+	ForceReceiveBuffer bool          // Set the receive buffer with SO_RCVBUFFORCE, which ignores net.core.rmem_max but needs CAP_NET_ADMIN
+	ReceiveTimeout     time.Duration // Longest Receive waits for a message before returning none, 0 waits forever
+	MulticastGroup     uint32        // Read events from this multicast group instead of registering as the audit pid, 0 for none
+	MaxFailures        int           // Consecutive failed reconnects before giving up, 0 disables reconnecting
+	Backoff            time.Duration // Wait before the first reconnect attempt
+}
+
 type NetlinkClient struct {
-	fd      int
-	address syscall.Sockaddr
-	seq     uint32
-	buf     []byte
+	fd        int
+	address   syscall.Sockaddr
+	seq       uint32
+	buf       []byte
+	recvSize  int
+	force     bool          // Set the receive buffer with SO_RCVBUFFORCE
+	timeout   time.Duration // Receive timeout of the socket, 0 for none
+	multicast uint32        // Multicast group we read events from, 0 when we are the audit pid
+	lock      sync.RWMutex  // Guards fd while reconnecting
+
+	maxFailures int           // Consecutive failed reconnects before giving up, 0 disables reconnecting
+	backoff     time.Duration // Wait before the first reconnect attempt, doubled for every consecutive failure
+	failures    int
+
+	maxRecvSize int  // Largest receive buffer to grow to when the kernel reports an overflow, 0 disables growing
+	capped      bool // Set once we have warned about hitting maxRecvSize
+
+	released int32 // Set once we gave up the audit pid, we never claim it again
 }
 
 func NewNetlinkClient(recvSize int) *NetlinkClient {
+	return NewNetlinkClientWithRetry(recvSize, 0, 0)
+}
+
+// Creates a netlink client that reconnects the socket when receiving fails
+func NewNetlinkClientWithRetry(recvSize int, maxFailures int, backoff time.Duration) *NetlinkClient {
+	return NewNetlinkClientWithOptions(NetlinkOptions{ReceiveBuffer: recvSize, MaxFailures: maxFailures, Backoff: backoff})
+}
+
+// Creates a netlink client with full control over the socket
+// Without a multicast group the client registers as the audit pid, and keeps doing so, which takes the events
+// away from any other reader like auditd. With one, every reader in the group gets a copy of each event
+func NewNetlinkClientWithOptions(o NetlinkOptions) *NetlinkClient {
+	n := &NetlinkClient{
+		address:     &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 0, Pid: 0},
+		buf:         make([]byte, MAX_AUDIT_MESSAGE_LENGTH),
+		recvSize:    o.ReceiveBuffer,
+		force:       o.ForceReceiveBuffer,
+		timeout:     o.ReceiveTimeout,
+		multicast:   o.MulticastGroup,
+		maxFailures: o.MaxFailures,
+		backoff:     o.Backoff,
+	}
+
+	if err := n.connect(); err != nil {
+		logger.Err("%v", err)
+		panic(err)
+	}
+
+	if n.multicast > 0 {
+		return n
+	}
+
+	go func() {
+		for !n.Released() {
+			n.KeepConnection()
+			time.Sleep(time.Second * 5)
+		}
+	}()
+
+	return n
+}
+
+// Opens and binds a new netlink socket, replacing the current one
+func (n *NetlinkClient) connect() error {
 	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_AUDIT)
 	if err != nil {
-		logger.Err("Could not create a socket: %v", err)
-		panic(err)
+		return fmt.Errorf("Could not create a socket: %v", err)
 	}
 
-	n := &NetlinkClient{
-		fd:      fd,
-		address: &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 0, Pid: 0},
-		buf:     make([]byte, MAX_AUDIT_MESSAGE_LENGTH),
+	// Requests always go to the kernel, only the socket joins the multicast group
+	address := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if n.multicast > 0 {
+		address.Groups = 1 << (n.multicast - 1)
 	}
 
-	if err = syscall.Bind(fd, n.address); err != nil {
+	if err = syscall.Bind(fd, address); err != nil {
 		syscall.Close(fd)
-		logger.Err("Could not bind to netlink socket: %v", err)
-		panic(err)
+		if n.multicast > 0 {
+			return fmt.Errorf("Could not join netlink multicast group %d, this needs kernel 3.16 or newer and CAP_AUDIT_READ: %v", n.multicast, err)
+		}
+
+		return fmt.Errorf("Could not bind to netlink socket: %v", err)
+	}
+
+	if n.timeout > 0 {
+		timeout := syscall.NsecToTimeval(n.timeout.Nanoseconds())
+		if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+			syscall.Close(fd)
+			return fmt.Errorf("Could not set a receive timeout: %v", err)
+		}
 	}
 
 	// Set the buffer size if we were asked
-	if recvSize > 0 {
-		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, recvSize)
+	if n.recvSize > 0 {
+		n.setReceiveBuffer(fd, n.recvSize)
 	}
 
 	// Print the current receive buffer size
-	if v, err := syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
+	if v, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
 		logger.Info("Socket receive buffer size: %d", v)
 	}
 
-	go func() {
-		for {
-			n.KeepConnection()
-			time.Sleep(time.Second * 5)
+	n.lock.Lock()
+	n.fd = fd
+	n.lock.Unlock()
+
+	return nil
+}
+
+// Closes the current socket and keeps trying to open a new one, backing off between attempts
+// Once we are connected we register as the audit pid again
+func (n *NetlinkClient) reconnect(cause error) error {
+	n.lock.Lock()
+	syscall.Close(n.fd)
+	n.lock.Unlock()
+
+	for {
+		n.failures++
+		if n.failures > n.maxFailures {
+			logger.Err("Failed to reconnect to the netlink socket %d times in a row, giving up", n.maxFailures)
+
+			// Whoever carries on past this gets another full round of attempts on the next receive
+			n.failures = 0
+			return ErrReconnectFailed
 		}
-	}()
 
-	return n
+		wait := n.backoff << uint(n.failures-1)
+		if wait > MAX_RECONNECT_BACKOFF || wait <= 0 {
+			wait = MAX_RECONNECT_BACKOFF
+		}
+
+		logger.Warning("Reconnecting to the netlink socket in %v, attempt %d of %d. Error: %v", wait, n.failures, n.maxFailures, cause)
+		time.Sleep(wait)
+
+		if cause = n.connect(); cause == nil {
+			if n.multicast == 0 && !n.Released() {
+				n.KeepConnection()
+			}
+
+			return nil
+		}
+	}
+}
+
+// Errors that do not mean the socket is broken
+func isTransient(err error) bool {
+	switch err {
+	case syscall.EINTR, syscall.EAGAIN, syscall.ENOBUFS:
+		return true
+	}
+
+	return false
 }
 
 func (n *NetlinkClient) Send(np *NetlinkPacket, a *AuditStatusPayload) error {
+	n.lock.RLock()
+	fd := n.fd
+	n.lock.RUnlock()
+
+	if err := syscall.Sendto(fd, n.encode(np, a), 0, n.address); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Serializes the packet, setting its sequence and length
+func (n *NetlinkClient) encode(np *NetlinkPacket, a *AuditStatusPayload) []byte {
 	//We need to get the length first. This is a bit wasteful, but requests are rare so yolo..
 	buf := new(bytes.Buffer)
 	var length int
@@ -99,19 +263,168 @@ func (n *NetlinkClient) Send(np *NetlinkPacket, a *AuditStatusPayload) error {
 		}
 	}
 
-	if err := syscall.Sendto(n.fd, buf.Bytes(), 0, n.address); err != nil {
+	return buf.Bytes()
+}
+
+// Asks the kernel for its audit status, which includes how many events it has lost and its current backlog
+func (n *NetlinkClient) GetStatus() (*AuditStatusPayload, error) {
+	packet := &NetlinkPacket{
+		Type:  AUDIT_GET,
+		Flags: syscall.NLM_F_REQUEST,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	msg, err := n.request(packet, &AuditStatusPayload{})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStatus(msg)
+}
+
+// Changes the kernel audit settings selected by the mask of the payload, see the AUDIT_STATUS_* constants
+// An error is returned if the kernel rejects the change
+func (n *NetlinkClient) SetStatus(status *AuditStatusPayload) error {
+	packet := &NetlinkPacket{
+		Type:  AUDIT_SET,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	msg, err := n.request(packet, status)
+	if err != nil {
 		return err
 	}
 
+	return parseAck(msg)
+}
+
+// Sends a request and waits for the reply
+// A separate socket is used so the reply does not end up mixed in with the events
+func (n *NetlinkClient) request(packet *NetlinkPacket, payload *AuditStatusPayload) (*syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_AUDIT)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	address := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err = syscall.Bind(fd, address); err != nil {
+		return nil, fmt.Errorf("Could not bind to netlink socket: %v", err)
+	}
+
+	timeout := syscall.NsecToTimeval(REQUEST_TIMEOUT.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		return nil, fmt.Errorf("Could not set a receive timeout: %v", err)
+	}
+
+	if err = syscall.Sendto(fd, n.encode(packet, payload), 0, address); err != nil {
+		return nil, fmt.Errorf("Could not send the request: %v", err)
+	}
+
+	buf := make([]byte, MAX_AUDIT_MESSAGE_LENGTH)
+	for {
+		nlen, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Could not receive the reply: %v", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:nlen])
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse the reply: %v", err)
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Seq == packet.Seq {
+				return &msg, nil
+			}
+		}
+	}
+}
+
+// Checks the acknowledgement of a request for an error
+func parseAck(msg *syscall.NetlinkMessage) error {
+	if msg.Header.Type != syscall.NLMSG_ERROR {
+		return fmt.Errorf("Got message type %d instead of an acknowledgement", msg.Header.Type)
+	}
+
+	if len(msg.Data) < 4 {
+		return errors.New("Got a truncated acknowledgement")
+	}
+
+	if code := int32(Endianness.Uint32(msg.Data[0:4])); code < 0 {
+		return syscall.Errno(-code)
+	}
+
 	return nil
 }
 
+// Reads the audit status out of a reply to AUDIT_GET
+func parseStatus(msg *syscall.NetlinkMessage) (*AuditStatusPayload, error) {
+	switch msg.Header.Type {
+	case AUDIT_GET:
+	case syscall.NLMSG_ERROR:
+		if err := parseAck(msg); err != nil {
+			return nil, fmt.Errorf("Could not get the audit status: %v", err)
+		}
+
+		return nil, errors.New("Got an acknowledgement instead of the audit status")
+	default:
+		return nil, fmt.Errorf("Got message type %d instead of the audit status", msg.Header.Type)
+	}
+
+	// Older kernels send fewer fields and newer ones more, anything we do not get is left at 0
+	data := make([]byte, binary.Size(AuditStatusPayload{}))
+	copy(data, msg.Data)
+
+	status := &AuditStatusPayload{}
+	if err := binary.Read(bytes.NewReader(data), Endianness, status); err != nil {
+		return nil, fmt.Errorf("Could not parse the audit status: %v", err)
+	}
+
+	return status, nil
+}
+
+// Allows the receive buffer to be doubled, up to max bytes, every time the kernel reports it overflowed
+func (n *NetlinkClient) SetMaxReceiveBuffer(max int) {
+	n.maxRecvSize = max
+}
+
 func (n *NetlinkClient) Receive() (*syscall.NetlinkMessage, error) {
-	nlen, _, err := syscall.Recvfrom(n.fd, n.buf, 0)
+	n.lock.RLock()
+	fd := n.fd
+	n.lock.RUnlock()
+
+	nlen, _, err := syscall.Recvfrom(fd, n.buf, 0)
+	if err == syscall.EAGAIN && n.Released() {
+		// Nothing is left on the socket and nothing more is coming
+		return nil, ErrReleased
+	}
+
+	if err == syscall.EAGAIN && n.timeout > 0 {
+		// Nothing arrived within the receive timeout
+		return nil, nil
+	}
+
+	if err == syscall.ENOBUFS {
+		// The kernel had to throw away events, we can not know how many
+		metrics.NetlinkOverflows.Inc()
+		n.growReceiveBuffer(fd)
+		return nil, err
+	}
+
 	if err != nil {
+		if n.maxFailures > 0 && !isTransient(err) {
+			if rerr := n.reconnect(err); rerr != nil {
+				return nil, rerr
+			}
+		}
+
 		return nil, err
 	}
 
+	n.failures = 0
+
 	if nlen < 1 {
 		return nil, errors.New("Got a 0 length packet")
 	}
@@ -127,19 +440,122 @@ func (n *NetlinkClient) Receive() (*syscall.NetlinkMessage, error) {
 		Data: n.buf[syscall.SizeofNlMsghdr:nlen],
 	}
 
+	// The status Release asked for to wake us up is no event
+	if msg.Header.Type == AUDIT_GET && n.Released() {
+		return nil, nil
+	}
+
 	return msg, nil
 }
 
+// Gives up the audit pid, so another reader like a new go-audit can take over, and never claims it again
+// The kernel stops sending us events, Receive hands out the messages left on the socket and then returns ErrReleased
+func (n *NetlinkClient) Release() error {
+	atomic.StoreInt32(&n.released, 1)
+
+	n.lock.RLock()
+	fd := n.fd
+	n.lock.RUnlock()
+
+	// Only applies to the next receive, one already waiting is woken up by the status we ask for below
+	timeout := syscall.NsecToTimeval(RELEASE_RECEIVE_TIMEOUT.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		return fmt.Errorf("Could not set a receive timeout: %v", err)
+	}
+
+	// A multicast reader never had the pid
+	if n.multicast == 0 {
+		if err := n.SetStatus(&AuditStatusPayload{Mask: AUDIT_STATUS_PID, Pid: 0}); err != nil {
+			return fmt.Errorf("Could not give up the audit pid: %v", err)
+		}
+	}
+
+	packet := &NetlinkPacket{
+		Type:  AUDIT_GET,
+		Flags: syscall.NLM_F_REQUEST,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	return n.Send(packet, &AuditStatusPayload{})
+}
+
+// Whether Release was called
+func (n *NetlinkClient) Released() bool {
+	return atomic.LoadInt32(&n.released) == 1
+}
+
+// Sets the receive buffer of the socket, with SO_RCVBUFFORCE when asked to. If that is not allowed we fall back to
+// SO_RCVBUF, which the kernel caps at net.core.rmem_max
+func (n *NetlinkClient) setReceiveBuffer(fd int, size int) {
+	if n.force {
+		err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, size)
+		if err == nil {
+			return
+		}
+
+		logger.Warning("Could not force the receive buffer to %d bytes, falling back to net.core.rmem_max. Error: %v", size, err)
+	}
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, size); err != nil {
+		logger.Err("Could not set the receive buffer to %d bytes. Error: %v", size, err)
+	}
+}
+
+// Doubles the receive buffer, up to maxRecvSize
+func (n *NetlinkClient) growReceiveBuffer(fd int) {
+	if n.maxRecvSize < 1 {
+		logger.Warning("Netlink receive buffer overflowed and events were lost, consider raising socket_buffer.receive")
+		return
+	}
+
+	// The kernel reports double what was set to account for its own bookkeeping
+	current, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	if err != nil {
+		logger.Err("Could not get the receive buffer size. Error: %v", err)
+		return
+	}
+
+	size := current
+	if size > n.maxRecvSize {
+		size = n.maxRecvSize
+	}
+
+	if current/2 >= n.maxRecvSize {
+		if !n.capped {
+			logger.Warning("Netlink receive buffer overflowed at the maximum size of %d bytes and events were lost, raise socket_buffer.receive or socket_buffer.max_receive", n.maxRecvSize)
+			n.capped = true
+		}
+		return
+	}
+
+	// SO_RCVBUFFORCE ignores net.core.rmem_max but needs CAP_NET_ADMIN
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, size); err != nil {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+	}
+
+	if err != nil {
+		logger.Err("Could not grow the receive buffer to %d bytes. Error: %v", size, err)
+		return
+	}
+
+	// Keep the new size if we ever have to reconnect
+	n.recvSize = size
+	logger.Warning("Netlink receive buffer overflowed and events were lost, grew it to %d bytes", size)
+}
+
 func (n *NetlinkClient) KeepConnection() {
+	if n.Released() {
+		return
+	}
+
 	payload := &AuditStatusPayload{
-		Mask:    4,
+		Mask:    AUDIT_STATUS_PID,
 		Enabled: 1,
 		Pid:     uint32(syscall.Getpid()),
-		//TODO: Failure: http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L338
 	}
 
 	packet := &NetlinkPacket{
-		Type:  uint16(1001),
+		Type:  AUDIT_SET,
 		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
 		Pid:   uint32(syscall.Getpid()),
 	}
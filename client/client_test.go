@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"github.com/stretchr/testify/assert"
+	"log"
 	"os"
 	"syscall"
 	"testing"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
 )
 
 func TestNetlinkClient_KeepConnection(t *testing.T) {
@@ -87,6 +90,185 @@ func TestNetlinkClient_SendReceive(t *testing.T) {
 	assert.Equal(t, "socket operation on non-socket", err.Error(), "Error was incorrect")
 }
 
+func TestNetlinkClient_Reconnect(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+	n.maxFailures = 2
+	n.backoff = time.Millisecond
+
+	// A successful receive resets the failure count
+	n.failures = 1
+	sendReceive(t, n, &NetlinkPacket{Type: uint16(1001)}, &AuditStatusPayload{})
+	assert.Equal(t, 0, n.failures, "Failures should reset after a receive")
+
+	// Transient errors never reconnect
+	assert.True(t, isTransient(syscall.EINTR))
+	assert.True(t, isTransient(syscall.ENOBUFS))
+	assert.False(t, isTransient(syscall.EBADF))
+
+	// Give up once we are out of attempts
+	n.failures = 2
+	syscall.Close(n.fd)
+	_, err := n.Receive()
+	assert.Equal(t, ErrReconnectFailed, err)
+	assert.Contains(t, elb.String(), "Failed to reconnect to the netlink socket")
+	assert.Equal(t, 0, n.failures, "Giving up should start the next receive over")
+
+	// Reconnecting is disabled by default
+	n.maxFailures = 0
+	n.failures = 0
+	_, err = n.Receive()
+	assert.Equal(t, syscall.EBADF, err)
+	assert.Equal(t, 0, n.failures)
+}
+
+func TestNetlinkClient_growReceiveBuffer(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+
+	// Growing is disabled by default
+	syscall.SetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+	n.growReceiveBuffer(n.fd)
+	v, _ := syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	assert.Equal(t, 8192, v)
+	assert.Contains(t, elb.String(), "consider raising socket_buffer.receive")
+
+	// Doubles every time
+	n.SetMaxReceiveBuffer(12288)
+	n.growReceiveBuffer(n.fd)
+	v, _ = syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	assert.Equal(t, 16384, v)
+	assert.Equal(t, 8192, n.recvSize)
+
+	// Up to the cap
+	n.growReceiveBuffer(n.fd)
+	v, _ = syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	assert.Equal(t, 24576, v)
+	assert.False(t, n.capped)
+
+	elb.Reset()
+	n.growReceiveBuffer(n.fd)
+	assert.True(t, n.capped)
+	assert.Contains(t, elb.String(), "Netlink receive buffer overflowed at the maximum size of")
+}
+
+func TestNetlinkClient_ReceiveTimeout(t *testing.T) {
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+
+	n.timeout = 10 * time.Millisecond
+	timeout := syscall.NsecToTimeval(n.timeout.Nanoseconds())
+	syscall.SetsockoptTimeval(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+
+	// Nothing to receive is not an error
+	msg, err := n.Receive()
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+
+	msg = sendReceive(t, n, &NetlinkPacket{Type: uint16(1001)}, &AuditStatusPayload{})
+	assert.Equal(t, uint16(1001), msg.Header.Type)
+}
+
+func TestNetlinkClient_Release(t *testing.T) {
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+
+	// A multicast reader has no pid to give up, it only wakes up the receiver
+	n.multicast = AUDIT_NLGRP_READLOG
+	sendReceive(t, n, &NetlinkPacket{Type: uint16(1300)}, &AuditStatusPayload{})
+	n.Send(&NetlinkPacket{Type: uint16(1300)}, &AuditStatusPayload{})
+	assert.Nil(t, n.Release())
+	assert.True(t, n.Released())
+
+	// What was already on the socket is still handed out, the wake up is not
+	msg, err := n.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1300), msg.Header.Type)
+
+	msg, err = n.Receive()
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+
+	// The pid is never claimed again and the receiver learns there is nothing more coming
+	n.KeepConnection()
+	started := time.Now()
+	msg, err = n.Receive()
+	assert.Equal(t, ErrReleased, err)
+	assert.Nil(t, msg)
+	assert.True(t, time.Since(started) >= RELEASE_RECEIVE_TIMEOUT)
+}
+
+func TestNetlinkClient_setReceiveBuffer(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+
+	n.setReceiveBuffer(n.fd, 4096)
+	v, _ := syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	assert.Equal(t, 8192, v)
+
+	// Forcing works the same when we are allowed to, and falls back to the capped size when we are not
+	n.force = true
+	n.setReceiveBuffer(n.fd, 6144)
+	v, _ = syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	assert.Equal(t, 12288, v)
+
+	syscall.Close(n.fd)
+	n.setReceiveBuffer(n.fd, 6144)
+	assert.Contains(t, elb.String(), "Could not force the receive buffer to 6144 bytes")
+	assert.Contains(t, elb.String(), "Could not set the receive buffer to 6144 bytes")
+}
+
+func Test_parseStatus(t *testing.T) {
+	// A full reply from a newer kernel
+	data := make([]byte, 44)
+	Endianness.PutUint32(data[4:8], 1)
+	Endianness.PutUint32(data[20:24], 8192)
+	Endianness.PutUint32(data[24:28], 12)
+	Endianness.PutUint32(data[28:32], 3)
+
+	status, err := parseStatus(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: AUDIT_GET}, Data: data})
+	assert.Nil(t, err)
+	assert.Equal(t, &AuditStatusPayload{Enabled: 1, BacklogLimit: 8192, Lost: 12, Backlog: 3}, status)
+
+	// Older kernels send less
+	status, err = parseStatus(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: AUDIT_GET}, Data: data[:32]})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), status.Backlog)
+
+	// Errors
+	errData := make([]byte, 4)
+	code := -int32(syscall.EPERM)
+	Endianness.PutUint32(errData, uint32(code))
+	status, err = parseStatus(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.NLMSG_ERROR}, Data: errData})
+	assert.EqualError(t, err, "Could not get the audit status: operation not permitted")
+	assert.Nil(t, status)
+
+	status, err = parseStatus(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}})
+	assert.EqualError(t, err, "Got message type 1300 instead of the audit status")
+	assert.Nil(t, status)
+}
+
+func Test_parseAck(t *testing.T) {
+	data := make([]byte, 20)
+	assert.Nil(t, parseAck(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.NLMSG_ERROR}, Data: data}))
+
+	code := -int32(syscall.EINVAL)
+	Endianness.PutUint32(data, uint32(code))
+	assert.Equal(t, syscall.EINVAL, parseAck(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.NLMSG_ERROR}, Data: data}))
+
+	assert.EqualError(t, parseAck(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.NLMSG_ERROR}}), "Got a truncated acknowledgement")
+	assert.EqualError(t, parseAck(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: AUDIT_GET}}), "Got message type 1000 instead of an acknowledgement")
+}
+
 func TestNewNetlinkClient(t *testing.T) {
 	lb, elb := hookLogger()
 	defer resetLogger()
@@ -141,16 +323,13 @@ func sendReceive(t *testing.T, n *NetlinkClient, packet *NetlinkPacket, payload
 
 // Resets global loggers
 func resetLogger() {
-	l.SetOutput(os.Stdout)
-	el.SetOutput(os.Stderr)
+	logger.AuditLoggerNew(log.New(os.Stdout, "", 0), log.New(os.Stderr, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
 }
 
 // Hooks the global loggers writers so you can assert their contents
 func hookLogger() (lb *bytes.Buffer, elb *bytes.Buffer) {
 	lb = &bytes.Buffer{}
-	l.SetOutput(lb)
-
 	elb = &bytes.Buffer{}
-	el.SetOutput(elb)
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
 	return
 }
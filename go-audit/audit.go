@@ -1,21 +1,33 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
 	"log"
 	"log/syslog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 	. "github.com/Xeralux/go-audit/client"
 	"github.com/Xeralux/go-audit/logger"
 	. "github.com/Xeralux/go-audit/marshaller"
+	"github.com/Xeralux/go-audit/metrics"
+	. "github.com/Xeralux/go-audit/parser"
 	. "github.com/Xeralux/go-audit/writer"
 )
 
@@ -25,23 +37,203 @@ var el = log.New(os.Stderr, "", 0)
 type executor func(string, ...string) error
 
 func lExec(s string, a ...string) error {
-	return exec.Command(s, a...).Run()
+	// Output keeps stderr around for commandError
+	_, err := exec.Command(s, a...).Output()
+	return commandError(s, err)
+}
+
+// Like executor but hands back what the command printed
+type outputExecutor func(string, ...string) ([]byte, error)
+
+func lOutput(s string, a ...string) ([]byte, error) {
+	out, err := exec.Command(s, a...).Output()
+	return out, commandError(s, err)
+}
+
+// Turns the ways running auditctl usually fails into something that says how to fix it, the binary is missing or
+// we lack CAP_AUDIT_CONTROL. Any other failure gets what the command printed to stderr added
+func commandError(name string, err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *exec.Error:
+		if e.Err == exec.ErrNotFound || os.IsNotExist(e.Err) {
+			return errors.New(fmt.Sprintf("%s not found; install auditd userspace", name))
+		}
+
+		if os.IsPermission(e.Err) {
+			return errors.New(fmt.Sprintf("%s could not be run, insufficient privileges. Error: %s", name, e.Err))
+		}
+	case *os.PathError:
+		if os.IsNotExist(e) {
+			return errors.New(fmt.Sprintf("%s not found; install auditd userspace", name))
+		}
+
+		if os.IsPermission(e) {
+			return errors.New(fmt.Sprintf("%s could not be run, insufficient privileges. Error: %s", name, e.Err))
+		}
+	case *exec.ExitError:
+		stderr := strings.TrimSpace(string(e.Stderr))
+		if strings.Contains(stderr, "Operation not permitted") || strings.Contains(stderr, "must be root") {
+			return errors.New(fmt.Sprintf("%s: insufficient privileges; need CAP_AUDIT_CONTROL", name))
+		}
+
+		if stderr != "" {
+			return errors.New(fmt.Sprintf("%s: %s", e, stderr))
+		}
+	}
+
+	return err
 }
 
 func loadConfig(configFile string) (*viper.Viper, error) {
 	config := viper.New()
 	config.SetConfigFile(configFile)
 
+	config.SetDefault("socket_buffer.max_receive", 0)
+	config.SetDefault("socket_buffer.max_reconnect_failures", 10)
+	config.SetDefault("socket_buffer.reconnect_backoff", "1s")
+	config.SetDefault("socket_buffer.queue_depth", 8192)
+	config.SetDefault("processing.workers", 1)
+	config.SetDefault("protect.max_sustained_eps", 0)
+	config.SetDefault("protect.sustain", "10s")
+	config.SetDefault("protect.cooldown", "5m")
+	config.SetDefault("protect.rate_limit", 0)
+	config.SetDefault("reliability.max_consecutive_failures", 0)
+	config.SetDefault("reliability.on_exhaustion", ON_EXHAUSTION_EXIT)
+	config.SetDefault("netlink.multicast_group", 0)
+	config.SetDefault("netlink.force_receive_buffer", false)
+	config.SetDefault("netlink.receive_timeout", 0)
+	config.SetDefault("priority.low_watermark", 75)
+	config.SetDefault("input.type", INPUT_NETLINK)
+	config.SetDefault("input.netlink.multicast", false)
+	config.SetDefault("input.file.path", "")
+	config.SetDefault("input.file.follow", false)
+	config.SetDefault("heartbeat.interval", 0)
+	config.SetDefault("startup.selftest", false)
+	config.SetDefault("startup.selftest_fatal", false)
 	config.SetDefault("message_tracking.enabled", true)
 	config.SetDefault("message_tracking.log_out_of_order", false)
 	config.SetDefault("message_tracking.max_out_of_order", 500)
+	config.SetDefault("message_tracking.completion_timeout", 2000)
+	config.SetDefault("message_tracking.drop_incomplete", false)
+	config.SetDefault("message_tracking.max_events_per_second", 0)
+	config.SetDefault("message_tracking.max_event_bytes", 0)
+	config.SetDefault("message_tracking.drop_oversized", false)
+	config.SetDefault("message_tracking.log_in_flight_interval", time.Minute)
+	config.SetDefault("output.format", FORMAT_JSON)
+	config.SetDefault("output.cef.vendor", "Xeralux")
+	config.SetDefault("output.cef.product", "go-audit")
+	config.SetDefault("output.cef.version", "1")
+	config.SetDefault("output.cef.severity", 5)
+	config.SetDefault("output.buffer.size", 0)
+	config.SetDefault("output.buffer.flush_interval", "1s")
+	config.SetDefault("output.spool.dir", "")
+	config.SetDefault("output.deadletter.path", "")
+	config.SetDefault("output.spool.max_bytes", 104857600)
+	config.SetDefault("output.spool.replay_interval", "1s")
 	config.SetDefault("output.syslog.enabled", false)
 	config.SetDefault("output.syslog.priority", int(syslog.LOG_LOCAL0|syslog.LOG_WARNING))
 	config.SetDefault("output.syslog.tag", "go-audit")
+	config.SetDefault("output.syslog.hostname", "")
 	config.SetDefault("output.syslog.attempts", "3")
+	config.SetDefault("output.syslog.rfc5424", false)
+	config.SetDefault("output.syslog.write_timeout", "5s")
+	config.SetDefault("output.syslog.template", "")
+
+	for _, name := range outputNames {
+		config.SetDefault("output."+name+".circuit_breaker.failures", 0)
+		config.SetDefault("output."+name+".circuit_breaker.cooldown", "30s")
+		config.SetDefault("output."+name+".retry_backoff.strategy", BACKOFF_FIXED)
+		config.SetDefault("output."+name+".retry_backoff.delay", "1s")
+		config.SetDefault("output."+name+".retry_backoff.max_delay", 0)
+		config.SetDefault("output."+name+".retry_backoff.jitter", 0)
+		config.SetDefault("output."+name+".retry_backoff.max_elapsed", 0)
+	}
+
+	config.SetDefault("output.http.method", "POST")
+	config.SetDefault("output.http.timeout", "5s")
+	config.SetDefault("output.http.batch_size", 1)
+	config.SetDefault("output.http.flush_interval", "1s")
+	config.SetDefault("output.http.max_idle_conns", 2)
+	config.SetDefault("output.http.max_in_flight", 1)
+	config.SetDefault("output.tcp.tls", false)
+	config.SetDefault("output.tcp.timeout", "5s")
+	config.SetDefault("output.tcp.max_buffered", 10000)
+	config.SetDefault("output.tcp.reconnect_backoff", "1s")
+	config.SetDefault("output.unix.type", "stream")
+	config.SetDefault("output.unix.timeout", "5s")
+	config.SetDefault("output.unix.max_buffered", 10000)
+	config.SetDefault("output.unix.reconnect_backoff", "1s")
+	config.SetDefault("output.gelf.protocol", "udp")
+	config.SetDefault("output.gelf.compression", "")
+	config.SetDefault("output.gelf.chunk_size", GELF_CHUNK_SIZE)
+	config.SetDefault("output.gelf.host", "")
+	config.SetDefault("output.gelf.timeout", "5s")
+	config.SetDefault("output.gelf.max_buffered", 10000)
+	config.SetDefault("output.gelf.reconnect_backoff", "1s")
+	config.SetDefault("output.kafka.required_acks", 1)
+	config.SetDefault("output.kafka.timeout", "5s")
+	config.SetDefault("output.kafka.batch_size", 100)
+	config.SetDefault("output.kafka.max_buffered", 10000)
+	config.SetDefault("output.kafka.flush_interval", "1s")
+	config.SetDefault("output.nats.jetstream", false)
+	config.SetDefault("output.nats.timeout", "5s")
+	config.SetDefault("output.nats.tls", false)
+	config.SetDefault("output.elasticsearch.index", "go-audit-%Y.%m.%d")
+	config.SetDefault("output.elasticsearch.timeout", "5s")
+	config.SetDefault("output.elasticsearch.batch_size", 100)
+	config.SetDefault("output.elasticsearch.flush_interval", "1s")
+	config.SetDefault("output.s3.attempts", 3)
+	config.SetDefault("output.s3.prefix", "go-audit/%Y/%m/%d/")
+	config.SetDefault("output.s3.region", "us-east-1")
+	config.SetDefault("output.s3.path_style", false)
+	config.SetDefault("output.s3.timeout", "30s")
+	config.SetDefault("output.s3.max_bytes", 64*1024*1024)
+	config.SetDefault("output.s3.part_size", 8*1024*1024)
+	config.SetDefault("output.s3.flush_interval", "5m")
+	config.SetDefault("resolve.ids", false)
+	config.SetDefault("resolve.cache_size", 1024)
+	config.SetDefault("resolve.cache_ttl", "10m")
+	config.SetDefault("resolve.source", RESOLVE_SOURCE_NSS)
+	config.SetDefault("resolve.passwd_file", PASSWD_FILE)
+	config.SetDefault("resolve.group_file", GROUP_FILE)
+	config.SetDefault("resolve.files_fallback", false)
+	config.SetDefault("transform.decode_hex", false)
+	config.SetDefault("transform.join_split_fields", false)
+	config.SetDefault("transform.require_records", []string{})
+	config.SetDefault("transform.structured", false)
+	config.SetDefault("transform.reassemble_execve", false)
+	config.SetDefault("transform.drop_execve_args", false)
+	config.SetDefault("transform.parse_selinux", false)
+	config.SetDefault("transform.decode_saddr", false)
+	config.SetDefault("transform.resolve_syscall", false)
+	config.SetDefault("transform.parse_timestamp", false)
+	config.SetDefault("transform.emit_seq", false)
+	config.SetDefault("transform.resolve_container", false)
+	config.SetDefault("transform.include_raw", false)
+	config.SetDefault("transform.resolve_saddr", false)
+	config.SetDefault("transform.dedupe_window_ms", 0)
+	config.SetDefault("integrity.hmac_key", "")
+	config.SetDefault("integrity.hmac_key_file", "")
+	config.SetDefault("integrity.chain", false)
+	config.SetDefault("max_age", 0)
+	config.SetDefault("metrics.enabled", false)
+	config.SetDefault("metrics.address", "127.0.0.1:9138")
+	config.SetDefault("metrics.kernel_status_interval", "10s")
+	config.SetDefault("debug.ring_size", 0)
+	for name, v := range rulesDefaults {
+		config.SetDefault("rules."+name, v)
+	}
+
+	config.SetDefault("flush_rules_on_exit", false)
 	config.SetDefault("log.flags", 0)
+	config.SetDefault("log.format", logger.FORMAT_TEXT)
+	config.SetDefault("log.level", "debug")
+	config.SetDefault("log.suppress_rule_setup", false)
 
-	if err := config.ReadInConfig(); err != nil {
+	bindEnv(config)
+	if err := readConfig(config, configFile); err != nil {
 		return nil, err
 	}
 
@@ -51,299 +243,2740 @@ func loadConfig(configFile string) (*viper.Viper, error) {
 	return config, nil
 }
 
-func setRules(config *viper.Viper, e executor) error {
+// Builds the netlink socket options out of the netlink and socket_buffer sections
+func getNetlinkOptions(config *viper.Viper) (NetlinkOptions, error) {
+	group := config.GetInt("netlink.multicast_group")
+	if group < 0 || group > 32 {
+		return NetlinkOptions{}, errors.New(fmt.Sprintf("Netlink multicast_group must be between 0 and 32, %v provided", group))
+	}
+
+	timeout := config.GetDuration("netlink.receive_timeout")
+	if timeout < 0 {
+		return NetlinkOptions{}, errors.New(fmt.Sprintf("Netlink receive_timeout must not be negative, %v provided", timeout))
+	}
+
+	// Passive readers join the group the kernel copies every event to, unless another group was picked
+	if group == 0 && config.GetBool("input.netlink.multicast") {
+		group = AUDIT_NLGRP_READLOG
+	}
+
+	return NetlinkOptions{
+		ReceiveBuffer:      config.GetInt("socket_buffer.receive"),
+		ForceReceiveBuffer: config.GetBool("netlink.force_receive_buffer"),
+		ReceiveTimeout:     timeout,
+		MulticastGroup:     uint32(group),
+		MaxFailures:        config.GetInt("socket_buffer.max_reconnect_failures"),
+		Backoff:            config.GetDuration("socket_buffer.reconnect_backoff"),
+	}, nil
+}
+
+// True when the audit rules and kernel settings belong to someone else, either because we are replaying a file or
+// because we are reading from the multicast group next to auditd
+func leaveKernelAlone(config *viper.Viper) bool {
+	return config.GetString("input.type") == INPUT_FILE || config.GetBool("input.netlink.multicast")
+}
+
+// True when the audit rules belong to someone else, see leaveKernelAlone, or rules.manage is off because a
+// configuration management tool or auditd loads them. The kernel settings are still ours in the latter case
+func leaveRulesAlone(config *viper.Viper) bool {
+	return leaveKernelAlone(config) || !rulesSetting(config, "manage")
+}
+
+// Switches the logger to the configured format and level
+func setupLogger(config *viper.Viper) error {
+	format, level, err := getLogSettings(config)
+	if err != nil {
+		return err
+	}
+
+	if format == logger.FORMAT_JSON {
+		// Prefixes would break the json
+		l.SetFlags(0)
+		el.SetFlags(0)
+	}
+
+	logger.AuditLoggerNew(l, el, nil, format, level)
+	return nil
+}
+
+func getLogSettings(config *viper.Viper) (string, logger.Level, error) {
+	level, err := logger.ParseLevel(config.GetString("log.level"))
+	if err != nil {
+		return "", level, err
+	}
+
+	format := config.GetString("log.format")
+	if format != logger.FORMAT_TEXT && format != logger.FORMAT_JSON {
+		return "", level, errors.New(fmt.Sprintf("Unknown log format `%s`", format))
+	}
+
+	return format, level, nil
+}
+
+// Replaces the live rules with ours. auditctl has no way to check a rule without loading it, so the live rules are
+// saved first and put back if auditctl rejects any of ours, instead of leaving the kernel with part of a rule set
+func setRules(config *viper.Viper, e executor, o outputExecutor) error {
+	// Catch what we can before we touch the live rules
+	rules, err := checkRules(config)
+	if err != nil {
+		return err
+	}
+
+	saved, err := listRules(o)
+	if err != nil {
+		return err
+	}
+
 	// Clear existing rules
 	if err := e("auditctl", "-D"); err != nil {
 		return errors.New(fmt.Sprintf("Failed to flush existing audit rules. Error: %s", err))
 	}
 
-	logger.Info("Flushed existing audit rules")
+	// With hundreds of rules every boot floods the journal, log.suppress_rule_setup leaves a summary instead
+	suppress := config.GetBool("log.suppress_rule_setup")
+	ruleLog := logger.Info
+	if suppress {
+		ruleLog = logger.Debug
+	}
+
+	ruleLog("Flushed existing audit rules")
 
 	// Add ours in
-	if rules := config.GetStringSlice("rules"); len(rules) != 0 {
-		for i, v := range rules {
-			// Skip rules with no content
-			if v == "" {
-				continue
-			}
+	added := 0
+	for i, v := range rules {
+		// Skip rules with no content
+		if v == "" {
+			continue
+		}
 
-			if err := e("auditctl", strings.Fields(v)...); err != nil {
-				return errors.New(fmt.Sprintf("Failed to add rule #%d. Error: %s", i+1, err))
+		if err := e("auditctl", strings.Fields(v)...); err != nil {
+			logger.Err("Failed to add rule #%d `%s`, putting the %d rules from before back. Error: %s", i+1, v, len(saved), err)
+			if rerr := restoreRules(saved, e); rerr != nil {
+				logger.Err("%v", rerr)
 			}
 
-			logger.Info("Added audit rule #%d", i+1)
+			return errors.New(fmt.Sprintf("Failed to add rule #%d `%s`. Error: %s", i+1, v, err))
 		}
-	} else {
-		return errors.New("No audit rules found.")
+
+		ruleLog("Added audit rule #%d", i+1)
+		added++
+	}
+
+	if suppress {
+		logger.Info("Applied %d audit rules, flushed existing", added)
 	}
 
 	return nil
 }
 
-func createOutput(config *viper.Viper) (*AuditWriter, error) {
-	var writer *AuditWriter
-	var err error
-	i := 0
+// Lists the audit rules loaded right now, before we flush them, so they can be put back on exit
+func saveRules(o outputExecutor) ([]string, error) {
+	rules, err := listRules(o)
+	if err != nil {
+		return nil, err
+	}
 
-	if config.GetBool("output.syslog.enabled") == true {
-		i++
-		writer, err = createSyslogOutput(config)
-		if err != nil {
-			return nil, err
-		}
+	for i, rule := range rules {
+		logger.Info("Saved existing audit rule #%d: %s", i+1, rule)
 	}
 
-	if config.GetBool("output.file.enabled") == true {
-		i++
-		writer, err = createFileOutput(config)
-		if err != nil {
-			return nil, err
-		}
+	logger.Info("Saved %d existing audit rules", len(rules))
+	return rules, nil
+}
+
+// Lists the audit rules loaded right now, one per entry
+func listRules(o outputExecutor) ([]string, error) {
+	out, err := o("auditctl", "-l")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to list existing audit rules. Error: %s", err))
 	}
 
-	if config.GetBool("output.stdout.enabled") == true {
-		i++
-		writer, err = createStdOutOutput(config)
-		if err != nil {
-			return nil, err
+	rules := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+
+		// auditctl prints `No rules` when there are none
+		if line == "" || line == "No rules" {
+			continue
 		}
+
+		rules = append(rules, line)
 	}
 
-	if i > 1 {
-		return nil, errors.New("Only one output can be enabled at a time")
+	return rules, nil
+}
+
+// Replaces our audit rules with the ones saved at startup
+// A rule that fails is logged and the rest are still restored
+func restoreRules(saved []string, e executor) error {
+	if err := e("auditctl", "-D"); err != nil {
+		return errors.New(fmt.Sprintf("Failed to flush audit rules before restoring the saved ones. Error: %s", err))
 	}
 
-	if writer == nil {
-		return nil, errors.New("No outputs were configured")
+	failed := 0
+	for i, rule := range saved {
+		if err := e("auditctl", strings.Fields(rule)...); err != nil {
+			logger.Err("Failed to restore saved audit rule #%d: %s. Error: %v", i+1, rule, err)
+			failed++
+			continue
+		}
+
+		logger.Info("Restored saved audit rule #%d: %s", i+1, rule)
+	}
+
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("Failed to restore %d of %d saved audit rules", failed, len(saved)))
 	}
 
-	return writer, nil
+	logger.Info("Restored %d saved audit rules", len(saved))
+	return nil
 }
 
-func createSyslogOutput(config *viper.Viper) (*AuditWriter, error) {
-	attempts := config.GetInt("output.syslog.attempts")
-	if attempts < 1 {
-		return nil, errors.New(
-			fmt.Sprintf("Output attempts for syslog must be at least 1, %v provided", attempts),
-		)
-	}
+// The kernel audit settings, NetlinkClient in practice
+type kernelStatus interface {
+	GetStatus() (*AuditStatusPayload, error)
+	SetStatus(status *AuditStatusPayload) error
+}
 
-	syslogWriter, err := syslog.Dial(
-		config.GetString("output.syslog.network"),
-		config.GetString("output.syslog.address"),
-		syslog.Priority(config.GetInt("output.syslog.priority")),
-		config.GetString("output.syslog.tag"),
-	)
+var failureModes = map[string]uint32{
+	"silent": AUDIT_FAIL_SILENT,
+	"printk": AUDIT_FAIL_PRINTK,
+	"panic":  AUDIT_FAIL_PANIC,
+}
 
+// Applies the kernel audit settings from the config, anything that is not set is left alone
+func setKernelStatus(config *viper.Viper, k kernelStatus) error {
+	want, err := checkKernelStatus(config)
+	if err != nil || want.Mask == 0 {
+		return err
+	}
+
+	current, err := k.GetStatus()
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Failed to open syslog writer. Error: %v", err))
+		return errors.New(fmt.Sprintf("Failed to get the kernel audit status. Error: %s", err))
 	}
 
-	return NewAuditWriter(syslogWriter, attempts), nil
-}
+	if err := k.SetStatus(want); err != nil {
+		return errors.New(fmt.Sprintf("Kernel rejected the audit settings. Error: %s", err))
+	}
 
-func createFileOutput(config *viper.Viper) (*AuditWriter, error) {
-	attempts := config.GetInt("output.file.attempts")
-	if attempts < 1 {
-		return nil, errors.New(
-			fmt.Sprintf("Output attempts for file must be at least 1, %v provided", attempts),
-		)
+	if want.Mask&AUDIT_STATUS_BACKLOG_LIMIT != 0 {
+		logger.Info("Set kernel audit backlog_limit to %d, was %d", want.BacklogLimit, current.BacklogLimit)
 	}
 
-	mode := os.FileMode(config.GetInt("output.file.mode"))
-	if mode < 1 {
-		return nil, errors.New("Output file mode should be greater than 0000")
+	if want.Mask&AUDIT_STATUS_RATE_LIMIT != 0 {
+		logger.Info("Set kernel audit rate_limit to %d, was %d", want.RateLimit, current.RateLimit)
 	}
 
-	f, err := os.OpenFile(
-		config.GetString("output.file.path"),
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode,
-	)
+	if want.Mask&AUDIT_STATUS_FAILURE != 0 {
+		logger.Info("Set kernel audit failure_mode to %s, was %s", failureModeName(want.Failure), failureModeName(current.Failure))
+	}
 
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Failed to open output file. Error: %s", err))
+	return nil
+}
+
+// Builds the kernel audit settings to apply from the config without applying them
+func checkKernelStatus(config *viper.Viper) (*AuditStatusPayload, error) {
+	status := &AuditStatusPayload{}
+
+	if config.IsSet("kernel.backlog_limit") {
+		limit := config.GetInt("kernel.backlog_limit")
+		if limit < 0 {
+			return nil, errors.New(fmt.Sprintf("Kernel backlog_limit must be at least 0, %v provided", limit))
+		}
+
+		status.Mask |= AUDIT_STATUS_BACKLOG_LIMIT
+		status.BacklogLimit = uint32(limit)
 	}
 
-	if err := f.Chmod(mode); err != nil {
-		return nil, errors.New(fmt.Sprintf("Failed to set file permissions. Error: %s", err))
+	if config.IsSet("kernel.rate_limit") {
+		limit := config.GetInt("kernel.rate_limit")
+		if limit < 0 {
+			return nil, errors.New(fmt.Sprintf("Kernel rate_limit must be at least 0, %v provided", limit))
+		}
+
+		status.Mask |= AUDIT_STATUS_RATE_LIMIT
+		status.RateLimit = uint32(limit)
 	}
 
-	uname := config.GetString("output.file.user")
-	u, err := user.Lookup(uname)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Could not find uid for user %s. Error: %s", uname, err))
+	if config.IsSet("kernel.failure_mode") {
+		name := config.GetString("kernel.failure_mode")
+		mode, ok := failureModes[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown kernel failure_mode `%s`, must be silent, printk or panic", name))
+		}
+
+		status.Mask |= AUDIT_STATUS_FAILURE
+		status.Failure = mode
 	}
 
-	gname := config.GetString("output.file.group")
-	g, err := user.LookupGroup(gname)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Could not find gid for group %s. Error: %s", gname, err))
+	return status, nil
+}
+
+func failureModeName(mode uint32) string {
+	for name, m := range failureModes {
+		if m == mode {
+			return name
+		}
 	}
 
-	uid, err := strconv.ParseInt(u.Uid, 10, 32)
+	return strconv.Itoa(int(mode))
+}
+
+// Loads and validates all rules without applying them
+func checkRules(config *viper.Viper) ([]string, error) {
+	rules, err := loadRules(config)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Found uid could not be parsed. Error: %s", err))
+		return nil, err
 	}
 
-	gid, err := strconv.ParseInt(g.Gid, 10, 32)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Found gid could not be parsed. Error: %s", err))
+	if len(rules) == 0 {
+		return nil, errors.New("No audit rules found.")
 	}
 
-	if err = f.Chown(int(uid), int(gid)); err != nil {
-		return nil, errors.New(fmt.Sprintf("Could not chown output file. Error: %s", err))
+	for i, v := range rules {
+		if err := validateRule(v, i == len(rules)-1); err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to validate rule #%d `%s`. Error: %s", i+1, v, err))
+		}
 	}
 
-	return NewAuditWriter(f, attempts), nil
+	return rules, nil
 }
 
-func createStdOutOutput(config *viper.Viper) (*AuditWriter, error) {
-	attempts := config.GetInt("output.stdout.attempts")
-	if attempts < 1 {
-		return nil, errors.New(
-			fmt.Sprintf("Output attempts for stdout must be at least 1, %v provided", attempts),
-		)
-	}
+// Settings kept under rules next to the list of rules and their defaults. Viper can not see them, defaults included,
+// when `rules` is only the list so they are read with rulesSetting
+var rulesDefaults = map[string]bool{"manage": true, "preserve_existing": false}
 
-	// l logger is no longer stdout
-	l.SetOutput(os.Stderr)
+func rulesSetting(config *viper.Viper, name string) bool {
+	if !config.IsSet("rules." + name) {
+		return rulesDefaults[name]
+	}
 
-	return NewAuditWriter(os.Stdout, attempts), nil
+	return config.GetBool("rules." + name)
 }
 
-func createFilters(config *viper.Viper) []AuditFilter {
-	var err error
-	var ok bool
+// The rules set in the config. `rules` is either the list of rules itself or, to set rules.manage and the like next
+// to them, a map with the list under `list`
+func configRules(config *viper.Viper) []string {
+	switch config.Get("rules").(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		return config.GetStringSlice("rules.list")
+	}
 
-	fs := config.Get("filters")
-	filters := []AuditFilter{}
+	return config.GetStringSlice("rules")
+}
 
-	if fs == nil {
-		return filters
+// Gathers the rules from the config, then the ones syscall_rules expand to, followed by those in rules_file and
+// then the `.rules` files in rules_dir, in sorted filename order
+func loadRules(config *viper.Viper) ([]string, error) {
+	rules := configRules(config)
+
+	generated, err := syscallRules(config)
+	if err != nil {
+		return nil, err
 	}
 
-	ft, ok := fs.([]interface{})
-	if !ok {
-		return filters
+	rules = append(rules, generated...)
+
+	files := []string{}
+	if file := config.GetString("rules_file"); file != "" {
+		files = append(files, file)
 	}
 
-	for i, f := range ft {
-		f2, ok := f.(map[interface{}]interface{})
-		if !ok {
-			logger.Crit("Could not parse filter %d, %v", i+1, f)
-			panic("Could not parse filter")
+	if dir := config.GetString("rules_dir"); dir != "" {
+		found, err := filepath.Glob(filepath.Join(dir, "*.rules"))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to list rules directory %s. Error: %s", dir, err))
 		}
 
-		af := AuditFilter{}
-		for k, v := range f2 {
-			switch k {
-			case "message_type":
-				if ev, ok := v.(string); ok {
-					fv, err := strconv.ParseUint(ev, 10, 64)
-					if err != nil {
-						logger.Crit("`message_type` in filter %d could not be parsed %v (%v) ", i+1, v, err)
-						panic(err)
-					}
-					af.MessageType = uint16(fv)
-
-				} else if ev, ok := v.(int); ok {
-					if !ok {
-						logger.Crit("`message_type` in filter %d could not be parsed %v", i+1,  v)
-						panic("`message_type` in filter could not be parsed")
-					}
-					af.MessageType = uint16(ev)
+		sort.Strings(found)
+		files = append(files, found...)
+	}
 
-				} else {
-					logger.Crit("`message_type` in filter %d could not be parsed %v", i+1,  v)
-					panic("`message_type` in filter could not be parsed")
-				}
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to read rules file %s. Error: %s", file, err))
+		}
 
-			case "regex":
-				re, ok := v.(string)
-				if !ok {
-					logger.Crit("`regex` in filter %d could not be parsed %v", i+1,  v)
-					panic("`regex` in filter could not be parsed")
-				}
+		for _, line := range strings.Split(string(contents), "\n") {
+			line = strings.TrimSpace(line)
 
-				if af.Regex, err = regexp.Compile(re); err != nil {
-					logger.Crit("`regex` in filter %d could not be parsed %v", i+1,  v)
-					panic(err)
-				}
+			// Skip comments and blank lines, as auditctl does
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
 
-			case "syscall":
-				if af.Syscall, ok = v.(string); ok {
-					// All is good
-				} else if ev, ok := v.(int); ok {
-					af.Syscall = strconv.Itoa(ev)
-				} else {
-					logger.Crit("`syscall` in filter %d could not be parsed %v", i+1,  v)
-					panic("`syscall` in filter could not be parsed")
-				}
+			// Rule files usually start by flushing, we always do that ourselves
+			if line == "-D" {
+				continue
 			}
+
+			rules = append(rules, line)
 		}
 
-		filters = append(filters, af)
-		logger.Info("Ignoring  syscall `%v` containing message type `%v` matching string `%s`\n",
-			af.Syscall, af.MessageType, af.Regex.String())
+		logger.Info("Loaded audit rules from %s", file)
 	}
 
-	return filters
+	return rules, nil
 }
 
-func main() {
-	configFile := flag.String("config", "", "Config file location")
+// Checks a rule for what would leave the live rules half applied, anything else is left to auditctl which reports
+// what it rejects when the rule is added. last is true for the final rule
+func validateRule(rule string, last bool) error {
+	args := strings.Fields(rule)
+	for i, arg := range args {
+		if arg == "-D" {
+			return errors.New("Flushing the rules with -D would remove the ones added before it")
+		}
 
-	flag.Parse()
+		if arg == "-e" && i+1 < len(args) && args[i+1] == "2" && !last {
+			return errors.New("Locking the rules with -e 2 must be the last rule, the ones after it could not be added")
+		}
+	}
 
-	logger.AuditLoggerNew(l, el, nil)
+	return nil
+}
 
-	if *configFile == "" {
-		logger.Err("A config file must be provided")
-		flag.Usage()
-		os.Exit(1)
-	}
+func createOutput(config *viper.Viper) ([]*AuditWriter, error) {
+	var writers []*AuditWriter
 
-	config, err := loadConfig(*configFile)
-	if err != nil {
-		logger.Crit("%v", err)
-		panic(err)
+	if config.GetBool("output.syslog.enabled") == true {
+		writer, err := createSyslogOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("syslog")
+		writers = append(writers, writer)
 	}
 
-	// output needs to be created before anything that write to stdout
-	writer, err := createOutput(config)
-	if err != nil {
-		logger.Crit("%v", err)
-		panic(err)
+	if config.GetBool("output.file.enabled") == true {
+		writer, err := createFileOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("file")
+		writers = append(writers, writer)
 	}
 
-	if err := setRules(config, lExec); err != nil {
-		logger.Crit("%v", err)
-		panic(err)
+	if config.GetBool("output.stdout.enabled") == true {
+		writer, err := createStdOutOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("stdout")
+		writers = append(writers, writer)
 	}
 
-	nlClient := NewNetlinkClient(config.GetInt("socket_buffer.receive"))
-	marshaller := NewAuditMarshaller(
-		writer,
-		config.GetBool("message_tracking.enabled"),
-		config.GetBool("message_tracking.log_out_of_order"),
-		config.GetInt("message_tracking.max_out_of_order"),
-		createFilters(config),
-	)
-
-	logger.Info("Started processing events")
-
-	//Main loop. Get data from netlink and send it to the json lib for processing
-	for {
-		msg, err := nlClient.Receive()
+	if config.GetBool("output.http.enabled") == true {
+		writer, err := createHTTPOutput(config)
 		if err != nil {
-			logger.Err("Error during message receive: %+v", err)
-			continue
+			return nil, err
 		}
+		writer.SetName("http")
+		writers = append(writers, writer)
+	}
 
-		if msg == nil {
-			continue
+	if config.GetBool("output.tcp.enabled") == true {
+		writer, err := createTCPOutput(config)
+		if err != nil {
+			return nil, err
 		}
-
-		marshaller.Consume(msg)
+		writer.SetName("tcp")
+		writers = append(writers, writer)
 	}
+
+	if config.GetBool("output.unix.enabled") == true {
+		writer, err := createUnixSocketOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("unix")
+		writers = append(writers, writer)
+	}
+
+	if config.GetBool("output.gelf.enabled") == true {
+		writer, err := createGELFOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("gelf")
+		writers = append(writers, writer)
+	}
+
+	if config.GetBool("output.kafka.enabled") == true {
+		writer, err := createKafkaOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("kafka")
+		writers = append(writers, writer)
+	}
+
+	if config.GetBool("output.nats.enabled") == true {
+		writer, err := createNATSOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("nats")
+		writers = append(writers, writer)
+	}
+
+	if config.GetBool("output.elasticsearch.enabled") == true {
+		writer, err := createElasticsearchOutput(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("elasticsearch")
+		writers = append(writers, writer)
+	}
+
+	if config.GetBool("output.s3.enabled") == true {
+		writer, err := createS3Output(config)
+		if err != nil {
+			return nil, err
+		}
+		writer.SetName("s3")
+		writers = append(writers, writer)
+	}
+
+	if len(writers) == 0 {
+		return nil, errors.New("No outputs were configured")
+	}
+
+	for _, writer := range writers {
+		if err := routeOutput(config, writer); err != nil {
+			return nil, err
+		}
+
+		if err := formatOutput(config, writer); err != nil {
+			return nil, err
+		}
+
+		writer.SetCircuitBreaker(
+			config.GetInt("output."+writer.Name()+".circuit_breaker.failures"),
+			config.GetDuration("output."+writer.Name()+".circuit_breaker.cooldown"),
+		)
+
+		if err := spoolOutput(config, writer); err != nil {
+			return nil, err
+		}
+	}
+
+	return writers, nil
+}
+
+// Reads output.<name>.retry_backoff into the options for the writer of the output
+func getWriterOptions(config *viper.Viper, name string) (WriterOptions, error) {
+	key := "output." + name + ".retry_backoff."
+	b := Backoff{
+		Strategy:   config.GetString(key + "strategy"),
+		Delay:      config.GetDuration(key + "delay"),
+		MaxDelay:   config.GetDuration(key + "max_delay"),
+		Jitter:     config.GetFloat64(key + "jitter"),
+		MaxElapsed: config.GetDuration(key + "max_elapsed"),
+	}
+
+	// Unset without the defaults of loadConfig, they mean the same
+	if b.Strategy == "" {
+		b.Strategy = BACKOFF_FIXED
+	}
+
+	if !config.IsSet(key + "delay") {
+		b.Delay = DEFAULT_RETRY_DELAY
+	}
+
+	if b.Strategy != BACKOFF_FIXED && b.Strategy != BACKOFF_EXPONENTIAL {
+		return WriterOptions{}, errors.New(fmt.Sprintf("Output %s retry_backoff strategy must be fixed or exponential, %v provided", name, b.Strategy))
+	}
+
+	if b.Delay < 0 || b.MaxDelay < 0 || b.MaxElapsed < 0 {
+		return WriterOptions{}, errors.New(fmt.Sprintf("Output %s retry_backoff delay, max_delay and max_elapsed must not be negative", name))
+	}
+
+	if b.Jitter < 0 || b.Jitter > 1 {
+		return WriterOptions{}, errors.New(fmt.Sprintf("Output %s retry_backoff jitter must be between 0 and 1, %v provided", name, b.Jitter))
+	}
+
+	return WriterOptions{Backoff: b}, nil
+}
+
+// Gives the output a spool under output.spool.dir, named after the output, if a directory is set
+func spoolOutput(config *viper.Viper, writer *AuditWriter) error {
+	dir := config.GetString("output.spool.dir")
+	if dir == "" {
+		return nil
+	}
+
+	maxBytes := config.GetInt64("output.spool.max_bytes")
+	if maxBytes < 1 {
+		return errors.New(fmt.Sprintf("Output spool max_bytes must be at least 1, %v provided", maxBytes))
+	}
+
+	spool, err := OpenSpool(filepath.Join(dir, writer.Name()), writer.Name(), maxBytes)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to open the spool for output %s. Error: %s", writer.Name(), err))
+	}
+
+	writer.SetSpool(spool, config.GetDuration("output.spool.replay_interval"))
+	return nil
+}
+
+// Outputs that wrap events in json of their own, they can only write json events
+var jsonOnlyOutputs = map[string]bool{"http": true, "elasticsearch": true}
+
+// Applies the format of the output, output.<name>.format if set, output.format otherwise
+func formatOutput(config *viper.Viper, writer *AuditWriter) error {
+	format, err := getFormat(config, writer.Name())
+	if err != nil {
+		return err
+	}
+
+	writer.SetFormat(format)
+	return nil
+}
+
+func getFormat(config *viper.Viper, name string) (Formatter, error) {
+	if name == "gelf" {
+		if config.IsSet("output.gelf.format") {
+			return nil, errors.New("Output gelf always writes gelf, its format can not be set")
+		}
+
+		return NewGELFFormatter(config.GetString("output.gelf.host")), nil
+	}
+
+	// Without a template syslog writes its format like any other output, json unless set
+	template := config.GetString("output.syslog.template")
+	if name == "syslog" && template != "" {
+		if config.IsSet("output.syslog.format") {
+			return nil, errors.New("Output syslog template and format can not both be set")
+		}
+
+		f, err := NewTemplateFormatter(template)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Output syslog template could not be parsed. Error: %s", err))
+		}
+
+		return f, nil
+	}
+
+	format := config.GetString("output.format")
+	if config.IsSet("output." + name + ".format") {
+		format = config.GetString("output." + name + ".format")
+	}
+
+	if format == "" {
+		format = FORMAT_JSON
+	}
+
+	if format != FORMAT_JSON && jsonOnlyOutputs[name] {
+		return nil, errors.New(fmt.Sprintf("Output %s can only write json, %s provided", name, format))
+	}
+
+	severity := config.GetInt("output.cef.severity")
+	if format == FORMAT_CEF && (severity < 0 || severity > 10) {
+		return nil, errors.New(fmt.Sprintf("Output cef severity must be between 0 and 10, %v provided", severity))
+	}
+
+	return NewFormatter(format, &CEFFormatter{
+		Vendor:   config.GetString("output.cef.vendor"),
+		Product:  config.GetString("output.cef.product"),
+		Version:  config.GetString("output.cef.version"),
+		Severity: severity,
+	})
+}
+
+// Applies the message_types and exclude_message_types of the output
+func routeOutput(config *viper.Viper, writer *AuditWriter) error {
+	include, err := getMessageTypes(config, writer.Name(), "message_types")
+	if err != nil {
+		return err
+	}
+
+	exclude, err := getMessageTypes(config, writer.Name(), "exclude_message_types")
+	if err != nil {
+		return err
+	}
+
+	writer.SetMessageTypes(include, exclude)
+
+	keys, err := getKeys(config, writer.Name(), "keys")
+	if err != nil {
+		return err
+	}
+
+	skipKeys, err := getKeys(config, writer.Name(), "exclude_keys")
+	if err != nil {
+		return err
+	}
+
+	writer.SetKeys(keys, skipKeys)
+	return nil
+}
+
+func getKeys(config *viper.Viper, name, key string) ([]string, error) {
+	v := config.Get("output." + name + "." + key)
+	if v == nil {
+		return nil, nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Output %s %s must be a list of rule keys, %v provided", name, key, v))
+	}
+
+	keys := make([]string, 0, len(list))
+	for _, lv := range list {
+		k, ok := lv.(string)
+		if !ok || k == "" {
+			return nil, errors.New(fmt.Sprintf("Output %s %s has an invalid rule key %v", name, key, lv))
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// Reads transform.require_records, record types by the name auditd logs them under, like PROCTITLE, or their number
+func getRequiredRecords(config *viper.Viper) ([]uint16, error) {
+	v := config.Get("transform.require_records")
+	if v == nil {
+		return nil, nil
+	}
+
+	var list []interface{}
+	switch l := v.(type) {
+	case []interface{}:
+		list = l
+	case []string:
+		for _, s := range l {
+			list = append(list, s)
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Transform require_records must be a list of record types, %v provided", v))
+	}
+
+	var types []uint16
+	for _, lv := range list {
+		name := strings.ToUpper(fmt.Sprint(lv))
+		if t, ok := RecordType(name); ok {
+			types = append(types, t)
+		} else if t, err := strconv.ParseUint(name, 10, 16); err == nil {
+			types = append(types, uint16(t))
+		} else {
+			return nil, errors.New(fmt.Sprintf("Transform require_records has an unknown record type %v", lv))
+		}
+	}
+
+	return types, nil
+}
+
+// The smallest HMAC key allowed, the size of the hash is recommended
+const MIN_HMAC_KEY_BYTES = 16
+
+// Reads the key events are signed with from integrity.hmac_key or integrity.hmac_key_file, nil when neither is set
+// A key file has its trailing newline trimmed
+func getIntegrityKey(config *viper.Viper) ([]byte, error) {
+	key, file := config.GetString("integrity.hmac_key"), config.GetString("integrity.hmac_key_file")
+	if key != "" && file != "" {
+		return nil, errors.New("Integrity hmac_key and hmac_key_file can not both be set")
+	}
+
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to read integrity hmac_key_file. Error: %s", err))
+		}
+
+		key = strings.TrimRight(string(b), "\r\n")
+	}
+
+	if key == "" {
+		if config.GetBool("integrity.chain") {
+			return nil, errors.New("Integrity chain needs an hmac_key or hmac_key_file")
+		}
+
+		return nil, nil
+	}
+
+	if len(key) < MIN_HMAC_KEY_BYTES {
+		return nil, errors.New(fmt.Sprintf("Integrity hmac_key must be at least %d bytes, %d provided", MIN_HMAC_KEY_BYTES, len(key)))
+	}
+
+	return []byte(key), nil
+}
+
+func getMessageTypes(config *viper.Viper, name, key string) ([]uint16, error) {
+	v := config.Get("output." + name + "." + key)
+	if v == nil {
+		return nil, nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Output %s %s must be a list of message types, %v provided", name, key, v))
+	}
+
+	types := make([]uint16, 0, len(list))
+	for _, lv := range list {
+		t, err := strconv.ParseUint(fmt.Sprint(lv), 10, 16)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Output %s %s has an invalid message type %v", name, key, lv))
+		}
+
+		types = append(types, uint16(t))
+	}
+
+	return types, nil
+}
+
+func createSyslogOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.syslog.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for syslog must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "syslog")
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := createSyslogTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var syslogWriter io.Writer
+
+	// The connection may be refused while the syslog daemon is starting up
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			logger.Err("Failed to open syslog writer, retrying in 1 second. Error: %v", err)
+			time.Sleep(time.Second * 1)
+		}
+
+		if syslogWriter, err = dialSyslog(config, tlsConfig); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to open syslog writer. Error: %v", err))
+	}
+
+	return NewAuditWriter(syslogWriter, attempts, opts), nil
+}
+
+func dialSyslog(config *viper.Viper, tlsConfig *tls.Config) (io.Writer, error) {
+	network := config.GetString("output.syslog.network")
+	address := config.GetString("output.syslog.address")
+	priority := syslog.Priority(config.GetInt("output.syslog.priority"))
+	tag := config.GetString("output.syslog.tag")
+	hostname := config.GetString("output.syslog.hostname")
+
+	return NewSyslogWriter(network, address, tlsConfig, priority, tag, hostname, config.GetBool("output.syslog.rfc5424"), config.GetDuration("output.syslog.write_timeout"))
+}
+
+// Builds the TLS config of the syslog output when its network is tls, nil otherwise
+// A client certificate is only presented when one is set, the system roots are trusted unless a ca is set
+func createSyslogTLSConfig(config *viper.Viper) (*tls.Config, error) {
+	if config.GetString("output.syslog.network") != SYSLOG_NETWORK_TLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.GetString("output.syslog.tls.server_name"),
+	}
+
+	cert, key := config.GetString("output.syslog.tls.cert"), config.GetString("output.syslog.tls.key")
+	if (cert == "") != (key == "") {
+		return nil, errors.New("Output syslog tls cert and key must be set together")
+	}
+
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to load the syslog tls certificate. Error: %s", err))
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	if ca := config.GetString("output.syslog.tls.ca"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to read the syslog tls ca. Error: %s", err))
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates were found in the syslog tls ca %s", ca))
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func createFileOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.file.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for file must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "file")
+	if err != nil {
+		return nil, err
+	}
+
+	mode := os.FileMode(0600)
+	if config.IsSet("output.file.mode") {
+		if mode = os.FileMode(config.GetInt("output.file.mode")); mode < 1 {
+			return nil, errors.New("Output file mode should be greater than 0000")
+		}
+	}
+
+	// An unset user or group leaves that part of the owner alone, -1 tells chown the same
+	uid, gid := int64(-1), int64(-1)
+
+	if uname := config.GetString("output.file.user"); uname != "" {
+		u, err := user.Lookup(uname)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not find uid for user %s. Error: %s", uname, err))
+		}
+
+		if uid, err = strconv.ParseInt(u.Uid, 10, 32); err != nil {
+			return nil, errors.New(fmt.Sprintf("Found uid could not be parsed. Error: %s", err))
+		}
+	}
+
+	if gname := config.GetString("output.file.group"); gname != "" {
+		g, err := user.LookupGroup(gname)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not find gid for group %s. Error: %s", gname, err))
+		}
+
+		if gid, err = strconv.ParseInt(g.Gid, 10, 32); err != nil {
+			return nil, errors.New(fmt.Sprintf("Found gid could not be parsed. Error: %s", err))
+		}
+	}
+
+	path := config.GetString("output.file.path")
+	if !strings.Contains(path, SHARD_PLACEHOLDER) {
+		w, err := openOutputFile(config, path, mode, int(uid), int(gid))
+		if err != nil {
+			return nil, err
+		}
+
+		return NewAuditWriter(w, attempts, opts), nil
+	}
+
+	if err := checkShardPath(path); err != nil {
+		return nil, err
+	}
+
+	// Every shard is opened up front so a bad path fails now and not with the first event of its category
+	// Each one is buffered on its own, buffering the lot would lose the category of the events
+	shards := map[string]io.Writer{}
+	for _, category := range Categories {
+		w, err := openOutputFile(config, ShardPath(path, category), mode, int(uid), int(gid))
+		if err != nil {
+			NewShardedFile(shards).Close()
+			return nil, err
+		}
+
+		shards[category] = w
+	}
+
+	return NewAuditWriter(NewShardedFile(shards), attempts, opts), nil
+}
+
+// Opens an output file with the mode, owner, rotation and buffering of the file output
+func openOutputFile(config *viper.Viper, path string, mode os.FileMode, uid, gid int) (io.Writer, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to open output file. Error: %s", err))
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return nil, errors.New(fmt.Sprintf("Failed to set file permissions. Error: %s", err))
+	}
+
+	if uid >= 0 || gid >= 0 {
+		if err = f.Chown(uid, gid); err != nil {
+			f.Close()
+			return nil, errors.New(fmt.Sprintf("Could not chown output file. Error: %s", err))
+		}
+	}
+
+	maxSize := int64(config.GetInt("output.file.rotate.max_size_mb")) * 1024 * 1024
+	maxAge := time.Duration(config.GetInt("output.file.rotate.max_age_days")) * time.Hour * 24
+	if maxSize > 0 || maxAge > 0 {
+		r, err := NewRotatingFile(
+			f,
+			mode,
+			uid,
+			gid,
+			maxSize,
+			maxAge,
+			config.GetInt("output.file.rotate.max_backups"),
+			config.GetBool("output.file.compress"),
+		)
+		if err != nil {
+			f.Close()
+			return nil, errors.New(fmt.Sprintf("Could not setup output file rotation. Error: %s", err))
+		}
+
+		return bufferOutput(config, r), nil
+	}
+
+	return bufferOutput(config, f), nil
+}
+
+// Makes sure a sharded output file path has no placeholder but the category of the shards
+func checkShardPath(path string) error {
+	if rest := ShardPath(path, ""); strings.Contains(rest, "%{") {
+		return errors.New(
+			fmt.Sprintf("Output file path %s has an unknown placeholder, only %s is supported", path, SHARD_PLACEHOLDER),
+		)
+	}
+
+	return nil
+}
+
+// Opens output.deadletter.path for messages that can not be parsed, nil when no path is set
+func createDeadLetterOutput(config *viper.Viper) (*AuditWriter, error) {
+	path := config.GetString("output.deadletter.path")
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to open dead letter file. Error: %s", err))
+	}
+
+	w := NewAuditWriter(f, 1)
+	w.SetName("deadletter")
+	return w, nil
+}
+
+func createStdOutOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.stdout.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for stdout must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "stdout")
+	if err != nil {
+		return nil, err
+	}
+
+	// l logger is no longer stdout
+	l.SetOutput(os.Stderr)
+
+	return NewAuditWriter(bufferOutput(config, os.Stdout), attempts, opts), nil
+}
+
+// Wraps the file and stdout outputs to write events in large chunks instead of one write per event
+// Other outputs either batch on their own or need every event to be its own message, like syslog
+func bufferOutput(config *viper.Viper, w io.Writer) io.Writer {
+	size := config.GetInt("output.buffer.size")
+	if size <= 0 {
+		return w
+	}
+
+	return NewBufferedWriter(w, size, config.GetDuration("output.buffer.flush_interval"))
+}
+
+func createHTTPOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.http.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for http must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "http")
+	if err != nil {
+		return nil, err
+	}
+
+	url := config.GetString("output.http.url")
+	if url == "" {
+		return nil, errors.New("Output http url must be set")
+	}
+
+	method := config.GetString("output.http.method")
+	if method == "" {
+		method = "POST"
+	}
+
+	if inFlight := config.GetInt("output.http.max_in_flight"); config.IsSet("output.http.max_in_flight") && inFlight < 1 {
+		return nil, errors.New(fmt.Sprintf("Output http max_in_flight must be at least 1, %v provided", inFlight))
+	}
+
+	w := NewHTTPWriter(
+		url,
+		method,
+		config.GetStringMapString("output.http.headers"),
+		config.GetDuration("output.http.timeout"),
+		config.GetBool("output.http.insecure_skip_verify"),
+		config.GetInt("output.http.batch_size"),
+		config.GetDuration("output.http.flush_interval"),
+		config.GetInt("output.http.max_idle_conns"),
+		config.GetInt("output.http.max_in_flight"),
+	)
+
+	return NewAuditWriter(w, attempts, opts), nil
+}
+
+func createTCPOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.tcp.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for tcp must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "tcp")
+	if err != nil {
+		return nil, err
+	}
+
+	address := config.GetString("output.tcp.address")
+	if address == "" {
+		return nil, errors.New("Output tcp address must be set")
+	}
+
+	var tlsConfig *tls.Config
+	if config.GetBool("output.tcp.tls") {
+		tlsConfig = &tls.Config{InsecureSkipVerify: config.GetBool("output.tcp.insecure_skip_verify")}
+	}
+
+	w, err := NewTCPWriter(
+		address,
+		tlsConfig,
+		config.GetDuration("output.tcp.timeout"),
+		config.GetInt("output.tcp.max_buffered"),
+		config.GetDuration("output.tcp.reconnect_backoff"),
+	)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to connect to tcp output. Error: %v", err))
+	}
+
+	return NewAuditWriter(w, attempts, opts), nil
+}
+
+func createUnixSocketOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.unix.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for unix must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "unix")
+	if err != nil {
+		return nil, err
+	}
+
+	path := config.GetString("output.unix.path")
+	if path == "" {
+		return nil, errors.New("Output unix path must be set")
+	}
+
+	w, err := NewUnixSocketWriter(
+		path,
+		config.GetString("output.unix.type"),
+		config.GetDuration("output.unix.timeout"),
+		config.GetInt("output.unix.max_buffered"),
+		config.GetDuration("output.unix.reconnect_backoff"),
+	)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to connect to unix output. Error: %v", err))
+	}
+
+	return NewAuditWriter(w, attempts, opts), nil
+}
+
+func createGELFOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.gelf.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for gelf must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "gelf")
+	if err != nil {
+		return nil, err
+	}
+
+	address := config.GetString("output.gelf.address")
+	if address == "" {
+		return nil, errors.New("Output gelf address must be set")
+	}
+
+	w, err := NewGELFWriter(
+		config.GetString("output.gelf.protocol"),
+		address,
+		config.GetString("output.gelf.compression"),
+		config.GetInt("output.gelf.chunk_size"),
+		config.GetDuration("output.gelf.timeout"),
+		config.GetInt("output.gelf.max_buffered"),
+		config.GetDuration("output.gelf.reconnect_backoff"),
+	)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to connect to gelf output. Error: %v", err))
+	}
+
+	return NewAuditWriter(w, attempts, opts), nil
+}
+
+func createKafkaOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.kafka.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for kafka must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "kafka")
+	if err != nil {
+		return nil, err
+	}
+
+	brokers := config.GetStringSlice("output.kafka.brokers")
+	if len(brokers) == 0 {
+		return nil, errors.New("Output kafka brokers must be set")
+	}
+
+	topic := config.GetString("output.kafka.topic")
+	if topic == "" {
+		return nil, errors.New("Output kafka topic must be set")
+	}
+
+	w, err := NewKafkaWriter(
+		brokers,
+		topic,
+		config.GetString("output.kafka.partition_key"),
+		config.GetInt("output.kafka.required_acks"),
+		config.GetDuration("output.kafka.timeout"),
+		config.GetInt("output.kafka.batch_size"),
+		config.GetInt("output.kafka.max_buffered"),
+		config.GetDuration("output.kafka.flush_interval"),
+	)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to create kafka writer. Error: %v", err))
+	}
+
+	return NewAuditWriter(w, attempts, opts), nil
+}
+
+func createNATSOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.nats.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for nats must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "nats")
+	if err != nil {
+		return nil, err
+	}
+
+	url := config.GetString("output.nats.url")
+	if url == "" {
+		return nil, errors.New("Output nats url must be set")
+	}
+
+	subject := config.GetString("output.nats.subject")
+	if subject == "" {
+		return nil, errors.New("Output nats subject must be set")
+	}
+
+	var tlsConfig *tls.Config
+	if config.GetBool("output.nats.tls") {
+		tlsConfig = &tls.Config{InsecureSkipVerify: config.GetBool("output.nats.insecure_skip_verify")}
+	}
+
+	w, err := NewNATSWriter(
+		url,
+		subject,
+		config.GetBool("output.nats.jetstream"),
+		config.GetString("output.nats.username"),
+		config.GetString("output.nats.password"),
+		config.GetString("output.nats.token"),
+		tlsConfig,
+		config.GetDuration("output.nats.timeout"),
+	)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to connect to nats output. Error: %v", err))
+	}
+
+	return NewAuditWriter(w, attempts, opts), nil
+}
+
+func createElasticsearchOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.elasticsearch.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for elasticsearch must be at least 1, %v provided", attempts),
+		)
+	}
+
+	opts, err := getWriterOptions(config, "elasticsearch")
+	if err != nil {
+		return nil, err
+	}
+
+	urls := config.GetStringSlice("output.elasticsearch.urls")
+	if len(urls) == 0 {
+		return nil, errors.New("Output elasticsearch urls must be set")
+	}
+
+	index := config.GetString("output.elasticsearch.index")
+	if index == "" {
+		return nil, errors.New("Output elasticsearch index must be set")
+	}
+
+	w := NewElasticsearchWriter(
+		urls,
+		index,
+		config.GetString("output.elasticsearch.username"),
+		config.GetString("output.elasticsearch.password"),
+		config.GetString("output.elasticsearch.api_key"),
+		config.GetDuration("output.elasticsearch.timeout"),
+		config.GetBool("output.elasticsearch.insecure_skip_verify"),
+		config.GetInt("output.elasticsearch.batch_size"),
+		config.GetDuration("output.elasticsearch.flush_interval"),
+	)
+
+	return NewAuditWriter(w, attempts, opts), nil
+}
+
+// The s3 writer retries uploads on its own, retrying the write of the event that filled an object would only upload it
+// again. Credentials come from the AWS_ environment variables when they are not in the config
+func createS3Output(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.s3.attempts")
+	if attempts < 1 {
+		return nil, errors.New(
+			fmt.Sprintf("Output attempts for s3 must be at least 1, %v provided", attempts),
+		)
+	}
+
+	bucket := config.GetString("output.s3.bucket")
+	if bucket == "" {
+		return nil, errors.New("Output s3 bucket must be set")
+	}
+
+	maxBytes := config.GetInt("output.s3.max_bytes")
+	if maxBytes < 1 {
+		return nil, errors.New(fmt.Sprintf("Output s3 max_bytes must be at least 1, %v provided", maxBytes))
+	}
+
+	partSize := config.GetInt("output.s3.part_size")
+	if partSize < S3_MIN_PART_SIZE {
+		return nil, errors.New(fmt.Sprintf("Output s3 part_size must be at least %d, %v provided", S3_MIN_PART_SIZE, partSize))
+	}
+
+	accessKey, secretKey := config.GetString("output.s3.access_key_id"), config.GetString("output.s3.secret_access_key")
+	sessionToken := config.GetString("output.s3.session_token")
+	if accessKey == "" && secretKey == "" {
+		accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	if (accessKey == "") != (secretKey == "") {
+		return nil, errors.New("Output s3 access_key_id and secret_access_key must be set together")
+	}
+
+	w, err := NewS3Writer(
+		config.GetString("output.s3.endpoint"),
+		config.GetString("output.s3.region"),
+		bucket,
+		config.GetString("output.s3.prefix"),
+		accessKey,
+		secretKey,
+		sessionToken,
+		config.GetBool("output.s3.path_style"),
+		config.GetDuration("output.s3.timeout"),
+		config.GetBool("output.s3.insecure_skip_verify"),
+		attempts,
+		maxBytes,
+		partSize,
+		config.GetDuration("output.s3.flush_interval"),
+	)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to create s3 writer. Error: %v", err))
+	}
+
+	return NewAuditWriter(w, 1), nil
+}
+
+func createFilters(config *viper.Viper) ([]AuditFilter, error) {
+	var err error
+	var ok bool
+
+	fs := config.Get("filters")
+	filters := []AuditFilter{}
+
+	if fs == nil {
+		return filters, nil
+	}
+
+	ft, ok := fs.([]interface{})
+	if !ok {
+		return filters, nil
+	}
+
+	names := map[string]int{}
+	for i, f := range ft {
+		f2, ok := f.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Could not parse filter %d, %v", i+1, f))
+		}
+
+		af := AuditFilter{}
+		for k, v := range f2 {
+			switch k {
+			case "name":
+				if af.Name, ok = v.(string); !ok || af.Name == "" {
+					return nil, errors.New(fmt.Sprintf("`name` in filter %d must be some text, got %v", i+1, v))
+				}
+
+				// Filters without a name go by their position
+				if _, err := strconv.Atoi(af.Name); err == nil {
+					return nil, errors.New(fmt.Sprintf("`name` in filter %d can not be a number, got %v", i+1, v))
+				}
+
+				if n, ok := names[af.Name]; ok {
+					return nil, errors.New(fmt.Sprintf("`name` in filter %d is already the name of filter %d, got %v", i+1, n, v))
+				}
+
+				names[af.Name] = i + 1
+
+			case "message_type":
+				if ev, ok := v.(string); ok {
+					fv, err := strconv.ParseUint(ev, 10, 64)
+					if err != nil {
+						return nil, errors.New(fmt.Sprintf("`message_type` in filter %d could not be parsed %v. Error: %s", i+1, v, err))
+					}
+					af.MessageType = uint16(fv)
+
+				} else if ev, ok := v.(int); ok {
+					af.MessageType = uint16(ev)
+
+				} else {
+					return nil, errors.New(fmt.Sprintf("`message_type` in filter %d could not be parsed %v", i+1, v))
+				}
+
+			case "regex":
+				// A single regex or a list of them
+				if re, ok := v.(string); ok {
+					if af.Regex, err = regexp.Compile(re); err != nil {
+						return nil, errors.New(fmt.Sprintf("`regex` in filter %d could not be parsed %v. Error: %s", i+1, v, err))
+					}
+				} else if list, ok := v.([]interface{}); ok && len(list) > 0 {
+					for _, lv := range list {
+						re, ok := lv.(string)
+						if !ok {
+							return nil, errors.New(fmt.Sprintf("`regex` in filter %d could not be parsed %v", i+1, lv))
+						}
+
+						compiled, err := regexp.Compile(re)
+						if err != nil {
+							return nil, errors.New(fmt.Sprintf("`regex` in filter %d could not be parsed %v. Error: %s", i+1, lv, err))
+						}
+
+						af.Regexes = append(af.Regexes, compiled)
+					}
+				} else {
+					return nil, errors.New(fmt.Sprintf("`regex` in filter %d could not be parsed %v", i+1, v))
+				}
+
+			case "regex_match":
+				switch v {
+				case "all":
+					af.MatchAny = false
+				case "any":
+					af.MatchAny = true
+				default:
+					return nil, errors.New(fmt.Sprintf("`regex_match` in filter %d must be all or any, got %v", i+1, v))
+				}
+
+			case "syscall":
+				if af.Syscall, ok = v.(string); ok && af.Syscall == "any" {
+					af.Syscall, af.AnySyscall = "", true
+				} else if ok {
+					// All is good
+				} else if ev, ok := v.(int); ok {
+					af.Syscall = strconv.Itoa(ev)
+				} else {
+					return nil, errors.New(fmt.Sprintf("`syscall` in filter %d could not be parsed %v", i+1, v))
+				}
+
+			case "uid":
+				if af.Uid, err = parseFilterUid(i, "uid", v); err != nil {
+					return nil, err
+				}
+
+			case "auid":
+				if af.Auid, err = parseFilterUid(i, "auid", v); err != nil {
+					return nil, err
+				}
+
+			case "key":
+				if af.Key, ok = v.(string); !ok || af.Key == "" {
+					return nil, errors.New(fmt.Sprintf("`key` in filter %d could not be parsed %v", i+1, v))
+				}
+
+			case "exe", "comm":
+				value, ok := v.(string)
+				if !ok || value == "" {
+					return nil, errors.New(fmt.Sprintf("`%s` in filter %d could not be parsed %v", k, i+1, v))
+				}
+
+				if k == "exe" {
+					af.Exe = value
+				} else {
+					af.Comm = value
+				}
+
+			case "exe_regex", "comm_regex":
+				value, ok := v.(string)
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("`%s` in filter %d could not be parsed %v", k, i+1, v))
+				}
+
+				re, err := regexp.Compile(value)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("`%s` in filter %d could not be parsed %v. Error: %s", k, i+1, v, err))
+				}
+
+				if k == "exe_regex" {
+					af.ExeRegex = re
+				} else {
+					af.CommRegex = re
+				}
+
+			case "success":
+				// yaml reads a bare yes or no as a bool
+				switch v {
+				case "yes", true:
+					af.Success = "yes"
+				case "no", false:
+					af.Success = "no"
+				case "any":
+					af.Success = ""
+				default:
+					return nil, errors.New(fmt.Sprintf("`success` in filter %d must be yes, no or any, got %v", i+1, v))
+				}
+
+			case "arch":
+				arch, ok := v.(string)
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("`arch` in filter %d could not be parsed %v", i+1, v))
+				}
+
+				af.Arch = strings.ToLower(strings.TrimPrefix(arch, "0x"))
+				if _, err := strconv.ParseUint(af.Arch, 16, 32); err != nil && af.Arch != "b64" && af.Arch != "b32" {
+					return nil, errors.New(fmt.Sprintf("`arch` in filter %d must be b64, b32 or a hex value, got %v", i+1, v))
+				}
+
+			case "tty":
+				if af.Tty, ok = v.(string); !ok || af.Tty == "" || strings.ContainsAny(af.Tty, " =") {
+					return nil, errors.New(fmt.Sprintf("`tty` in filter %d must be a tty like pts0 or none, got %v", i+1, v))
+				}
+
+				if af.Tty == "none" {
+					af.Tty = TTY_NONE
+				}
+
+			case "pid", "ppid":
+				r, err := parseFilterPid(i, k.(string), v)
+				if err != nil {
+					return nil, err
+				}
+
+				if k == "pid" {
+					af.Pid = r
+				} else {
+					af.Ppid = r
+				}
+
+			case "fields":
+				if af.Fields, err = parseFilterFields(i, v); err != nil {
+					return nil, err
+				}
+
+			case "has_field", "missing_field":
+				names, err := parseFilterFieldNames(i, k.(string), v)
+				if err != nil {
+					return nil, err
+				}
+
+				if k == "has_field" {
+					af.HasFields = names
+				} else {
+					af.MissingFields = names
+				}
+
+			case "action":
+				switch v {
+				case "include":
+					af.Include = true
+				case "exclude":
+					af.Include = false
+				default:
+					return nil, errors.New(fmt.Sprintf("`action` in filter %d must be include or exclude, got %v", i+1, v))
+				}
+
+			case "sample":
+				if af.Sample, err = parseFilterSample(i, v); err != nil {
+					return nil, err
+				}
+
+			case "invert":
+				if af.Invert, ok = v.(bool); !ok {
+					return nil, errors.New(fmt.Sprintf("`invert` in filter %d must be true or false, got %v", i+1, v))
+				}
+			}
+		}
+
+		if af.Sample > 0 && af.Include {
+			return nil, errors.New(fmt.Sprintf("`sample` in filter %d keeps some of the events an exclude filter drops, it can not be used with action include", i+1))
+		}
+
+		if af.Syscall == "" && af.MessageType == 0 && af.Regex == nil && len(af.Regexes) == 0 && af.Uid == "" && af.Auid == "" && af.Key == "" &&
+			af.Exe == "" && af.ExeRegex == nil && af.Comm == "" && af.CommRegex == nil && af.Success == "" && af.Arch == "" && af.Tty == "" && af.Pid == nil && af.Ppid == nil && len(af.Fields) == 0 &&
+			len(af.HasFields) == 0 && len(af.MissingFields) == 0 {
+			return nil, errors.New(fmt.Sprintf("Filter %d has nothing to match on", i+1))
+		}
+
+		filters = append(filters, af)
+		if af.Include {
+			logger.Info("Keeping events matching %s\n", af.String())
+		} else if af.Sample > 0 {
+			logger.Info("Keeping %v of the events matching %s\n", af.Sample, af.String())
+		} else {
+			logger.Info("Ignoring events matching %s\n", af.String())
+		}
+	}
+
+	return filters, nil
+}
+
+// Parses the fraction of matching events a sampling filter keeps, a number like 0.01 or a ratio like 1/100
+func parseFilterSample(i int, v interface{}) (float64, error) {
+	var rate float64
+	var err error
+
+	switch s := v.(type) {
+	case float64:
+		rate = s
+	case int:
+		rate = float64(s)
+	case string:
+		parts := strings.SplitN(s, "/", 2)
+		if rate, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err == nil && len(parts) == 2 {
+			var d float64
+			if d, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err == nil {
+				rate /= d
+			}
+		}
+	default:
+		err = errors.New("not a number")
+	}
+
+	if err != nil || !(rate > 0 && rate <= 1) {
+		return 0, errors.New(fmt.Sprintf("`sample` in filter %d must be a fraction over 0 and up to 1, like 0.01 or 1/100, got %v", i+1, v))
+	}
+
+	return rate, nil
+}
+
+// Parses a pid, or a range of them, for a filter
+func parseFilterPid(i int, name string, v interface{}) (*PidRange, error) {
+	var s string
+	switch pid := v.(type) {
+	case int:
+		s = strconv.Itoa(pid)
+	case string:
+		s = pid
+	default:
+		return nil, errors.New(fmt.Sprintf("`%s` in filter %d could not be parsed %v", name, i+1, v))
+	}
+
+	r, err := ParsePidRange(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("`%s` in filter %d must be a pid, a range like 300-400 or a bound like <100, got %v. Error: %s", name, i+1, v, err))
+	}
+
+	return r, nil
+}
+
+// Parses a user id for a filter, user names are resolved to their id
+func parseFilterUid(i int, name string, v interface{}) (string, error) {
+	switch uid := v.(type) {
+	case int:
+		return strconv.Itoa(uid), nil
+
+	case string:
+		if _, err := strconv.ParseUint(uid, 10, 32); err == nil {
+			return uid, nil
+		}
+
+		u, err := user.Lookup(uid)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("`%s` in filter %d could not be resolved %v. Error: %s", name, i+1, v, err))
+		}
+
+		return u.Uid, nil
+	}
+
+	return "", errors.New(fmt.Sprintf("`%s` in filter %d could not be parsed %v", name, i+1, v))
+}
+
+// Parses the `fields` of a filter, a map of field names to the value they must have or to a map with a regex
+// they must match. Sorted by name to keep the order stable
+func parseFilterFields(i int, v interface{}) ([]FieldFilter, error) {
+	fields, ok := v.(map[interface{}]interface{})
+	if !ok || len(fields) == 0 {
+		return nil, errors.New(fmt.Sprintf("`fields` in filter %d could not be parsed %v", i+1, v))
+	}
+
+	ffs := []FieldFilter{}
+	for k, fv := range fields {
+		ff := FieldFilter{Name: fmt.Sprint(k)}
+
+		switch value := fv.(type) {
+		case string:
+			ff.Value = value
+		case int:
+			ff.Value = strconv.Itoa(value)
+		case map[interface{}]interface{}:
+			re, ok := value["regex"].(string)
+			if !ok || len(value) != 1 {
+				return nil, errors.New(fmt.Sprintf("Field `%s` in filter %d could not be parsed %v", ff.Name, i+1, fv))
+			}
+
+			var err error
+			if ff.Regex, err = regexp.Compile(re); err != nil {
+				return nil, errors.New(fmt.Sprintf("Field `%s` in filter %d could not be parsed %v. Error: %s", ff.Name, i+1, re, err))
+			}
+		}
+
+		if ff.Name == "" || (ff.Value == "" && ff.Regex == nil) {
+			return nil, errors.New(fmt.Sprintf("Field `%s` in filter %d could not be parsed %v", ff.Name, i+1, fv))
+		}
+
+		ffs = append(ffs, ff)
+	}
+
+	sort.Slice(ffs, func(a, b int) bool { return ffs[a].Name < ffs[b].Name })
+	return ffs, nil
+}
+
+// Parses the field names of has_field or missing_field, a single name or a list of them
+func parseFilterFieldNames(i int, key string, v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+
+	names := make([]string, 0, len(list))
+	for _, lv := range list {
+		name, ok := lv.(string)
+		if !ok || name == "" || strings.ContainsAny(name, " =") {
+			return nil, errors.New(fmt.Sprintf("`%s` in filter %d must be a field name or a list of them, got %v", key, i+1, v))
+		}
+
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New(fmt.Sprintf("`%s` in filter %d must be a field name or a list of them, got %v", key, i+1, v))
+	}
+
+	return names, nil
+}
+
+func getCompletionTimeout(config *viper.Viper) (time.Duration, error) {
+	timeout := time.Duration(config.GetInt("message_tracking.completion_timeout")) * time.Millisecond
+	if timeout <= 0 {
+		return 0, errors.New(fmt.Sprintf("Message tracking completion timeout must be greater than 0, %v provided", timeout))
+	}
+
+	return timeout, nil
+}
+
+// Where the debug ring is served on the metrics server
+const DEBUG_EVENTS_PATH = "/debug/events"
+
+// How many events to keep in the debug ring, it is served by the metrics server so that has to be enabled
+func getDebugRingSize(config *viper.Viper) (int, error) {
+	size := config.GetInt("debug.ring_size")
+	if size < 0 {
+		return 0, errors.New(fmt.Sprintf("Debug ring size must not be negative, %v provided", size))
+	}
+
+	if size > 0 && !config.GetBool("metrics.enabled") {
+		return 0, errors.New("Debug ring is served by the metrics server, metrics.enabled must be true")
+	}
+
+	return size, nil
+}
+
+// Resolves the value of a field that is filled in at startup
+const AUTO_FIELD = "<auto>"
+
+var hostname = os.Hostname
+
+// Builds the fields added to every event, a `host` of `<auto>` becomes the hostname of this machine
+func createFields(config *viper.Viper) (map[string]string, error) {
+	fields := config.GetStringMapString("transform.add_fields")
+	for k, v := range fields {
+		if v != AUTO_FIELD {
+			continue
+		}
+
+		if k != "host" {
+			return nil, errors.New(fmt.Sprintf("Only the host field can be %s, %s provided it", AUTO_FIELD, k))
+		}
+
+		name, err := hostname()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not determine the hostname. Error: %s", err))
+		}
+
+		fields[k] = name
+	}
+
+	return fields, nil
+}
+
+// Creates the resolver for resolve.ids, nil when ids are not resolved. Names come from nss until useIdFiles
+// hands it the passwd and group files
+func createResolver(config *viper.Viper) *IdResolver {
+	if !config.GetBool("resolve.ids") {
+		return nil
+	}
+
+	return NewIdResolver(config.GetInt("resolve.cache_size"), config.GetDuration("resolve.cache_ttl"))
+}
+
+// Names the uid_map of every event, and the ids the resolver resolves if there is one, from the passwd and group
+// files so events never go through nss. Nothing changes without files, when ids are resolved with nss
+func useIdFiles(files *IdFiles, fallback bool, resolver *IdResolver) {
+	if files == nil {
+		return
+	}
+
+	UseUidFiles(files, fallback)
+	if resolver != nil {
+		resolver.UseFiles(files, fallback)
+	}
+}
+
+// Where ids are resolved from, nss asks the system for every id and files snapshots the passwd and group files
+const (
+	RESOLVE_SOURCE_NSS   = "nss"
+	RESOLVE_SOURCE_FILES = "files"
+)
+
+// Reads the passwd and group files when ids are resolved from files, nil when they are resolved with nss
+func loadIdFiles(config *viper.Viper) (*IdFiles, error) {
+	switch source := config.GetString("resolve.source"); source {
+	case RESOLVE_SOURCE_NSS:
+		return nil, nil
+	case RESOLVE_SOURCE_FILES:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown resolve source `%s`, must be one of nss or files", source))
+	}
+
+	passwd, group := config.GetString("resolve.passwd_file"), config.GetString("resolve.group_file")
+	files, err := LoadIdFiles(passwd, group)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Resolving ids from the %d users in %s and %d groups in %s", files.Users(), passwd, files.Groups(), group)
+	return files, nil
+}
+
+// Container ids are cached briefly, pids are reused
+func createContainerResolver(config *viper.Viper) *IdResolver {
+	if !config.GetBool("transform.resolve_container") {
+		return nil
+	}
+
+	return NewIdResolver(config.GetInt("resolve.cache_size"), CONTAINER_CACHE_TTL)
+}
+
+// Addresses are cached apart from ids but with the same size and ttl
+func createHostResolver(config *viper.Viper) *IdResolver {
+	if !config.GetBool("transform.resolve_saddr") {
+		return nil
+	}
+
+	return NewIdResolver(config.GetInt("resolve.cache_size"), config.GetDuration("resolve.cache_ttl"))
+}
+
+// Outputs and the settings each of them can not do without
+var outputNames = []string{"syslog", "file", "stdout", "http", "tcp", "unix", "gelf", "kafka", "nats", "elasticsearch", "s3"}
+var outputRequired = map[string][]string{
+	"file":          {"path"},
+	"http":          {"url"},
+	"tcp":           {"address"},
+	"unix":          {"path"},
+	"gelf":          {"address"},
+	"kafka":         {"brokers", "topic"},
+	"nats":          {"url", "subject"},
+	"elasticsearch": {"urls"},
+	"s3":            {"bucket"},
+}
+
+// Finds as many problems with the config as possible without applying anything
+// Outputs are only checked for their settings, nothing is opened or connected to
+func testConfig(config *viper.Viper) []error {
+	errs := []error{}
+
+	if _, _, err := getLogSettings(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if rulesSetting(config, "manage") {
+		if _, err := checkRules(config); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := checkKernelStatus(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := getCompletionTimeout(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := getDebugRingSize(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if depth := config.GetInt("socket_buffer.queue_depth"); depth < 1 {
+		errs = append(errs, errors.New(fmt.Sprintf("Socket buffer queue depth must be at least 1, %v provided", depth)))
+	}
+
+	if _, err := getWorkers(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := createProtector(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := createReliability(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := createPriorities(config, config.GetInt("socket_buffer.queue_depth")); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := getNetlinkOptions(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := createFields(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := loadIdFiles(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if interval := config.GetDuration("heartbeat.interval"); interval < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("Heartbeat interval must not be negative, %v provided", interval)))
+	}
+
+	switch config.GetString("input.type") {
+	case INPUT_NETLINK:
+	case INPUT_FILE:
+		if config.GetString("input.file.path") == "" {
+			errs = append(errs, errors.New("Input file path must be set"))
+		}
+	default:
+		errs = append(errs, errors.New(fmt.Sprintf("Unknown input type `%s`, must be one of netlink or file", config.GetString("input.type"))))
+	}
+
+	enabled := 0
+	for _, name := range outputNames {
+		if !config.GetBool("output." + name + ".enabled") {
+			continue
+		}
+
+		enabled++
+		if attempts := config.GetInt("output." + name + ".attempts"); attempts < 1 {
+			errs = append(errs, errors.New(fmt.Sprintf("Output attempts for %s must be at least 1, %v provided", name, attempts)))
+		}
+
+		if _, err := getWriterOptions(config, name); err != nil {
+			errs = append(errs, err)
+		}
+
+		for _, key := range []string{"message_types", "exclude_message_types"} {
+			if _, err := getMessageTypes(config, name, key); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if _, err := getFormat(config, name); err != nil {
+			errs = append(errs, err)
+		}
+
+		if name == "syslog" {
+			if _, err := createSyslogTLSConfig(config); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if name == "gelf" {
+			err := CheckGELF(config.GetString("output.gelf.protocol"), config.GetString("output.gelf.compression"), config.GetInt("output.gelf.chunk_size"))
+			if err != nil {
+				errs = append(errs, errors.New(fmt.Sprintf("Output gelf is invalid. Error: %v", err)))
+			}
+		}
+
+		for _, key := range outputRequired[name] {
+			if !config.IsSet("output." + name + "." + key) {
+				errs = append(errs, errors.New(fmt.Sprintf("Output %s %s must be set", name, key)))
+			}
+		}
+	}
+
+	if enabled == 0 {
+		errs = append(errs, errors.New("No outputs were configured"))
+	}
+
+	if config.GetString("output.spool.dir") != "" && config.GetInt64("output.spool.max_bytes") < 1 {
+		errs = append(errs, errors.New(fmt.Sprintf("Output spool max_bytes must be at least 1, %v provided", config.GetInt64("output.spool.max_bytes"))))
+	}
+
+	if config.GetBool("output.file.enabled") && config.IsSet("output.file.mode") && config.GetInt("output.file.mode") < 1 {
+		errs = append(errs, errors.New("Output file mode should be greater than 0000"))
+	}
+
+	if err := checkShardPath(config.GetString("output.file.path")); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := createFilters(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := getRequiredRecords(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := getIntegrityKey(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// Prints the problems found in the config and returns the exit code to use
+func reportConfig(file string, config *viper.Viper, err error) int {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load %s. Error: %v\n", file, err)
+		return 1
+	}
+
+	// Filters log what they do, keep the report readable
+	logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+	errs := testConfig(config)
+	logger.AuditLoggerNew(l, el, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	if len(errs) == 0 {
+		fmt.Printf("%s is valid\n", file)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Found %d problem(s) in %s\n", len(errs), file)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "  - %v\n", err)
+	}
+
+	return 1
+}
+
+func main() {
+	configFile := flag.String("config", "", "Config file location")
+	checkConfig := flag.Bool("test-config", false, "Check the config file for problems and exit without touching netlink or the audit rules")
+	showVersion := flag.Bool("version", false, "Print the version, git commit and build date and exit")
+	showConfig := flag.Bool("dump-config", false, "Print the config in effect, with defaults and environment overrides and secrets redacted, and exit")
+
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	logger.AuditLoggerNew(l, el, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	if *configFile == "" {
+		logger.Err("A config file must be provided")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := loadConfig(*configFile)
+	if *checkConfig {
+		os.Exit(reportConfig(*configFile, config, err))
+	}
+
+	if *showConfig {
+		if err == nil {
+			err = dumpConfig(os.Stdout, config)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load %s. Error: %v\n", *configFile, err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	if err := setupLogger(config); err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	logger.Info("Starting %s", versionString())
+
+	// output needs to be created before anything that write to stdout
+	writers, err := createOutput(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	// Replaying a file or reading passively leaves the kernel alone, the rules may be left to someone else on their own
+	replay := config.GetString("input.type") == INPUT_FILE
+	passive := leaveKernelAlone(config)
+	externalRules := leaveRulesAlone(config)
+
+	var savedRules []string
+	if rulesSetting(config, "preserve_existing") && !externalRules {
+		if savedRules, err = saveRules(lOutput); err != nil {
+			logger.Crit("%v", err)
+			panic(err)
+		}
+	}
+
+	if !externalRules {
+		if err := setRules(config, lExec, lOutput); err != nil {
+			logger.Crit("%v", err)
+			panic(err)
+		}
+	} else if !passive {
+		logger.Info("Leaving the audit rules as they are, rules.manage is false")
+	}
+
+	if config.GetBool("metrics.enabled") {
+		if err := metrics.Serve(config.GetString("metrics.address")); err != nil {
+			logger.Crit("%v", err)
+			panic(err)
+		}
+	}
+
+	var nlClient *NetlinkClient
+	var input *FileReceiver
+	if replay {
+		if input, err = NewFileReceiver(config.GetString("input.file.path"), config.GetBool("input.file.follow")); err != nil {
+			logger.Crit("%v", err)
+			panic(err)
+		}
+	} else {
+		options, err := getNetlinkOptions(config)
+		if err != nil {
+			logger.Crit("%v", err)
+			panic(err)
+		}
+
+		nlClient = NewNetlinkClientWithOptions(options)
+		nlClient.SetMaxReceiveBuffer(config.GetInt("socket_buffer.max_receive"))
+
+		if passive {
+			logger.Info("Reading events from netlink multicast group %d, the audit rules and kernel settings are left to auditd", options.MulticastGroup)
+		} else if err := setKernelStatus(config, nlClient); err != nil {
+			logger.Crit("%v", err)
+			panic(err)
+		}
+
+		if config.GetBool("metrics.enabled") {
+			go watchKernelStatus(nlClient, config.GetDuration("metrics.kernel_status_interval"))
+		}
+	}
+
+	// A typo in a filter is not worth a stack trace
+	filters, err := createFilters(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		os.Exit(1)
+	}
+
+	files, err := loadIdFiles(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	resolver := createResolver(config)
+	useIdFiles(files, config.GetBool("resolve.files_fallback"), resolver)
+
+	marshaller := NewAuditMarshaller(
+		writers,
+		config.GetBool("message_tracking.enabled"),
+		config.GetBool("message_tracking.log_out_of_order"),
+		config.GetInt("message_tracking.max_out_of_order"),
+		filters,
+		resolver,
+	)
+
+	completionTimeout, err := getCompletionTimeout(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	marshaller.SetCompletionTimeout(completionTimeout, config.GetBool("message_tracking.drop_incomplete"))
+	marshaller.SetRateLimit(config.GetInt("message_tracking.max_events_per_second"))
+	marshaller.SetMaxEventBytes(config.GetInt("message_tracking.max_event_bytes"), config.GetBool("message_tracking.drop_oversized"))
+
+	fields, err := createFields(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	marshaller.SetFields(fields)
+	marshaller.SetDecodeHex(config.GetBool("transform.decode_hex"))
+	marshaller.SetJoinSplitFields(config.GetBool("transform.join_split_fields"))
+
+	required, err := getRequiredRecords(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	marshaller.SetRequiredRecords(required)
+	marshaller.SetStructured(config.GetBool("transform.structured"))
+	marshaller.SetReassembleExecve(config.GetBool("transform.reassemble_execve"))
+	marshaller.SetDropExecveArgs(config.GetBool("transform.drop_execve_args"))
+	if config.GetBool("transform.drop_execve_args") && !config.GetBool("transform.reassemble_execve") {
+		logger.Warning("Keeping the execve arguments, transform.drop_execve_args needs transform.reassemble_execve")
+	}
+	marshaller.SetParseSELinux(config.GetBool("transform.parse_selinux"))
+	marshaller.SetIncludeRaw(config.GetBool("transform.include_raw"))
+	marshaller.SetResolveSyscall(config.GetBool("transform.resolve_syscall"))
+	marshaller.SetParseTimestamp(config.GetBool("transform.parse_timestamp"))
+	marshaller.SetEmitSeq(config.GetBool("transform.emit_seq"))
+
+	key, err := getIntegrityKey(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	marshaller.SetIntegrity(key, config.GetBool("integrity.chain"))
+	marshaller.SetResolveContainer(createContainerResolver(config))
+	marshaller.SetDecodeSaddr(config.GetBool("transform.decode_saddr") || config.GetBool("transform.resolve_saddr"), createHostResolver(config))
+	marshaller.SetMaxAge(config.GetDuration("max_age"))
+	marshaller.SetDedupeWindow(time.Duration(config.GetInt("transform.dedupe_window_ms")) * time.Millisecond)
+	marshaller.Sweep(completionTimeout)
+	if interval := config.GetDuration("message_tracking.log_in_flight_interval"); interval > 0 {
+		marshaller.LogInFlight(interval)
+	}
+
+	deadLetter, err := createDeadLetterOutput(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	marshaller.SetDeadLetter(deadLetter)
+
+	ringSize, err := getDebugRingSize(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	if ringSize > 0 {
+		marshaller.SetDebugRing(ringSize)
+		metrics.Handle(DEBUG_EVENTS_PATH, marshaller.DebugHandler())
+		logger.Info("Serving the last %d events on http://%s%s", ringSize, config.GetString("metrics.address"), DEBUG_EVENTS_PATH)
+	}
+
+	// Nothing has been received yet, the rules are in place but no event is lost by stopping here
+	if config.GetBool("startup.selftest") && !selfTest(marshaller, writers) && config.GetBool("startup.selftest_fatal") {
+		logger.Crit("Exiting, the startup self-test failed and startup.selftest_fatal is set")
+		shutdown(config, marshaller, lExec, savedRules, false)
+		os.Exit(1)
+	}
+
+	queueDepth := config.GetInt("socket_buffer.queue_depth")
+	if queueDepth < 1 {
+		err := errors.New(fmt.Sprintf("Socket buffer queue depth must be at least 1, %v provided", queueDepth))
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	priorities, err := createPriorities(config, queueDepth)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	workers, err := getWorkers(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	queue := make(chan *syscall.NetlinkMessage, queueDepth)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	logger.Info("Started processing events with %d workers", workers)
+	go process(queue, marshaller, workers, stop, done)
+
+	if interval := config.GetDuration("heartbeat.interval"); interval > 0 {
+		var getStatus func() (*AuditStatusPayload, error)
+		if nlClient != nil {
+			getStatus = nlClient.GetStatus
+		}
+
+		go heartbeat(marshaller, interval, getStatus)
+	}
+
+	protect, err := createProtector(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	limits, err := createReliability(config)
+	if err != nil {
+		logger.Crit("%v", err)
+		panic(err)
+	}
+
+	if limits != nil {
+		marshaller.SetFailureHandler(func(output string, failures int) {
+			limits.failed("Writing to output "+output, failures)
+		})
+	}
+
+	// Only what comes from netlink is measured, a replay can go as fast as it likes
+	if protect != nil && !replay {
+		if !passive {
+			protect.kernel = nlClient
+		}
+
+		protect.alert = marshaller.Alert
+		go protect.watch(metrics.NetlinkReceived.Value)
+		logger.Info("Protecting the host from more than %d messages per second for %v", protect.maxRate, protect.sustain)
+	}
+
+	finished := make(chan struct{})
+	received := make(chan struct{})
+	if replay {
+		go func() {
+			readInput(input, queue)
+			input.Close()
+			close(finished)
+		}()
+	} else {
+		go func() {
+			receive(nlClient, queue, priorities, limits)
+			close(received)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+
+	draining := false
+	exhausted := false
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := reload(*configFile, marshaller, resolver, lExec, lOutput, externalRules); err != nil {
+					logger.Err("Failed to reload, keeping the current config. Error: %v", err)
+				}
+				continue
+			}
+
+			// Hand over to another go-audit, it can claim the audit pid once we let go of it
+			if sig == syscall.SIGUSR1 && nlClient != nil {
+				logger.Info("Got %v, releasing netlink and draining what was already received", sig)
+				if err := nlClient.Release(); err != nil {
+					logger.Err("Failed to release netlink, shutting down instead. Error: %v", err)
+					break wait
+				}
+
+				<-received
+				draining = true
+				break wait
+			}
+
+			logger.Info("Got %v, shutting down", sig)
+			break wait
+		case <-finished:
+			logger.Info("Reached the end of the input, shutting down")
+			break wait
+		case <-limits.exhaustion():
+			exhausted = true
+			break wait
+		}
+	}
+
+	// Process what has already been received before closing the outputs
+	close(stop)
+	<-done
+	if draining {
+		if left := drainInFlight(marshaller, completionTimeout); left > 0 {
+			logger.Warning("Writing %d events that were not complete after draining for %v", left, completionTimeout)
+		}
+	}
+
+	if protect != nil {
+		protect.stop()
+	}
+	shutdown(config, marshaller, lExec, savedRules, draining)
+	if draining {
+		logger.Info("Drained, exiting")
+	}
+
+	if exhausted {
+		os.Exit(1)
+	}
+}
+
+const DRAIN_POLL_INTERVAL = time.Millisecond * 10 // How often to check if the events in flight were completed
+
+// Waits up to timeout for the events in flight to be completed, by their end or by the completion timeout
+// Returns how many are still in flight
+func drainInFlight(marshaller *AuditMarshaller, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		n, _ := marshaller.InFlight()
+		if n == 0 || !time.Now().Before(deadline) {
+			return n
+		}
+
+		time.Sleep(DRAIN_POLL_INTERVAL)
+	}
+}
+
+// Loads the config file again on SIGHUP and swaps in its filters and rules, everything else needs a restart
+// The passwd and group files are read again when ids are resolved from them
+// Nothing changes unless the whole new config checks out. Rules are left alone when external, see leaveRulesAlone
+func reload(configFile string, marshaller *AuditMarshaller, resolver *IdResolver, e executor, o outputExecutor, externalRules bool) error {
+	logger.Info("Reloading %s", configFile)
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to load %s. Error: %s", configFile, err))
+	}
+
+	if errs := testConfig(config); len(errs) > 0 {
+		for _, err := range errs {
+			logger.Err("%v", err)
+		}
+
+		return errors.New(fmt.Sprintf("%s has %d problems", configFile, len(errs)))
+	}
+
+	filters, err := createFilters(config)
+	if err != nil {
+		return err
+	}
+
+	files, err := loadIdFiles(config)
+	if err != nil {
+		return err
+	}
+
+	if !externalRules {
+		if err := setRules(config, e, o); err != nil {
+			return err
+		}
+	}
+
+	marshaller.SetFilters(filters)
+	useIdFiles(files, config.GetBool("resolve.files_fallback"), resolver)
+	logger.Info("Reloaded filters and rules from %s", configFile)
+	return nil
+}
+
+// Keeps the kernel side metrics up to date, these show events lost before they ever reached us
+func watchKernelStatus(nlClient *NetlinkClient, interval time.Duration) {
+	for {
+		updateKernelStatus(nlClient.GetStatus)
+		time.Sleep(interval)
+	}
+}
+
+func updateKernelStatus(getStatus func() (*AuditStatusPayload, error)) {
+	status, err := getStatus()
+	if err != nil {
+		logger.Err("Failed to get the kernel audit status. Error: %v", err)
+		return
+	}
+
+	metrics.KernelLost.Set(uint64(status.Lost))
+	metrics.KernelBacklog.Set(uint64(status.Backlog))
+}
+
+// Writes a synthetic event through the filters, transforms and every output, see AuditMarshaller.SelfTest
+// Anything that keeps it from an output is logged as critical, false when it did not reach every output
+func selfTest(marshaller *AuditMarshaller, writers []*AuditWriter) bool {
+	failed, err := marshaller.SelfTest(NewSelfTestEvent(time.Now()))
+	if err != nil {
+		logger.Crit("Startup self-test failed, no output was tested. Error: %v", err)
+		return false
+	}
+
+	for i, w := range writers {
+		if err, ok := failed[i]; ok {
+			logger.Crit("Startup self-test failed, the event did not reach output %s. Error: %v", w.Name(), err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return false
+	}
+
+	logger.Info("Startup self-test passed, the event reached every output that wants it")
+	return true
+}
+
+// Writes a heartbeat every interval, getStatus is nil when there is no kernel to ask for its counts
+func heartbeat(marshaller *AuditMarshaller, interval time.Duration, getStatus func() (*AuditStatusPayload, error)) {
+	started := time.Now()
+	for {
+		time.Sleep(interval)
+		marshaller.Heartbeat(newHeartbeat(started, time.Now(), getStatus))
+	}
+}
+
+func newHeartbeat(started, now time.Time, getStatus func() (*AuditStatusPayload, error)) *Heartbeat {
+	hb := NewHeartbeat(started, now)
+	hb.Version = version
+	if getStatus == nil {
+		return hb
+	}
+
+	status, err := getStatus()
+	if err != nil {
+		logger.Err("Failed to get the kernel audit status for the heartbeat. Error: %v", err)
+		return hb
+	}
+
+	hb.KernelLost = &status.Lost
+	hb.KernelBacklog = &status.Backlog
+	return hb
+}
+
+const QUEUE_DROP_REPORT_INTERVAL = time.Second // How often to log a summary of messages dropped because the queue was full
+
+// Anything that hands out netlink messages, NetlinkClient in practice
+type netlinkReceiver interface {
+	Receive() (*syscall.NetlinkMessage, error)
+}
+
+// Main loop. Get data from netlink and queue it for processing
+// This only waits on the processor for high priority messages, others are dropped when the queue is too full for
+// their priority so netlink keeps draining. Returns once the client was released and has nothing left to hand out
+// Receive errors in a row are counted against the limits and giving up on reconnecting exhausts them, without limits
+// giving up panics
+func receive(nlClient netlinkReceiver, queue chan<- *syscall.NetlinkMessage, p *priorities, limits *reliability) {
+	var dropped [2]int
+	var reported time.Time
+	failures := 0
+
+	for {
+		msg, err := nlClient.Receive()
+		if err == ErrReleased {
+			return
+		}
+
+		if err == ErrReconnectFailed && limits == nil {
+			logger.Crit("%v", err)
+			panic(err)
+		}
+
+		if err == ErrReconnectFailed {
+			limits.exhaust(err.Error())
+			continue
+		}
+
+		if err != nil {
+			logger.Err("Error during message receive: %+v", err)
+			failures++
+			limits.failed("Receiving from netlink", failures)
+			continue
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		failures = 0
+		metrics.NetlinkReceived.Inc()
+
+		// The client reuses its buffer for the next message
+		msg.Data = append([]byte(nil), msg.Data...)
+
+		if priority, queued := p.enqueue(queue, msg); !queued {
+			metrics.QueueDropped.With(priorityNames[priority]).Inc()
+			dropped[priority]++
+		}
+
+		if dropped[PRIORITY_LOW]+dropped[PRIORITY_NORMAL] > 0 && time.Since(reported) >= QUEUE_DROP_REPORT_INTERVAL {
+			logger.Warning(
+				"Dropped %d low and %d normal priority messages because the processing queue was backed up, consider raising socket_buffer.queue_depth",
+				dropped[PRIORITY_LOW],
+				dropped[PRIORITY_NORMAL],
+			)
+			dropped = [2]int{}
+			reported = time.Now()
+		}
+	}
+}
+
+const WORKER_QUEUE_DEPTH = 64 // Messages handed to a worker ahead of it, the processing queue is where they pile up
+
+// How many goroutines marshal events, processing.workers
+func getWorkers(config *viper.Viper) (int, error) {
+	workers := config.GetInt("processing.workers")
+	if workers < 1 {
+		return 0, errors.New(fmt.Sprintf("Processing workers must be at least 1, %v provided", workers))
+	}
+
+	return workers, nil
+}
+
+// Marshals and writes everything the receiver queued, on as many goroutines as there are workers
+// Messages are sharded by their audit sequence so every message of an event is consumed by the same worker, in order
+// Workers consume out of order between them, so sequences are tracked here before messages are sharded
+// Once stop is closed whatever is already queued is processed and done is closed
+func process(queue <-chan *syscall.NetlinkMessage, marshaller *AuditMarshaller, workers int, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	consume := marshaller.Consume
+	if workers > 1 {
+		shards := make([]chan *syscall.NetlinkMessage, workers)
+		wg := &sync.WaitGroup{}
+		for i := range shards {
+			shards[i] = make(chan *syscall.NetlinkMessage, WORKER_QUEUE_DEPTH)
+			wg.Add(1)
+			go func(shard <-chan *syscall.NetlinkMessage) {
+				defer wg.Done()
+				for msg := range shard {
+					marshaller.Consume(msg)
+				}
+			}(shards[i])
+		}
+
+		defer func() {
+			for _, shard := range shards {
+				close(shard)
+			}
+			wg.Wait()
+		}()
+
+		marshaller.SetTrackAhead(true)
+		consume = func(msg *syscall.NetlinkMessage) {
+			marshaller.TrackSequence(msg)
+			shards[MessageSeq(msg)%workers] <- msg
+		}
+	}
+
+	for {
+		select {
+		case msg := <-queue:
+			consume(msg)
+			metrics.QueueDepth.Set(uint64(len(queue)))
+
+		case <-stop:
+			for {
+				select {
+				case msg := <-queue:
+					consume(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Writes out what we have, drains and closes every output and optionally flushes our audit rules
+// If rules were saved at startup they replace ours instead, even when flush_rules_on_exit is set
+// Rules are never touched when replaying a file, reading passively, when rules.manage is false or when handing over
+// to another go-audit, the rules are theirs by then
+// The receive loop may still be blocked on netlink, the marshaller ignores anything it hands over from now on
+func shutdown(config *viper.Viper, marshaller *AuditMarshaller, e executor, savedRules []string, handover bool) {
+	if err := marshaller.Close(); err != nil {
+		logger.Err("Failed to cleanly close all outputs. Error: %v", err)
+	}
+
+	if handover {
+		logger.Info("Shutdown complete, leaving the audit rules to the go-audit taking over")
+		return
+	}
+
+	if savedRules != nil {
+		if err := restoreRules(savedRules, e); err != nil {
+			logger.Err("%v", err)
+		}
+	} else if config.GetBool("flush_rules_on_exit") && !leaveRulesAlone(config) {
+		if err := e("auditctl", "-D"); err != nil {
+			logger.Err("Failed to flush audit rules. Error: %v", err)
+		} else {
+			logger.Info("Flushed audit rules")
+		}
+	}
+
+	logger.Info("Shutdown complete")
 }
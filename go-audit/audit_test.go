@@ -1,18 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
-	"log/syslog"
+	"log"
 	"net"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
+	. "github.com/Xeralux/go-audit/client"
+	"github.com/Xeralux/go-audit/logger"
+	. "github.com/Xeralux/go-audit/marshaller"
+	"github.com/Xeralux/go-audit/metrics"
+	. "github.com/Xeralux/go-audit/parser"
+	. "github.com/Xeralux/go-audit/writer"
 )
 
 func Test_loadConfig(t *testing.T) {
@@ -27,8 +40,75 @@ func Test_loadConfig(t *testing.T) {
 	assert.Equal(t, false, config.GetBool("output.syslog.enabled"), "output.syslog.enabled should default to false")
 	assert.Equal(t, 132, config.GetInt("output.syslog.priority"), "output.syslog.priority should default to 132")
 	assert.Equal(t, "go-audit", config.GetString("output.syslog.tag"), "output.syslog.tag should default to go-audit")
+	assert.Equal(t, "", config.GetString("output.syslog.hostname"), "output.syslog.hostname should default to empty")
 	assert.Equal(t, 3, config.GetInt("output.syslog.attempts"), "output.syslog.attempts should default to 3")
+	assert.Equal(t, 5*time.Second, config.GetDuration("output.syslog.write_timeout"), "output.syslog.write_timeout should default to 5s")
+	assert.Equal(t, "json", config.GetString("output.format"), "output.format should default to json")
+	assert.Equal(t, "Xeralux", config.GetString("output.cef.vendor"), "output.cef.vendor should default to Xeralux")
+	assert.Equal(t, "go-audit", config.GetString("output.cef.product"), "output.cef.product should default to go-audit")
+	assert.Equal(t, "1", config.GetString("output.cef.version"), "output.cef.version should default to 1")
+	assert.Equal(t, 5, config.GetInt("output.cef.severity"), "output.cef.severity should default to 5")
+	assert.Equal(t, false, config.GetBool("transform.decode_hex"), "transform.decode_hex should default to false")
+	assert.Equal(t, false, config.GetBool("transform.structured"), "transform.structured should default to false")
+	assert.Equal(t, false, config.GetBool("transform.reassemble_execve"), "transform.reassemble_execve should default to false")
+	assert.Equal(t, false, config.GetBool("transform.join_split_fields"), "transform.join_split_fields should default to false")
+	assert.Empty(t, config.GetStringSlice("transform.require_records"), "transform.require_records should default to none")
+	assert.Equal(t, false, config.GetBool("transform.parse_selinux"), "transform.parse_selinux should default to false")
+	assert.Equal(t, false, config.GetBool("transform.resolve_container"), "transform.resolve_container should default to false")
+	assert.Equal(t, "nss", config.GetString("resolve.source"), "resolve.source should default to nss")
+	assert.Equal(t, "/etc/passwd", config.GetString("resolve.passwd_file"), "resolve.passwd_file should default to /etc/passwd")
+	assert.Equal(t, "/etc/group", config.GetString("resolve.group_file"), "resolve.group_file should default to /etc/group")
+	assert.Equal(t, false, config.GetBool("resolve.files_fallback"), "resolve.files_fallback should default to false")
+	assert.Equal(t, false, config.GetBool("transform.decode_saddr"), "transform.decode_saddr should default to false")
+	assert.Equal(t, false, config.GetBool("transform.resolve_syscall"), "transform.resolve_syscall should default to false")
+	assert.Equal(t, false, config.GetBool("transform.parse_timestamp"), "transform.parse_timestamp should default to false")
+	assert.Equal(t, false, config.GetBool("transform.emit_seq"), "transform.emit_seq should default to false")
+	assert.Equal(t, "", config.GetString("integrity.hmac_key"), "integrity.hmac_key should default to empty")
+	assert.Equal(t, "", config.GetString("integrity.hmac_key_file"), "integrity.hmac_key_file should default to empty")
+	assert.Equal(t, false, config.GetBool("integrity.chain"), "integrity.chain should default to false")
+	assert.Equal(t, false, config.GetBool("transform.drop_execve_args"), "transform.drop_execve_args should default to false")
+	assert.Equal(t, false, config.GetBool("transform.include_raw"), "transform.include_raw should default to false")
+	assert.Equal(t, false, config.GetBool("transform.resolve_saddr"), "transform.resolve_saddr should default to false")
+	assert.Equal(t, 0, config.GetInt("transform.dedupe_window_ms"), "transform.dedupe_window_ms should default to 0")
+	assert.Equal(t, 0, config.GetInt("max_age"), "max_age should default to 0")
+	assert.Equal(t, 0, config.GetInt("debug.ring_size"), "debug.ring_size should default to 0")
+	assert.Equal(t, 8192, config.GetInt("socket_buffer.queue_depth"), "socket_buffer.queue_depth should default to 8192")
+	assert.Equal(t, 0, config.GetInt("netlink.multicast_group"), "netlink.multicast_group should default to 0")
+	assert.Equal(t, false, config.GetBool("netlink.force_receive_buffer"), "netlink.force_receive_buffer should default to false")
+	assert.Equal(t, time.Duration(0), config.GetDuration("netlink.receive_timeout"), "netlink.receive_timeout should default to 0")
+	assert.Equal(t, 75, config.GetInt("priority.low_watermark"), "priority.low_watermark should default to 75")
+	assert.Equal(t, 0, config.GetInt("message_tracking.max_event_bytes"), "message_tracking.max_event_bytes should default to 0")
+	assert.Equal(t, false, config.GetBool("message_tracking.drop_oversized"), "message_tracking.drop_oversized should default to false")
+	assert.Equal(t, time.Minute, config.GetDuration("message_tracking.log_in_flight_interval"), "message_tracking.log_in_flight_interval should default to 1m")
+	assert.Equal(t, "netlink", config.GetString("input.type"), "input.type should default to netlink")
+	assert.Equal(t, false, config.GetBool("input.netlink.multicast"), "input.netlink.multicast should default to false")
+	assert.Equal(t, false, config.GetBool("input.file.follow"), "input.file.follow should default to false")
+	assert.Equal(t, time.Duration(0), config.GetDuration("heartbeat.interval"), "heartbeat.interval should default to 0")
+	assert.Equal(t, false, config.GetBool("startup.selftest"), "startup.selftest should default to false")
+	assert.Equal(t, false, config.GetBool("startup.selftest_fatal"), "startup.selftest_fatal should default to false")
+	assert.Equal(t, false, config.GetBool("rules.preserve_existing"), "rules.preserve_existing should default to false")
+	assert.Equal(t, true, config.GetBool("rules.manage"), "rules.manage should default to true")
+	assert.Equal(t, 1, config.GetInt("processing.workers"), "processing.workers should default to 1")
+	assert.Equal(t, 0, config.GetInt("output.syslog.circuit_breaker.failures"), "output.syslog.circuit_breaker.failures should default to 0")
+	assert.Equal(t, "30s", config.GetString("output.http.circuit_breaker.cooldown"), "output.http.circuit_breaker.cooldown should default to 30s")
+	assert.Equal(t, "fixed", config.GetString("output.tcp.retry_backoff.strategy"), "output.tcp.retry_backoff.strategy should default to fixed")
+	assert.Equal(t, time.Second, config.GetDuration("output.tcp.retry_backoff.delay"), "output.tcp.retry_backoff.delay should default to 1s")
+	assert.Equal(t, time.Duration(0), config.GetDuration("output.tcp.retry_backoff.max_elapsed"), "output.tcp.retry_backoff.max_elapsed should default to 0")
+	assert.Equal(t, 2, config.GetInt("output.http.max_idle_conns"), "output.http.max_idle_conns should default to 2")
+	assert.Equal(t, 1, config.GetInt("output.http.max_in_flight"), "output.http.max_in_flight should default to 1")
+	assert.Equal(t, "", config.GetString("output.syslog.template"), "output.syslog.template should default to empty")
+	assert.Equal(t, "udp", config.GetString("output.gelf.protocol"), "output.gelf.protocol should default to udp")
+	assert.Equal(t, "", config.GetString("output.gelf.compression"), "output.gelf.compression should default to empty")
+	assert.Equal(t, 1420, config.GetInt("output.gelf.chunk_size"), "output.gelf.chunk_size should default to 1420")
+	assert.Equal(t, 3, config.GetInt("output.s3.attempts"), "output.s3.attempts should default to 3")
+	assert.Equal(t, "go-audit/%Y/%m/%d/", config.GetString("output.s3.prefix"), "output.s3.prefix should default to go-audit/%Y/%m/%d/")
+	assert.Equal(t, 8*1024*1024, config.GetInt("output.s3.part_size"), "output.s3.part_size should default to 8MB")
 	assert.Equal(t, 0, config.GetInt("log.flags"), "log.flags should default to 0")
+	assert.Equal(t, "text", config.GetString("log.format"), "log.format should default to text")
+	assert.Equal(t, "debug", config.GetString("log.level"), "log.level should default to debug")
+	assert.Equal(t, false, config.GetBool("log.suppress_rule_setup"), "log.suppress_rule_setup should default to false")
+	assert.Equal(t, 0, config.GetInt("reliability.max_consecutive_failures"), "reliability.max_consecutive_failures should default to 0")
+	assert.Equal(t, "exit", config.GetString("reliability.on_exhaustion"), "reliability.on_exhaustion should default to exit")
 	assert.Equal(t, 0, l.Flags(), "stdout log flags was wrong")
 	assert.Equal(t, 0, el.Flags(), "stderr log flags was wrong")
 	assert.Nil(t, err)
@@ -40,196 +120,1940 @@ func Test_loadConfig(t *testing.T) {
 	assert.Nil(t, config)
 }
 
+func Test_setupLogger(t *testing.T) {
+	defer resetLogger()
+
+	config := viper.New()
+	config.Set("log.level", "loud")
+	assert.EqualError(t, setupLogger(config), "Unknown log level `loud`")
+
+	config.Set("log.level", "debug")
+	config.Set("log.format", "xml")
+	assert.EqualError(t, setupLogger(config), "Unknown log format `xml`")
+
+	config.Set("log.format", "json")
+	l.SetFlags(16)
+	assert.Nil(t, setupLogger(config))
+	assert.Equal(t, 0, l.Flags())
+	assert.Equal(t, 0, el.Flags())
+
+	lb := &bytes.Buffer{}
+	l.SetOutput(lb)
+	logger.Info("Testing %s\n", "json")
+
+	line := map[string]string{}
+	assert.Nil(t, json.Unmarshal(lb.Bytes(), &line))
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "Testing json", line["msg"])
+	assert.Contains(t, line["caller"], "audit_test.go:")
+	assert.NotEmpty(t, line["time"])
+}
+
+func Test_testConfig(t *testing.T) {
+	defer resetLogger()
+
+	file := createTempFile(t, "testConfig.test.yaml", `
+log:
+  level: loud
+input:
+  type: file
+heartbeat:
+  interval: -1s
+debug:
+  ring_size: 10
+message_tracking:
+  completion_timeout: 0
+output:
+  file:
+    enabled: true
+    attempts: 0
+    mode: 0
+  http:
+    enabled: true
+    attempts: 1
+  gelf:
+    enabled: true
+    attempts: 1
+    protocol: tcp
+    compression: zlib
+rules:
+  - -a exit,always -S execve
+  - -D
+filters:
+  - syscall: 49
+    regex: "("
+`)
+	defer os.Remove(file)
+
+	config, err := loadConfig(file)
+	assert.Nil(t, err)
+
+	errs := []string{}
+	for _, err := range testConfig(config) {
+		errs = append(errs, err.Error())
+	}
+
+	assert.Equal(
+		t,
+		[]string{
+			"Unknown log level `loud`",
+			"Failed to validate rule #2 `-D`. Error: Flushing the rules with -D would remove the ones added before it",
+			"Message tracking completion timeout must be greater than 0, 0s provided",
+			"Debug ring is served by the metrics server, metrics.enabled must be true",
+			"Heartbeat interval must not be negative, -1s provided",
+			"Input file path must be set",
+			"Output attempts for file must be at least 1, 0 provided",
+			"Output file path must be set",
+			"Output http url must be set",
+			"Output gelf is invalid. Error: Gelf over tcp can not be compressed, zlib provided",
+			"Output gelf address must be set",
+			"Output file mode should be greater than 0000",
+			"`regex` in filter 1 could not be parsed (. Error: error parsing regexp: missing closing ): `(`",
+		},
+		errs,
+	)
+
+	// A good config
+	file = createTempFile(t, "testConfig.test.yaml", `
+output:
+  stdout:
+    enabled: true
+    attempts: 1
+rules:
+  - -a exit,always -S execve
+`)
+
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(testConfig(config)))
+	assert.Equal(t, 0, reportConfig(file, config, nil))
+	assert.Equal(t, 1, reportConfig(file, nil, errors.New("derp")))
+
+	// No rules are needed when they are managed elsewhere
+	file = createTempFile(t, "testConfig.test.yaml", `
+rules:
+  manage: false
+output:
+  stdout:
+    enabled: true
+    attempts: 1
+`)
+
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(testConfig(config)))
+}
+
 func Test_setRules(t *testing.T) {
 	defer resetLogger()
 
-	// fail to flush rules
-	config := viper.New()
+	// fail on 0 rules
+	config := viper.New()
+	err := setRules(config, func(s string, a ...string) error { return nil }, noRules)
+	assert.EqualError(t, err, "No audit rules found.")
+
+	// fail to flush rules
+	config.Set("rules", []string{"-a exit,always -S 1", "", "-a exit,always -S 3"})
+	err = setRules(config, func(s string, a ...string) error {
+		if s == "auditctl" && a[0] == "-D" {
+			return errors.New("testing")
+		}
+
+		return nil
+	}, noRules)
+
+	assert.EqualError(t, err, "Failed to flush existing audit rules. Error: testing")
+
+	// failure to set rule
+	r := 0
+	err = setRules(config, func(s string, a ...string) error {
+		if a[0] != "-D" {
+			return errors.New("testing rule")
+		}
+
+		r++
+
+		return nil
+	}, noRules)
+
+	assert.Equal(t, 2, r, "Should have flushed again to put the previous rules back")
+	assert.EqualError(t, err, "Failed to add rule #1 `-a exit,always -S 1`. Error: testing rule")
+
+	// properly set rules
+	r = 0
+	err = setRules(config, func(s string, a ...string) error {
+		// Skip the flush rules
+		if a[0] != "-a" {
+			return nil
+		}
+
+		if (a[1] == "exit,always" && a[3] == "1") || (a[1] == "exit,always" && a[3] == "3") {
+			r++
+		}
+
+		return nil
+	}, noRules)
+
+	assert.Equal(t, 2, r, "Wrong number of correct rule set attempts")
+	assert.Nil(t, err)
+
+	// a summary instead of a line per rule, those are still there at debug
+	lb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(&bytes.Buffer{}, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_INFO)
+	config.Set("log.suppress_rule_setup", true)
+	assert.Nil(t, setRules(config, func(s string, a ...string) error { return nil }, noRules))
+	assert.Equal(t, "Applied 2 audit rules, flushed existing\n", lb.String())
+
+	lb.Reset()
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(&bytes.Buffer{}, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+	assert.Nil(t, setRules(config, func(s string, a ...string) error { return nil }, noRules))
+	assert.Equal(t, "Flushed existing audit rules\nAdded audit rule #1\nAdded audit rule #3\nApplied 2 audit rules, flushed existing\n", lb.String())
+	config.Set("log.suppress_rule_setup", false)
+
+	// invalid rules never touch the live rules
+	r = 0
+	config.Set("rules", []string{"-e 2", "-a exit,always -S 1"})
+	err = setRules(config, func(s string, a ...string) error {
+		r++
+		return nil
+	}, noRules)
+
+	assert.Equal(t, 0, r, "Should not have run auditctl")
+	assert.EqualError(t, err, "Failed to validate rule #1 `-e 2`. Error: Locking the rules with -e 2 must be the last rule, the ones after it could not be added")
+
+	// fail to list the live rules, nothing is flushed
+	config.Set("rules", []string{"-a exit,always -S 1"})
+	r = 0
+	err = setRules(config, func(s string, a ...string) error {
+		r++
+		return nil
+	}, func(s string, a ...string) ([]byte, error) { return nil, errors.New("testing") })
+
+	assert.Equal(t, 0, r, "Should not have run auditctl")
+	assert.EqualError(t, err, "Failed to list existing audit rules. Error: testing")
+
+	// a rule auditctl rejects in the middle puts the previous rules back
+	config.Set("rules", []string{"-a exit,always -S 1", "-a exit,always -S nope", "-a exit,always -S 3"})
+	calls := []string{}
+	err = setRules(config, func(s string, a ...string) error {
+		calls = append(calls, strings.Join(a, " "))
+		if a[len(a)-1] == "nope" {
+			return errors.New("testing rule")
+		}
+
+		return nil
+	}, func(s string, a ...string) ([]byte, error) { return []byte("-w /etc/passwd -p wa\n"), nil })
+
+	assert.EqualError(t, err, "Failed to add rule #2 `-a exit,always -S nope`. Error: testing rule")
+	assert.Equal(t, []string{"-D", "-a exit,always -S 1", "-a exit,always -S nope", "-D", "-w /etc/passwd -p wa"}, calls)
+}
+
+func noRules(s string, a ...string) ([]byte, error) {
+	return []byte("No rules\n"), nil
+}
+
+type fakeKernel struct {
+	status *AuditStatusPayload
+	set    *AuditStatusPayload
+	err    error
+}
+
+func (k *fakeKernel) GetStatus() (*AuditStatusPayload, error) {
+	return k.status, nil
+}
+
+func (k *fakeKernel) SetStatus(status *AuditStatusPayload) error {
+	k.set = status
+	return k.err
+}
+
+func Test_setKernelStatus(t *testing.T) {
+	defer resetLogger()
+	lb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(&bytes.Buffer{}, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	// nothing set leaves the kernel alone
+	k := &fakeKernel{status: &AuditStatusPayload{BacklogLimit: 64, Failure: AUDIT_FAIL_PRINTK}}
+	assert.Nil(t, setKernelStatus(viper.New(), k))
+	assert.Nil(t, k.set)
+
+	c := viper.New()
+	c.Set("kernel.backlog_limit", 8192)
+	c.Set("kernel.failure_mode", "silent")
+	assert.Nil(t, setKernelStatus(c, k))
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_LIMIT | AUDIT_STATUS_FAILURE, BacklogLimit: 8192, Failure: AUDIT_FAIL_SILENT}, k.set)
+	assert.Equal(
+		t,
+		"Set kernel audit backlog_limit to 8192, was 64\nSet kernel audit failure_mode to silent, was printk\n",
+		lb.String(),
+	)
+
+	// rejected
+	k.err = syscall.EPERM
+	assert.EqualError(t, setKernelStatus(c, k), "Kernel rejected the audit settings. Error: operation not permitted")
+
+	// bad values
+	c = viper.New()
+	c.Set("kernel.rate_limit", -1)
+	assert.EqualError(t, setKernelStatus(c, k), "Kernel rate_limit must be at least 0, -1 provided")
+
+	c = viper.New()
+	c.Set("kernel.backlog_limit", -1)
+	assert.EqualError(t, setKernelStatus(c, k), "Kernel backlog_limit must be at least 0, -1 provided")
+
+	c = viper.New()
+	c.Set("kernel.failure_mode", "loud")
+	assert.EqualError(t, setKernelStatus(c, k), "Unknown kernel failure_mode `loud`, must be silent, printk or panic")
+}
+
+func Test_loadRules(t *testing.T) {
+	defer resetLogger()
+
+	dir, err := ioutil.TempDir("", "go-audit.rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(path.Join(dir, "20-exec.rules"), []byte("# exec\n-a exit,always -F arch=b64 -S execve\n\n"), 0644)
+	ioutil.WriteFile(path.Join(dir, "10-base.rules"), []byte("-D\n  -b 8192  \n"), 0644)
+	ioutil.WriteFile(path.Join(dir, "99-ignored.txt"), []byte("-e 2\n"), 0644)
+
+	file := createTempFile(t, "audit.rules", "-w /etc/passwd -p wa -k passwd\n")
+	defer os.Remove(file)
+
+	config := viper.New()
+	config.Set("rules", []string{"-e 1"})
+	config.Set("rules_file", file)
+	config.Set("rules_dir", dir)
+
+	rules, err := loadRules(config)
+	assert.Nil(t, err)
+	assert.Equal(
+		t,
+		[]string{"-e 1", "-w /etc/passwd -p wa -k passwd", "-b 8192", "-a exit,always -F arch=b64 -S execve"},
+		rules,
+	)
+
+	// the rules can sit under list, next to their settings
+	yml := createTempFile(t, "rules.test.yaml", "rules:\n  manage: false\n  preserve_existing: true\n  list:\n    - -e 1\n    - -b 8192\n")
+	defer os.Remove(yml)
+	config, err = loadConfig(yml)
+	assert.Nil(t, err)
+	rules, err = loadRules(config)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-e 1", "-b 8192"}, rules)
+	assert.False(t, rulesSetting(config, "manage"))
+	assert.True(t, rulesSetting(config, "preserve_existing"))
+
+	yml = createTempFile(t, "rules.test.yaml", "rules:\n  - -e 1\n")
+	config, err = loadConfig(yml)
+	assert.Nil(t, err)
+	rules, err = loadRules(config)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-e 1"}, rules)
+	assert.True(t, rulesSetting(config, "manage"), "the default even when rules is only the list")
+	assert.False(t, rulesSetting(config, "preserve_existing"))
+
+	// missing file
+	config = viper.New()
+	config.Set("rules_file", path.Join(dir, "nope.rules"))
+	rules, err = loadRules(config)
+	assert.Contains(t, err.Error(), "Failed to read rules file "+path.Join(dir, "nope.rules")+". Error: ")
+	assert.Nil(t, rules)
+}
+
+func Test_validateRule(t *testing.T) {
+	// the rest is up to auditctl
+	good := []string{
+		"",
+		"-a exit,always -F arch=b64 -S execve",
+		"-w /etc/passwd -p wa -k passwd",
+		"-a always,exit -F arch=b64 -S execve -F key=exec --some-new-option",
+		"-e 1",
+	}
+
+	for _, rule := range good {
+		assert.Nil(t, validateRule(rule, false), rule)
+	}
+
+	assert.Nil(t, validateRule("-e 2", true))
+	assert.EqualError(t, validateRule("-e 2", false), "Locking the rules with -e 2 must be the last rule, the ones after it could not be added")
+	assert.EqualError(t, validateRule("-D", true), "Flushing the rules with -D would remove the ones added before it")
+}
+
+func Test_shutdown(t *testing.T) {
+	defer resetLogger()
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+
+	// rules are left alone by default
+	flushed := 0
+	e := func(s string, a ...string) error {
+		if s == "auditctl" && a[0] == "-D" {
+			flushed++
+		}
+		return nil
+	}
+
+	config := viper.New()
+	config.Set("rules.manage", true)
+	shutdown(config, m, e, nil, false)
+	assert.Equal(t, 0, flushed)
+	assert.Contains(t, w.String(), "hi there")
+
+	config.Set("flush_rules_on_exit", true)
+	shutdown(config, m, e, nil, false)
+	assert.Equal(t, 1, flushed)
+
+	// a replay never installed any rules
+	config.Set("input.type", "file")
+	shutdown(config, m, e, nil, false)
+	assert.Equal(t, 1, flushed)
+	config.Set("input.type", "netlink")
+
+	// neither did a passive reader, the rules belong to auditd
+	config.Set("input.netlink.multicast", true)
+	shutdown(config, m, e, nil, false)
+	assert.Equal(t, 1, flushed)
+	config.Set("input.netlink.multicast", false)
+
+	// nor did we when the rules are managed elsewhere
+	config.Set("rules.manage", false)
+	shutdown(config, m, e, nil, false)
+	assert.Equal(t, 1, flushed)
+	config.Set("rules.manage", true)
+
+	// saved rules are put back in place of ours, flushing only once
+	added := [][]string{}
+	e = func(s string, a ...string) error {
+		if a[0] == "-D" {
+			flushed++
+		} else {
+			added = append(added, a)
+		}
+		return nil
+	}
+
+	shutdown(config, m, e, []string{"-w /etc/passwd -p wa -k passwd"}, false)
+	assert.Equal(t, 2, flushed)
+	assert.Equal(t, [][]string{{"-w", "/etc/passwd", "-p", "wa", "-k", "passwd"}}, added)
+
+	// handing over leaves the rules to the go-audit taking over
+	config.Set("flush_rules_on_exit", true)
+	shutdown(config, m, e, []string{"-w /etc/passwd -p wa -k passwd"}, true)
+	assert.Equal(t, 2, flushed)
+	assert.Equal(t, 1, len(added))
+}
+
+func Test_drainInFlight(t *testing.T) {
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)}, false, false, 0, []AuditFilter{}, nil)
+	assert.Equal(t, 0, drainInFlight(m, time.Second))
+
+	// waits for the completion timeout to write out the event
+	m.SetCompletionTimeout(time.Millisecond*30, false)
+	m.Sweep(time.Millisecond * 5)
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1300)}, Data: []byte("audit(10000001:1): hi there")})
+
+	started := time.Now()
+	assert.Equal(t, 0, drainInFlight(m, time.Second))
+	assert.True(t, time.Since(started) < time.Second)
+
+	// gives up after the timeout
+	m.SetCompletionTimeout(time.Hour, false)
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1300)}, Data: []byte("audit(10000001:2): hi there")})
+	assert.Equal(t, 1, drainInFlight(m, time.Millisecond*20))
+	m.Close()
+}
+
+func Test_commandError(t *testing.T) {
+	assert.Nil(t, commandError("auditctl", nil))
+
+	err := commandError("auditctl", exec.Command("go-audit-no-such-auditctl").Run())
+	assert.EqualError(t, err, "auditctl not found; install auditd userspace")
+
+	err = commandError("auditctl", exec.Command("/does/not/exist/auditctl").Run())
+	assert.EqualError(t, err, "auditctl not found; install auditd userspace")
+
+	// Not executable, even root needs an execute bit
+	file := createTempFile(t, "auditctl.test", "#!/bin/sh\n")
+	defer os.Remove(file)
+	err = commandError("auditctl", exec.Command(file).Run())
+	assert.EqualError(t, err, "auditctl could not be run, insufficient privileges. Error: permission denied")
+
+	_, err = exec.Command("sh", "-c", "echo 'Error deleting rule (Operation not permitted)' >&2; exit 1").Output()
+	assert.EqualError(t, commandError("auditctl", err), "auditctl: insufficient privileges; need CAP_AUDIT_CONTROL")
+
+	_, err = exec.Command("sh", "-c", "echo 'You must be root to run this program.' >&2; exit 4").Output()
+	assert.EqualError(t, commandError("auditctl", err), "auditctl: insufficient privileges; need CAP_AUDIT_CONTROL")
+
+	// Anything else keeps what was printed
+	_, err = exec.Command("sh", "-c", "echo 'Rule exists' >&2; exit 1").Output()
+	assert.EqualError(t, commandError("auditctl", err), "exit status 1: Rule exists")
+
+	err = exec.Command("sh", "-c", "exit 1").Run()
+	assert.EqualError(t, commandError("auditctl", err), "exit status 1")
+}
+
+func Test_saveRules(t *testing.T) {
+	defer resetLogger()
+
+	lb, elb := &bytes.Buffer{}, &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+	rules, err := saveRules(func(s string, a ...string) ([]byte, error) {
+		assert.Equal(t, "auditctl", s)
+		assert.Equal(t, []string{"-l"}, a)
+		return []byte("-a always,exit -F arch=b64 -S execve\n-w /etc/passwd -p wa -k passwd\n"), nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-a always,exit -F arch=b64 -S execve", "-w /etc/passwd -p wa -k passwd"}, rules)
+	assert.Contains(t, lb.String(), "Saved 2 existing audit rules")
+	assert.Equal(t, "", elb.String())
+
+	// nothing loaded
+	rules, err = saveRules(func(s string, a ...string) ([]byte, error) { return []byte("No rules\n"), nil })
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, rules)
+
+	_, err = saveRules(func(s string, a ...string) ([]byte, error) { return nil, errors.New("testing") })
+	assert.EqualError(t, err, "Failed to list existing audit rules. Error: testing")
+}
+
+func Test_restoreRules(t *testing.T) {
+	defer resetLogger()
+
+	// a failed rule does not stop the rest
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(&bytes.Buffer{}, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+	added := 0
+	err := restoreRules([]string{"-a bad", "-a good"}, func(s string, a ...string) error {
+		if a[0] == "-D" {
+			return nil
+		}
+		if a[1] == "bad" {
+			return errors.New("testing")
+		}
+		added++
+		return nil
+	})
+	assert.EqualError(t, err, "Failed to restore 1 of 2 saved audit rules")
+	assert.Equal(t, 1, added)
+	assert.Contains(t, elb.String(), "Failed to restore saved audit rule #1: -a bad. Error: testing")
+
+	err = restoreRules([]string{"-a good"}, func(s string, a ...string) error { return errors.New("testing") })
+	assert.EqualError(t, err, "Failed to flush audit rules before restoring the saved ones. Error: testing")
+}
+
+func Test_reload(t *testing.T) {
+	defer resetLogger()
+	lb, elb := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+
+	added := []string{}
+	e := func(s string, a ...string) error {
+		added = append(added, strings.Join(a, " "))
+		return nil
+	}
+
+	file := createTempFile(t, "reload.test.yaml", `
+output:
+  stdout:
+    enabled: true
+    attempts: 1
+rules:
+  - -a exit,always -S execve
+filters:
+  - syscall: 2
+`)
+	defer os.Remove(file)
+
+	assert.Nil(t, reload(file, m, nil, e, noRules, false))
+	assert.Equal(t, []string{"-D", "-a exit,always -S execve"}, added)
+	assert.Contains(t, lb.String(), "Reloaded filters and rules from "+file)
+
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1300)}, Data: []byte("audit(10000001:1): syscall=2")})
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1320)}, Data: []byte("audit(10000001:1): ")})
+	assert.Equal(t, "", w.String(), "the new filter is in place")
+
+	// a bad config leaves everything as it was
+	added = []string{}
+	createTempFile(t, "reload.test.yaml", `
+output:
+  stdout:
+    enabled: true
+    attempts: 1
+rules:
+  - -D
+`)
+	assert.EqualError(t, reload(file, m, nil, e, noRules, false), file+" has 1 problems")
+	assert.Contains(t, elb.String(), "Failed to validate rule #1 `-D`")
+	assert.Equal(t, []string{}, added)
+
+	// replaying leaves the rules alone
+	createTempFile(t, "reload.test.yaml", `
+output:
+  stdout:
+    enabled: true
+    attempts: 1
+rules:
+  - -a exit,always -S execve
+`)
+	assert.Nil(t, reload(file, m, nil, e, noRules, true))
+	assert.Equal(t, []string{}, added)
+
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1300)}, Data: []byte("audit(10000001:2): syscall=2")})
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1320)}, Data: []byte("audit(10000001:2): ")})
+	assert.Contains(t, w.String(), "syscall=2", "the filter was removed")
+
+	assert.EqualError(t, reload("/does/not/exist.yaml", m, nil, e, noRules, false), "Failed to load /does/not/exist.yaml. Error: open /does/not/exist.yaml: no such file or directory")
+
+	// the passwd and group files are read again
+	defer UseUidFiles(nil, false)
+	passwd := createTempFile(t, "reload.passwd", "root:x:0:0::/root:/bin/sh\n")
+	defer os.Remove(passwd)
+	group := createTempFile(t, "reload.group", "root:x:0:\n")
+	defer os.Remove(group)
+
+	createTempFile(t, "reload.test.yaml", `
+output:
+  stdout:
+    enabled: true
+    attempts: 1
+rules:
+  - -a exit,always -S execve
+resolve:
+  ids: true
+  source: files
+  passwd_file: `+passwd+`
+  group_file: `+group+`
+`)
+	r := NewIdResolver(10, time.Hour)
+	assert.Nil(t, reload(file, m, r, e, noRules, true))
+	assert.Equal(t, "root", r.User("0"))
+	assert.Equal(t, "UNKNOWN_USER", r.User("1"))
+
+	createTempFile(t, "reload.passwd", "root:x:0:0::/root:/bin/sh\nbin:x:1:1::/bin:/bin/false\n")
+	assert.Nil(t, reload(file, m, r, e, noRules, true))
+	assert.Equal(t, "bin", r.User("1"))
+}
+
+func Test_createResolver(t *testing.T) {
+	c := viper.New()
+	assert.Nil(t, createResolver(c))
+
+	c.Set("resolve.ids", true)
+	c.Set("resolve.cache_size", 10)
+	assert.NotNil(t, createResolver(c))
+}
+
+func Test_useIdFiles(t *testing.T) {
+	defer resetLogger()
+	defer UseUidFiles(nil, false)
+
+	c := viper.New()
+	c.Set("resolve.source", "nss")
+	files, err := loadIdFiles(c)
+	assert.Nil(t, err)
+	assert.Nil(t, files)
+
+	c.Set("resolve.source", "ldap")
+	_, err = loadIdFiles(c)
+	assert.EqualError(t, err, "Unknown resolve source `ldap`, must be one of nss or files")
+
+	passwd := createTempFile(t, "resolver.passwd", "daemon:x:2:2::/:/bin/false\n")
+	defer os.Remove(passwd)
+	group := createTempFile(t, "resolver.group", "adm:x:4:\n")
+	defer os.Remove(group)
+
+	c.Set("resolve.source", "files")
+	c.Set("resolve.passwd_file", passwd)
+	c.Set("resolve.group_file", group)
+	files, err = loadIdFiles(c)
+	assert.Nil(t, err)
+
+	r := NewIdResolver(10, time.Hour)
+	useIdFiles(files, false, r)
+	assert.Equal(t, "daemon", r.User("2"))
+	assert.Equal(t, "adm", r.Group("4"))
+	assert.Equal(t, "UNKNOWN_GROUP", r.Group("0"))
+
+	// the uid_map of events is named from the files too, even without resolving ids
+	useIdFiles(files, false, nil)
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "uid=0 auid=2"})
+	assert.Equal(t, map[string]string{"0": "UNKNOWN_USER", "2": "daemon"}, amg.UidMap)
+
+	// ids missing from the files can be looked up with nss, root is always there
+	useIdFiles(files, true, r)
+	assert.Equal(t, "root", r.User("0"))
+
+	c.Set("resolve.group_file", "/does/not/exist")
+	_, err = loadIdFiles(c)
+	assert.EqualError(t, err, "Failed to read /does/not/exist. Error: open /does/not/exist: no such file or directory")
+}
+
+func Test_updateKernelStatus(t *testing.T) {
+	defer resetLogger()
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(&bytes.Buffer{}, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	updateKernelStatus(func() (*AuditStatusPayload, error) {
+		return &AuditStatusPayload{Lost: 12, Backlog: 3}, nil
+	})
+	assert.Equal(t, uint64(12), metrics.KernelLost.Value())
+	assert.Equal(t, uint64(3), metrics.KernelBacklog.Value())
+
+	// failures leave the last values alone
+	updateKernelStatus(func() (*AuditStatusPayload, error) {
+		return nil, errors.New("nope")
+	})
+	assert.Equal(t, uint64(12), metrics.KernelLost.Value())
+	assert.Equal(t, "Failed to get the kernel audit status. Error: nope\n", elb.String())
+}
+
+func Test_selfTest(t *testing.T) {
+	defer resetLogger()
+	lb, elb := &bytes.Buffer{}, &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	good := NewAuditWriter(&bytes.Buffer{}, 1)
+	good.SetName("stdout")
+	m := NewAuditMarshaller([]*AuditWriter{good}, false, false, 0, []AuditFilter{}, nil)
+	assert.True(t, selfTest(m, []*AuditWriter{good}))
+	assert.Equal(t, "Startup self-test passed, the event reached every output that wants it\n", lb.String())
+	assert.Contains(t, good.Writer().(*bytes.Buffer).String(), "go-audit-selftest")
+
+	// a closed file can not be written to
+	f, err := ioutil.TempFile("", "go-audit-selftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	bad := NewAuditWriter(f, 1)
+	bad.SetName("file")
+	m = NewAuditMarshaller([]*AuditWriter{good, bad}, false, false, 0, []AuditFilter{}, nil)
+	assert.False(t, selfTest(m, []*AuditWriter{good, bad}))
+	assert.Equal(t, "Startup self-test failed, the event did not reach output file. Error: write "+f.Name()+": file already closed\n", elb.String())
+
+	// filtered
+	elb.Reset()
+	m = NewAuditMarshaller([]*AuditWriter{good}, false, false, 0, []AuditFilter{{Key: "go-audit-selftest"}}, nil)
+	assert.False(t, selfTest(m, []*AuditWriter{good}))
+	assert.Equal(t, "Startup self-test failed, no output was tested. Error: The self-test event was dropped by the filters\n", elb.String())
+}
+
+func Test_newHeartbeat(t *testing.T) {
+	defer resetLogger()
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(&bytes.Buffer{}, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	started := time.Now()
+	hb := newHeartbeat(started, started.Add(time.Minute), func() (*AuditStatusPayload, error) {
+		return &AuditStatusPayload{Lost: 12, Backlog: 3}, nil
+	})
+	assert.Equal(t, "heartbeat", hb.Type)
+	assert.Equal(t, int64(60), hb.Uptime)
+	assert.Equal(t, "dev", hb.Version)
+	assert.Equal(t, uint32(12), *hb.KernelLost)
+	assert.Equal(t, uint32(3), *hb.KernelBacklog)
+
+	// the heartbeat still goes out without the kernel counts
+	hb = newHeartbeat(started, started, func() (*AuditStatusPayload, error) {
+		return nil, errors.New("nope")
+	})
+	assert.Nil(t, hb.KernelLost)
+	assert.Equal(t, "Failed to get the kernel audit status for the heartbeat. Error: nope\n", elb.String())
+
+	hb = newHeartbeat(started, started, nil)
+	assert.Nil(t, hb.KernelBacklog)
+}
+
+func Test_createFileOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.file.attempts", 0)
+	w, err := createFileOutput(c)
+	assert.EqualError(t, err, "Output attempts for file must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// failure to create/open file
+	c = viper.New()
+	c.Set("output.file.attempts", 1)
+	c.Set("output.file.path", "/do/not/exist/please")
+	c.Set("output.file.mode", 0644)
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "Failed to open output file. Error: open /do/not/exist/please: no such file or directory")
+	assert.Nil(t, w)
+
+	// chmod error
+	c = viper.New()
+	c.Set("output.file.attempts", 1)
+	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
+	c.Set("output.file.mode", 0)
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "Output file mode should be greater than 0000")
+	assert.Nil(t, w)
+
+	// uid error
+	c = viper.New()
+	c.Set("output.file.attempts", 1)
+	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
+	c.Set("output.file.mode", 0644)
+	c.Set("output.file.user", "go-audit-nope")
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "Could not find uid for user go-audit-nope. Error: user: unknown user go-audit-nope")
+	assert.Nil(t, w)
+
+	// no user, group or mode leaves the owner alone and defaults to 0600
+	os.Remove(path.Join(os.TempDir(), "go-audit.test.log"))
+	c = viper.New()
+	c.Set("output.file.attempts", 1)
+	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
+	w, err = createFileOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	st, err := os.Stat(path.Join(os.TempDir(), "go-audit.test.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), st.Mode())
+
+	uid := os.Getuid()
+	gid := os.Getgid()
+	u, _ := user.LookupId(strconv.Itoa(uid))
+	g, _ := user.LookupGroupId(strconv.Itoa(gid))
+
+	// travis-ci is silly
+	if u.Name == "" {
+		u.Name = g.Name
+	}
+
+	// gid error
+	c = viper.New()
+	c.Set("output.file.attempts", 1)
+	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
+	c.Set("output.file.mode", 0644)
+	c.Set("output.file.user", u.Name)
+	c.Set("output.file.group", "go-audit-nope")
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "Could not find gid for group go-audit-nope. Error: group: unknown group go-audit-nope")
+	assert.Nil(t, w)
+
+	// chown error
+	c = viper.New()
+	c.Set("output.file.attempts", 1)
+	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
+	c.Set("output.file.mode", 0644)
+	c.Set("output.file.user", "root")
+	c.Set("output.file.group", "root")
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "Could not chown output file. Error: chown /tmp/go-audit.test.log: operation not permitted")
+	assert.Nil(t, w)
+
+	// All good
+	c = viper.New()
+	c.Set("output.file.attempts", 1)
+	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
+	c.Set("output.file.mode", 0644)
+	c.Set("output.file.user", u.Name)
+	c.Set("output.file.group", g.Name)
+	w, err = createFileOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &os.File{}, w.Writer())
+
+	// All good with rotation
+	c.Set("output.file.rotate.max_size_mb", 1)
+	c.Set("output.file.rotate.max_backups", 2)
+	w, err = createFileOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &RotatingFile{}, w.Writer())
+}
+
+func Test_createFileOutput_sharded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit-shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// unknown placeholder
+	c := viper.New()
+	c.Set("output.file.attempts", 1)
+	c.Set("output.file.path", path.Join(dir, "audit-%{msgtype_category}-%{host}.log"))
+	w, err := createFileOutput(c)
+	assert.EqualError(t, err, "Output file path "+path.Join(dir, "audit-%{msgtype_category}-%{host}.log")+" has an unknown placeholder, only %{msgtype_category} is supported")
+	assert.Nil(t, w)
+	assert.Contains(t, fmt.Sprint(testConfig(c)), "has an unknown placeholder")
+
+	// a shard that can not be opened fails the output
+	c.Set("output.file.path", path.Join(dir, "nope", "audit-%{msgtype_category}.log"))
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "Failed to open output file. Error: open "+path.Join(dir, "nope", "audit-anom.log")+": no such file or directory")
+	assert.Nil(t, w)
+
+	// every category gets its own file with the same mode, rotation and buffering
+	c.Set("output.file.path", path.Join(dir, "audit-%{msgtype_category}.log"))
+	c.Set("output.file.mode", 0640)
+	c.Set("output.file.rotate.max_size_mb", 1)
+	c.Set("output.buffer.size", 1024)
+	w, err = createFileOutput(c)
+	assert.Nil(t, err)
+	assert.IsType(t, &ShardedFile{}, w.Writer())
+
+	for _, category := range Categories {
+		st, err := os.Stat(path.Join(dir, "audit-"+category+".log"))
+		assert.Nil(t, err, category)
+		assert.Equal(t, os.FileMode(0640), st.Mode(), category)
+		assert.IsType(t, &BufferedWriter{}, w.Writer().(*ShardedFile).Shard(category), category)
+	}
+
+	assert.Nil(t, w.Write(&AuditMessageGroup{Seq: 1, Msgs: []*AuditMessage{{Type: 1305}}}))
+	assert.Nil(t, w.Close())
+
+	b, err := ioutil.ReadFile(path.Join(dir, "audit-config.log"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "\"sequence\":1")
+
+	b, err = ioutil.ReadFile(path.Join(dir, "audit-syscall.log"))
+	assert.Nil(t, err)
+	assert.Empty(t, b)
+}
+
+func Test_createSyslogOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.syslog.attempts", 0)
+	w, err := createSyslogOutput(c)
+	assert.EqualError(t, err, "Output attempts for syslog must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// dial error
+	c = viper.New()
+	c.Set("output.syslog.attempts", 1)
+	c.Set("output.syslog.priority", -1)
+	w, err = createSyslogOutput(c)
+	assert.EqualError(t, err, "Failed to open syslog writer. Error: Invalid syslog priority -1")
+	assert.Nil(t, w)
+
+	// All good
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	c = viper.New()
+	c.Set("output.syslog.attempts", 1)
+	c.Set("output.syslog.network", "tcp")
+	c.Set("output.syslog.address", l.Addr().String())
+	w, err = createSyslogOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &SyslogWriter{}, w.Writer())
+
+	// rfc5424
+	c.Set("output.syslog.rfc5424", true)
+	w, err = createSyslogOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &SyslogWriter{}, w.Writer())
+
+	// tls problems are found before dialing
+	c.Set("output.syslog.network", "tls")
+	c.Set("output.syslog.tls.cert", "/does/not/exist.crt")
+	w, err = createSyslogOutput(c)
+	assert.EqualError(t, err, "Output syslog tls cert and key must be set together")
+	assert.Nil(t, w)
+}
+
+func Test_createSyslogTLSConfig(t *testing.T) {
+	c := viper.New()
+	c.Set("output.syslog.network", "tcp")
+	tlsConfig, err := createSyslogTLSConfig(c)
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+
+	c.Set("output.syslog.network", "tls")
+	c.Set("output.syslog.tls.server_name", "syslog.example.com")
+	tlsConfig, err = createSyslogTLSConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "syslog.example.com", tlsConfig.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	assert.Nil(t, tlsConfig.RootCAs, "the system roots are used")
+	assert.Empty(t, tlsConfig.Certificates)
+
+	c.Set("output.syslog.tls.key", "/does/not/exist.key")
+	_, err = createSyslogTLSConfig(c)
+	assert.EqualError(t, err, "Output syslog tls cert and key must be set together")
+
+	c.Set("output.syslog.tls.cert", "/does/not/exist.crt")
+	_, err = createSyslogTLSConfig(c)
+	assert.EqualError(t, err, "Failed to load the syslog tls certificate. Error: open /does/not/exist.crt: no such file or directory")
+
+	c.Set("output.syslog.tls.cert", "")
+	c.Set("output.syslog.tls.key", "")
+	c.Set("output.syslog.tls.ca", "/does/not/exist.crt")
+	_, err = createSyslogTLSConfig(c)
+	assert.EqualError(t, err, "Failed to read the syslog tls ca. Error: open /does/not/exist.crt: no such file or directory")
+
+	ca := createTempFile(t, "syslog-ca.crt", "not a certificate")
+	defer os.Remove(ca)
+
+	c.Set("output.syslog.tls.ca", ca)
+	_, err = createSyslogTLSConfig(c)
+	assert.EqualError(t, err, "No certificates were found in the syslog tls ca "+ca)
+}
+
+func Test_createStdOutOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.stdout.attempts", 0)
+	w, err := createStdOutOutput(c)
+	assert.EqualError(t, err, "Output attempts for stdout must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// backoff error
+	c = viper.New()
+	c.Set("output.stdout.attempts", 1)
+	c.Set("output.stdout.retry_backoff.strategy", "linear")
+	w, err = createStdOutOutput(c)
+	assert.EqualError(t, err, "Output stdout retry_backoff strategy must be fixed or exponential, linear provided")
+	assert.Nil(t, w)
+
+	// All good
+	c = viper.New()
+	c.Set("output.stdout.attempts", 1)
+	w, err = createStdOutOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &os.File{}, w.Writer())
+	assert.Equal(t, Backoff{Strategy: BACKOFF_FIXED, Delay: time.Second}, w.Backoff())
+}
+
+func Test_getWriterOptions(t *testing.T) {
+	c := viper.New()
+	c.Set("output.http.retry_backoff.strategy", "exponential")
+	c.Set("output.http.retry_backoff.delay", "500ms")
+	c.Set("output.http.retry_backoff.max_delay", "10s")
+	c.Set("output.http.retry_backoff.jitter", 0.2)
+	c.Set("output.http.retry_backoff.max_elapsed", "30s")
+	opts, err := getWriterOptions(c, "http")
+	assert.Nil(t, err)
+	assert.Equal(t, Backoff{Strategy: BACKOFF_EXPONENTIAL, Delay: 500 * time.Millisecond, MaxDelay: 10 * time.Second, Jitter: 0.2, MaxElapsed: 30 * time.Second}, opts.Backoff)
+
+	// no delay at all is allowed
+	c.Set("output.http.retry_backoff.delay", 0)
+	opts, err = getWriterOptions(c, "http")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), opts.Backoff.Delay)
+
+	c.Set("output.http.retry_backoff.jitter", 1.5)
+	_, err = getWriterOptions(c, "http")
+	assert.EqualError(t, err, "Output http retry_backoff jitter must be between 0 and 1, 1.5 provided")
+
+	c.Set("output.http.retry_backoff.jitter", 0)
+	c.Set("output.http.retry_backoff.max_elapsed", "-1s")
+	_, err = getWriterOptions(c, "http")
+	assert.EqualError(t, err, "Output http retry_backoff delay, max_delay and max_elapsed must not be negative")
+}
+
+func Test_bufferOutput(t *testing.T) {
+	w := &bytes.Buffer{}
+
+	// disabled by default
+	assert.Equal(t, w, bufferOutput(viper.New(), w))
+
+	c := viper.New()
+	c.Set("output.buffer.size", 4096)
+	assert.IsType(t, &BufferedWriter{}, bufferOutput(c, w))
+}
+
+func Test_createHTTPOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.http.attempts", 0)
+	w, err := createHTTPOutput(c)
+	assert.EqualError(t, err, "Output attempts for http must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// url error
+	c = viper.New()
+	c.Set("output.http.attempts", 1)
+	w, err = createHTTPOutput(c)
+	assert.EqualError(t, err, "Output http url must be set")
+	assert.Nil(t, w)
+
+	// max_in_flight error
+	c.Set("output.http.url", "https://localhost/audit")
+	c.Set("output.http.max_in_flight", 0)
+	w, err = createHTTPOutput(c)
+	assert.EqualError(t, err, "Output http max_in_flight must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// All good
+	c = viper.New()
+	c.Set("output.http.attempts", 1)
+	c.Set("output.http.url", "https://localhost/audit")
+	w, err = createHTTPOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &HTTPWriter{}, w.Writer())
+}
+
+func Test_createTCPOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.tcp.attempts", 0)
+	w, err := createTCPOutput(c)
+	assert.EqualError(t, err, "Output attempts for tcp must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// address error
+	c = viper.New()
+	c.Set("output.tcp.attempts", 1)
+	w, err = createTCPOutput(c)
+	assert.EqualError(t, err, "Output tcp address must be set")
+	assert.Nil(t, w)
+
+	// connect error
+	c = viper.New()
+	c.Set("output.tcp.attempts", 1)
+	c.Set("output.tcp.address", "127.0.0.1:1")
+	w, err = createTCPOutput(c)
+	assert.Contains(t, err.Error(), "Failed to connect to tcp output. Error: ")
+	assert.Nil(t, w)
+
+	// All good
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c = viper.New()
+	c.Set("output.tcp.attempts", 1)
+	c.Set("output.tcp.address", l.Addr().String())
+	w, err = createTCPOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &SocketWriter{}, w.Writer())
+}
+
+func Test_createUnixSocketOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.unix.attempts", 0)
+	w, err := createUnixSocketOutput(c)
+	assert.EqualError(t, err, "Output attempts for unix must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// path error
+	c = viper.New()
+	c.Set("output.unix.attempts", 1)
+	w, err = createUnixSocketOutput(c)
+	assert.EqualError(t, err, "Output unix path must be set")
+	assert.Nil(t, w)
+
+	// type error
+	c.Set("output.unix.path", path.Join(os.TempDir(), "go-audit.test.output.sock"))
+	c.Set("output.unix.type", "raw")
+	w, err = createUnixSocketOutput(c)
+	assert.EqualError(t, err, "Failed to connect to unix output. Error: Unknown unix socket type `raw`, must be stream or dgram")
+	assert.Nil(t, w)
+
+	// All good
+	os.Remove(c.GetString("output.unix.path"))
+	l, err := net.Listen("unix", c.GetString("output.unix.path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c.Set("output.unix.type", "stream")
+	w, err = createUnixSocketOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &SocketWriter{}, w.Writer())
+}
+
+func Test_createGELFOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.gelf.attempts", 0)
+	w, err := createGELFOutput(c)
+	assert.EqualError(t, err, "Output attempts for gelf must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// address error
+	c = viper.New()
+	c.Set("output.gelf.attempts", 1)
+	w, err = createGELFOutput(c)
+	assert.EqualError(t, err, "Output gelf address must be set")
+	assert.Nil(t, w)
+
+	// settings error
+	c.Set("output.gelf.address", "127.0.0.1:12201")
+	c.Set("output.gelf.protocol", "tcp")
+	c.Set("output.gelf.compression", "gzip")
+	c.Set("output.gelf.chunk_size", GELF_CHUNK_SIZE)
+	w, err = createGELFOutput(c)
+	assert.EqualError(t, err, "Failed to connect to gelf output. Error: Gelf over tcp can not be compressed, gzip provided")
+	assert.Nil(t, w)
+
+	// All good
+	c.Set("output.gelf.protocol", "udp")
+	w, err = createGELFOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &GELFWriter{}, w.Writer())
+}
+
+func Test_createKafkaOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.kafka.attempts", 0)
+	w, err := createKafkaOutput(c)
+	assert.EqualError(t, err, "Output attempts for kafka must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// brokers error
+	c = viper.New()
+	c.Set("output.kafka.attempts", 1)
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "Output kafka brokers must be set")
+	assert.Nil(t, w)
+
+	// topic error
+	c = viper.New()
+	c.Set("output.kafka.attempts", 1)
+	c.Set("output.kafka.brokers", []string{"127.0.0.1:1"})
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "Output kafka topic must be set")
+	assert.Nil(t, w)
+
+	// partition key error
+	c = viper.New()
+	c.Set("output.kafka.attempts", 1)
+	c.Set("output.kafka.brokers", []string{"127.0.0.1:1"})
+	c.Set("output.kafka.topic", "audit")
+	c.Set("output.kafka.partition_key", "pid")
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "Failed to create kafka writer. Error: Unknown kafka partition key `pid`")
+	assert.Nil(t, w)
+}
+
+func Test_createNATSOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.nats.attempts", 0)
+	w, err := createNATSOutput(c)
+	assert.EqualError(t, err, "Output attempts for nats must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// url error
+	c = viper.New()
+	c.Set("output.nats.attempts", 1)
+	w, err = createNATSOutput(c)
+	assert.EqualError(t, err, "Output nats url must be set")
+	assert.Nil(t, w)
+
+	// subject error
+	c = viper.New()
+	c.Set("output.nats.attempts", 1)
+	c.Set("output.nats.url", "nats://127.0.0.1:1")
+	w, err = createNATSOutput(c)
+	assert.EqualError(t, err, "Output nats subject must be set")
+	assert.Nil(t, w)
+
+	// scheme error
+	c = viper.New()
+	c.Set("output.nats.attempts", 1)
+	c.Set("output.nats.url", "http://127.0.0.1:1")
+	c.Set("output.nats.subject", "audit")
+	w, err = createNATSOutput(c)
+	assert.EqualError(t, err, "Failed to connect to nats output. Error: Unknown nats url scheme `http`, must be nats or tls")
+	assert.Nil(t, w)
+}
+
+func Test_createFilters(t *testing.T) {
+	defer resetLogger()
+
+	file := createTempFile(t, "filters.test.yaml", `
+filters:
+  - syscall: 49
+    message_type: 1306
+    regex: saddr=(10..|0A..)
+  - syscall: "2"
+    uid: root
+    auid: 1000
+  - uid: "0"
+  - key: noisy-key
+  - syscall: 59
+    action: include
+  - regex:
+      - one
+      - two
+    regex_match: any
+  - exe: /usr/sbin/collectd
+    comm_regex: ^collect
+  - syscall: 257
+    success: yes
+  - success: "no"
+  - arch: B32
+  - arch: "0xC000003E"
+  - fields:
+      ppid: 1
+      exe: /usr/sbin/cron
+      tty:
+        regex: ^pts
+  - pid: "<100"
+    ppid: 2
+  - syscall: 2
+    sample: 0.25
+  - key: noisy-key
+    sample: 1/100
+  - exe: /usr/sbin/nginx
+    invert: true
+  - has_field: [tty, ses]
+    missing_field: auid
+    name: no-auid
+  - tty: none
+  - tty: pts0
+  - syscall: any
+    regex: everywhere
+`)
+	defer os.Remove(file)
+
+	config, err := loadConfig(file)
+	assert.Nil(t, err)
+
+	fs, err := createFilters(config)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(fs))
+	assert.Equal(t, "49", fs[0].Syscall)
+	assert.Equal(t, uint16(1306), fs[0].MessageType)
+	assert.Equal(t, "saddr=(10..|0A..)", fs[0].Regex.String())
+	assert.Equal(t, "2", fs[1].Syscall)
+	assert.Equal(t, "0", fs[1].Uid)
+	assert.Equal(t, "1000", fs[1].Auid)
+	assert.Nil(t, fs[1].Regex)
+	assert.Equal(t, "0", fs[2].Uid)
+	assert.Equal(t, "noisy-key", fs[3].Key)
+	assert.False(t, fs[3].Include)
+	assert.Equal(t, "59", fs[4].Syscall)
+	assert.True(t, fs[4].Include)
+	assert.Nil(t, fs[5].Regex)
+	assert.Equal(t, 2, len(fs[5].Regexes))
+	assert.Equal(t, "two", fs[5].Regexes[1].String())
+	assert.True(t, fs[5].MatchAny)
+	assert.Equal(t, "/usr/sbin/collectd", fs[6].Exe)
+	assert.Equal(t, "^collect", fs[6].CommRegex.String())
+	assert.Equal(t, "yes", fs[7].Success)
+	assert.Equal(t, "no", fs[8].Success)
+	assert.Equal(t, "b32", fs[9].Arch)
+	assert.Equal(t, "c000003e", fs[10].Arch)
+	assert.Equal(t, 3, len(fs[11].Fields))
+	assert.Equal(t, FieldFilter{Name: "exe", Value: "/usr/sbin/cron"}, fs[11].Fields[0])
+	assert.Equal(t, FieldFilter{Name: "ppid", Value: "1"}, fs[11].Fields[1])
+	assert.Equal(t, "tty", fs[11].Fields[2].Name)
+	assert.Equal(t, "^pts", fs[11].Fields[2].Regex.String())
+	assert.Equal(t, &PidRange{Max: 99}, fs[12].Pid)
+	assert.Equal(t, &PidRange{Min: 2, Max: 2}, fs[12].Ppid)
+	assert.Equal(t, 0.25, fs[13].Sample)
+	assert.Equal(t, 0.01, fs[14].Sample)
+	assert.False(t, fs[14].Include)
+	assert.False(t, fs[14].Invert)
+	assert.Equal(t, "/usr/sbin/nginx", fs[15].Exe)
+	assert.True(t, fs[15].Invert)
+	assert.Equal(t, []string{"tty", "ses"}, fs[16].HasFields)
+	assert.Equal(t, []string{"auid"}, fs[16].MissingFields)
+	assert.Equal(t, "no-auid", fs[16].Name)
+	assert.Equal(t, "", fs[15].Name)
+	assert.Equal(t, "(none)", fs[17].Tty)
+	assert.Equal(t, "pts0", fs[18].Tty)
+	assert.Equal(t, "", fs[19].Syscall)
+	assert.True(t, fs[19].AnySyscall)
+	assert.False(t, fs[0].AnySyscall)
+
+	// a filter must match on something
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - nope: 1\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "Filter 1 has nothing to match on")
+	assert.Nil(t, fs)
+
+	// bad action
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - syscall: 1\n    action: maybe\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`action` in filter 1 must be include or exclude, got maybe")
+	assert.Nil(t, fs)
+
+	// bad regex list
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - regex:\n      - ok\n      - (\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`regex` in filter 1 could not be parsed (. Error: error parsing regexp: missing closing ): `(`")
+	assert.Nil(t, fs)
+
+	// bad regex_match
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - regex: a\n    regex_match: some\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`regex_match` in filter 1 must be all or any, got some")
+	assert.Nil(t, fs)
+
+	// bad success, any on its own leaves nothing to match on
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - success: maybe\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`success` in filter 1 must be yes, no or any, got maybe")
+	assert.Nil(t, fs)
+
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - success: any\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "Filter 1 has nothing to match on")
+	assert.Nil(t, fs)
+
+	// bad arch
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - arch: arm\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`arch` in filter 1 must be b64, b32 or a hex value, got arm")
+	assert.Nil(t, fs)
+
+	// bad pid
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - ppid: 10-1\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`ppid` in filter 1 must be a pid, a range like 300-400 or a bound like <100, got 10-1. Error: The start of the range is after its end")
+	assert.Nil(t, fs)
+
+	// bad invert
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - syscall: 2\n    invert: sometimes\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`invert` in filter 1 must be true or false, got sometimes")
+	assert.Nil(t, fs)
+
+	// bad field names
+	for _, names := range []string{"[]", "\"\"", "[tty, 1]", "\"a=b\""} {
+		file = createTempFile(t, "filters.test.yaml", "filters:\n  - missing_field: "+names+"\n")
+		config, err = loadConfig(file)
+		assert.Nil(t, err)
+		fs, err = createFilters(config)
+		assert.Contains(t, fmt.Sprint(err), "`missing_field` in filter 1 must be a field name or a list of them, got ", names)
+		assert.Nil(t, fs)
+	}
+
+	// bad ttys
+	for _, tty := range []string{"\"\"", "1", "[pts0]", "\"pts 0\""} {
+		file = createTempFile(t, "filters.test.yaml", "filters:\n  - tty: "+tty+"\n")
+		config, err = loadConfig(file)
+		assert.Nil(t, err)
+		fs, err = createFilters(config)
+		assert.Contains(t, fmt.Sprint(err), "`tty` in filter 1 must be a tty like pts0 or none, got ")
+		assert.Nil(t, fs)
+	}
+
+	// bad names
+	for name, e := range map[string]string{
+		"3":                          "`name` in filter 1 must be some text, got 3",
+		"\"3\"":                      "`name` in filter 1 can not be a number, got 3",
+		"\"\"":                       "`name` in filter 1 must be some text, got ",
+		"[a]":                        "`name` in filter 1 must be some text, got [a]",
+		"a\n  - key: b\n    name: a": "`name` in filter 2 is already the name of filter 1, got a",
+	} {
+		file = createTempFile(t, "filters.test.yaml", "filters:\n  - syscall: 2\n    name: "+name+"\n")
+		config, err = loadConfig(file)
+		assert.Nil(t, err)
+		fs, err = createFilters(config)
+		assert.EqualError(t, err, e)
+		assert.Nil(t, fs)
+	}
+
+	// naming alone matches on nothing
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - name: nothing\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "Filter 1 has nothing to match on")
+	assert.Nil(t, fs)
+
+	// inverting alone matches on nothing
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - invert: true\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "Filter 1 has nothing to match on")
+	assert.Nil(t, fs)
+
+	// bad sample
+	for _, sample := range []string{"0", "2", "1/0", "nope", "[1]"} {
+		file = createTempFile(t, "filters.test.yaml", "filters:\n  - syscall: 2\n    sample: "+sample+"\n")
+		config, err = loadConfig(file)
+		assert.Nil(t, err)
+		fs, err = createFilters(config)
+		assert.Contains(t, err.Error(), "`sample` in filter 1 must be a fraction over 0 and up to 1, like 0.01 or 1/100, got ")
+		assert.Nil(t, fs)
+	}
+
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - syscall: 2\n    sample: 0.5\n    action: include\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`sample` in filter 1 keeps some of the events an exclude filter drops, it can not be used with action include")
+	assert.Nil(t, fs)
+
+	// bad fields
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - fields: ppid\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`fields` in filter 1 could not be parsed ppid")
+	assert.Nil(t, fs)
+
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - fields:\n      exe:\n        regex: (\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "Field `exe` in filter 1 could not be parsed (. Error: error parsing regexp: missing closing ): `(`")
+	assert.Nil(t, fs)
+
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - fields:\n      exe: [a, b]\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "Field `exe` in filter 1 could not be parsed [a b]")
+	assert.Nil(t, fs)
+
+	// bad exe_regex
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - exe_regex: (\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.EqualError(t, err, "`exe_regex` in filter 1 could not be parsed (. Error: error parsing regexp: missing closing ): `(`")
+	assert.Nil(t, fs)
+
+	// unknown users can not be resolved
+	file = createTempFile(t, "filters.test.yaml", "filters:\n  - uid: go-audit-no-such-user\n")
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	fs, err = createFilters(config)
+	assert.Contains(t, err.Error(), "`uid` in filter 1 could not be resolved go-audit-no-such-user")
+	assert.Nil(t, fs)
+}
+
+func Test_getNetlinkOptions(t *testing.T) {
+	c := viper.New()
+	c.Set("socket_buffer.receive", 16384)
+	c.Set("socket_buffer.max_reconnect_failures", 10)
+	c.Set("socket_buffer.reconnect_backoff", "1s")
+	c.Set("netlink.multicast_group", 1)
+	c.Set("netlink.force_receive_buffer", true)
+	c.Set("netlink.receive_timeout", "500ms")
+
+	o, err := getNetlinkOptions(c)
+	assert.Nil(t, err)
+	assert.Equal(t, NetlinkOptions{
+		ReceiveBuffer:      16384,
+		ForceReceiveBuffer: true,
+		ReceiveTimeout:     500 * time.Millisecond,
+		MulticastGroup:     AUDIT_NLGRP_READLOG,
+		MaxFailures:        10,
+		Backoff:            time.Second,
+	}, o)
+
+	// passive readers join the read log group unless another one was picked
+	c.Set("netlink.multicast_group", 0)
+	c.Set("input.netlink.multicast", true)
+	o, err = getNetlinkOptions(c)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(AUDIT_NLGRP_READLOG), o.MulticastGroup)
+
+	c.Set("netlink.multicast_group", 2)
+	o, err = getNetlinkOptions(c)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), o.MulticastGroup)
+
+	c.Set("netlink.receive_timeout", "-1s")
+	_, err = getNetlinkOptions(c)
+	assert.EqualError(t, err, "Netlink receive_timeout must not be negative, -1s provided")
+
+	c.Set("netlink.multicast_group", 33)
+	_, err = getNetlinkOptions(c)
+	assert.EqualError(t, err, "Netlink multicast_group must be between 0 and 32, 33 provided")
+}
+
+func Test_getDebugRingSize(t *testing.T) {
+	c := viper.New()
+	size, err := getDebugRingSize(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
+
+	c.Set("debug.ring_size", -1)
+	_, err = getDebugRingSize(c)
+	assert.EqualError(t, err, "Debug ring size must not be negative, -1 provided")
+
+	c.Set("debug.ring_size", 100)
+	_, err = getDebugRingSize(c)
+	assert.EqualError(t, err, "Debug ring is served by the metrics server, metrics.enabled must be true")
+
+	c.Set("metrics.enabled", true)
+	size, err = getDebugRingSize(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, size)
+}
+
+func Test_getRequiredRecords(t *testing.T) {
+	c := viper.New()
+	types, err := getRequiredRecords(c)
+	assert.Nil(t, err)
+	assert.Nil(t, types)
+
+	// names in any case and numbers
+	c.Set("transform.require_records", []interface{}{"SYSCALL", "proctitle", 1307})
+	types, err = getRequiredRecords(c)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{1300, 1327, 1307}, types)
 
-	err := setRules(config, func(s string, a ...string) error {
-		if s == "auditctl" && a[0] == "-D" {
-			return errors.New("testing")
-		}
+	c.Set("transform.require_records", []interface{}{"SYSCALL", "NOPE"})
+	_, err = getRequiredRecords(c)
+	assert.EqualError(t, err, "Transform require_records has an unknown record type NOPE")
+	assert.Contains(t, fmt.Sprint(testConfig(c)), "Transform require_records has an unknown record type NOPE")
 
-		return nil
-	})
+	c.Set("transform.require_records", "SYSCALL")
+	_, err = getRequiredRecords(c)
+	assert.EqualError(t, err, "Transform require_records must be a list of record types, SYSCALL provided")
+}
 
-	assert.EqualError(t, err, "Failed to flush existing audit rules. Error: testing")
+func Test_getIntegrityKey(t *testing.T) {
+	c := viper.New()
+	key, err := getIntegrityKey(c)
+	assert.Nil(t, err)
+	assert.Nil(t, key)
 
-	// fail on 0 rules
-	err = setRules(config, func(s string, a ...string) error { return nil })
-	assert.EqualError(t, err, "No audit rules found.")
+	c.Set("integrity.hmac_key", "0123456789abcdef")
+	key, err = getIntegrityKey(c)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("0123456789abcdef"), key)
 
-	// failure to set rule
-	r := 0
-	config.Set("rules", []string{"-a -1 -2", "", "-a -3 -4"})
-	err = setRules(config, func(s string, a ...string) error {
-		if a[0] != "-D" {
-			return errors.New("testing rule")
-		}
+	c.Set("integrity.hmac_key", "short")
+	_, err = getIntegrityKey(c)
+	assert.EqualError(t, err, "Integrity hmac_key must be at least 16 bytes, 5 provided")
+	assert.Contains(t, fmt.Sprint(testConfig(c)), "Integrity hmac_key must be at least 16 bytes, 5 provided")
 
-		r++
+	// from a file, without its newline
+	file := createTempFile(t, "hmac.key", "fedcba9876543210fedcba9876543210\n")
+	defer os.Remove(file)
 
-		return nil
-	})
+	c = viper.New()
+	c.Set("integrity.hmac_key_file", file)
+	key, err = getIntegrityKey(c)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("fedcba9876543210fedcba9876543210"), key)
 
-	assert.Equal(t, 1, r, "Wrong number of rule set attempts")
-	assert.EqualError(t, err, "Failed to add rule #1. Error: testing rule")
+	c.Set("integrity.hmac_key", "0123456789abcdef")
+	_, err = getIntegrityKey(c)
+	assert.EqualError(t, err, "Integrity hmac_key and hmac_key_file can not both be set")
 
-	// properly set rules
-	r = 0
-	err = setRules(config, func(s string, a ...string) error {
-		// Skip the flush rules
-		if a[0] != "-a" {
-			return nil
-		}
+	c = viper.New()
+	c.Set("integrity.hmac_key_file", file+".nope")
+	_, err = getIntegrityKey(c)
+	assert.Contains(t, fmt.Sprint(err), "Failed to read integrity hmac_key_file. Error: ")
 
-		if (a[1] == "-1" && a[2] == "-2") || (a[1] == "-3" && a[2] == "-4") {
-			r++
-		}
+	// chaining needs a key
+	c = viper.New()
+	c.Set("integrity.chain", true)
+	_, err = getIntegrityKey(c)
+	assert.EqualError(t, err, "Integrity chain needs an hmac_key or hmac_key_file")
+}
 
-		return nil
-	})
+func Test_createFields(t *testing.T) {
+	defer func() { hostname = os.Hostname }()
+	hostname = func() (string, error) { return "box", nil }
 
-	assert.Equal(t, 2, r, "Wrong number of correct rule set attempts")
+	// none
+	fields, err := createFields(viper.New())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(fields))
+
+	c := viper.New()
+	c.Set("transform.add_fields", map[string]interface{}{"host": AUTO_FIELD, "env": "prod"})
+	fields, err = createFields(c)
 	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"host": "box", "env": "prod"}, fields)
+
+	// only host can be automatic
+	c.Set("transform.add_fields", map[string]interface{}{"env": AUTO_FIELD})
+	fields, err = createFields(c)
+	assert.EqualError(t, err, "Only the host field can be <auto>, env provided it")
+	assert.Nil(t, fields)
+
+	// hostname failure
+	hostname = func() (string, error) { return "", errors.New("nope") }
+	c.Set("transform.add_fields", map[string]interface{}{"host": AUTO_FIELD})
+	fields, err = createFields(c)
+	assert.EqualError(t, err, "Could not determine the hostname. Error: nope")
+	assert.Nil(t, fields)
 }
 
-func Test_createFileOutput(t *testing.T) {
+func Test_createElasticsearchOutput(t *testing.T) {
 	// attempts error
 	c := viper.New()
-	c.Set("output.file.attempts", 0)
-	w, err := createFileOutput(c)
-	assert.EqualError(t, err, "Output attempts for file must be at least 1, 0 provided")
+	c.Set("output.elasticsearch.attempts", 0)
+	w, err := createElasticsearchOutput(c)
+	assert.EqualError(t, err, "Output attempts for elasticsearch must be at least 1, 0 provided")
 	assert.Nil(t, w)
 
-	// failure to create/open file
+	// urls error
 	c = viper.New()
-	c.Set("output.file.attempts", 1)
-	c.Set("output.file.path", "/do/not/exist/please")
-	c.Set("output.file.mode", 0644)
-	w, err = createFileOutput(c)
-	assert.EqualError(t, err, "Failed to open output file. Error: open /do/not/exist/please: no such file or directory")
+	c.Set("output.elasticsearch.attempts", 1)
+	w, err = createElasticsearchOutput(c)
+	assert.EqualError(t, err, "Output elasticsearch urls must be set")
 	assert.Nil(t, w)
 
-	// chmod error
-	c = viper.New()
-	c.Set("output.file.attempts", 1)
-	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
-	w, err = createFileOutput(c)
-	assert.EqualError(t, err, "Output file mode should be greater than 0000")
+	// index error
+	c.Set("output.elasticsearch.urls", []string{"http://127.0.0.1:9200"})
+	w, err = createElasticsearchOutput(c)
+	assert.EqualError(t, err, "Output elasticsearch index must be set")
 	assert.Nil(t, w)
 
-	// uid error
-	c = viper.New()
-	c.Set("output.file.attempts", 1)
-	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
-	c.Set("output.file.mode", 0644)
-	w, err = createFileOutput(c)
-	assert.EqualError(t, err, "Could not find uid for user . Error: user: unknown user ")
+	// All good
+	c.Set("output.elasticsearch.index", "audit-%Y.%m.%d")
+	w, err = createElasticsearchOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &ElasticsearchWriter{}, w.Writer())
+}
+
+func Test_createS3Output(t *testing.T) {
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	// attempts error
+	c := viper.New()
+	c.Set("output.s3.attempts", 0)
+	w, err := createS3Output(c)
+	assert.EqualError(t, err, "Output attempts for s3 must be at least 1, 0 provided")
 	assert.Nil(t, w)
 
-	uid := os.Getuid()
-	gid := os.Getgid()
-	u, _ := user.LookupId(strconv.Itoa(uid))
-	g, _ := user.LookupGroupId(strconv.Itoa(gid))
+	// bucket error
+	c.Set("output.s3.attempts", 3)
+	w, err = createS3Output(c)
+	assert.EqualError(t, err, "Output s3 bucket must be set")
+	assert.Nil(t, w)
 
-	// travis-ci is silly
-	if u.Name == "" {
-		u.Name = g.Name
-	}
+	// max_bytes error
+	c.Set("output.s3.bucket", "audit")
+	w, err = createS3Output(c)
+	assert.EqualError(t, err, "Output s3 max_bytes must be at least 1, 0 provided")
+	assert.Nil(t, w)
 
-	// gid error
-	c = viper.New()
-	c.Set("output.file.attempts", 1)
-	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
-	c.Set("output.file.mode", 0644)
-	c.Set("output.file.user", u.Name)
-	w, err = createFileOutput(c)
-	assert.EqualError(t, err, "Could not find gid for group . Error: group: unknown group ")
+	// part_size error
+	c.Set("output.s3.max_bytes", 1024)
+	c.Set("output.s3.part_size", 1024)
+	w, err = createS3Output(c)
+	assert.EqualError(t, err, "Output s3 part_size must be at least 5242880, 1024 provided")
 	assert.Nil(t, w)
 
-	// chown error
-	c = viper.New()
-	c.Set("output.file.attempts", 1)
-	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
-	c.Set("output.file.mode", 0644)
-	c.Set("output.file.user", "root")
-	c.Set("output.file.group", "root")
-	w, err = createFileOutput(c)
-	assert.EqualError(t, err, "Could not chown output file. Error: chown /tmp/go-audit.test.log: operation not permitted")
+	// half the credentials
+	c.Set("output.s3.part_size", S3_MIN_PART_SIZE)
+	c.Set("output.s3.access_key_id", "AKID")
+	w, err = createS3Output(c)
+	assert.EqualError(t, err, "Output s3 access_key_id and secret_access_key must be set together")
+	assert.Nil(t, w)
+
+	// bad endpoint
+	c.Set("output.s3.secret_access_key", "secret")
+	c.Set("output.s3.endpoint", "minio:9000")
+	w, err = createS3Output(c)
+	assert.EqualError(t, err, "Failed to create s3 writer. Error: Endpoint minio:9000 must be a url like https://s3.example.com")
 	assert.Nil(t, w)
 
 	// All good
-	c = viper.New()
-	c.Set("output.file.attempts", 1)
-	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
-	c.Set("output.file.mode", 0644)
-	c.Set("output.file.user", u.Name)
-	c.Set("output.file.group", g.Name)
-	w, err = createFileOutput(c)
+	c.Set("output.s3.endpoint", "http://127.0.0.1:9000")
+	w, err = createS3Output(c)
 	assert.Nil(t, err)
 	assert.NotNil(t, w)
-	assert.IsType(t, &os.File{}, w.w)
+	assert.IsType(t, &S3Writer{}, w.Writer())
+
+	// credentials from the environment
+	c.Set("output.s3.access_key_id", "")
+	c.Set("output.s3.secret_access_key", "")
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	w, err = createS3Output(c)
+	assert.EqualError(t, err, "Output s3 access_key_id and secret_access_key must be set together")
+	assert.Nil(t, w)
 }
 
-func Test_createSyslogOutput(t *testing.T) {
-	// attempts error
+func Test_routeOutput(t *testing.T) {
 	c := viper.New()
-	c.Set("output.syslog.attempts", 0)
-	w, err := createSyslogOutput(c)
-	assert.EqualError(t, err, "Output attempts for syslog must be at least 1, 0 provided")
+	c.Set("output.syslog.message_types", []interface{}{1100, "1102"})
+	c.Set("output.syslog.exclude_message_types", []interface{}{1327})
+
+	w := NewAuditWriter(&bytes.Buffer{}, 1)
+	w.SetName("syslog")
+	assert.Nil(t, routeOutput(c, w))
+	assert.True(t, w.Wants(&AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1102}}}))
+	assert.False(t, w.Wants(&AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1300}}}))
+
+	// bad types
+	c.Set("output.syslog.message_types", []interface{}{"login"})
+	assert.EqualError(t, routeOutput(c, w), "Output syslog message_types has an invalid message type login")
+
+	c.Set("output.syslog.message_types", 1100)
+	assert.EqualError(t, routeOutput(c, w), "Output syslog message_types must be a list of message types, 1100 provided")
+
+	// rule keys, any key of a rule with several matches
+	c.Set("output.syslog.message_types", nil)
+	c.Set("output.syslog.exclude_message_types", nil)
+	c.Set("output.syslog.keys", []interface{}{"shadow"})
+	c.Set("output.syslog.exclude_keys", []interface{}{"noisy"})
+	assert.Nil(t, routeOutput(c, w))
+	assert.True(t, w.Wants(&AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1300, Data: `key="identity" key="shadow"`}}}))
+	assert.False(t, w.Wants(&AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1300, Data: `key="identity"`}}}))
+	assert.False(t, w.Wants(&AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1300, Data: `key=736861646F77016E6F697379`}}}))
+
+	// bad keys
+	c.Set("output.syslog.keys", []interface{}{""})
+	assert.EqualError(t, routeOutput(c, w), "Output syslog keys has an invalid rule key ")
+
+	c.Set("output.syslog.keys", "shadow")
+	assert.EqualError(t, routeOutput(c, w), "Output syslog keys must be a list of rule keys, shadow provided")
+}
+
+func Test_formatOutput(t *testing.T) {
+	c := viper.New()
+	c.Set("output.format", "logfmt")
+	c.Set("output.tcp.format", "cef")
+	c.Set("output.cef.vendor", "Acme")
+	c.Set("output.cef.product", "audit")
+	c.Set("output.cef.version", "2")
+	c.Set("output.cef.severity", 7)
+
+	w := NewAuditWriter(&bytes.Buffer{}, 1)
+	w.SetName("stdout")
+	assert.Nil(t, formatOutput(c, w))
+	assert.Nil(t, w.Encode(0, &Heartbeat{Type: "heartbeat", Uptime: 5}))
+	assert.Equal(t, "type=heartbeat timestamp=\"\" events_processed=0 uptime_seconds=5\n", w.Writer().(*bytes.Buffer).String())
+
+	// the format of the output wins over output.format
+	w = NewAuditWriter(&bytes.Buffer{}, 1)
+	w.SetName("tcp")
+	assert.Nil(t, formatOutput(c, w))
+	assert.Nil(t, w.Encode(0, &Heartbeat{Type: "heartbeat", Uptime: 5}))
+	assert.Equal(t, "CEF:0|Acme|audit|2|heartbeat|heartbeat|7|timestamp= events_processed=0 uptime_seconds=5\n", w.Writer().(*bytes.Buffer).String())
+
+	// bad formats
+	c.Set("output.cef.severity", 11)
+	assert.EqualError(t, formatOutput(c, w), "Output cef severity must be between 0 and 10, 11 provided")
+
+	c.Set("output.tcp.format", "xml")
+	assert.EqualError(t, formatOutput(c, w), "Unknown output format `xml`, must be json, logfmt or cef")
+
+	w.SetName("http")
+	assert.EqualError(t, formatOutput(c, w), "Output http can only write json, logfmt provided")
+
+	// a syslog template takes the place of the format
+	c.Set("output.syslog.template", "{{.Type}} up {{.Uptime}}s")
+	w = NewAuditWriter(&bytes.Buffer{}, 1)
+	w.SetName("syslog")
+	assert.Nil(t, formatOutput(c, w))
+	assert.Nil(t, w.Encode(0, &Heartbeat{Type: "heartbeat", Uptime: 5}))
+	assert.Equal(t, "heartbeat up 5s\n", w.Writer().(*bytes.Buffer).String())
+
+	c.Set("output.syslog.template", "{{.Type")
+	assert.EqualError(t, formatOutput(c, w), "Output syslog template could not be parsed. Error: template: output:1: unclosed action")
+
+	c.Set("output.syslog.format", "json")
+	assert.EqualError(t, formatOutput(c, w), "Output syslog template and format can not both be set")
+
+	// even a template that writes the same as the format
+	c.Set("output.syslog.template", "{{json .}}")
+	c.Set("output.syslog.format", "logfmt")
+	assert.EqualError(t, formatOutput(c, w), "Output syslog template and format can not both be set")
+
+	// without a template the body is the json format, as it always was
+	hb := &Heartbeat{Type: "heartbeat", Uptime: 5}
+	w = NewAuditWriter(&bytes.Buffer{}, 1)
+	w.SetName("syslog")
+	assert.Nil(t, formatOutput(viper.New(), w))
+	assert.Nil(t, w.Encode(0, hb))
+	expected, _ := JSONFormatter{}.Format(hb)
+	assert.Equal(t, string(expected), w.Writer().(*bytes.Buffer).String())
+
+	// gelf always writes gelf, whatever output.format says
+	c.Set("output.gelf.host", "web-1")
+	w = NewAuditWriter(&bytes.Buffer{}, 1)
+	w.SetName("gelf")
+	assert.Nil(t, formatOutput(c, w))
+	assert.Nil(t, w.Encode(0, &Heartbeat{Type: "heartbeat", Uptime: 5}))
+	assert.Contains(t, w.Writer().(*bytes.Buffer).String(), "\"host\":\"web-1\",\"level\":6,\"short_message\":\"heartbeat\",")
+
+	c.Set("output.gelf.format", "json")
+	assert.EqualError(t, formatOutput(c, w), "Output gelf always writes gelf, its format can not be set")
+}
+
+func Test_createDeadLetterOutput(t *testing.T) {
+	// disabled
+	c := viper.New()
+	w, err := createDeadLetterOutput(c)
+	assert.Nil(t, err)
 	assert.Nil(t, w)
 
-	// dial error
-	c = viper.New()
-	c.Set("output.syslog.attempts", 1)
-	c.Set("output.syslog.priority", -1)
-	w, err = createSyslogOutput(c)
-	assert.EqualError(t, err, "Failed to open syslog writer. Error: log/syslog: invalid priority")
+	// bad path
+	c.Set("output.deadletter.path", "/not/a/real/dir/deadletter.log")
+	w, err = createDeadLetterOutput(c)
+	assert.EqualError(t, err, "Failed to open dead letter file. Error: open /not/a/real/dir/deadletter.log: no such file or directory")
 	assert.Nil(t, w)
 
 	// All good
-	l, err := net.Listen("tcp", ":0")
+	dir, err := ioutil.TempDir("", "go-audit.deadletter")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	defer l.Close()
+	defer os.RemoveAll(dir)
 
-	c = viper.New()
-	c.Set("output.syslog.attempts", 1)
-	c.Set("output.syslog.network", "tcp")
-	c.Set("output.syslog.address", l.Addr().String())
-	w, err = createSyslogOutput(c)
+	c.Set("output.deadletter.path", path.Join(dir, "deadletter.log"))
+	w, err = createDeadLetterOutput(c)
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
-	assert.IsType(t, &syslog.Writer{}, w.w)
-}
-
-func Test_createStdOutOutput(t *testing.T) {
-	// attempts error
-	c := viper.New()
-	c.Set("output.stdout.attempts", 0)
-	w, err := createStdOutOutput(c)
-	assert.EqualError(t, err, "Output attempts for stdout must be at least 1, 0 provided")
-	assert.Nil(t, w)
+	assert.Equal(t, "deadletter", w.Name())
+	assert.IsType(t, &os.File{}, w.Writer())
 
-	// All good
-	c = viper.New()
-	c.Set("output.stdout.attempts", 1)
-	w, err = createStdOutOutput(c)
+	info, err := os.Stat(path.Join(dir, "deadletter.log"))
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
-	assert.IsType(t, &os.File{}, w.w)
+	assert.Equal(t, os.FileMode(0600), info.Mode())
 }
 
 func Test_createOutput(t *testing.T) {
 	// no outputs
 	c := viper.New()
-	w, err := createOutput(c)
+	ws, err := createOutput(c)
 	assert.EqualError(t, err, "No outputs were configured")
-	assert.Nil(t, w)
+	assert.Nil(t, ws)
 
 	// multiple outputs
 	uid := os.Getuid()
@@ -262,43 +2086,47 @@ func Test_createOutput(t *testing.T) {
 	c.Set("output.file.user", u.Name)
 	c.Set("output.file.group", g.Name)
 
-	w, err = createOutput(c)
-	assert.EqualError(t, err, "Only one output can be enabled at a time")
-	assert.Nil(t, w)
+	ws, err = createOutput(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ws))
+	assert.IsType(t, &SyslogWriter{}, ws[0].Writer())
+	assert.IsType(t, &os.File{}, ws[1].Writer())
+	assert.Equal(t, "syslog", ws[0].Name())
+	assert.Equal(t, "file", ws[1].Name())
 
 	// syslog error
 	c = viper.New()
 	c.Set("output.syslog.enabled", true)
 	c.Set("output.syslog.attempts", 0)
-	w, err = createOutput(c)
+	ws, err = createOutput(c)
 	assert.EqualError(t, err, "Output attempts for syslog must be at least 1, 0 provided")
-	assert.Nil(t, w)
+	assert.Nil(t, ws)
 
 	// file error
 	c = viper.New()
 	c.Set("output.file.enabled", true)
 	c.Set("output.file.attempts", 0)
-	w, err = createOutput(c)
+	ws, err = createOutput(c)
 	assert.EqualError(t, err, "Output attempts for file must be at least 1, 0 provided")
-	assert.Nil(t, w)
+	assert.Nil(t, ws)
 
 	// stdout error
 	c = viper.New()
 	c.Set("output.stdout.enabled", true)
 	c.Set("output.stdout.attempts", 0)
-	w, err = createOutput(c)
+	ws, err = createOutput(c)
 	assert.EqualError(t, err, "Output attempts for stdout must be at least 1, 0 provided")
-	assert.Nil(t, w)
+	assert.Nil(t, ws)
 
 	// All good syslog
 	c = viper.New()
 	c.Set("output.syslog.attempts", 1)
 	c.Set("output.syslog.network", "tcp")
 	c.Set("output.syslog.address", l.Addr().String())
-	w, err = createSyslogOutput(c)
+	w, err := createSyslogOutput(c)
 	assert.Nil(t, err)
 	assert.NotNil(t, w)
-	assert.IsType(t, &syslog.Writer{}, w.w)
+	assert.IsType(t, &SyslogWriter{}, w.Writer())
 
 	// All good file
 	c = viper.New()
@@ -308,15 +2136,15 @@ func Test_createOutput(t *testing.T) {
 	c.Set("output.file.mode", 0644)
 	c.Set("output.file.user", u.Name)
 	c.Set("output.file.group", g.Name)
-	w, err = createOutput(c)
+	ws, err = createOutput(c)
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
-	assert.IsType(t, &AuditWriter{}, w)
-	assert.IsType(t, &os.File{}, w.w)
+	assert.Equal(t, 1, len(ws))
+	assert.IsType(t, &AuditWriter{}, ws[0])
+	assert.IsType(t, &os.File{}, ws[0].Writer())
 }
 
 func Benchmark_MultiPacketMessage(b *testing.B) {
-	marshaller := NewAuditMarshaller(NewAuditWriter(&noopWriter{}, 1), false, false, 1, []AuditFilter{})
+	marshaller := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&noopWriter{}, 1)}, false, false, 1, []AuditFilter{}, nil)
 
 	data := make([][]byte, 6)
 
@@ -356,12 +2184,249 @@ func Benchmark_MultiPacketMessage(b *testing.B) {
 	}
 }
 
+func Test_receive(t *testing.T) {
+	defer resetLogger()
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(&bytes.Buffer{}, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	queue := make(chan *syscall.NetlinkMessage, 2)
+	before := metrics.QueueDropped.With("normal").Value()
+	p, err := createPriorities(viper.New(), 2)
+	assert.Nil(t, err)
+
+	// Never blocks on a full queue, runs until the receiver gives up
+	f := newFakeReceiver(3)
+	assert.Panics(t, func() { receive(f, queue, p, nil) })
+	assert.Equal(t, 2, len(queue))
+	assert.Equal(t, before+4, metrics.QueueDropped.With("normal").Value())
+	assert.Contains(t, elb.String(), "Dropped 0 low and 1 normal priority messages because the processing queue was backed up")
+
+	// Messages do not share the buffer of the receiver
+	assert.Equal(t, "audit(10000001:1): hi there", string((<-queue).Data))
+
+	// Returns once the client was released and has handed out everything
+	queue = make(chan *syscall.NetlinkMessage, 4)
+	p, err = createPriorities(viper.New(), 4)
+	assert.Nil(t, err)
+	f = newFakeReceiver(2)
+	f.done = ErrReleased
+	receive(f, queue, p, nil)
+	assert.Equal(t, 4, len(queue))
+}
+
+func Test_process(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+
+	queue := make(chan *syscall.NetlinkMessage, 10)
+	for _, msg := range newFakeReceiver(2).msgs {
+		queue <- msg
+	}
+
+	// Whatever is queued is processed before stopping
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	close(stop)
+	process(queue, m, 1, stop, done)
+
+	<-done
+	assert.Equal(t, 0, len(queue))
+	assert.Equal(t, 2, strings.Count(w.String(), "\n"))
+}
+
+func Test_process_workers(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+
+	// Every event is written whole even though its messages are spread over the queue
+	queue := make(chan *syscall.NetlinkMessage, 1000)
+	for i := 1; i <= 200; i++ {
+		seq := strconv.Itoa(i)
+		queue <- &syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + seq + "): syscall=" + seq)}
+	}
+
+	for i := 1; i <= 200; i++ {
+		seq := strconv.Itoa(i)
+		queue <- &syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1307}, Data: []byte("audit(10000001:" + seq + "): cwd=\"/" + seq + "\"")}
+		queue <- &syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1320}, Data: []byte("audit(10000001:" + seq + "): ")}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	close(stop)
+	process(queue, m, 4, stop, done)
+
+	<-done
+	assert.Equal(t, 0, len(queue))
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Equal(t, 200, len(lines))
+	for _, line := range lines {
+		g := &AuditMessageGroup{}
+		assert.Nil(t, json.Unmarshal([]byte(line), g))
+		seq := strconv.Itoa(g.Seq)
+		assert.Equal(t, []*AuditMessage{{Type: 1300, Data: "syscall=" + seq}, {Type: 1307, Data: "cwd=\"/" + seq + "\""}}, g.Msgs)
+	}
+}
+
+func Test_process_workersTracking(t *testing.T) {
+	defer resetLogger()
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(&bytes.Buffer{}, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, true, true, 2, []AuditFilter{}, nil)
+
+	// Workers consume out of order between them, sequences received in order are never reported missing
+	queue := make(chan *syscall.NetlinkMessage, 1000)
+	for i := 1; i <= 400; i++ {
+		queue <- &syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + strconv.Itoa(i) + "): syscall=2")}
+	}
+
+	// but a gap still is
+	queue <- &syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:402): syscall=2")}
+	for i := 403; i <= 406; i++ {
+		queue <- &syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + strconv.Itoa(i) + "): syscall=2")}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	close(stop)
+	process(queue, m, 4, stop, done)
+	<-done
+
+	assert.Equal(t, "Likely missed sequence 401, current 404, worst message delay 0\n", elb.String())
+}
+
+func Test_getWorkers(t *testing.T) {
+	c := viper.New()
+	c.Set("processing.workers", 4)
+	workers, err := getWorkers(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, workers)
+
+	c.Set("processing.workers", 0)
+	_, err = getWorkers(c)
+	assert.EqualError(t, err, "Processing workers must be at least 1, 0 provided")
+}
+
+// Writes bursts of 500 events to an output that takes 20us per event and reports how long netlink went undrained
+// per event. Inline the receiver waits on every write, with the queue it only waits once the queue is full
+// On a laptop inline came out around 1100000 netlink-ns/event and queued around 220
+func Benchmark_SlowOutput(b *testing.B) {
+	defer resetLogger()
+	logger.AuditLoggerNew(log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	const burst = 500
+
+	b.Run("inline", func(b *testing.B) {
+		var receiving time.Duration
+		for i := 0; i < b.N; i++ {
+			m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&slowWriter{delay: 20 * time.Microsecond}, 1)}, false, false, 0, []AuditFilter{}, nil)
+			f := newFakeReceiver(burst)
+
+			start := time.Now()
+			for {
+				msg, err := f.Receive()
+				if err != nil {
+					break
+				}
+
+				m.Consume(msg)
+			}
+			receiving += time.Since(start)
+		}
+
+		b.ReportMetric(float64(receiving.Nanoseconds())/float64(b.N*burst), "netlink-ns/event")
+	})
+
+	b.Run("queued", func(b *testing.B) {
+		var receiving time.Duration
+		for i := 0; i < b.N; i++ {
+			m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&slowWriter{delay: 20 * time.Microsecond}, 1)}, false, false, 0, []AuditFilter{}, nil)
+			f := newFakeReceiver(burst)
+			queue := make(chan *syscall.NetlinkMessage, 2*burst)
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go process(queue, m, 1, stop, done)
+
+			start := time.Now()
+			func() {
+				// receive panics once the fake receiver runs out
+				defer func() { recover() }()
+				receive(f, queue, &priorities{limits: [2]int{2 * burst, 2 * burst}}, nil)
+			}()
+			receiving += time.Since(start)
+
+			close(stop)
+			<-done
+		}
+
+		b.ReportMetric(float64(receiving.Nanoseconds())/float64(b.N*burst), "netlink-ns/event")
+	})
+}
+
+// Hands out a complete event for every sequence, reusing a single buffer like NetlinkClient does
+type fakeReceiver struct {
+	msgs []*syscall.NetlinkMessage
+	buf  []byte
+	i    int
+	done error // Returned once every message was handed out, ErrReconnectFailed by default
+}
+
+func newFakeReceiver(events int) *fakeReceiver {
+	f := &fakeReceiver{}
+	for i := 1; i <= events; i++ {
+		seq := strconv.Itoa(i)
+		f.msgs = append(
+			f.msgs,
+			&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + seq + "): hi there")},
+			&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1320}, Data: []byte("audit(10000001:" + seq + "): ")},
+		)
+	}
+
+	return f
+}
+
+func (f *fakeReceiver) Receive() (*syscall.NetlinkMessage, error) {
+	if f.i >= len(f.msgs) {
+		if f.done != nil {
+			return nil, f.done
+		}
+
+		return nil, ErrReconnectFailed
+	}
+
+	msg := *f.msgs[f.i]
+	f.i++
+
+	f.buf = append(f.buf[:0], msg.Data...)
+	msg.Data = f.buf
+	return &msg, nil
+}
+
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return len(p), nil
+}
+
 type noopWriter struct{ t *testing.T }
 
 func (t *noopWriter) Write(a []byte) (int, error) {
 	return 0, nil
 }
 
+// Resets global loggers
+func resetLogger() {
+	l.SetOutput(os.Stdout)
+	el.SetOutput(os.Stderr)
+	logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+}
+
 func createTempFile(t *testing.T, name string, contents string) string {
 	file := os.TempDir() + string(os.PathSeparator) + "go-audit." + name
 	if err := ioutil.WriteFile(file, []byte(contents), os.FileMode(0644)); err != nil {
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	"io"
+	"strings"
+)
+
+// Shown in place of the value of a secret by -dump-config
+const REDACTED = "<redacted>"
+
+// Words in a key that make its value a secret, keys are split on underscores so secret_access_key and api_key are
+// secrets while keys and skip_keys are not. Authorization covers the http headers
+var secretWords = map[string]bool{
+	"password":      true,
+	"secret":        true,
+	"key":           true,
+	"token":         true,
+	"authorization": true,
+}
+
+// Writes the config in effect as yaml, the defaults, the file and the GO_AUDIT_ environment variables all merged
+// Secrets are redacted, an empty one is left as it is so a missing secret still shows
+func dumpConfig(w io.Writer, config *viper.Viper) error {
+	settings := map[string]interface{}{}
+	for k, v := range config.AllSettings() {
+		settings[k] = redact(k, v)
+	}
+
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// Returns v with the values of every secret key in it redacted, key is the name v goes by
+// Lists are left alone, they hold rules and filters and a filter on a rule key is no secret
+func redact(key string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, mv := range t {
+			m[k] = redact(k, mv)
+		}
+
+		return m
+
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(t))
+		for k, mv := range t {
+			m[k] = redact(fmt.Sprint(k), mv)
+		}
+
+		return m
+
+	case []interface{}, []string:
+		return v
+	}
+
+	if isSecret(key) && fmt.Sprint(v) != "" {
+		return REDACTED
+	}
+
+	return v
+}
+
+func isSecret(key string) bool {
+	for _, word := range strings.Split(strings.ToLower(key), "_") {
+		if secretWords[word] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func Test_dumpConfig(t *testing.T) {
+	os.Setenv("GO_AUDIT_OUTPUT_NATS_PASSWORD", "hunter2")
+	defer os.Unsetenv("GO_AUDIT_OUTPUT_NATS_PASSWORD")
+	os.Setenv("GO_AUDIT_OUTPUT_SYSLOG_TAG", "audit-env")
+	defer os.Unsetenv("GO_AUDIT_OUTPUT_SYSLOG_TAG")
+
+	file := createTempFile(t, "dump.test.yaml", `
+output:
+  http:
+    headers:
+      Authorization: Bearer abc
+      X-Source: audit
+  s3:
+    access_key_id: AKID
+    secret_access_key: shh
+    session_token: ""
+  nats:
+    password: changeme
+  syslog:
+    keys: [exec]
+filters:
+  - key: exec
+`)
+	defer os.Remove(file)
+
+	config, err := loadConfig(file)
+	assert.Nil(t, err)
+
+	b := &bytes.Buffer{}
+	assert.Nil(t, dumpConfig(b, config))
+
+	dump := map[string]interface{}{}
+	assert.Nil(t, yaml.Unmarshal(b.Bytes(), &dump))
+	out := dump["output"].(map[interface{}]interface{})
+	get := func(output, key string) interface{} {
+		return out[output].(map[interface{}]interface{})[key]
+	}
+
+	// secrets from the file and the environment are redacted, empty ones are not
+	assert.Equal(t, REDACTED, get("s3", "access_key_id"))
+	assert.Equal(t, REDACTED, get("s3", "secret_access_key"))
+	assert.Equal(t, "", get("s3", "session_token"))
+	assert.Equal(t, REDACTED, get("nats", "password"))
+	assert.Equal(t, map[interface{}]interface{}{"authorization": REDACTED, "x-source": "audit"}, get("http", "headers"))
+
+	// everything else is shown, defaults and the environment included
+	assert.Equal(t, []interface{}{"exec"}, get("syslog", "keys"))
+	assert.Equal(t, 132, get("syslog", "priority"))
+	assert.Equal(t, "audit-env", get("syslog", "tag"))
+	assert.Equal(t, []interface{}{map[interface{}]interface{}{"key": "exec"}}, dump["filters"])
+	assert.NotContains(t, b.String(), "hunter2")
+	assert.NotContains(t, b.String(), "shh")
+}
+
+func Test_isSecret(t *testing.T) {
+	for _, key := range []string{"password", "api_key", "secret_access_key", "session_token", "key", "Authorization"} {
+		assert.True(t, isSecret(key), key)
+	}
+
+	for _, key := range []string{"keys", "skip_keys", "keyword", "tag", "passwords_file"} {
+		assert.False(t, isSecret(key), key)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Environment variables named GO_AUDIT_ and the key with dots as underscores override the config file, like
+// GO_AUDIT_OUTPUT_S3_SECRET_KEY for output.s3.secret_key
+const ENV_PREFIX = "GO_AUDIT"
+
+// A reference to an environment variable in a config value, like ${S3_SECRET_KEY}
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Makes the config take GO_AUDIT_ environment variables over what the file has, see ENV_PREFIX
+// Only keys read as a single value can be overridden, maps like output.http.headers and lists need ${NAME} instead
+func bindEnv(config *viper.Viper) {
+	config.SetEnvPrefix(ENV_PREFIX)
+	config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	config.AutomaticEnv()
+}
+
+// Reads the config file with every ${NAME} in its values replaced by the environment variable NAME, so secrets can
+// be kept out of the file. Only yaml and json files are interpolated, others are read as they are
+// A variable that is not set is an error instead of an empty value, a missing secret should not go unnoticed
+func readConfig(config *viper.Viper, configFile string) error {
+	switch strings.TrimPrefix(filepath.Ext(configFile), ".") {
+	case "yaml", "yml", "json":
+	default:
+		return config.ReadInConfig()
+	}
+
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	// json is yaml as well
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return errors.New(fmt.Sprintf("While parsing config: %s", err))
+	}
+
+	if doc, err = interpolate(doc, ""); err != nil {
+		return err
+	}
+
+	if b, err = yaml.Marshal(doc); err != nil {
+		return err
+	}
+
+	config.SetConfigType("yaml")
+	return config.ReadConfig(bytes.NewReader(b))
+}
+
+// Replaces the environment variable references in every string of v, key is where v is in the config
+func interpolate(v interface{}, key string) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		var missing string
+		s := envRef.ReplaceAllStringFunc(t, func(ref string) string {
+			name := envRef.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok && missing == "" {
+				missing = name
+			}
+
+			return value
+		})
+
+		if missing != "" {
+			return nil, errors.New(fmt.Sprintf("Config %s uses the environment variable %s which is not set", key, missing))
+		}
+
+		return s, nil
+
+	case map[interface{}]interface{}:
+		// In order so the same missing variable is reported every time
+		keys := make([]interface{}, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+
+		for _, k := range keys {
+			iv, err := interpolate(t[k], joinKey(key, fmt.Sprint(k)))
+			if err != nil {
+				return nil, err
+			}
+
+			t[k] = iv
+		}
+
+	case []interface{}:
+		for i, lv := range t {
+			iv, err := interpolate(lv, joinKey(key, fmt.Sprint(i)))
+			if err != nil {
+				return nil, err
+			}
+
+			t[i] = iv
+		}
+	}
+
+	return v, nil
+}
+
+func joinKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+
+	return parent + "." + key
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadConfig_env(t *testing.T) {
+	os.Setenv("GO_AUDIT_TEST_TOKEN", "s3cr3t")
+	defer os.Unsetenv("GO_AUDIT_TEST_TOKEN")
+
+	file := createTempFile(t, "env.test.yaml", `
+output:
+  http:
+    timeout: 5s
+    headers:
+      Authorization: Bearer ${GO_AUDIT_TEST_TOKEN}
+  s3:
+    secret_access_key: ${GO_AUDIT_TEST_TOKEN}
+  file:
+    mode: 0640
+rules:
+  - -a exit,always -S execve -k ${GO_AUDIT_TEST_TOKEN}
+  - -w /etc/$HOME
+`)
+	defer os.Remove(file)
+
+	// ${NAME} is filled in anywhere, anything else is left alone
+	config, err := loadConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer s3cr3t", config.GetStringMapString("output.http.headers")["authorization"])
+	assert.Equal(t, "s3cr3t", config.GetString("output.s3.secret_access_key"))
+	assert.Equal(t, []string{"-a exit,always -S execve -k s3cr3t", "-w /etc/$HOME"}, config.GetStringSlice("rules"))
+	assert.Equal(t, 0640, config.GetInt("output.file.mode"))
+
+	// the environment wins over the file and the defaults
+	os.Setenv("GO_AUDIT_OUTPUT_HTTP_TIMEOUT", "9s")
+	defer os.Unsetenv("GO_AUDIT_OUTPUT_HTTP_TIMEOUT")
+	os.Setenv("GO_AUDIT_OUTPUT_HTTP_METHOD", "PUT")
+	defer os.Unsetenv("GO_AUDIT_OUTPUT_HTTP_METHOD")
+
+	config, err = loadConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 9*time.Second, config.GetDuration("output.http.timeout"))
+	assert.Equal(t, "PUT", config.GetString("output.http.method"))
+
+	// a variable that is not set stops the config from loading
+	os.Unsetenv("GO_AUDIT_TEST_TOKEN")
+	config, err = loadConfig(file)
+	assert.Nil(t, config)
+	assert.EqualError(t, err, "Config output.http.headers.Authorization uses the environment variable GO_AUDIT_TEST_TOKEN which is not set")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+const (
+	INPUT_NETLINK         = "netlink"
+	INPUT_FILE            = "file"
+	INPUT_FOLLOW_INTERVAL = 250 * time.Millisecond // How often a followed file is checked for new lines
+)
+
+// Reads audit log lines, as auditd writes them, and hands them out as the netlink messages they came from
+// This allows replaying old logs through the same filters, transforms and outputs as live events
+type FileReceiver struct {
+	name    string
+	f       *os.File
+	r       *bufio.Reader
+	follow  bool   // Wait for more lines at the end of the file instead of stopping, like tail -f
+	partial []byte // A line that has not been completely written yet
+}
+
+// Opens the file at path, - reads stdin
+func NewFileReceiver(path string, follow bool) (*FileReceiver, error) {
+	fr := &FileReceiver{name: path, follow: follow}
+	if path == "-" {
+		fr.name = "stdin"
+		fr.r = bufio.NewReader(os.Stdin)
+		return fr, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to open input file %s. Error: %s", path, err))
+	}
+
+	fr.f = f
+	fr.r = bufio.NewReader(f)
+	return fr, nil
+}
+
+// Returns the message for the next line, io.EOF once the file is done or can no longer be read
+// Lines for record types we can not name are skipped by returning a nil message
+func (fr *FileReceiver) Receive() (*syscall.NetlinkMessage, error) {
+	for {
+		line, err := fr.r.ReadBytes('\n')
+		fr.partial = append(fr.partial, line...)
+
+		if err == io.EOF && fr.follow {
+			time.Sleep(INPUT_FOLLOW_INTERVAL)
+			continue
+		}
+
+		if err != nil && err != io.EOF {
+			logger.Err("Failed to read %s. Error: %v", fr.name, err)
+			return nil, io.EOF
+		}
+
+		if err == io.EOF && len(fr.partial) == 0 {
+			return nil, io.EOF
+		}
+
+		line, fr.partial = fr.partial, nil
+		return parseLogLine(string(line))
+	}
+}
+
+func (fr *FileReceiver) Close() error {
+	if fr.f == nil {
+		return nil
+	}
+
+	return fr.f.Close()
+}
+
+// Turns a line like `type=SYSCALL msg=audit(1364481363.243:24287): arch=c000003e ...` into a netlink message
+// Lines may start with a `node=` and, in the enriched log format, end with the interpreted fields after a 0x1d
+func parseLogLine(line string) (*syscall.NetlinkMessage, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if i := strings.IndexByte(line, 0x1d); i >= 0 {
+		line = line[:i]
+	}
+
+	if line == "" {
+		return nil, nil
+	}
+
+	start := strings.Index(line, "msg=audit(")
+	if start < 0 {
+		return nil, errors.New(fmt.Sprintf("Not an audit log line: %s", line))
+	}
+
+	var name string
+	for _, f := range strings.Fields(line[:start]) {
+		if strings.HasPrefix(f, "type=") {
+			name = f[len("type="):]
+		}
+	}
+
+	t, ok := RecordType(name)
+	if !ok {
+		return nil, nil
+	}
+
+	return &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: t},
+		Data:   []byte(line[start+len("msg="):]),
+	}, nil
+}
+
+// Queues every message of the file, waiting for room in the queue instead of dropping messages like receive does
+// since the file is not going anywhere. Returns once the file is done
+func readInput(fr *FileReceiver, queue chan<- *syscall.NetlinkMessage) {
+	lines := 0
+	for {
+		msg, err := fr.Receive()
+		if err == io.EOF {
+			logger.Info("Read %d lines from %s", lines, fr.name)
+			return
+		}
+
+		lines++
+		if err != nil {
+			logger.Err("Skipping line %d of %s. Error: %v", lines, fr.name, err)
+			continue
+		}
+
+		if msg != nil {
+			queue <- msg
+		}
+	}
+}
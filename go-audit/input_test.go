@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	. "github.com/Xeralux/go-audit/marshaller"
+	. "github.com/Xeralux/go-audit/writer"
+)
+
+func Test_parseLogLine(t *testing.T) {
+	msg, err := parseLogLine("type=SYSCALL msg=audit(1364481363.243:24287): arch=c000003e syscall=2 comm=\"cat\"\n")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1300), msg.Header.Type)
+	assert.Equal(t, "audit(1364481363.243:24287): arch=c000003e syscall=2 comm=\"cat\"", string(msg.Data))
+
+	// node names and the interpreted fields of the enriched format are dropped
+	msg, err = parseLogLine("node=box type=EOE msg=audit(1364481363.243:24287): \x1dUID=\"root\"")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1320), msg.Header.Type)
+	assert.Equal(t, "audit(1364481363.243:24287): ", string(msg.Data))
+
+	msg, err = parseLogLine("type=UNKNOWN[1334] msg=audit(1364481363.243:24287): hi")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1334), msg.Header.Type)
+
+	// types we can not name and blank lines are skipped
+	msg, err = parseLogLine("type=USER_LOGIN msg=audit(1364481363.243:24287): pid=1")
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+
+	msg, err = parseLogLine("\n")
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+
+	_, err = parseLogLine("hi there")
+	assert.EqualError(t, err, "Not an audit log line: hi there")
+}
+
+func Test_readInput(t *testing.T) {
+	defer resetLogger()
+
+	lb, elb := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	// the last line has no newline
+	file := createTempFile(t, "input.test.log", "type=SYSCALL msg=audit(10000001.000:1): syscall=2\n"+
+		"garbage\n"+
+		"type=CWD msg=audit(10000001.000:1): cwd=\"/\"\n"+
+		"type=EOE msg=audit(10000001.000:1): ")
+	defer os.Remove(file)
+
+	_, err := NewFileReceiver("/does/not/exist", false)
+	assert.EqualError(t, err, "Failed to open input file /does/not/exist. Error: open /does/not/exist: no such file or directory")
+
+	fr, err := NewFileReceiver(file, false)
+	assert.Nil(t, err)
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	queue := make(chan *syscall.NetlinkMessage, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go process(queue, m, 1, stop, done)
+
+	readInput(fr, queue)
+	close(stop)
+	<-done
+
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001.000\",\"messages\":[{\"type\":1300,\"data\":\"syscall=2\"},{\"type\":1307,\"data\":\"cwd=\\\"/\\\"\"}],\"uid_map\":{}}\n", w.String())
+	assert.Contains(t, elb.String(), "Skipping line 2 of "+file+". Error: Not an audit log line: garbage")
+	assert.Contains(t, lb.String(), "Read 4 lines from "+file)
+	assert.Nil(t, fr.Close())
+}
+
+func TestFileReceiver_follow(t *testing.T) {
+	file := createTempFile(t, "input.test.log", "type=CWD msg=audit(10000001.000:1): cwd=\"/")
+	defer os.Remove(file)
+
+	fr, err := NewFileReceiver(file, true)
+	assert.Nil(t, err)
+	defer fr.Close()
+
+	// the rest of the line shows up later
+	go func() {
+		time.Sleep(INPUT_FOLLOW_INTERVAL)
+		f, _ := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+		f.WriteString("tmp\"\n")
+		f.Close()
+	}()
+
+	msg, err := fr.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, "audit(10000001.000:1): cwd=\"/tmp\"", string(msg.Data))
+
+	// stdin can be read as well
+	fr, err = NewFileReceiver("-", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "stdin", fr.name)
+
+	fr.r.Reset(bytes.NewBufferString(""))
+	_, err = fr.Receive()
+	assert.Equal(t, io.EOF, err)
+}
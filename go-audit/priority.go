@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"syscall"
+	"github.com/spf13/viper"
+)
+
+const (
+	PRIORITY_LOW = iota
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+)
+
+var priorityNames = []string{"low", "normal", "high"}
+
+// Decides which messages to drop when the processing queue backs up
+// Low priority messages are dropped once the queue is low_watermark percent full and normal ones once it is full
+// High priority messages are always queued, the receiver waits for room if it has to
+type priorities struct {
+	types  map[uint16]int // Message types that are not normal priority
+	limits [2]int         // Queue length at which low and normal priority messages are dropped
+}
+
+func createPriorities(config *viper.Viper, depth int) (*priorities, error) {
+	watermark := config.GetInt("priority.low_watermark")
+	if watermark < 0 || watermark > 100 {
+		return nil, errors.New(fmt.Sprintf("Priority low_watermark must be between 0 and 100, %v provided", watermark))
+	}
+
+	p := &priorities{
+		types:  make(map[uint16]int),
+		limits: [2]int{depth * watermark / 100, depth},
+	}
+
+	for k, v := range config.GetStringMapString("priority.message_types") {
+		t, err := strconv.ParseUint(k, 10, 16)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Priority message type `%s` could not be parsed. Error: %s", k, err))
+		}
+
+		priority := -1
+		for i, name := range priorityNames {
+			if v == name {
+				priority = i
+			}
+		}
+
+		if priority < 0 {
+			return nil, errors.New(fmt.Sprintf("Unknown priority `%s` for message type %s, must be one of low, normal or high", v, k))
+		}
+
+		p.types[uint16(t)] = priority
+	}
+
+	return p, nil
+}
+
+// Queues the message unless the queue is too full for its priority
+// Returns the priority of the message and whether it was queued
+func (p *priorities) enqueue(queue chan<- *syscall.NetlinkMessage, msg *syscall.NetlinkMessage) (int, bool) {
+	priority, ok := p.types[msg.Header.Type]
+	if !ok {
+		priority = PRIORITY_NORMAL
+	}
+
+	if priority == PRIORITY_HIGH {
+		queue <- msg
+		return priority, true
+	}
+
+	if len(queue) >= p.limits[priority] {
+		return priority, false
+	}
+
+	select {
+	case queue <- msg:
+		return priority, true
+	default:
+		return priority, false
+	}
+}
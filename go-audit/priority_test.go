@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_createPriorities(t *testing.T) {
+	c := viper.New()
+	c.Set("priority.low_watermark", 50)
+	c.Set("priority.message_types", map[string]interface{}{"1300": "high", "1302": "low"})
+
+	p, err := createPriorities(c, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint16]int{1300: PRIORITY_HIGH, 1302: PRIORITY_LOW}, p.types)
+	assert.Equal(t, [2]int{5, 10}, p.limits)
+
+	c.Set("priority.low_watermark", 101)
+	_, err = createPriorities(c, 10)
+	assert.EqualError(t, err, "Priority low_watermark must be between 0 and 100, 101 provided")
+
+	c.Set("priority.low_watermark", 50)
+	c.Set("priority.message_types", map[string]interface{}{"1300": "urgent"})
+	_, err = createPriorities(c, 10)
+	assert.EqualError(t, err, "Unknown priority `urgent` for message type 1300, must be one of low, normal or high")
+
+	c.Set("priority.message_types", map[string]interface{}{"syscall": "high"})
+	_, err = createPriorities(c, 10)
+	assert.EqualError(t, err, "Priority message type `syscall` could not be parsed. Error: strconv.ParseUint: parsing \"syscall\": invalid syntax")
+}
+
+func Test_priorities_enqueue(t *testing.T) {
+	p := &priorities{types: map[uint16]int{1300: PRIORITY_HIGH, 1302: PRIORITY_LOW}, limits: [2]int{1, 2}}
+	queue := make(chan *syscall.NetlinkMessage, 2)
+	msg := func(t uint16) *syscall.NetlinkMessage {
+		return &syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: t}}
+	}
+
+	// low priority messages are dropped first
+	priority, queued := p.enqueue(queue, msg(1302))
+	assert.Equal(t, PRIORITY_LOW, priority)
+	assert.True(t, queued)
+
+	priority, queued = p.enqueue(queue, msg(1302))
+	assert.Equal(t, PRIORITY_LOW, priority)
+	assert.False(t, queued)
+
+	priority, queued = p.enqueue(queue, msg(1307))
+	assert.Equal(t, PRIORITY_NORMAL, priority)
+	assert.True(t, queued)
+
+	priority, queued = p.enqueue(queue, msg(1307))
+	assert.False(t, queued)
+
+	// high priority messages wait for room
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-queue
+	}()
+
+	priority, queued = p.enqueue(queue, msg(1300))
+	assert.Equal(t, PRIORITY_HIGH, priority)
+	assert.True(t, queued)
+	assert.Equal(t, 2, len(queue))
+}
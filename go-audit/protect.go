@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	. "github.com/Xeralux/go-audit/client"
+	"github.com/Xeralux/go-audit/logger"
+	. "github.com/Xeralux/go-audit/marshaller"
+	"github.com/Xeralux/go-audit/metrics"
+	"github.com/spf13/viper"
+)
+
+const (
+	PROTECT_INTERVAL   = time.Second      // How often the rate messages arrive at is measured
+	PROTECT_ALERT      = "sustained_rate" // Name of the alerts written when protecting starts and stops
+	PROTECT_ALERT_ONLY = 0                // protect.rate_limit that alerts without touching the kernel
+)
+
+// Keeps audit from being used to exhaust the host. Once messages keep arriving faster than maxRate for sustain an
+// alert is written and, unless alerting only, the kernel rate_limit is tightened to rateLimit. The previous limit is
+// put back, with another alert, once the rate stayed at or under maxRate for cooldown
+// While tightened the kernel drops what is over the limit, so the rate only counts as calm if it lost nothing either
+type protector struct {
+	maxRate   uint64        // Messages per second that may be sustained
+	sustain   time.Duration // How long the rate has to stay over maxRate before protecting
+	cooldown  time.Duration // How long the rate has to stay calm before relaxing
+	rateLimit uint32        // Kernel rate_limit to set while protecting, PROTECT_ALERT_ONLY to leave the kernel alone
+	kernel    kernelStatus  // nil when the kernel settings are not ours
+	alert     func(*Alert)
+
+	lock      sync.Mutex
+	received  uint64    // Messages received at the last tick
+	lost      uint32    // Messages the kernel had lost at the last tick, only kept while protecting
+	measured  time.Time // When the last tick was
+	busySince time.Time // When the rate went over maxRate, zero while it is not
+	calmSince time.Time // When the rate went calm while protecting, zero while it is not
+	active    bool
+	previous  *uint32 // The kernel rate_limit before it was tightened, nil when it was not
+}
+
+// Reads protect.*, a nil protector means protection is off
+func createProtector(config *viper.Viper) (*protector, error) {
+	maxRate := config.GetInt("protect.max_sustained_eps")
+	if maxRate < 0 {
+		return nil, errors.New(fmt.Sprintf("Protect max_sustained_eps must be at least 0, %v provided", maxRate))
+	}
+
+	if maxRate == 0 {
+		return nil, nil
+	}
+
+	sustain := config.GetDuration("protect.sustain")
+	if sustain < PROTECT_INTERVAL {
+		return nil, errors.New(fmt.Sprintf("Protect sustain must be at least %v, %v provided", PROTECT_INTERVAL, sustain))
+	}
+
+	cooldown := config.GetDuration("protect.cooldown")
+	if cooldown < PROTECT_INTERVAL {
+		return nil, errors.New(fmt.Sprintf("Protect cooldown must be at least %v, %v provided", PROTECT_INTERVAL, cooldown))
+	}
+
+	rateLimit := config.GetInt("protect.rate_limit")
+	if rateLimit < 0 {
+		return nil, errors.New(fmt.Sprintf("Protect rate_limit must be at least 0, %v provided", rateLimit))
+	}
+
+	if rateLimit != PROTECT_ALERT_ONLY && leaveKernelAlone(config) {
+		return nil, errors.New("Protect rate_limit can not be set when the kernel settings are left alone, set it to 0 to only alert")
+	}
+
+	return &protector{
+		maxRate:   uint64(maxRate),
+		sustain:   sustain,
+		cooldown:  cooldown,
+		rateLimit: uint32(rateLimit),
+	}, nil
+}
+
+// Measures the rate every PROTECT_INTERVAL, forever
+func (p *protector) watch(received func() uint64) {
+	p.tick(time.Now(), received())
+	for {
+		time.Sleep(PROTECT_INTERVAL)
+		p.tick(time.Now(), received())
+	}
+}
+
+// Takes in how many messages have been received so far and protects or relaxes as needed
+func (p *protector) tick(now time.Time, received uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.measured.IsZero() {
+		p.measured, p.received = now, received
+		return
+	}
+
+	elapsed := now.Sub(p.measured)
+	if elapsed <= 0 {
+		return
+	}
+
+	rate := uint64(float64(received-p.received) / elapsed.Seconds())
+	p.measured, p.received = now, received
+
+	if rate > p.maxRate {
+		p.calmSince = time.Time{}
+		if p.busySince.IsZero() {
+			p.busySince = now
+		}
+
+		if !p.active && now.Sub(p.busySince) >= p.sustain {
+			p.protect(now, rate)
+		}
+
+		return
+	}
+
+	p.busySince = time.Time{}
+	if !p.active {
+		return
+	}
+
+	if p.kernelLost() {
+		p.calmSince = time.Time{}
+		return
+	}
+
+	if p.calmSince.IsZero() {
+		p.calmSince = now
+	}
+
+	if now.Sub(p.calmSince) >= p.cooldown {
+		p.relax(now, rate)
+	}
+}
+
+// True if the kernel lost messages since the last tick, it drops what is over a tightened rate_limit
+func (p *protector) kernelLost() bool {
+	if p.previous == nil {
+		return false
+	}
+
+	status, err := p.kernel.GetStatus()
+	if err != nil {
+		logger.Err("Failed to get the kernel audit status. Error: %v", err)
+		return false
+	}
+
+	lost := status.Lost != p.lost
+	p.lost = status.Lost
+	return lost
+}
+
+func (p *protector) protect(now time.Time, rate uint64) {
+	p.active = true
+	metrics.Protecting.Set(1)
+
+	alert := NewAlert(
+		PROTECT_ALERT,
+		"crit",
+		fmt.Sprintf("Received %d messages per second for over %v, more than the %d allowed by protect.max_sustained_eps", rate, p.sustain, p.maxRate),
+		now,
+	)
+	alert.EventsPerSecond = rate
+
+	if p.rateLimit != PROTECT_ALERT_ONLY && p.kernel != nil {
+		if previous, err := p.setRateLimit(p.rateLimit); err != nil {
+			logger.Err("Failed to tighten the kernel audit rate_limit. Error: %v", err)
+		} else {
+			p.previous = &previous
+			alert.KernelRateLimit = &p.rateLimit
+			alert.Message += fmt.Sprintf(", the kernel audit rate_limit is now %d, was %d", p.rateLimit, previous)
+		}
+	}
+
+	logger.Crit("%s", alert.Message)
+	if p.alert != nil {
+		p.alert(alert)
+	}
+}
+
+func (p *protector) relax(now time.Time, rate uint64) {
+	alert := NewAlert(
+		PROTECT_ALERT,
+		"info",
+		fmt.Sprintf("Received no more than %d messages per second for %v", p.maxRate, p.cooldown),
+		now,
+	)
+	alert.EventsPerSecond = rate
+
+	if p.previous != nil {
+		if err := p.restore(); err != nil {
+			// Keep protecting and try again after another cooldown
+			logger.Err("Failed to put back the kernel audit rate_limit. Error: %v", err)
+			p.calmSince = now
+			return
+		}
+
+		alert.KernelRateLimit = p.previous
+		alert.Message += fmt.Sprintf(", the kernel audit rate_limit is back to %d", *p.previous)
+		p.previous = nil
+	}
+
+	p.active = false
+	p.calmSince = time.Time{}
+	metrics.Protecting.Set(0)
+
+	logger.Notice("%s", alert.Message)
+	if p.alert != nil {
+		p.alert(alert)
+	}
+}
+
+// Sets the kernel rate_limit, returning what it was, and starts counting what the kernel loses from there
+func (p *protector) setRateLimit(limit uint32) (uint32, error) {
+	current, err := p.kernel.GetStatus()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.kernel.SetStatus(&AuditStatusPayload{Mask: AUDIT_STATUS_RATE_LIMIT, RateLimit: limit}); err != nil {
+		return 0, err
+	}
+
+	p.lost = current.Lost
+	return current.RateLimit, nil
+}
+
+func (p *protector) restore() error {
+	return p.kernel.SetStatus(&AuditStatusPayload{Mask: AUDIT_STATUS_RATE_LIMIT, RateLimit: *p.previous})
+}
+
+// Puts back the kernel rate_limit when stopping while protecting, so the host is not left with it
+func (p *protector) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.previous == nil {
+		return
+	}
+
+	if err := p.restore(); err != nil {
+		logger.Err("Failed to put back the kernel audit rate_limit. Error: %v", err)
+		return
+	}
+
+	logger.Info("Put the kernel audit rate_limit back to %d", *p.previous)
+	p.previous = nil
+}
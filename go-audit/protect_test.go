@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	. "github.com/Xeralux/go-audit/client"
+	. "github.com/Xeralux/go-audit/marshaller"
+)
+
+func Test_createProtector(t *testing.T) {
+	c := viper.New()
+	p, err := createProtector(c)
+	assert.Nil(t, err)
+	assert.Nil(t, p, "off by default")
+
+	c.Set("protect.max_sustained_eps", 1000)
+	c.Set("protect.sustain", "10s")
+	c.Set("protect.cooldown", "5m")
+	c.Set("protect.rate_limit", 200)
+	p, err = createProtector(c)
+	assert.Nil(t, err)
+	assert.Equal(t, &protector{maxRate: 1000, sustain: 10 * time.Second, cooldown: 5 * time.Minute, rateLimit: 200}, p)
+
+	c.Set("protect.sustain", "10ms")
+	_, err = createProtector(c)
+	assert.EqualError(t, err, "Protect sustain must be at least 1s, 10ms provided")
+
+	c.Set("protect.sustain", "10s")
+	c.Set("protect.cooldown", 0)
+	_, err = createProtector(c)
+	assert.EqualError(t, err, "Protect cooldown must be at least 1s, 0s provided")
+
+	c.Set("protect.cooldown", "5m")
+	c.Set("protect.rate_limit", -1)
+	_, err = createProtector(c)
+	assert.EqualError(t, err, "Protect rate_limit must be at least 0, -1 provided")
+
+	// the kernel is not ours to tighten when reading passively
+	c.Set("protect.rate_limit", 200)
+	c.Set("input.netlink.multicast", true)
+	_, err = createProtector(c)
+	assert.EqualError(t, err, "Protect rate_limit can not be set when the kernel settings are left alone, set it to 0 to only alert")
+
+	c.Set("protect.rate_limit", 0)
+	_, err = createProtector(c)
+	assert.Nil(t, err)
+
+	c.Set("protect.max_sustained_eps", -1)
+	_, err = createProtector(c)
+	assert.EqualError(t, err, "Protect max_sustained_eps must be at least 0, -1 provided")
+}
+
+func Test_protector(t *testing.T) {
+	defer resetLogger()
+
+	k := &fakeKernel{status: &AuditStatusPayload{RateLimit: 1000}}
+	alerts := []*Alert{}
+	p := &protector{
+		maxRate:   100,
+		sustain:   3 * time.Second,
+		cooldown:  5 * time.Second,
+		rateLimit: 50,
+		kernel:    k,
+		alert:     func(a *Alert) { alerts = append(alerts, a) },
+	}
+
+	now := time.Unix(10000000, 0)
+	received := uint64(0)
+	tick := func(rate uint64) {
+		now = now.Add(time.Second)
+		received += rate
+		p.tick(now, received)
+	}
+
+	p.tick(now, received)
+
+	// a short burst is fine
+	tick(500)
+	tick(500)
+	tick(50)
+	tick(500)
+	tick(500)
+	tick(500)
+	assert.Equal(t, 0, len(alerts))
+	assert.Nil(t, k.set)
+
+	// a sustained one is not
+	tick(500)
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, "crit", alerts[0].Severity)
+	assert.Equal(t, uint64(500), alerts[0].EventsPerSecond)
+	assert.Equal(t, uint32(50), *alerts[0].KernelRateLimit)
+	assert.Equal(t, "Received 500 messages per second for over 3s, more than the 100 allowed by protect.max_sustained_eps, the kernel audit rate_limit is now 50, was 1000", alerts[0].Message)
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_RATE_LIMIT, RateLimit: 50}, k.set)
+
+	// the kernel keeps us under the limit, but as long as it is losing messages that is not calm
+	for i := 0; i < 10; i++ {
+		k.status = &AuditStatusPayload{RateLimit: 50, Lost: uint32(i + 1)}
+		tick(50)
+	}
+	assert.Equal(t, 1, len(alerts))
+
+	for i := 0; i < 5; i++ {
+		tick(50)
+	}
+	assert.Equal(t, 1, len(alerts))
+
+	tick(50)
+	assert.Equal(t, 2, len(alerts))
+	assert.Equal(t, "info", alerts[1].Severity)
+	assert.Equal(t, uint32(1000), *alerts[1].KernelRateLimit)
+	assert.Equal(t, "Received no more than 100 messages per second for 5s, the kernel audit rate_limit is back to 1000", alerts[1].Message)
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_RATE_LIMIT, RateLimit: 1000}, k.set)
+
+	// stopping while protecting puts the rate_limit back
+	k.status = &AuditStatusPayload{RateLimit: 1000, Lost: 10}
+	for i := 0; i < 4; i++ {
+		tick(500)
+	}
+	assert.Equal(t, 3, len(alerts))
+	assert.Equal(t, uint32(50), k.set.RateLimit)
+	p.stop()
+	assert.Equal(t, uint32(1000), k.set.RateLimit)
+
+	// only alerting leaves the kernel alone
+	k = &fakeKernel{status: &AuditStatusPayload{RateLimit: 1000}}
+	alerts = []*Alert{}
+	p = &protector{maxRate: 100, sustain: time.Second, cooldown: time.Second, kernel: k, alert: func(a *Alert) { alerts = append(alerts, a) }}
+	p.tick(now, received)
+	tick(500)
+	tick(500)
+	tick(10)
+	tick(10)
+	assert.Equal(t, 2, len(alerts))
+	assert.Nil(t, alerts[0].KernelRateLimit)
+	assert.Nil(t, k.set)
+	p.stop()
+	assert.Nil(t, k.set)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/spf13/viper"
+)
+
+const (
+	ON_EXHAUSTION_EXIT     = "exit"     // Shut down and exit non zero so a supervisor can restart us
+	ON_EXHAUSTION_CONTINUE = "continue" // Log it and keep trying
+)
+
+// Limits how long receiving from netlink, or writing to an output, may keep failing. Once one of them failed
+// maxFailures times in a row, without succeeding in between, we either shut down or carry on with an error logged
+type reliability struct {
+	maxFailures int
+	exit        bool
+	exhausted   chan struct{} // Closed once a limit was reached with exit, main shuts down on it
+	once        sync.Once
+}
+
+// Reads reliability.*, a nil reliability means there is no limit
+func createReliability(config *viper.Viper) (*reliability, error) {
+	maxFailures := config.GetInt("reliability.max_consecutive_failures")
+	if maxFailures < 0 {
+		return nil, errors.New(fmt.Sprintf("Reliability max_consecutive_failures must be at least 0, %v provided", maxFailures))
+	}
+
+	policy := config.GetString("reliability.on_exhaustion")
+	if policy != ON_EXHAUSTION_EXIT && policy != ON_EXHAUSTION_CONTINUE {
+		return nil, errors.New(fmt.Sprintf("Reliability on_exhaustion must be exit or continue, %v provided", policy))
+	}
+
+	if maxFailures == 0 {
+		return nil, nil
+	}
+
+	return &reliability{
+		maxFailures: maxFailures,
+		exit:        policy == ON_EXHAUSTION_EXIT,
+		exhausted:   make(chan struct{}),
+	}, nil
+}
+
+// Takes in how many times what failed in a row, the policy applies every time that reaches another maxFailures
+func (r *reliability) failed(what string, failures int) {
+	if r == nil || failures%r.maxFailures != 0 {
+		return
+	}
+
+	r.exhaust(fmt.Sprintf("%s failed %d times in a row", what, failures))
+}
+
+// Applies the policy to something that gave up on its own, like reconnecting to netlink, why says what did
+func (r *reliability) exhaust(why string) {
+	if !r.exit {
+		logger.Err("%s, carrying on since reliability.on_exhaustion is continue", why)
+		return
+	}
+
+	r.once.Do(func() {
+		logger.Crit("%s, shutting down since reliability.on_exhaustion is exit", why)
+		close(r.exhausted)
+	})
+}
+
+// Closed once a limit was reached and we should exit, without limits it is nil and never is
+func (r *reliability) exhaustion() <-chan struct{} {
+	if r == nil {
+		return nil
+	}
+
+	return r.exhausted
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"syscall"
+	"testing"
+	. "github.com/Xeralux/go-audit/client"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+func Test_createReliability(t *testing.T) {
+	c := viper.New()
+	c.Set("reliability.on_exhaustion", ON_EXHAUSTION_EXIT)
+	r, err := createReliability(c)
+	assert.Nil(t, err)
+	assert.Nil(t, r, "no limit by default")
+
+	c.Set("reliability.max_consecutive_failures", 5)
+	r, err = createReliability(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, r.maxFailures)
+	assert.True(t, r.exit)
+
+	c.Set("reliability.on_exhaustion", ON_EXHAUSTION_CONTINUE)
+	r, err = createReliability(c)
+	assert.Nil(t, err)
+	assert.False(t, r.exit)
+
+	c.Set("reliability.on_exhaustion", "restart")
+	_, err = createReliability(c)
+	assert.EqualError(t, err, "Reliability on_exhaustion must be exit or continue, restart provided")
+
+	c.Set("reliability.on_exhaustion", ON_EXHAUSTION_EXIT)
+	c.Set("reliability.max_consecutive_failures", -1)
+	_, err = createReliability(c)
+	assert.EqualError(t, err, "Reliability max_consecutive_failures must be at least 0, -1 provided")
+}
+
+func Test_reliability_failed(t *testing.T) {
+	defer resetLogger()
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(&bytes.Buffer{}, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	// without limits nothing happens
+	var r *reliability
+	r.failed("Receiving from netlink", 100)
+	assert.Nil(t, r.exhaustion())
+	assert.Equal(t, "", elb.String())
+
+	// continue logs every time the limit is reached again
+	r = &reliability{maxFailures: 2, exhausted: make(chan struct{})}
+	for i := 1; i <= 4; i++ {
+		r.failed("Writing to output file", i)
+	}
+
+	assert.Equal(
+		t,
+		"Writing to output file failed 2 times in a row, carrying on since reliability.on_exhaustion is continue\n"+
+			"Writing to output file failed 4 times in a row, carrying on since reliability.on_exhaustion is continue\n",
+		elb.String(),
+	)
+
+	// exit closes the channel main waits on, once
+	elb.Reset()
+	r.exit = true
+	r.failed("Writing to output file", 1)
+	select {
+	case <-r.exhaustion():
+		t.Fatal("exhausted before reaching the limit")
+	default:
+	}
+
+	r.failed("Writing to output file", 2)
+	r.failed("Receiving from netlink", 2)
+	<-r.exhaustion()
+	assert.Equal(t, "Writing to output file failed 2 times in a row, shutting down since reliability.on_exhaustion is exit\n", elb.String())
+}
+
+// Returns each of errs in turn, a nil one hands out a message instead. Released after the last one
+type failingReceiver struct {
+	errs []error
+}
+
+func (f *failingReceiver) Receive() (*syscall.NetlinkMessage, error) {
+	if len(f.errs) == 0 {
+		return nil, ErrReleased
+	}
+
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	if err != nil {
+		return nil, err
+	}
+
+	return newFakeReceiver(1).msgs[0], nil
+}
+
+func Test_receive_reliability(t *testing.T) {
+	defer resetLogger()
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(&bytes.Buffer{}, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	queue := make(chan *syscall.NetlinkMessage, 4)
+	p, err := createPriorities(viper.New(), 4)
+	assert.Nil(t, err)
+
+	r := &reliability{maxFailures: 3, exit: true, exhausted: make(chan struct{})}
+	derp := errors.New("derp")
+	f := &failingReceiver{errs: []error{derp, derp, derp}}
+	receive(f, queue, p, r)
+	<-r.exhaustion()
+	assert.Contains(t, elb.String(), "Receiving from netlink failed 3 times in a row, shutting down since reliability.on_exhaustion is exit")
+
+	// giving up on reconnecting exhausts the limits right away, continue keeps receiving
+	elb.Reset()
+	r = &reliability{maxFailures: 3, exhausted: make(chan struct{})}
+	receive(&failingReceiver{errs: []error{ErrReconnectFailed, nil}}, queue, p, r)
+	assert.Equal(t, "Gave up reconnecting to the netlink socket, carrying on since reliability.on_exhaustion is continue\n", elb.String())
+
+	r.exit = true
+	receive(&failingReceiver{errs: []error{ErrReconnectFailed}}, queue, p, r)
+	<-r.exhaustion()
+
+	// without limits it panics like it always did
+	assert.Panics(t, func() { receive(&failingReceiver{errs: []error{ErrReconnectFailed}}, queue, p, nil) })
+
+	// a message received starts the count over
+	elb.Reset()
+	r = &reliability{maxFailures: 3, exit: true, exhausted: make(chan struct{})}
+	receive(&failingReceiver{errs: []error{derp, derp, nil, derp, derp}}, queue, p, r)
+	assert.NotContains(t, elb.String(), "in a row")
+}
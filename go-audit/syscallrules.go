@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"runtime"
+	"sort"
+	"strings"
+	"github.com/Xeralux/go-audit/logger"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+// The architecture go-audit runs on, as GOARCH names it
+var hostArch = runtime.GOARCH
+
+// The rule arches every host architecture audits syscalls under and the syscall table of each, by GOARCH
+// 32 bit arm has no syscall table so b32 is not offered on arm64
+var ruleArches = map[string]map[string]string{
+	"amd64": {"b64": ARCH_X86_64, "b32": ARCH_I386},
+	"386":   {"b32": ARCH_I386},
+	"arm64": {"b64": ARCH_AARCH64},
+}
+
+var ruleActions = map[string]bool{"never": true, "always": true}
+var ruleFieldOps = []string{"!=", "<=", ">=", "&=", "=", "<", ">", "&"}
+
+// Turns every entry of syscall_rules into auditctl rules, one for each arch of the host, like
+// `{action: always, filter: exit, syscalls: [execve], keys: [exec]}` into
+// `-a exit,always -F arch=b64 -S execve -k exec` and the same with arch=b32
+// A syscall the arch does not have is left out of its rule, so one config works across hosts, but a syscall no
+// arch we know of has is an error
+func syscallRules(config *viper.Viper) ([]string, error) {
+	v := config.Get("syscall_rules")
+	if v == nil {
+		return nil, nil
+	}
+
+	specs, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("syscall_rules must be a list, got %v", v))
+	}
+
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	arches, ok := ruleArches[hostArch]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("syscall_rules are not supported on %s, use rules instead", hostArch))
+	}
+
+	rules := []string{}
+	for i, s := range specs {
+		spec, ok := s.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Could not parse syscall rule %d, %v", i+1, s))
+		}
+
+		r, err := syscallRule(i, spec, arches)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, r...)
+	}
+
+	return rules, nil
+}
+
+// Builds the auditctl rules of syscall rule i for the arches of the host
+func syscallRule(i int, spec map[interface{}]interface{}, arches map[string]string) ([]string, error) {
+	action, filter := "always", "exit"
+	var syscalls, keys, fields, only []string
+
+	for k, v := range spec {
+		var ok bool
+		switch k {
+		case "action":
+			action, ok = v.(string)
+			if !ok || !ruleActions[action] {
+				return nil, errors.New(fmt.Sprintf("Syscall rule %d action must be always or never, got %v", i+1, v))
+			}
+
+		case "filter":
+			// Syscalls are only matched on the exit list
+			if filter, ok = v.(string); !ok || filter != "exit" {
+				return nil, errors.New(fmt.Sprintf("Syscall rule %d filter must be exit, got %v", i+1, v))
+			}
+
+		case "syscalls":
+			if syscalls, ok = ruleWords(v); !ok || len(syscalls) == 0 {
+				return nil, errors.New(fmt.Sprintf("Syscall rule %d syscalls must be a syscall name or a list of them, got %v", i+1, v))
+			}
+
+		case "keys":
+			if keys, ok = ruleWords(v); !ok {
+				return nil, errors.New(fmt.Sprintf("Syscall rule %d keys must be a key or a list of them, got %v", i+1, v))
+			}
+
+		case "fields":
+			if fields, ok = ruleWords(v); !ok {
+				return nil, errors.New(fmt.Sprintf("Syscall rule %d fields must be a comparison like `auid>=1000` or a list of them, got %v", i+1, v))
+			}
+
+			for _, f := range fields {
+				if !hasFieldOp(f) || strings.HasPrefix(f, "arch") {
+					return nil, errors.New(fmt.Sprintf("Syscall rule %d field `%s` must be a comparison other than arch", i+1, f))
+				}
+			}
+
+		case "arch":
+			if only, ok = ruleWords(v); !ok {
+				return nil, errors.New(fmt.Sprintf("Syscall rule %d arch must be b64, b32 or a list of them, got %v", i+1, v))
+			}
+
+			for _, a := range only {
+				if _, ok := arches[a]; !ok {
+					return nil, errors.New(fmt.Sprintf("Syscall rule %d arch `%s` is not supported on %s", i+1, a, hostArch))
+				}
+			}
+
+		default:
+			return nil, errors.New(fmt.Sprintf("Syscall rule %d has an unknown option `%v`", i+1, k))
+		}
+	}
+
+	if len(syscalls) == 0 {
+		return nil, errors.New(fmt.Sprintf("Syscall rule %d has no syscalls", i+1))
+	}
+
+	if len(only) == 0 {
+		for a := range arches {
+			only = append(only, a)
+		}
+	}
+
+	// b64 before b32
+	sort.Sort(sort.Reverse(sort.StringSlice(only)))
+
+	for _, s := range syscalls {
+		if !knownSyscall(s) {
+			return nil, errors.New(fmt.Sprintf("Syscall rule %d has unknown syscall `%s`", i+1, s))
+		}
+	}
+
+	rules := []string{}
+	for _, a := range only {
+		rule := []string{"-a", filter + "," + action, "-F", "arch=" + a}
+		for _, s := range syscalls {
+			if !HasSyscall(arches[a], s) {
+				logger.Info("Syscall rule %d leaves out %s for arch %s, it has no such syscall", i+1, s, a)
+				continue
+			}
+
+			rule = append(rule, "-S", s)
+		}
+
+		if len(rule) == 4 {
+			logger.Info("Syscall rule %d has no syscalls for arch %s, no rule is added for it", i+1, a)
+			continue
+		}
+
+		for _, f := range fields {
+			rule = append(rule, "-F", f)
+		}
+
+		for _, k := range keys {
+			rule = append(rule, "-k", k)
+		}
+
+		rules = append(rules, strings.Join(rule, " "))
+	}
+
+	return rules, nil
+}
+
+// Whether any arch of any host has the syscall
+func knownSyscall(name string) bool {
+	for _, arches := range ruleArches {
+		for _, arch := range arches {
+			if HasSyscall(arch, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// A word or a list of them, words can not have spaces since rules are split on them
+func ruleWords(v interface{}) ([]string, bool) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+
+	words := make([]string, 0, len(list))
+	for _, lv := range list {
+		w, ok := lv.(string)
+		if !ok || w == "" || strings.ContainsAny(w, " \t\n") {
+			return nil, false
+		}
+
+		words = append(words, w)
+	}
+
+	return words, true
+}
+
+func hasFieldOp(field string) bool {
+	for _, op := range ruleFieldOps {
+		if i := strings.Index(field, op); i > 0 {
+			return true
+		}
+	}
+
+	return false
+}
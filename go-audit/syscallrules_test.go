@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_syscallRules(t *testing.T) {
+	defer resetLogger()
+	defer func(a string) { hostArch = a }(hostArch)
+
+	file := createTempFile(t, "syscallrules.test.yaml", `
+rules:
+  - -b 8192
+syscall_rules:
+  - action: always
+    filter: exit
+    syscalls: [open, openat, execve]
+    keys: [file-access, exec]
+  - syscalls: kill
+    fields: [auid>=1000, a1=9]
+    arch: b32
+`)
+	defer os.Remove(file)
+
+	config, err := loadConfig(file)
+	assert.Nil(t, err)
+
+	// both arches on x86_64, after the raw rules
+	hostArch = "amd64"
+	rules, err := loadRules(config)
+	assert.Nil(t, err)
+	assert.Equal(
+		t,
+		[]string{
+			"-b 8192",
+			"-a exit,always -F arch=b64 -S open -S openat -S execve -k file-access -k exec",
+			"-a exit,always -F arch=b32 -S open -S openat -S execve -k file-access -k exec",
+			"-a exit,always -F arch=b32 -S kill -F auid>=1000 -F a1=9",
+		},
+		rules,
+	)
+
+	for _, r := range rules {
+		assert.Nil(t, validateRule(r, false), r)
+	}
+
+	// arm64 has no open and no b32
+	hostArch = "arm64"
+	_, err = loadRules(config)
+	assert.EqualError(t, err, "Syscall rule 2 arch `b32` is not supported on arm64")
+
+	config.Set("syscall_rules", []interface{}{map[interface{}]interface{}{"syscalls": []interface{}{"open", "openat"}, "action": "never"}})
+	rules, err = syscallRules(config)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-a exit,never -F arch=b64 -S openat"}, rules)
+
+	// a rule left with no syscalls adds nothing
+	config.Set("syscall_rules", []interface{}{map[interface{}]interface{}{"syscalls": "open"}})
+	rules, err = syscallRules(config)
+	assert.Nil(t, err)
+	assert.Empty(t, rules)
+
+	hostArch = "riscv64"
+	_, err = syscallRules(config)
+	assert.EqualError(t, err, "syscall_rules are not supported on riscv64, use rules instead")
+
+	// mistakes
+	hostArch = "amd64"
+	bad := []struct {
+		spec map[interface{}]interface{}
+		err  string
+	}{
+		{map[interface{}]interface{}{"syscalls": []interface{}{"execve", "nope"}}, "Syscall rule 1 has unknown syscall `nope`"},
+		{map[interface{}]interface{}{"keys": "exec"}, "Syscall rule 1 has no syscalls"},
+		{map[interface{}]interface{}{"syscalls": []interface{}{}}, "Syscall rule 1 syscalls must be a syscall name or a list of them, got []"},
+		{map[interface{}]interface{}{"syscalls": "execve", "action": "sometimes"}, "Syscall rule 1 action must be always or never, got sometimes"},
+		{map[interface{}]interface{}{"syscalls": "execve", "filter": "task"}, "Syscall rule 1 filter must be exit, got task"},
+		{map[interface{}]interface{}{"syscalls": "execve", "keys": "a b"}, "Syscall rule 1 keys must be a key or a list of them, got a b"},
+		{map[interface{}]interface{}{"syscalls": "execve", "fields": "arch=b64"}, "Syscall rule 1 field `arch=b64` must be a comparison other than arch"},
+		{map[interface{}]interface{}{"syscalls": "execve", "fields": "auid"}, "Syscall rule 1 field `auid` must be a comparison other than arch"},
+		{map[interface{}]interface{}{"syscalls": "execve", "key": "exec"}, "Syscall rule 1 has an unknown option `key`"},
+	}
+
+	for _, b := range bad {
+		config.Set("syscall_rules", []interface{}{b.spec})
+		rules, err = syscallRules(config)
+		assert.EqualError(t, err, b.err)
+		assert.Nil(t, rules)
+	}
+
+	config.Set("syscall_rules", []interface{}{"-a exit,always -S execve"})
+	_, err = syscallRules(config)
+	assert.EqualError(t, err, "Could not parse syscall rule 1, -a exit,always -S execve")
+}
@@ -0,0 +1,15 @@
+package main
+
+import "fmt"
+
+// Set at build time, like go build -ldflags "-X main.version=1.0.0 -X main.commit=$(git rev-parse --short HEAD)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// Describes the build for -version and the startup log
+func versionString() string {
+	return fmt.Sprintf("go-audit %s (commit %s, built %s)", version, commit, buildDate)
+}
@@ -1,102 +1,215 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"log/syslog"
 	"path"
 	"runtime"
+	"strings"
+	"time"
 )
 
+const (
+	FORMAT_TEXT = "text" // Plain text, the default
+	FORMAT_JSON = "json" // One json object per line with level, msg, caller and time fields
+)
+
+// Syslog severities, least severe first
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_NOTICE
+	LEVEL_WARNING
+	LEVEL_ERR
+	LEVEL_CRIT
+	LEVEL_ALERT
+	LEVEL_EMERG
+)
+
+var levelNames = map[string]Level{
+	"debug":	LEVEL_DEBUG,
+	"info":		LEVEL_INFO,
+	"notice":	LEVEL_NOTICE,
+	"warning":	LEVEL_WARNING,
+	"err":		LEVEL_ERR,
+	"crit":		LEVEL_CRIT,
+	"alert":	LEVEL_ALERT,
+	"emerg":	LEVEL_EMERG,
+}
+
 var stdOut	*log.Logger
 var stdErr	*log.Logger
 var sysLog	*syslog.Writer
+var jsonFormat	bool
+var minLevel	Level
+
+type jsonLine struct {
+	Level	string	`json:"level"`
+	Msg	string	`json:"msg"`
+	Caller	string	`json:"caller"`
+	Time	string	`json:"time"`
+}
 
-func AuditLoggerNew(so *log.Logger, se *log.Logger, sl *syslog.Writer) {
+// Anything logged below level is discarded
+func AuditLoggerNew(so *log.Logger, se *log.Logger, sl *syslog.Writer, format string, level Level) {
 	stdOut = so
 	stdErr = se
 	sysLog = sl
+	jsonFormat = format == FORMAT_JSON
+	minLevel = level
 }
 
-func fmtLog (format string, a ...interface{}) string {
+// Gets the level for a syslog severity name like `warning`
+func ParseLevel (name string) (Level, error) {
+	if level, ok := levelNames[strings.ToLower (name)]; ok {
+		return level, nil
+	}
+
+	return LEVEL_DEBUG, fmt.Errorf ("Unknown log level `%s`", name)
+}
+
+func fmtLog (level string, format string, a ...interface{}) string {
 	_, file, line, _ := runtime.Caller (2)
 	str := fmt.Sprintf (format, a...)
+
+	if jsonFormat {
+		b, _ := json.Marshal (&jsonLine{
+			Level:	level,
+			Msg:	strings.TrimRight (str, "\n"),
+			Caller:	fmt.Sprintf ("%v:%v", path.Base (file), line),
+			Time:	time.Now ().UTC ().Format (time.RFC3339Nano),
+		})
+		return string (b)
+	}
+
 	str = fmt.Sprintf ("%v (%v): %v", path.Base (file), line, str)
 
 	return str
 }
 
 func Emerg (format string, a ...interface{}) (err error) {
+	if minLevel > LEVEL_EMERG {
+		return nil
+	}
+
 	if sysLog != nil {
-		err = sysLog.Emerg (fmtLog (format, a...))
+		err = sysLog.Emerg (fmtLog ("emerg", format, a...))
+	} else if stdErr != nil && jsonFormat {
+		stdErr.Println (fmtLog ("emerg", format, a...))
 	} else if stdErr != nil {
-		stdErr.Printf(format, a)
+		stdErr.Printf(format, a...)
 	}
 	return err
 }
 
 func Alert (format string, a ...interface{}) (err error) {
+	if minLevel > LEVEL_ALERT {
+		return nil
+	}
+
 	if sysLog != nil {
-		err = sysLog.Alert (fmtLog (format, a...))
+		err = sysLog.Alert (fmtLog ("alert", format, a...))
+	} else if stdErr != nil && jsonFormat {
+		stdErr.Println (fmtLog ("alert", format, a...))
 	} else if stdErr != nil {
-		stdErr.Printf(format, a)
+		stdErr.Printf(format, a...)
 	}
 	return err
 }
 
 func Crit (format string, a ...interface{}) (err error) {
+	if minLevel > LEVEL_CRIT {
+		return nil
+	}
+
 	if sysLog != nil {
-		err = sysLog.Crit (fmtLog (format, a...))
+		err = sysLog.Crit (fmtLog ("crit", format, a...))
+	} else if stdErr != nil && jsonFormat {
+		stdErr.Println (fmtLog ("crit", format, a...))
 	} else if stdErr != nil {
-		stdErr.Printf(format, a)
+		stdErr.Printf(format, a...)
 	}
 	return err
 }
 
 func Err (format string, a ...interface{}) (err error) {
+	if minLevel > LEVEL_ERR {
+		return nil
+	}
+
 	if sysLog != nil {
-		err = sysLog.Err (fmtLog (format, a...))
+		err = sysLog.Err (fmtLog ("err", format, a...))
+	} else if stdErr != nil && jsonFormat {
+		stdErr.Println (fmtLog ("err", format, a...))
 	} else if stdErr != nil {
-		stdErr.Printf(format, a)
+		stdErr.Printf(format, a...)
 	}
 	return err
 }
 
 func Warning (format string, a ...interface{}) (err error) {
+	if minLevel > LEVEL_WARNING {
+		return nil
+	}
+
 	if sysLog != nil {
-		err = sysLog.Warning (fmtLog (format, a...))
+		err = sysLog.Warning (fmtLog ("warning", format, a...))
+	} else if stdErr != nil && jsonFormat {
+		stdErr.Println (fmtLog ("warning", format, a...))
 	} else if stdErr != nil {
-		stdErr.Printf(format, a)
+		stdErr.Printf(format, a...)
 	}
 
 	return err
 }
 
 func Notice (format string, a ...interface{}) (err error) {
+	if minLevel > LEVEL_NOTICE {
+		return nil
+	}
+
 	if sysLog != nil {
-		err = sysLog.Notice (fmtLog (format, a...))
+		err = sysLog.Notice (fmtLog ("notice", format, a...))
+	} else if stdOut != nil && jsonFormat {
+		stdOut.Println (fmtLog ("notice", format, a...))
 	} else if stdOut != nil {
-		stdOut.Printf(format, a)
+		stdOut.Printf(format, a...)
 	}
 
 	return err
 }
 
 func Info (format string, a ...interface{}) (err error) {
+	if minLevel > LEVEL_INFO {
+		return nil
+	}
+
 	if sysLog != nil {
-		err = sysLog.Info (fmtLog (format, a...))
+		err = sysLog.Info (fmtLog ("info", format, a...))
+	} else if stdOut != nil && jsonFormat {
+		stdOut.Println (fmtLog ("info", format, a...))
 	} else if stdOut != nil {
-		stdOut.Printf(format, a)
+		stdOut.Printf(format, a...)
 	}
 
 	return err
 }
 
 func Debug (format string, a ...interface{}) (err error) {
+	if minLevel > LEVEL_DEBUG {
+		return nil
+	}
+
 	if sysLog != nil {
-		err = sysLog.Debug (fmtLog (format, a...))
+		err = sysLog.Debug (fmtLog ("debug", format, a...))
+	} else if stdOut != nil && jsonFormat {
+		stdOut.Println (fmtLog ("debug", format, a...))
 	} else if stdOut != nil {
-		stdOut.Printf(format, a)
+		stdOut.Printf(format, a...)
 	}
 
 	return err
@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_text(t *testing.T) {
+	lb, elb := hookLogger(FORMAT_TEXT)
+	defer AuditLoggerNew(nil, nil, nil, FORMAT_TEXT, LEVEL_DEBUG)
+
+	levels := []func(string, ...interface{}) error{Emerg, Alert, Crit, Err, Warning}
+	for _, f := range levels {
+		f("Got %s after %d tries\n", "derp", 3)
+	}
+
+	levels = []func(string, ...interface{}) error{Notice, Info, Debug}
+	for _, f := range levels {
+		f("Added rule #%d of %d\n", 1, 2)
+	}
+
+	assert.Equal(t, "Added rule #1 of 2\nAdded rule #1 of 2\nAdded rule #1 of 2\n", lb.String())
+	assert.Equal(
+		t,
+		"Got derp after 3 tries\nGot derp after 3 tries\nGot derp after 3 tries\nGot derp after 3 tries\nGot derp after 3 tries\n",
+		elb.String(),
+	)
+}
+
+func TestLogger_json(t *testing.T) {
+	lb, elb := hookLogger(FORMAT_JSON)
+	defer AuditLoggerNew(nil, nil, nil, FORMAT_TEXT, LEVEL_DEBUG)
+
+	Info("Added audit rule #%d of %d\n", 1, 2)
+	Err("Failed %s", "badly")
+
+	line := map[string]string{}
+	assert.Nil(t, json.Unmarshal(lb.Bytes(), &line))
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "Added audit rule #1 of 2", line["msg"])
+	assert.Equal(t, "logger_test.go:37", line["caller"])
+	assert.NotEmpty(t, line["time"])
+
+	line = map[string]string{}
+	assert.Nil(t, json.Unmarshal(elb.Bytes(), &line))
+	assert.Equal(t, "err", line["level"])
+	assert.Equal(t, "Failed badly", line["msg"])
+	assert.Equal(t, "logger_test.go:38", line["caller"])
+}
+
+func TestLogger_level(t *testing.T) {
+	lb, elb := hookLogger(FORMAT_TEXT)
+	defer AuditLoggerNew(nil, nil, nil, FORMAT_TEXT, LEVEL_DEBUG)
+
+	level, err := ParseLevel("Warning")
+	assert.Nil(t, err)
+	assert.Equal(t, LEVEL_WARNING, level)
+
+	_, err = ParseLevel("loud")
+	assert.EqualError(t, err, "Unknown log level `loud`")
+
+	AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, FORMAT_TEXT, level)
+	Debug("debug\n")
+	Info("info\n")
+	Notice("notice\n")
+	Warning("warning\n")
+	Err("err\n")
+	Emerg("emerg\n")
+
+	assert.Equal(t, "", lb.String())
+	assert.Equal(t, "warning\nerr\nemerg\n", elb.String())
+}
+
+// Points the loggers at buffers so you can assert their contents
+func hookLogger(format string) (lb *bytes.Buffer, elb *bytes.Buffer) {
+	lb = &bytes.Buffer{}
+	elb = &bytes.Buffer{}
+	AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, format, LEVEL_DEBUG)
+	return
+}
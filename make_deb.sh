@@ -10,7 +10,7 @@ PACKAGE_NAME="go-audit"
 DIRNAME="$(cd "$(dirname "$0")" && pwd)"
 OLDESTPWD="$PWD"
 
-go build
+go build -ldflags "-X main.version=$VERSION -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
 rm -f "$PWD/rootfs"
 mkdir -p "$PWD/rootfs/usr/local/bin"
 mv "$PWD/go-audit" "$PWD/rootfs/usr/local/bin/"
@@ -0,0 +1,66 @@
+package marshaller
+
+import (
+	"fmt"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+	. "github.com/Xeralux/go-audit/parser"
+	. "github.com/Xeralux/go-audit/writer"
+)
+
+const ALERT_TYPE = "alert"
+
+// A synthetic event go-audit writes when it notices something about the host worth a human's attention
+// Like heartbeats it has a top level `type` and is written to every output regardless of filters and routing
+type Alert struct {
+	Type            string            `json:"type"`
+	AuditTime       string            `json:"timestamp"` // Same format as the timestamp of audit events
+	Name            string            `json:"alert"`     // What the alert is about, `sustained_rate` for instance
+	Severity        string            `json:"severity"`  // crit when raised, info once it clears
+	Message         string            `json:"message"`
+	EventsPerSecond uint64            `json:"events_per_second,omitempty"`
+	KernelRateLimit *uint32           `json:"kernel_rate_limit,omitempty"` // The kernel rate_limit now, nil when it was not changed
+	Fields          map[string]string `json:"fields,omitempty"`
+	now             time.Time
+}
+
+// Creates an alert for now
+func NewAlert(name, severity, message string, now time.Time) *Alert {
+	return &Alert{
+		Type:      ALERT_TYPE,
+		AuditTime: fmt.Sprintf("%d.%03d", now.Unix(), now.Nanosecond()/int(time.Millisecond)),
+		Name:      name,
+		Severity:  severity,
+		Message:   message,
+		now:       now,
+	}
+}
+
+// Writes an alert to every output, filters and message type routing do not apply
+// A failure is logged and never stops go-audit
+func (a *AuditMarshaller) Alert(alert *Alert) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	if a.parseTimestamp {
+		alert.AuditTime = FormatTimestamp(alert.now)
+	}
+
+	alert.Fields = a.fields
+
+	a.emitLock.Lock()
+	defer a.emitLock.Unlock()
+
+	for i, w := range a.writers {
+		if err := w.Encode(0, alert); err != nil && err != ErrCircuitOpen {
+			logger.Err("Failed to write alert to output #%d. Error: %v", i+1, err)
+		}
+	}
+
+	metrics.Alerts.Inc()
+}
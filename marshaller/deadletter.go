@@ -0,0 +1,67 @@
+package marshaller
+
+import (
+	"strings"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+	. "github.com/Xeralux/go-audit/parser"
+	. "github.com/Xeralux/go-audit/writer"
+)
+
+// A message that could not be parsed, kept with why so nothing the kernel sent is lost and the parser can be improved
+type DeadLetter struct {
+	Time  string `json:"time"`               // When the message was received, RFC 3339
+	Type  uint16 `json:"type"`               // Netlink message type
+	Seq   int    `json:"sequence,omitempty"` // Audit sequence of the event the message was part of, when it was dead lettered with it
+	Error string `json:"error"`              // What was wrong with the message
+	Raw   []byte `json:"raw"`                // The netlink payload as received, base64 encoded
+}
+
+// Sets where messages that can not be parsed are written, nil to drop them like before
+// Filters, transforms and message type routing do not apply to dead letters
+func (a *AuditMarshaller) SetDeadLetter(w *AuditWriter) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.deadLetter = w
+}
+
+// Checks that a message is something we can parse, the reason it is not otherwise
+// A message without any fields is still added to its event, it is dead lettered as well so the raw payload is kept
+func parseError(aMsg *AuditMessage) string {
+	if aMsg.Seq == 0 {
+		return "Could not parse the audit header"
+	}
+
+	if aMsg.Type != EVENT_EOE && len(aMsg.Fields()) == 0 && strings.TrimSpace(aMsg.Data) != "" {
+		return "No key=value fields found"
+	}
+
+	return ""
+}
+
+// Writes a message that could not be parsed to the dead letter output
+func (a *AuditMarshaller) writeDeadLetter(t uint16, raw []byte, reason string) {
+	a.writeEventDeadLetter(0, t, raw, reason)
+}
+
+// Writes a message of the event with the given sequence to the dead letter output
+func (a *AuditMarshaller) writeEventDeadLetter(seq int, t uint16, raw []byte, reason string) {
+	metrics.DeadLettered.Inc()
+	if a.deadLetter == nil {
+		return
+	}
+
+	dl := &DeadLetter{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Type:  t,
+		Seq:   seq,
+		Error: reason,
+		Raw:   raw,
+	}
+
+	if err := a.deadLetter.Encode(seq, dl); err != nil && err != ErrCircuitOpen {
+		logger.Err("Failed to write dead letter. Error: %v", err)
+	}
+}
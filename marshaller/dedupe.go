@@ -0,0 +1,80 @@
+package marshaller
+
+import (
+	"crypto/sha256"
+	"time"
+	"github.com/Xeralux/go-audit/metrics"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+// Suppresses events identical to one already written within a window
+// The first event is written right away, repeats are counted and the last of them is written with
+// its `repeat_count` once the window closes
+type deduper struct {
+	window time.Duration
+	seen   map[[sha256.Size]byte]*dedupeEntry
+	now    func() time.Time
+}
+
+type dedupeEntry struct {
+	closes     time.Time
+	last       *AuditMessageGroup // The most recent repeat, nil if there were none
+	suppressed int
+}
+
+func newDeduper(window time.Duration) *deduper {
+	return &deduper{
+		window: window,
+		seen:   make(map[[sha256.Size]byte]*dedupeEntry),
+		now:    time.Now,
+	}
+}
+
+// Records the group, true means it repeats an event from an open window and should not be written now
+func (d *deduper) duplicate(msg *AuditMessageGroup) bool {
+	id := identity(msg)
+	if entry, ok := d.seen[id]; ok {
+		entry.last = msg
+		entry.suppressed++
+		metrics.Deduplicated.Inc()
+		return true
+	}
+
+	d.seen[id] = &dedupeEntry{closes: d.now().Add(d.window)}
+	return false
+}
+
+// Forgets every window that has closed, or all of them if all is true
+// Returns the last repeat of each window that had any, annotated with how many repeats were suppressed
+func (d *deduper) expired(all bool) []*AuditMessageGroup {
+	now := d.now()
+	var msgs []*AuditMessageGroup
+	for id, entry := range d.seen {
+		if !all && now.Before(entry.closes) {
+			continue
+		}
+
+		if entry.last != nil {
+			entry.last.RepeatCount = entry.suppressed
+			msgs = append(msgs, entry.last)
+		}
+
+		delete(d.seen, id)
+	}
+
+	return msgs
+}
+
+// Hashes the type and data of every message, the header holding the timestamp and sequence is already gone
+func identity(msg *AuditMessageGroup) [sha256.Size]byte {
+	h := sha256.New()
+	for _, m := range msg.Msgs {
+		h.Write([]byte{byte(m.Type >> 8), byte(m.Type)})
+		h.Write([]byte(m.Data))
+		h.Write([]byte{0})
+	}
+
+	var id [sha256.Size]byte
+	copy(id[:], h.Sum(nil))
+	return id
+}
@@ -0,0 +1,160 @@
+package marshaller
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+const FILTER_CACHE_SIZE = 4096 // Signatures to remember decisions for, the cache starts over once it is full
+
+// Remembers what the cheap filters decided for each event signature, the syscall, message types and rule keys of
+// a group, so hosts doing the same thing over and over do not run every filter for every event
+// Filters that look at anything else, like a regex or the uid, can not be decided by the signature and are
+// still checked for every group, but only when the cheap filters did not already settle it
+type decisionCache struct {
+	excludes     map[string][]AuditFilter // Exclude filters decided by the signature alone, keyed by syscall
+	includes     map[string][]AuditFilter // Include filters decided by the signature alone, keyed by syscall
+	slowExcludes map[string][]AuditFilter // Every other exclude filter
+	slowIncludes map[string][]AuditFilter // Every other include filter
+	hasIncludes  bool
+	max          int // Decisions to keep, 0 disables remembering them
+	decisions    map[string]decision
+}
+
+// What the cheap filters decided for a signature, the first filter of each kind to match so it can count its hits
+type decision struct {
+	exclude *AuditFilter // The exclude filter that matched, nil for none
+	include *AuditFilter // The include filter that matched, nil for none
+}
+
+func newDecisionCache(excludes, includes map[string][]AuditFilter, max int) *decisionCache {
+	c := &decisionCache{
+		excludes:     make(map[string][]AuditFilter),
+		includes:     make(map[string][]AuditFilter),
+		slowExcludes: make(map[string][]AuditFilter),
+		slowIncludes: make(map[string][]AuditFilter),
+		hasIncludes:  len(includes) > 0,
+		max:          max,
+		decisions:    make(map[string]decision),
+	}
+
+	splitFilters(excludes, c.excludes, c.slowExcludes)
+	splitFilters(includes, c.includes, c.slowIncludes)
+	return c
+}
+
+func splitFilters(filters, fast, slow map[string][]AuditFilter) {
+	for syscall, fs := range filters {
+		for _, f := range fs {
+			if f.signatureOnly() {
+				fast[syscall] = append(fast[syscall], f)
+			} else {
+				slow[syscall] = append(slow[syscall], f)
+			}
+		}
+	}
+}
+
+// Decides if a message group should be dropped, the same way dropMessage describes
+func (c *decisionCache) drop(msg *AuditMessageGroup) bool {
+	d := c.decide(msg)
+	if f := d.exclude; f != nil {
+		f.hit()
+		return true
+	}
+
+	if f := firstMatch(c.slowExcludes, msg); f != nil {
+		f.hit()
+		return true
+	}
+
+	if !c.hasIncludes {
+		return false
+	}
+
+	f := d.include
+	if f == nil {
+		f = firstMatch(c.slowIncludes, msg)
+	}
+
+	if f == nil {
+		return true
+	}
+
+	f.hit()
+	return false
+}
+
+// Runs the cheap filters, or looks up what they decided last time for the same signature
+func (c *decisionCache) decide(msg *AuditMessageGroup) decision {
+	if len(c.excludes) == 0 && len(c.includes) == 0 {
+		return decision{}
+	}
+
+	if c.max < 1 {
+		return decision{exclude: firstMatch(c.excludes, msg), include: firstMatch(c.includes, msg)}
+	}
+
+	sig := signature(msg)
+	if d, ok := c.decisions[sig]; ok {
+		return d
+	}
+
+	d := decision{exclude: firstMatch(c.excludes, msg), include: firstMatch(c.includes, msg)}
+	if len(c.decisions) >= c.max {
+		c.decisions = make(map[string]decision)
+	}
+
+	c.decisions[sig] = d
+	return d
+}
+
+// Everything a signatureOnly filter can look at, the syscall, the message types and the rule keys of the group
+func signature(msg *AuditMessageGroup) string {
+	types := make([]int, 0, len(msg.Msgs))
+	for _, m := range msg.Msgs {
+		types = append(types, int(m.Type))
+	}
+
+	sort.Ints(types)
+
+	b := &strings.Builder{}
+	b.WriteString(msg.Syscall)
+	for i, t := range types {
+		if i > 0 && t == types[i-1] {
+			continue
+		}
+
+		b.WriteByte(' ')
+		b.WriteString(strconv.Itoa(t))
+	}
+
+	for _, k := range msg.Keys() {
+		b.WriteByte(0)
+		b.WriteString(k)
+	}
+
+	return b.String()
+}
+
+// True when the filter only looks at the syscall, message types and rule keys of a group
+func (f *AuditFilter) signatureOnly() bool {
+	return f.Regex == nil &&
+		len(f.Regexes) == 0 &&
+		f.Uid == "" &&
+		f.Auid == "" &&
+		f.Exe == "" &&
+		f.ExeRegex == nil &&
+		f.Comm == "" &&
+		f.CommRegex == nil &&
+		f.Success == "" &&
+		f.Arch == "" &&
+		f.Tty == "" &&
+		f.Pid == nil &&
+		f.Ppid == nil &&
+		len(f.Fields) == 0 &&
+		len(f.HasFields) == 0 &&
+		len(f.MissingFields) == 0
+}
@@ -0,0 +1,89 @@
+package marshaller
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+func TestDecisionCache_drop(t *testing.T) {
+	excludes, includes := groupFilters([]AuditFilter{
+		{Key: "noisy"},
+		{Syscall: "2", Regex: regexp.MustCompile("quiet")},
+		{Syscall: "59", Include: true},
+		{Uid: "1000", Include: true},
+	})
+
+	c := newDecisionCache(excludes, includes, 2)
+	assert.Equal(t, 1, len(c.excludes[""]))
+	assert.Equal(t, 1, len(c.slowExcludes["2"]))
+	assert.Equal(t, 1, len(c.includes["59"]))
+	assert.Equal(t, 1, len(c.slowIncludes[""]))
+
+	group := func(data string) *AuditMessageGroup {
+		return NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: data, Seq: 1})
+	}
+
+	// exclude always wins, even over a remembered include
+	assert.False(t, c.drop(group("syscall=59 uid=0")))
+	assert.True(t, c.drop(group("syscall=59 uid=0 key=\"noisy\"")))
+	assert.Equal(t, decision{include: &c.includes["59"][0]}, c.decisions["59 1300"])
+	assert.Equal(t, decision{exclude: &c.excludes[""][0], include: &c.includes["59"][0]}, c.decisions["59 1300\x00noisy"])
+
+	// the same signature still runs the filters the signature can not decide
+	assert.True(t, c.drop(group("syscall=2 uid=0")))
+	assert.False(t, c.drop(group("syscall=2 uid=1000")))
+	assert.True(t, c.drop(group("syscall=2 uid=1000 quiet")))
+
+	// the cache starts over once it is full
+	assert.Equal(t, 1, len(c.decisions))
+
+	// disabled, the filters still apply
+	c = newDecisionCache(excludes, includes, 0)
+	assert.True(t, c.drop(group("syscall=59 uid=0 key=\"noisy\"")))
+	assert.False(t, c.drop(group("syscall=59 uid=0")))
+	assert.Equal(t, 0, len(c.decisions))
+}
+
+func Test_signature(t *testing.T) {
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1302, Data: "item=0 name=\"/etc/passwd\"", Seq: 1})
+	amg.AddMessage(&AuditMessage{Type: 1300, Data: "syscall=2 key=61016263", Seq: 1})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: "item=1 name=\"/etc/shadow\"", Seq: 1})
+
+	// types are sorted and only show up once, hex encoded keys are split
+	assert.Equal(t, "2 1300 1302\x00a\x00bc", signature(amg))
+}
+
+// Checks an execve against 200 filters, most of them on rule keys and syscalls with some regexes for other syscalls
+func BenchmarkAuditMarshaller_dropMessage(b *testing.B) {
+	var filters []AuditFilter
+	for i := 0; i < 50; i++ {
+		filters = append(filters,
+			AuditFilter{Key: "noisy-" + strconv.Itoa(i)},
+			AuditFilter{Syscall: strconv.Itoa(100 + i)},
+			AuditFilter{Syscall: "59", Key: "noisy-exec-" + strconv.Itoa(i)},
+			AuditFilter{Syscall: "2", Regex: regexp.MustCompile("name=\"/opt/tool-" + strconv.Itoa(i) + "\"")},
+		)
+	}
+
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=c000003e syscall=59 success=yes exit=0 uid=0 comm=\"ls\" exe=\"/usr/bin/ls\" key=\"exec\"", Seq: 1})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: "argc=2 a0=\"ls\" a1=\"-l\"", Seq: 1})
+	amg.AddMessage(&AuditMessage{Type: 1307, Data: "cwd=\"/root\"", Seq: 1})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: "item=0 name=\"/usr/bin/ls\" inode=1 mode=0100755", Seq: 1})
+	amg.AddMessage(&AuditMessage{Type: 1327, Data: "proctitle=6C73002D6C", Seq: 1})
+
+	for _, size := range []int{0, FILTER_CACHE_SIZE} {
+		b.Run("cache="+strconv.Itoa(size), func(b *testing.B) {
+			excludes, includes := groupFilters(filters)
+			c := newDecisionCache(excludes, includes, size)
+
+			for i := 0; i < b.N; i++ {
+				if c.drop(amg) {
+					b.Fatal("The event should not have been dropped")
+				}
+			}
+		})
+	}
+}
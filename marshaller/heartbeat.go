@@ -0,0 +1,71 @@
+package marshaller
+
+import (
+	"fmt"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+	. "github.com/Xeralux/go-audit/parser"
+	. "github.com/Xeralux/go-audit/writer"
+)
+
+const HEARTBEAT_TYPE = "heartbeat"
+
+// A synthetic event written on a timer so a quiet host can be told apart from a go-audit that is no longer running
+// Real events never have a top level `type`, which makes heartbeats easy to pick out
+type Heartbeat struct {
+	Type            string            `json:"type"`
+	AuditTime       string            `json:"timestamp"`                // Same format as the timestamp of audit events
+	Uptime          int64             `json:"uptime_seconds"`           // Seconds since go-audit started
+	Version         string            `json:"version,omitempty"`        // Version of the go-audit build writing it
+	EventsProcessed uint64            `json:"events_processed"`         // Events completed since the last heartbeat, filtered or not
+	KernelLost      *uint32           `json:"kernel_lost,omitempty"`    // Running total of events the kernel lost, nil when unknown
+	KernelBacklog   *uint32           `json:"kernel_backlog,omitempty"` // Events waiting in the kernel, nil when unknown
+	Fields          map[string]string `json:"fields,omitempty"`
+	EmitSeq         *EmitSeq          `json:"_emit_seq,omitempty"` // The last event written, a gap at the end of a run shows up here
+	now             time.Time
+}
+
+// Creates a heartbeat for now, the kernel counts are filled in by the caller when it has them
+func NewHeartbeat(started, now time.Time) *Heartbeat {
+	return &Heartbeat{
+		Type:      HEARTBEAT_TYPE,
+		AuditTime: fmt.Sprintf("%d.%03d", now.Unix(), now.Nanosecond()/int(time.Millisecond)),
+		Uptime:    int64(now.Sub(started) / time.Second),
+		now:       now,
+	}
+}
+
+// Writes a heartbeat to every output, filters and message type routing do not apply
+// A failure is logged and never stops go-audit, missing heartbeats are how the failure is noticed
+func (a *AuditMarshaller) Heartbeat(hb *Heartbeat) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	if a.parseTimestamp {
+		hb.AuditTime = FormatTimestamp(hb.now)
+	}
+
+	hb.EventsProcessed = a.processed
+	hb.Fields = a.fields
+
+	a.emitLock.Lock()
+	defer a.emitLock.Unlock()
+	if a.emitSeq != nil {
+		last := *a.emitSeq
+		hb.EmitSeq = &last
+	}
+	a.processed = 0
+
+	for i, w := range a.writers {
+		if err := w.Encode(0, hb); err != nil && err != ErrCircuitOpen {
+			logger.Err("Failed to write heartbeat to output #%d. Error: %v", i+1, err)
+		}
+	}
+
+	metrics.Heartbeats.Inc()
+}
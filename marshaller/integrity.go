@@ -0,0 +1,72 @@
+package marshaller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+// Signs the events written so changes made to them after they left go-audit can be detected
+type signer struct {
+	key   []byte
+	chain bool   // Sign every event along with the one before it, a missing event then breaks the chain
+	last  string // The HMAC of the last event written, hex encoded
+}
+
+// Adds an `_integrity` HMAC-SHA256 of every event written, keyed with key. When chain is set the HMAC of the event
+// before it is signed too, and written as `prev`, so an event that was taken out or reordered is noticed as well
+// The chain starts over when go-audit starts. A nil or empty key disables signing
+func (a *AuditMarshaller) SetIntegrity(key []byte, chain bool) {
+	a.emitLock.Lock()
+	defer a.emitLock.Unlock()
+
+	if len(key) == 0 {
+		a.signer = nil
+		return
+	}
+
+	a.signer = &signer{key: key, chain: chain}
+}
+
+// Signs v, the encodable form of msg, as it would be encoded without its signature
+// The emit lock must be held by the caller
+func (s *signer) sign(msg *AuditMessageGroup, v interface{}) error {
+	e, _ := v.(*AuditEvent)
+
+	msg.Integrity = nil
+	if e != nil {
+		e.Integrity = nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	i := &Integrity{}
+	if s.chain {
+		i.Prev = s.last
+	}
+
+	i.HMAC = Sign(s.key, i.Prev, b)
+	if s.chain {
+		s.last = i.HMAC
+	}
+
+	msg.Integrity = i
+	if e != nil {
+		e.Integrity = i
+	}
+
+	return nil
+}
+
+// The hex encoded HMAC-SHA256 of prev followed by the json of an event, as written in `_integrity`
+func Sign(key []byte, prev string, event []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(prev))
+	mac.Write(event)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,59 @@
+package marshaller
+
+import (
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+)
+
+const RATE_LIMIT_REPORT_INTERVAL = time.Second // How often to log a summary of events dropped by the rate limiter
+
+// A token bucket allowing a steady number of events per second, with bursts up to the same amount
+type rateLimiter struct {
+	rate     float64
+	tokens   float64
+	last     time.Time
+	dropped  int
+	reported time.Time
+	now      func() time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(perSecond),
+		tokens: float64(perSecond),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Takes a token for an event, false means the event should be dropped
+func (r *rateLimiter) allow() bool {
+	now := r.now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	if r.tokens >= 1 {
+		r.tokens--
+		return true
+	}
+
+	r.dropped++
+	metrics.RateLimited.Inc()
+	return false
+}
+
+// Logs how many events were dropped, at most once per interval so a flood does not become a flood of logs
+func (r *rateLimiter) report() {
+	now := r.now()
+	if r.dropped == 0 || now.Sub(r.reported) < RATE_LIMIT_REPORT_INTERVAL {
+		return
+	}
+
+	logger.Warning("Dropped %d events over the limit of %v events per second", r.dropped, r.rate)
+	r.dropped = 0
+	r.reported = now
+}
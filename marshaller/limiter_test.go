@@ -0,0 +1,51 @@
+package marshaller
+
+import (
+	"testing"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	lb, elb := hookLogger()
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	now := time.Now()
+	r := newRateLimiter(2)
+	r.now = func() time.Time { return now }
+	r.last = now
+	dropped := metrics.RateLimited.Value()
+
+	// Starts with a full bucket
+	assert.True(t, r.allow())
+	assert.True(t, r.allow())
+	assert.False(t, r.allow())
+	assert.False(t, r.allow())
+	assert.Equal(t, dropped+2, metrics.RateLimited.Value())
+
+	r.report()
+	assert.Contains(t, elb.String(), "Dropped ")
+
+	// Only one summary per interval
+	elb.Reset()
+	assert.False(t, r.allow())
+	r.report()
+	assert.Equal(t, "", elb.String())
+
+	// Tokens refill over time, never beyond the rate
+	now = now.Add(time.Millisecond * 500)
+	assert.True(t, r.allow())
+	assert.False(t, r.allow())
+
+	now = now.Add(time.Second * 10)
+	assert.True(t, r.allow())
+	assert.True(t, r.allow())
+	assert.False(t, r.allow())
+
+	r.report()
+	assert.Contains(t, elb.String(), "Dropped ")
+	assert.Equal(t, 0, r.dropped)
+	assert.Equal(t, "", lb.String())
+}
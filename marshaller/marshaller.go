@@ -1,149 +1,1209 @@
 package marshaller
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
 	. "github.com/Xeralux/go-audit/parser"
 	. "github.com/Xeralux/go-audit/writer"
 )
 
 const (
-	EVENT_START = 1300 // Start of the audit type ids that we care about
-	EVENT_END   = 1399 // End of the audit type ids that we care about
-	EVENT_EOE   = 1320 // End of multi packet event
+	EVENT_START   = 1300 // Start of the audit type ids that we care about
+	EVENT_END     = 1399 // End of the audit type ids that we care about
+	EVENT_EOE     = 1320 // End of multi packet event
+	EVENT_SYSCALL = 1300 // The syscall record of an event
+
+	AUDIT_ARCH_64BIT = 0x80000000 // Set on the `arch` of 64 bit architectures, see include/uapi/linux/audit.h
+	TTY_NONE         = "(none)"   // The `tty` of a process without a controlling terminal, like a daemon
+
+	NO_SYSCALL = "none" // Filters are keyed by syscall, filters that only match groups without one go under this
 )
 
 type AuditMarshaller struct {
+	lock          sync.Mutex // Guards everything below once a sweeper is running
+	emitLock      sync.Mutex // Taken after lock, or on its own, to write. Events are transformed before taking it
 	msgs          map[int]*AuditMessageGroup
-	writer        *AuditWriter
+	writers       []*AuditWriter
 	lastSeq       int
 	missed        map[int]bool
 	worstLag      int
 	trackMessages bool
+	trackAhead    bool // Sequences are tracked by TrackSequence before messages are handed out, not by consume
 	logOutOfOrder bool
 	maxOutOfOrder int
 	attempts      int
-	filters       map[string]map[uint16][]*regexp.Regexp // { syscall: { mtype: [regexp, ...] } }
+	filters       map[string][]AuditFilter // Exclude filters { syscall: [filter, ...] }, filters for any syscall are under ""
+	includes      map[string][]AuditFilter // Include filters, keyed the same way
+	decisions     *decisionCache           // Remembers what the filters decided for events like ones seen before
+	samples       *sampler                 // Keeps a fraction of the events matching a sampling filter, nil for none
+	named         []AuditFilter            // Every filter in the order they were given, to report their hits
+	resolver      *IdResolver              // Resolves user and group ids to names, nil when disabled
+	required      []uint16                 // Record types every event must have, nil for none
 
+	completeAfter  time.Duration     // How long to wait for the end of an event before it is considered incomplete
+	dropIncomplete bool              // Drop incomplete events instead of writing what we have
+	maxEventBytes  int               // Truncate events over this many bytes, 0 for no limit
+	dropOversized  bool              // Drop events over maxEventBytes instead of truncating them
+	limiter        *rateLimiter      // Bounds the events written per second, nil when disabled
+	deduper        *deduper          // Coalesces identical events, nil when disabled
+	maxAge         time.Duration     // Drop events with an audit timestamp older than this, 0 to keep everything
+	fields         map[string]string // Added to every event written, nil for none
+	decodeHex      bool              // Add readable copies of hex encoded fields
+	joinSplit      bool              // Put fields the kernel split into parts back together
+	structured     bool              // Write each event as a single object keyed by record type instead of a list of messages
+	reassemble     bool              // Put the execve arguments back together into a command line
+	dropArgs       bool              // Remove the execve arguments once they are in the command line
+	processed      uint64            // Events completed since the last heartbeat
+	parseSELinux   bool              // Split security contexts into their parts
+	decodeSaddr    bool              // Add the family, address and port of sockaddr fields
+	hosts          *IdResolver       // Resolves decoded addresses to names, nil to leave them be
+	resolveSyscall bool              // Add the name of the syscall for the arch of the event
+	containers     *IdResolver       // Resolves pids to the container they run in, nil when disabled
+	parseTimestamp bool              // Write the timestamp as RFC 3339 and the serial on its own
+	includeRaw     bool              // Keep the netlink payload of every message and write it base64 encoded
+	deadLetter     *AuditWriter      // Where messages that can not be parsed are written, nil to drop them
+	ring           *debugRing        // The last events seen, raw and transformed, nil when disabled
+	emitSeq        *EmitSeq          // The last event written, nil when events are not numbered
+	signer         *signer           // Signs every event written, nil when disabled
+	onFailure      func(string, int) // Told the output and how many writes to it failed in a row, nil for no one
+	failures       []int             // Writes that failed in a row, for each writer
+	closed         bool
 }
 
+// Drops message groups that match every condition that is set
 type AuditFilter struct {
-	MessageType uint16
-	Regex       *regexp.Regexp
-	Syscall     string
+	Name          string           // Reported with the hits of the filter, its position counting from 1 when empty
+	MessageType   uint16           // Only test the regex against messages of this type, 0 for any
+	Regex         *regexp.Regexp   // Must match the data of a message, nil for any
+	Regexes       []*regexp.Regexp // More regexes that must each match the data of a message, combined with Regex
+	MatchAny      bool             // Only one of the regexes has to match instead of all of them
+	Syscall       string           // Syscall id of the group, empty for any, see bucket
+	AnySyscall    bool             // With no Syscall, also match groups that have one even if only regexes are set
+	Uid           string           // The `uid` of the group, empty for any
+	Auid          string           // The `auid` of the group, empty for any
+	Key           string           // One of the rule keys of the group, empty for any
+	Exe           string           // The `exe` of the group, empty for any
+	ExeRegex      *regexp.Regexp   // Must match the `exe` of the group, nil for any
+	Comm          string           // The `comm` of the group, empty for any
+	CommRegex     *regexp.Regexp   // Must match the `comm` of the group, nil for any
+	Success       string           // The `success` of the syscall record, yes or no, empty for any
+	Arch          string           // The `arch` of the syscall record, b64, b32 or the lowercase hex value, empty for any
+	Tty           string           // The `tty` of the syscall record, like pts0 or TTY_NONE, empty for any
+	Pid           *PidRange        // Must contain the `pid` of the syscall record, nil for any
+	Ppid          *PidRange        // Must contain the `ppid` of the syscall record, nil for any
+	Fields        []FieldFilter    // Any other fields of the group, each one must match
+	HasFields     []string         // Fields the group must have, with any value
+	MissingFields []string         // Fields the group must not have at all
+	Include       bool             // Only keep groups matching an include filter instead of dropping matches
+	Sample        float64          // Keep this fraction of the matching groups instead of dropping them all, 0 drops all
+	Invert        bool             // Match the groups that fail the conditions instead of those that satisfy them
+
+	hits *metrics.Counter // Groups the filter decided, see nameFilters
 }
 
-// Create a new marshaller
-func NewAuditMarshaller(w *AuditWriter, trackMessages, logOOO bool, maxOOO int, filters []AuditFilter) *AuditMarshaller {
+// A field of the group to match, like exe and comm of AuditFilter but for any field name
+type FieldFilter struct {
+	Name  string
+	Value string         // Must equal the value of the field, empty for any
+	Regex *regexp.Regexp // Must match the value of the field, nil for any
+}
+
+// Create a new marshaller, every complete message group is written to each of the provided writers
+func NewAuditMarshaller(w []*AuditWriter, trackMessages, logOOO bool, maxOOO int, filters []AuditFilter, resolver *IdResolver) *AuditMarshaller {
 	am := AuditMarshaller{
-		writer:        w,
+		writers:       w,
 		msgs:          make(map[int]*AuditMessageGroup, 5), // It is not typical to have more than 2 message groups at any given time
 		missed:        make(map[int]bool, 10),
 		trackMessages: trackMessages,
 		logOutOfOrder: logOOO,
 		maxOutOfOrder: maxOOO,
-		filters:       make(map[string]map[uint16][]*regexp.Regexp),
+		resolver:      resolver,
+		completeAfter: COMPLETE_AFTER,
+	}
+
+	am.named = nameFilters(filters)
+	am.filters, am.includes = groupFilters(am.named)
+	am.decisions = newDecisionCache(am.filters, am.includes, FILTER_CACHE_SIZE)
+	am.samples = newSampler(am.named)
+	return &am
+}
+
+// Replaces the filters, events completed from now on are checked against the new ones
+// Decisions remembered for the old filters are forgotten
+func (a *AuditMarshaller) SetFilters(filters []AuditFilter) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.named = nameFilters(filters)
+	a.filters, a.includes = groupFilters(a.named)
+	a.decisions = newDecisionCache(a.filters, a.includes, FILTER_CACHE_SIZE)
+	a.samples = newSampler(a.named)
+}
+
+// Returns a copy of the filters with a name for each one and the counter of its hits
+// A filter counts a hit for every group it decided, the exclude filter that dropped it, the include filter that kept
+// it or the sampling filter that sampled it. A group matching several filters is only counted by the one that decided
+// it, filters that are decided by the signature go first, see decisionCache. Hits are kept by name, a filter that is
+// still there after the filters are replaced keeps counting
+func nameFilters(filters []AuditFilter) []AuditFilter {
+	named := make([]AuditFilter, len(filters))
+	for i, f := range filters {
+		if f.Name == "" {
+			f.Name = strconv.Itoa(i + 1)
+		}
+
+		f.hits = metrics.FilterHits.With(f.Name)
+		named[i] = f
 	}
 
+	return named
+}
+
+// Logs how many groups each filter decided, filters that never hit are logged too so they can be pruned
+func (a *AuditMarshaller) logFilterHits() {
+	for _, f := range a.named {
+		logger.Info("Filter %s matched %d events, %s", f.Name, f.hits.Value(), f.String())
+	}
+}
+
+// Splits filters into exclude and include filters, keyed by syscall, sampling filters are left to the sampler
+func groupFilters(filters []AuditFilter) (excludes, includes map[string][]AuditFilter) {
+	excludes = make(map[string][]AuditFilter)
+	includes = make(map[string][]AuditFilter)
+
 	for _, filter := range filters {
-		if _, ok := am.filters[filter.Syscall]; !ok {
-			am.filters[filter.Syscall] = make(map[uint16][]*regexp.Regexp)
+		if filter.Sample > 0 {
+			continue
 		}
 
-		if _, ok := am.filters[filter.Syscall][filter.MessageType]; !ok {
-			am.filters[filter.Syscall][filter.MessageType] = []*regexp.Regexp{}
+		if filter.Include {
+			includes[filter.bucket()] = append(includes[filter.bucket()], filter)
+		} else {
+			excludes[filter.bucket()] = append(excludes[filter.bucket()], filter)
 		}
+	}
+
+	return excludes, includes
+}
+
+// Sets how long to wait for the end of a multi packet event, once that passes the event is written as is
+// or dropped with a warning if drop is true
+func (a *AuditMarshaller) SetCompletionTimeout(timeout time.Duration, drop bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 
-		am.filters[filter.Syscall][filter.MessageType] = append(am.filters[filter.Syscall][filter.MessageType], filter.Regex)
+	a.completeAfter = timeout
+	a.dropIncomplete = drop
+}
+
+// Has message_tracking look at sequences passed to TrackSequence instead of those consumed. Workers consume messages
+// out of order, so with more than one they are tracked in the order they were received before being handed out
+func (a *AuditMarshaller) SetTrackAhead(ahead bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.trackAhead = ahead
+}
+
+// Tracks the sequence of a message for message_tracking ahead of it being consumed, see SetTrackAhead
+func (a *AuditMarshaller) TrackSequence(nlMsg *syscall.NetlinkMessage) {
+	seq := MessageSeq(nlMsg)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.trackMessages && a.trackAhead && !a.closed && seq != 0 {
+		a.detectMissing(seq)
 	}
+}
 
-	return &am
+// Limits the size of an event to maxBytes of message data while it is assembled and of json once it is complete
+// Events over the limit are truncated and marked `truncated`, or dropped with a warning if drop is true
+// A limit of 0 or less disables it
+func (a *AuditMarshaller) SetMaxEventBytes(maxBytes int, drop bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.maxEventBytes = maxBytes
+	a.dropOversized = drop
+}
+
+// Limits the complete events written to perSecond, anything over is dropped and periodically summarized in the logs
+// A limit of 0 or less disables rate limiting
+func (a *AuditMarshaller) SetRateLimit(perSecond int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if perSecond <= 0 {
+		a.limiter = nil
+		return
+	}
+
+	a.limiter = newRateLimiter(perSecond)
+}
+
+// Suppresses events identical to one seen within the window, ignoring the timestamp and sequence
+// Once the window closes the last repeat is written with `repeat_count` set to the number suppressed
+// A window of 0 or less disables deduplication
+func (a *AuditMarshaller) SetDedupeWindow(window time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if window <= 0 {
+		a.deduper = nil
+		return
+	}
+
+	a.deduper = newDeduper(window)
+}
+
+// Calls handler with the name of an output and how many writes to it failed in a row every time one fails
+// Skipped writes, while the circuit of the output is open, are failures too. A write that succeeds starts over
+func (a *AuditMarshaller) SetFailureHandler(handler func(output string, failures int)) {
+	a.emitLock.Lock()
+	defer a.emitLock.Unlock()
+
+	a.onFailure = handler
+	a.failures = make([]int, len(a.writers))
+}
+
+// Drops events whose audit timestamp is older than maxAge, like stale events replayed after a reconnect
+// Events without a timestamp are kept. A maxAge of 0 or less keeps everything
+func (a *AuditMarshaller) SetMaxAge(maxAge time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.maxAge = maxAge
+}
+
+// Sets fields, like the hostname, to add to every event written
+// They are kept under `fields` so they never collide with what the kernel provided
+func (a *AuditMarshaller) SetFields(fields map[string]string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(fields) == 0 {
+		a.fields = nil
+		return
+	}
+
+	a.fields = fields
+}
+
+// Enables adding a decoded copy of hex encoded fields, like `proctitle`, to the extra fields of each message
+func (a *AuditMarshaller) SetDecodeHex(decode bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.decodeHex = decode
+}
+
+// Enables joining fields the kernel split into `<name>_len` and `<name>[i]` parts back into `<name>`
+func (a *AuditMarshaller) SetJoinSplitFields(join bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.joinSplit = join
+}
+
+// Enables adding a `cmdline` extra field to execve records with every argument of the command in order
+func (a *AuditMarshaller) SetReassembleExecve(reassemble bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.reassemble = reassemble
+}
+
+// Enables removing the execve arguments after they were reassembled, they are kept when reassembling is off
+func (a *AuditMarshaller) SetDropExecveArgs(drop bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.dropArgs = drop
+}
+
+// Enables adding the parts of the `subj`, `obj`, `scontext` and `tcontext` security contexts to the extra fields
+// of each message
+func (a *AuditMarshaller) SetParseSELinux(parse bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.parseSELinux = parse
+}
+
+// Enables adding the family, address and port of `saddr` fields to the extra fields of each message
+// Addresses are resolved to a name as well when hosts is set
+func (a *AuditMarshaller) SetDecodeSaddr(decode bool, hosts *IdResolver) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.decodeSaddr = decode
+	a.hosts = hosts
+}
+
+// Enables adding a `syscall_name` extra field with the name of the syscall, like openat, to each message with a syscall
+func (a *AuditMarshaller) SetResolveSyscall(resolve bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.resolveSyscall = resolve
+}
+
+// Enables adding a `container_id` extra field to messages with the pid of a process running in a container
+// The id is read from the cgroups of the process, nil disables it
+func (a *AuditMarshaller) SetResolveContainer(containers *IdResolver) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.containers = containers
+}
+
+// Enables writing the timestamp of every event, and heartbeat, as RFC 3339 with the kernel's one kept next to it
+func (a *AuditMarshaller) SetParseTimestamp(parse bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.parseTimestamp = parse
+}
+
+// Enables numbering every event written as `_emit_seq`, the count starts over at 1 with a new epoch of now
+func (a *AuditMarshaller) SetEmitSeq(enabled bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.emitSeq = nil
+	if enabled {
+		a.emitSeq = &EmitSeq{Epoch: time.Now().UnixNano() / int64(time.Millisecond)}
+	}
+}
+
+// Enables keeping the netlink payload of every message as received, it is written base64 encoded under `_raw`
+// Only messages consumed from now on keep their payload
+func (a *AuditMarshaller) SetIncludeRaw(include bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.includeRaw = include
+}
+
+// Enables writing each event as a single object with a nested object, or array, for every record type
+// instead of the list of raw messages
+func (a *AuditMarshaller) SetStructured(structured bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.structured = structured
+}
+
+// Periodically flushes incomplete events in the background
+// Without this incomplete events are only flushed when another message arrives
+func (a *AuditMarshaller) Sweep(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			a.lock.Lock()
+			a.flushOld()
+			a.lock.Unlock()
+		}
+	}()
+}
+
+// Periodically logs the events being assembled at debug until the marshaller is closed, a steady climb means
+// events are not being completed
+func (a *AuditMarshaller) LogInFlight(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		a.logInFlight(ticker.C)
+		ticker.Stop()
+	}()
+}
+
+// Logs the events in flight on every tick, returns once the marshaller is closed or ticks is
+func (a *AuditMarshaller) logInFlight(ticks <-chan time.Time) {
+	for range ticks {
+		a.lock.Lock()
+		closed := a.closed
+		a.lock.Unlock()
+
+		if closed {
+			return
+		}
+
+		n, oldest := a.InFlight()
+		if n == 0 {
+			logger.Debug("No events in flight")
+			continue
+		}
+
+		logger.Debug("%d events in flight, the oldest received %v ago", n, time.Since(oldest).Round(time.Millisecond))
+	}
+}
+
+// The number of events being assembled and when the oldest of them was received
+func (a *AuditMarshaller) InFlight() (int, time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var oldest time.Time
+	for _, msg := range a.msgs {
+		if oldest.IsZero() || msg.Received.Before(oldest) {
+			oldest = msg.Received
+		}
+	}
+
+	return len(a.msgs), oldest
 }
 
 // Ingests a netlink message and likely prepares it to be logged
+// Safe to call from several goroutines, as long as every message of an event goes through the same one. An event
+// completed by its end is transformed without holding the lock, so events only wait on each other to be written
 func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
+	if msg := a.consume(nlMsg); msg != nil {
+		a.emit(msg)
+		metrics.MarshalLatency.Observe(time.Since(msg.Received).Seconds())
+	}
+}
+
+// Adds the message to the event it belongs to, the event is returned once its end was seen if it is to be written
+func (a *AuditMarshaller) consume(nlMsg *syscall.NetlinkMessage) *AuditMessageGroup {
+	// Parsing the message, and looking up the names of its uids, happens before taking the lock so workers do it
+	// side by side. Only assembling the event out of a.msgs is serialized
+	raw := nlMsg.Data
 	aMsg := NewAuditMessage(nlMsg)
+	reason := ""
+	if aMsg.Seq != 0 && nlMsg.Header.Type >= EVENT_START && nlMsg.Header.Type <= EVENT_END &&
+		nlMsg.Header.Type != EVENT_EOE {
+		reason = parseError(aMsg)
+		LookupUids(aMsg)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return nil
+	}
+
+	metrics.EventsReceived.Inc()
+	if a.includeRaw || a.ring != nil {
+		aMsg.Raw = raw
+	}
 
 	if aMsg.Seq == 0 {
 		// We got an invalid audit message, return the current message and reset
+		a.writeDeadLetter(nlMsg.Header.Type, raw, parseError(aMsg))
 		a.flushOld()
-		return
+		return nil
 	}
 
-	if a.trackMessages {
+	if a.trackMessages && !a.trackAhead {
 		a.detectMissing(aMsg.Seq)
 	}
 
 	if nlMsg.Header.Type < EVENT_START || nlMsg.Header.Type > EVENT_END {
 		// Drop all audit messages that aren't things we care about or end a multi packet event
 		a.flushOld()
-		return
+		return nil
 	} else if nlMsg.Header.Type == EVENT_EOE {
 		// This is end of event msg, flush the msg with that sequence and discard this one
-		a.completeMessage(aMsg.Seq)
-		return
+		return a.complete(aMsg.Seq)
+	}
+
+	if reason != "" {
+		a.writeDeadLetter(nlMsg.Header.Type, raw, reason)
 	}
 
 	if val, ok := a.msgs[aMsg.Seq]; ok {
 		// Use the original AuditMessageGroup if we have one
-		val.AddMessage(aMsg)
+		a.addMessage(val, aMsg)
 	} else {
 		// Create a new AuditMessageGroup
-		a.msgs[aMsg.Seq] = NewAuditMessageGroup(aMsg)
+		amg := NewAuditMessageGroup(aMsg)
+		amg.CompleteAfter = amg.Received.Add(a.completeAfter)
+		a.msgs[aMsg.Seq] = amg
+		a.limitSize(amg)
 	}
 
 	a.flushOld()
+	return nil
+}
+
+// Writes out every event still being assembled, incomplete or not, then flushes and closes all writers
+// Anything consumed afterwards is ignored
+func (a *AuditMarshaller) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return nil
+	}
+
+	for seq := range a.msgs {
+		a.completeMessage(seq)
+	}
+
+	if a.deduper != nil {
+		for _, msg := range a.deduper.expired(true) {
+			a.emit(msg)
+		}
+	}
+
+	a.logFilterHits()
+
+	// Events transformed outside of the lock may still be on their way, they are dropped once we are closed
+	a.emitLock.Lock()
+	defer a.emitLock.Unlock()
+	a.closed = true
+
+	var err error
+	for i, w := range a.writers {
+		if cerr := w.Close(); cerr != nil {
+			logger.Err("Failed to close output #%d. Error: %v", i+1, cerr)
+			err = cerr
+		}
+	}
+
+	if a.deadLetter != nil {
+		if cerr := a.deadLetter.Close(); cerr != nil {
+			logger.Err("Failed to close the dead letter output. Error: %v", cerr)
+			err = cerr
+		}
+	}
+
+	return err
 }
 
 // Outputs any messages that are old enough
 // This is because there is no indication of multi message events coming from kaudit
 func (a *AuditMarshaller) flushOld() {
+	if a.limiter != nil {
+		a.limiter.report()
+	}
+
+	if a.deduper != nil {
+		for _, msg := range a.deduper.expired(false) {
+			a.emit(msg)
+		}
+	}
+
 	now := time.Now()
 	for seq, msg := range a.msgs {
 		if msg.CompleteAfter.Before(now) || now.Equal(msg.CompleteAfter) {
+			metrics.Incomplete.Inc()
+			if a.dropIncomplete {
+				logger.Warning("Dropping incomplete event %d after waiting %v for the rest of it", seq, a.completeAfter)
+				delete(a.msgs, seq)
+				continue
+			}
+
 			a.completeMessage(seq)
 		}
 	}
+
+	metrics.InFlight.Set(uint64(len(a.msgs)))
 }
 
 // Write a complete message group to the configured output in json format
 func (a *AuditMarshaller) completeMessage(seq int) {
+	if msg := a.complete(seq); msg != nil {
+		a.emit(msg)
+		metrics.MarshalLatency.Observe(time.Since(msg.Received).Seconds())
+	}
+}
+
+// Takes a complete message group out of those being assembled and decides if it is written
+// Returns the group when it is, nil when it was dropped or is not being assembled
+func (a *AuditMarshaller) complete(seq int) *AuditMessageGroup {
 	var msg *AuditMessageGroup
 	var ok bool
 
 	if msg, ok = a.msgs[seq]; !ok {
 		//TODO: attempted to complete a missing message, log?
-		return
+		return nil
+	}
+
+	delete(a.msgs, seq)
+	metrics.InFlight.Set(uint64(len(a.msgs)))
+	a.processed++
+
+	if msg.Truncated && a.dropOversized {
+		a.remember(msg, a.rawMessages(msg), nil, "oversized")
+		return nil
+	}
+
+	if missing := a.missingRecords(msg); missing != nil {
+		a.dropMissingRecords(msg, missing)
+		return nil
 	}
 
 	if a.dropMessage(msg) {
-		delete(a.msgs, seq)
+		metrics.EventsFiltered.Inc()
+		a.remember(msg, a.rawMessages(msg), nil, "filtered")
+		return nil
+	}
+
+	if a.samples != nil && !a.samples.keep(msg) {
+		metrics.Sampled.Inc()
+		a.remember(msg, a.rawMessages(msg), nil, "sampled")
+		return nil
+	}
+
+	if a.tooOld(msg) {
+		metrics.TooOld.Inc()
+		a.remember(msg, a.rawMessages(msg), nil, "too old")
+		return nil
+	}
+
+	if a.deduper != nil && a.deduper.duplicate(msg) {
+		a.remember(msg, a.rawMessages(msg), nil, "duplicate")
+		return nil
+	}
+
+	if a.limiter != nil {
+		allowed := a.limiter.allow()
+		a.limiter.report()
+		if !allowed {
+			a.remember(msg, a.rawMessages(msg), nil, "rate limited")
+			return nil
+		}
+	}
+
+	return msg
+}
+
+// Applies the configured transforms to a message group and writes it
+func (a *AuditMarshaller) emit(msg *AuditMessageGroup) {
+	a.transform(msg)
+	a.write(msg)
+}
+
+// Applies the configured transforms to a message group
+func (a *AuditMarshaller) transform(msg *AuditMessageGroup) {
+	if a.resolver != nil {
+		msg.ResolveIds(a.resolver)
+	}
+
+	// Before decoding so split hex values are decoded whole
+	if a.joinSplit {
+		msg.JoinSplitFields()
+	}
+
+	if a.decodeHex {
+		msg.DecodeHex()
+	}
+
+	if a.reassemble {
+		msg.ReassembleExecve()
+		if a.dropArgs {
+			msg.DropExecveArgs()
+		}
+	}
+
+	if a.parseSELinux {
+		msg.ParseSELinux()
+	}
+
+	if a.resolveSyscall {
+		if err := msg.ResolveSyscall(); err != nil {
+			logger.Debug("%v", err)
+		}
+	}
+
+	if a.decodeSaddr {
+		if err := msg.DecodeSaddr(a.hosts); err != nil {
+			logger.Debug("%v", err)
+		}
+	}
+
+	if a.containers != nil {
+		msg.ResolveContainer(a.containers)
+	}
+
+	if a.parseTimestamp {
+		if err := msg.ParseTimestamp(); err != nil {
+			logger.Debug("%v", err)
+		}
+	}
+
+	msg.Fields = a.fields
+
+	if a.includeRaw {
+		msg.EncodeRaw()
+	}
+}
+
+// Fans a message group out to every writer that wants it, after the filters have had their say
+// A failure on one writer is logged and does not stop delivery to the others, only when every writer fails do we bail
+func (a *AuditMarshaller) write(msg *AuditMessageGroup) {
+	a.emitLock.Lock()
+	defer a.emitLock.Unlock()
+
+	if a.closed {
 		return
 	}
 
-	if err := a.writer.Write(msg); err != nil {
-		logger.Err("Failed to write message. Error: %v", err)
+	var err error
+	failed := 0
+	routed := 0
+
+	// The number is only used up once we know the event is being written, dropping it does not leave a gap
+	if a.emitSeq != nil {
+		msg.EmitSeq = &EmitSeq{Epoch: a.emitSeq.Epoch, Seq: a.emitSeq.Seq + 1}
+	}
+
+	// Truncating can throw messages away, hold on to the raw payloads first
+	raw := a.rawMessages(msg)
+	v := a.limitEvent(msg, a.encodable(msg))
+	if v == nil {
+		a.remember(msg, raw, nil, "oversized")
+		return
+	}
+
+	if a.emitSeq != nil {
+		a.emitSeq.Seq++
+	}
+
+	// Last, the signature covers everything else that was done to the event
+	if a.signer != nil {
+		if err := a.signer.sign(msg, v); err != nil {
+			logger.Err("Failed to sign event %d, writing it without a signature. Error: %v", msg.Seq, err)
+		}
+	}
+
+	a.remember(msg, raw, v, "")
+
+	for i, w := range a.writers {
+		if !w.Wants(msg) {
+			continue
+		}
+
+		routed++
+		err = w.Encode(msg.Seq, v)
+		a.countFailure(i, w, err)
+		if err == ErrCircuitOpen {
+			continue
+		} else if err != nil {
+			logger.Err("Failed to write message to output #%d. Error: %v", i+1, err)
+
+			// A circuit breaker deals with failures by dropping events for a while instead of taking us down
+			if !w.HasCircuitBreaker() {
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 && failed == routed {
+		logger.Err("Failed to write message to all outputs. Error: %v", err)
 		panic(err)
 	}
+}
 
-	delete(a.msgs, seq)
+// Keeps count of the writes to writer i that failed in a row for the failure handler
+// The emit lock must be held by the caller
+func (a *AuditMarshaller) countFailure(i int, w *AuditWriter, err error) {
+	if a.onFailure == nil {
+		return
+	}
+
+	if err == nil {
+		a.failures[i] = 0
+		return
+	}
+
+	a.failures[i]++
+	a.onFailure(w.Name(), a.failures[i])
 }
 
+// What gets encoded for a message group, the group itself or the assembled event when writing structured events
+func (a *AuditMarshaller) encodable(msg *AuditMessageGroup) interface{} {
+	if a.structured {
+		return msg.Event()
+	}
+
+	return msg
+}
+
+// Decides if a message group should be dropped, filters are applied in this order:
+//  1. If any exclude filter matches the group is dropped, exclude always wins
+//  2. If there are include filters the group is dropped unless at least one of them matches
+//  3. Otherwise the group is kept
+//
+// Filters that only look at the syscall, message types and rule keys are decided once per signature, see decisionCache
 func (a *AuditMarshaller) dropMessage(msg *AuditMessageGroup) bool {
-	filters, ok := a.filters[msg.Syscall]
+	return a.decisions.drop(msg)
+}
+
+// Checks the audit timestamp of the group against the max age
+func (a *AuditMarshaller) tooOld(msg *AuditMessageGroup) bool {
+	if a.maxAge <= 0 {
+		return false
+	}
+
+	t, ok := msg.Time()
+	return ok && time.Since(t) > a.maxAge
+}
+
+// Checks the filters for the group's syscall, or for groups without one, and then the filters for any syscall
+// Returns the first one to match or nil if none did
+func firstMatch(filters map[string][]AuditFilter, msg *AuditMessageGroup) *AuditFilter {
+	key := msg.Syscall
+	if key == "" {
+		key = NO_SYSCALL
+	}
+
+	fs := filters[key]
+	for i := range fs {
+		if fs[i].Matches(msg) {
+			return &fs[i]
+		}
+	}
+
+	// Filters that apply to any syscall
+	fs = filters[""]
+	for i := range fs {
+		if fs[i].Matches(msg) {
+			return &fs[i]
+		}
+	}
+
+	return nil
+}
+
+// Counts a group the filter decided
+func (f *AuditFilter) hit() {
+	if f.hits != nil {
+		f.hits.Inc()
+	}
+}
+
+// The syscall the filter is grouped under, an inverted filter matches the groups of every other syscall so it is
+// grouped with the filters for any syscall
+// A filter with no syscall that only tests message types and regexes keeps the meaning filters always had and only
+// matches groups without a syscall, unless AnySyscall is set. Any other condition makes it match every syscall
+func (f *AuditFilter) bucket() string {
+	if f.Invert {
+		return ""
+	}
+
+	if f.Syscall == "" && !f.AnySyscall && f.messagesOnly() {
+		return NO_SYSCALL
+	}
+
+	return f.Syscall
+}
+
+// True when the filter only looks at the data and types of the messages in a group
+func (f *AuditFilter) messagesOnly() bool {
+	return f.Uid == "" &&
+		f.Auid == "" &&
+		f.Key == "" &&
+		f.Exe == "" &&
+		f.ExeRegex == nil &&
+		f.Comm == "" &&
+		f.CommRegex == nil &&
+		f.Success == "" &&
+		f.Arch == "" &&
+		f.Tty == "" &&
+		f.Pid == nil &&
+		f.Ppid == nil &&
+		len(f.Fields) == 0 &&
+		len(f.HasFields) == 0 &&
+		len(f.MissingFields) == 0
+}
+
+// Describes the conditions of the filter, for logging
+func (f *AuditFilter) String() string {
+	if f.Invert {
+		inverted := *f
+		inverted.Invert = false
+		return "anything but " + inverted.String()
+	}
+
+	parts := []string{}
+	if f.AnySyscall && f.Syscall == "" {
+		parts = append(parts, "any syscall")
+	}
+
+	if f.Syscall != "" {
+		parts = append(parts, fmt.Sprintf("syscall `%s`", f.Syscall))
+	}
+
+	if f.MessageType != 0 {
+		parts = append(parts, fmt.Sprintf("message type `%d`", f.MessageType))
+	}
+
+	if regexes := f.regexes(); len(regexes) == 1 {
+		parts = append(parts, fmt.Sprintf("regex `%s`", regexes[0].String()))
+	} else if len(regexes) > 1 {
+		quoted := make([]string, len(regexes))
+		for i, re := range regexes {
+			quoted[i] = "`" + re.String() + "`"
+		}
+
+		combinator := "all"
+		if f.MatchAny {
+			combinator = "any"
+		}
+
+		parts = append(parts, fmt.Sprintf("%s of regexes %s", combinator, strings.Join(quoted, ", ")))
+	}
+	if f.Uid != "" {
+		parts = append(parts, fmt.Sprintf("uid `%s`", f.Uid))
+	}
+
+	if f.Auid != "" {
+		parts = append(parts, fmt.Sprintf("auid `%s`", f.Auid))
+	}
+
+	if f.Key != "" {
+		parts = append(parts, fmt.Sprintf("key `%s`", f.Key))
+	}
+
+	if f.Exe != "" {
+		parts = append(parts, fmt.Sprintf("exe `%s`", f.Exe))
+	}
+
+	if f.ExeRegex != nil {
+		parts = append(parts, fmt.Sprintf("exe regex `%s`", f.ExeRegex.String()))
+	}
+
+	if f.Comm != "" {
+		parts = append(parts, fmt.Sprintf("comm `%s`", f.Comm))
+	}
+
+	if f.CommRegex != nil {
+		parts = append(parts, fmt.Sprintf("comm regex `%s`", f.CommRegex.String()))
+	}
+
+	if f.Success != "" {
+		parts = append(parts, fmt.Sprintf("success `%s`", f.Success))
+	}
+
+	if f.Arch != "" {
+		parts = append(parts, fmt.Sprintf("arch `%s`", f.Arch))
+	}
+
+	if f.Tty != "" {
+		parts = append(parts, fmt.Sprintf("tty `%s`", f.Tty))
+	}
+
+	if f.Pid != nil {
+		parts = append(parts, fmt.Sprintf("pid `%s`", f.Pid))
+	}
+
+	if f.Ppid != nil {
+		parts = append(parts, fmt.Sprintf("ppid `%s`", f.Ppid))
+	}
+
+	for _, ff := range f.Fields {
+		if ff.Regex != nil {
+			parts = append(parts, fmt.Sprintf("%s regex `%s`", ff.Name, ff.Regex.String()))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s `%s`", ff.Name, ff.Value))
+		}
+	}
+
+	for _, name := range f.HasFields {
+		parts = append(parts, fmt.Sprintf("has field `%s`", name))
+	}
+
+	for _, name := range f.MissingFields {
+		parts = append(parts, fmt.Sprintf("missing field `%s`", name))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Checks if a message group satisfies every condition of the filter, or fails at least one if the filter is inverted
+func (f *AuditFilter) Matches(msg *AuditMessageGroup) bool {
+	return f.matches(msg) != f.Invert
+}
+
+func (f *AuditFilter) matches(msg *AuditMessageGroup) bool {
+	if f.Syscall != "" && f.Syscall != msg.Syscall {
+		return false
+	}
+
+	if f.Uid != "" {
+		if uid, ok := msg.Field("uid"); !ok || uid != f.Uid {
+			return false
+		}
+	}
+
+	if f.Auid != "" {
+		if auid, ok := msg.Field("auid"); !ok || auid != f.Auid {
+			return false
+		}
+	}
+
+	if f.Key != "" && !f.hasKey(msg) {
+		return false
+	}
+
+	if !matchesField(msg, "exe", f.Exe, f.ExeRegex) || !matchesField(msg, "comm", f.Comm, f.CommRegex) {
+		return false
+	}
+
+	if f.Success != "" && !f.matchesSuccess(msg) {
+		return false
+	}
+
+	if f.Arch != "" && !f.matchesArch(msg) {
+		return false
+	}
+
+	if f.Tty != "" && !f.matchesTty(msg) {
+		return false
+	}
+
+	if (f.Pid != nil && !matchesPid(msg, "pid", f.Pid)) || (f.Ppid != nil && !matchesPid(msg, "ppid", f.Ppid)) {
+		return false
+	}
+
+	for _, ff := range f.Fields {
+		if !matchesField(msg, ff.Name, ff.Value, ff.Regex) {
+			return false
+		}
+	}
+
+	for _, name := range f.HasFields {
+		if _, ok := msg.Field(name); !ok {
+			return false
+		}
+	}
+
+	for _, name := range f.MissingFields {
+		if _, ok := msg.Field(name); ok {
+			return false
+		}
+	}
+
+	regexes := f.regexes()
+	if len(regexes) == 0 {
+		return f.MessageType == 0 || f.matchesMessage(msg, nil)
+	}
+
+	// Each regex may match a different message of the group
+	for _, re := range regexes {
+		matched := f.matchesMessage(msg, re)
+		if matched && f.MatchAny {
+			return true
+		}
+
+		if !matched && !f.MatchAny {
+			return false
+		}
+	}
+
+	return !f.MatchAny
+}
+
+// Looks for a message of the right type with data matching the regex, a nil regex matches any data
+func (f *AuditFilter) matchesMessage(msg *AuditMessageGroup, re *regexp.Regexp) bool {
+	for _, m := range msg.Msgs {
+		if f.MessageType != 0 && m.Type != f.MessageType {
+			continue
+		}
+
+		if re == nil || re.MatchString(m.Data) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fields the kernel logs quoted, or hex encoded when they contain special characters, so an unquoted value is
+// always hex. Every other field is matched as logged, decoding would turn a uid like 1000 into garbage
+var textFields = map[string]bool{"exe": true, "comm": true, "name": true, "cwd": true, "proctitle": true}
+
+// Checks a field of the group against an exact value and a regex, either one may be unset
+// Text fields are decoded first when hex encoded
+func matchesField(msg *AuditMessageGroup, name, exact string, re *regexp.Regexp) bool {
+	if exact == "" && re == nil {
+		return true
+	}
+
+	field := msg.Field
+	if textFields[name] {
+		field = msg.TextField
+	}
+
+	v, ok := field(name)
 	if !ok {
 		return false
 	}
 
-	for _, msg := range msg.Msgs {
-		if fg, ok := filters[msg.Type]; ok {
-			for _, filter := range fg {
-				if filter.MatchString(msg.Data) {
-					return true
-				}
-			}
+	return (exact == "" || v == exact) && (re == nil || re.MatchString(v))
+}
+
+// Checks the `success` of the syscall record, groups without one never match
+func (f *AuditFilter) matchesSuccess(msg *AuditMessageGroup) bool {
+	for _, m := range msg.Msgs {
+		if m.Type == EVENT_SYSCALL {
+			return m.Fields()["success"] == f.Success
+		}
+	}
+
+	return false
+}
+
+// Checks the `arch` of the syscall record, groups without one never match
+// b64 and b32 match any 64 or 32 bit architecture, the kernel flags 64 bit ones with __AUDIT_ARCH_64BIT
+func (f *AuditFilter) matchesArch(msg *AuditMessageGroup) bool {
+	for _, m := range msg.Msgs {
+		if m.Type != EVENT_SYSCALL {
+			continue
+		}
+
+		arch := strings.ToLower(m.Fields()["arch"])
+		if f.Arch != "b64" && f.Arch != "b32" {
+			return arch == f.Arch
+		}
+
+		v, err := strconv.ParseUint(arch, 16, 32)
+		if err != nil {
+			return false
+		}
+
+		return (v&AUDIT_ARCH_64BIT != 0) == (f.Arch == "b64")
+	}
+
+	return false
+}
+
+// Checks the `tty` of the syscall record, groups without one never match
+func (f *AuditFilter) matchesTty(msg *AuditMessageGroup) bool {
+	for _, m := range msg.Msgs {
+		if m.Type == EVENT_SYSCALL {
+			return m.Fields()["tty"] == f.Tty
+		}
+	}
+
+	return false
+}
+
+// Every regex the filter has
+func (f *AuditFilter) regexes() []*regexp.Regexp {
+	if f.Regex == nil {
+		return f.Regexes
+	}
+
+	return append([]*regexp.Regexp{f.Regex}, f.Regexes...)
+}
+
+func (f *AuditFilter) hasKey(msg *AuditMessageGroup) bool {
+	for _, k := range msg.Keys() {
+		if k == f.Key {
+			return true
 		}
 	}
 
@@ -166,12 +1226,15 @@ func (a *AuditMarshaller) detectMissing(seq int) {
 				a.worstLag = lag
 			}
 
+			metrics.OutOfOrder.Inc()
+
 			if a.logOutOfOrder {
 				logger.Err("Got sequence %d after %d messages.  Worst lag so far %d messages", missedSeq, lag, a.worstLag)
 			}
 			delete(a.missed, missedSeq)
 		} else if seq-missedSeq > a.maxOutOfOrder {
 			logger.Err("Likely missed sequence %d, current %d, worst message delay %d\n", missedSeq, seq, a.worstLag)
+			metrics.Missed.Inc()
 			delete(a.missed, missedSeq)
 		}
 	}
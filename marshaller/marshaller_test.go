@@ -2,11 +2,23 @@ package marshaller
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
 	"github.com/stretchr/testify/assert"
+	"log"
+	"math"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+	. "github.com/Xeralux/go-audit/parser"
+	. "github.com/Xeralux/go-audit/writer"
 )
 
 func TestMarshallerConstants(t *testing.T) {
@@ -17,7 +29,7 @@ func TestMarshallerConstants(t *testing.T) {
 
 func TestAuditMarshaller_Consume(t *testing.T) {
 	w := &bytes.Buffer{}
-	m := NewAuditMarshaller(NewAuditWriter(w, 1), false, false, 0, []AuditFilter{})
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
 
 	// Flush group on 1320
 	m.Consume(&syscall.NetlinkMessage{
@@ -120,12 +132,1469 @@ func TestAuditMarshaller_Consume(t *testing.T) {
 	assert.Equal(t, 0, len(m.msgs))
 }
 
+func TestAuditMarshaller_multipleWriters(t *testing.T) {
+	lb, elb := hookLogger()
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&FailWriter{}, 1), NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:   uint32(44),
+			Type:  uint16(1300),
+			Flags: uint16(0),
+			Seq:   uint32(0),
+			Pid:   uint32(0),
+		},
+		Data: []byte("audit(10000001:1): hi there"),
+	})
+
+	// A failing writer must not prevent delivery to the others
+	m.Consume(new1320("1"))
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{}}\n", w.String())
+	assert.Equal(t, "", lb.String())
+	assert.Contains(t, elb.String(), "Failed to write message to output #1. Error: derp\n")
+	assert.Equal(t, 0, len(m.msgs))
+}
+
+func TestAuditMarshaller_metrics(t *testing.T) {
+	received := metrics.EventsReceived.Value()
+	filtered := metrics.EventsFiltered.Value()
+	written := metrics.EventsWritten.With("test").Value()
+
+	aw := NewAuditWriter(&bytes.Buffer{}, 1)
+	aw.SetName("test")
+	m := NewAuditMarshaller(
+		[]*AuditWriter{aw},
+		false,
+		false,
+		0,
+		[]AuditFilter{{MessageType: 1300, Syscall: "1", Regex: regexp.MustCompile("drop")}},
+		nil,
+	)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): syscall=1 keep"),
+	})
+	m.Consume(new1320("1"))
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:2): syscall=1 drop"),
+	})
+	m.Consume(new1320("2"))
+
+	assert.Equal(t, received+4, metrics.EventsReceived.Value())
+	assert.Equal(t, filtered+1, metrics.EventsFiltered.Value())
+	assert.Equal(t, written+1, metrics.EventsWritten.With("test").Value())
+}
+
+func TestAuditMarshaller_dropMessage(t *testing.T) {
+	m := NewAuditMarshaller(
+		[]*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)},
+		false,
+		false,
+		0,
+		[]AuditFilter{
+			{Syscall: "2", Uid: "0", MessageType: 1300, Regex: regexp.MustCompile("noisy")},
+			{Auid: "1000"},
+			{Key: "noisy-key"},
+		},
+		nil,
+	)
+
+	group := func(data string) *AuditMessageGroup {
+		return NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: data, Seq: 1})
+	}
+
+	// every condition has to match
+	assert.True(t, m.dropMessage(group("syscall=2 uid=0 auid=4294967295 noisy")))
+	assert.False(t, m.dropMessage(group("syscall=2 uid=1 auid=4294967295 noisy")))
+	assert.False(t, m.dropMessage(group("syscall=2 uid=0 auid=4294967295 quiet")))
+	assert.False(t, m.dropMessage(group("syscall=3 uid=0 auid=4294967295 noisy")))
+
+	// filters without a syscall apply to all of them
+	assert.True(t, m.dropMessage(group("syscall=59 uid=0 auid=1000")))
+	assert.True(t, m.dropMessage(group("syscall=2 uid=0 auid=1000")))
+	assert.False(t, m.dropMessage(group("syscall=59 uid=1000 auid=0")))
+
+	// rule keys
+	assert.True(t, m.dropMessage(group("syscall=59 uid=1000 auid=0 key=\"noisy-key\"")))
+	assert.False(t, m.dropMessage(group("syscall=59 uid=1000 auid=0 key=\"quiet-key\"")))
+}
+
+func TestAuditMarshaller_dropMessage_noSyscall(t *testing.T) {
+	m := NewAuditMarshaller(
+		[]*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)},
+		false,
+		false,
+		0,
+		[]AuditFilter{
+			{MessageType: 1305, Regex: regexp.MustCompile("noisy")},
+			{Regex: regexp.MustCompile("everywhere"), AnySyscall: true},
+		},
+		nil,
+	)
+
+	group := func(t uint16, data string) *AuditMessageGroup {
+		return NewAuditMessageGroup(&AuditMessage{Type: t, Data: data, Seq: 1})
+	}
+
+	// filters with only a message type and regex keep to groups without a syscall
+	assert.True(t, m.dropMessage(group(1305, "op=set noisy")))
+	amg := group(1300, "syscall=2")
+	amg.AddMessage(&AuditMessage{Type: 1305, Data: "op=set noisy", Seq: 1})
+	assert.False(t, m.dropMessage(amg))
+
+	// unless they ask for any syscall
+	assert.True(t, m.dropMessage(group(1300, "syscall=2 everywhere")))
+	assert.True(t, m.dropMessage(group(1305, "op=set everywhere")))
+	f := AuditFilter{Regex: regexp.MustCompile("everywhere"), AnySyscall: true}
+	assert.Equal(t, "any syscall, regex `everywhere`", f.String())
+}
+
+func TestAuditFilter_Matches_regexes(t *testing.T) {
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 exe=\"/usr/bin/backup\"", Seq: 1})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: "item=0 name=\"/var/backups/a\"", Seq: 1})
+
+	all := AuditFilter{Regexes: []*regexp.Regexp{regexp.MustCompile("backup\""), regexp.MustCompile("/var/backups/")}}
+	assert.True(t, all.Matches(amg), "each regex may match a different message")
+	assert.Equal(t, "all of regexes `backup\"`, `/var/backups/`", all.String())
+
+	all.Regex = regexp.MustCompile("nope")
+	assert.False(t, all.Matches(amg), "Regex has to match along with the rest")
+
+	either := AuditFilter{Regexes: []*regexp.Regexp{regexp.MustCompile("nope"), regexp.MustCompile("/var/backups/")}, MatchAny: true}
+	assert.True(t, either.Matches(amg))
+	assert.Equal(t, "any of regexes `nope`, `/var/backups/`", either.String())
+
+	either.MessageType = 1300
+	assert.False(t, either.Matches(amg), "only messages of the type are tested")
+
+	single := AuditFilter{Regexes: []*regexp.Regexp{regexp.MustCompile("exe=")}}
+	assert.True(t, single.Matches(amg))
+	assert.Equal(t, "regex `exe=`", single.String())
+}
+
+func TestAuditFilter_Matches_process(t *testing.T) {
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 comm=\"collectd\" exe=\"/usr/sbin/collectd\"", Seq: 1})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: "item=0 name=\"/usr/bin/other\"", Seq: 1})
+	other := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 comm=\"cat\" exe=\"/usr/bin/cat\"", Seq: 2})
+	other.AddMessage(&AuditMessage{Type: 1302, Data: "item=0 name=\"/usr/sbin/collectd\"", Seq: 2})
+
+	exe := AuditFilter{Exe: "/usr/sbin/collectd"}
+	assert.True(t, exe.Matches(amg))
+	assert.False(t, exe.Matches(other), "only the exe field is tested, not the whole event")
+	assert.Equal(t, "exe `/usr/sbin/collectd`", exe.String())
+
+	comm := AuditFilter{CommRegex: regexp.MustCompile("^collect")}
+	assert.True(t, comm.Matches(amg))
+	assert.False(t, comm.Matches(other))
+	assert.Equal(t, "comm regex `^collect`", comm.String())
+
+	both := AuditFilter{ExeRegex: regexp.MustCompile("^/usr/sbin/"), Comm: "cat"}
+	assert.False(t, both.Matches(amg), "every part has to match")
+	assert.False(t, both.Matches(other))
+
+	missing := AuditFilter{Exe: "/usr/sbin/collectd"}
+	assert.False(t, missing.Matches(NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59", Seq: 3})))
+}
+
+func TestAuditFilter_Matches_fields(t *testing.T) {
+	cron := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 ppid=1 pid=812 tty=(none) exe=\"/usr/sbin/cron\"", Seq: 1})
+	cron.AddMessage(&AuditMessage{Type: 1302, Data: "item=0 name=\"/usr/sbin/cron\" ogid=0", Seq: 1})
+	shell := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 ppid=2231 pid=2240 tty=pts0 exe=\"/usr/bin/bash\"", Seq: 2})
+
+	f := AuditFilter{Fields: []FieldFilter{{Name: "exe", Value: "/usr/sbin/cron"}, {Name: "ppid", Value: "1"}}}
+	assert.True(t, f.Matches(cron))
+	assert.False(t, f.Matches(shell))
+	assert.Equal(t, "exe `/usr/sbin/cron`, ppid `1`", f.String())
+
+	// fields of any record of the group can be used
+	f = AuditFilter{Fields: []FieldFilter{{Name: "ogid", Value: "0"}}}
+	assert.True(t, f.Matches(cron))
+
+	f = AuditFilter{Fields: []FieldFilter{{Name: "tty", Regex: regexp.MustCompile("^pts")}}}
+	assert.False(t, f.Matches(cron))
+	assert.True(t, f.Matches(shell))
+	assert.Equal(t, "tty regex `^pts`", f.String())
+
+	// a missing field never matches
+	f = AuditFilter{Fields: []FieldFilter{{Name: "cwd", Regex: regexp.MustCompile(".*")}}}
+	assert.False(t, f.Matches(cron))
+
+	// numbers are matched as logged, even ones that look like hex
+	user := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 ppid=12 pid=40 uid=1000 comm=6C73202D6C", Seq: 3})
+	for _, ff := range []FieldFilter{{Name: "uid", Value: "1000"}, {Name: "ppid", Value: "12"}, {Name: "syscall", Value: "59"}} {
+		f = AuditFilter{Fields: []FieldFilter{ff}}
+		assert.True(t, f.Matches(user), ff.Name)
+	}
+
+	// text fields are decoded when hex encoded
+	f = AuditFilter{Fields: []FieldFilter{{Name: "comm", Value: "ls -l"}}}
+	assert.True(t, f.Matches(user))
+}
+
+func TestAuditFilter_Matches_success(t *testing.T) {
+	failed := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=257 success=no exit=-13", Seq: 1})
+	failed.AddMessage(&AuditMessage{Type: 1302, Data: "item=0 name=\"/etc/shadow\" success=yes", Seq: 1})
+	succeeded := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=257 success=yes exit=3", Seq: 2})
+
+	f := AuditFilter{Syscall: "257", Success: "yes"}
+	failed.Syscall, succeeded.Syscall = "257", "257"
+	assert.False(t, f.Matches(failed), "only the syscall record is tested")
+	assert.True(t, f.Matches(succeeded))
+	assert.Equal(t, "syscall `257`, success `yes`", f.String())
+
+	f.Success = "no"
+	assert.True(t, f.Matches(failed))
+	assert.False(t, f.Matches(succeeded))
+
+	// events without a syscall record never match
+	assert.False(t, f.Matches(NewAuditMessageGroup(&AuditMessage{Type: 1305, Data: "op=add_rule success=no", Seq: 3})))
+}
+
+func TestAuditFilter_Matches_arch(t *testing.T) {
+	native := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=c000003e syscall=2 success=yes", Seq: 1})
+	compat := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=40000003 syscall=5 success=yes", Seq: 2})
+	compat.AddMessage(&AuditMessage{Type: 1302, Data: "item=0 arch=c000003e", Seq: 2})
+
+	f := AuditFilter{Arch: "b32"}
+	assert.False(t, f.Matches(native))
+	assert.True(t, f.Matches(compat), "only the syscall record is tested")
+	assert.Equal(t, "arch `b32`", f.String())
+
+	f.Arch = "b64"
+	assert.True(t, f.Matches(native))
+	assert.False(t, f.Matches(compat))
+
+	f.Arch = "40000003"
+	assert.False(t, f.Matches(native))
+	assert.True(t, f.Matches(compat))
+
+	// events without a syscall record never match
+	assert.False(t, f.Matches(NewAuditMessageGroup(&AuditMessage{Type: 1305, Data: "arch=40000003", Seq: 3})))
+}
+
+func TestAuditFilter_Matches_tty(t *testing.T) {
+	shell := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 tty=pts0 ses=2", Seq: 1})
+	daemon := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 tty=(none) ses=4294967295", Seq: 2})
+	daemon.AddMessage(&AuditMessage{Type: 1309, Data: "argc=1 a0=\"tty=pts0\"", Seq: 2})
+
+	f := AuditFilter{Tty: TTY_NONE}
+	assert.False(t, f.Matches(shell))
+	assert.True(t, f.Matches(daemon), "only the syscall record is tested")
+	assert.Equal(t, "tty `(none)`", f.String())
+
+	f.Tty = "pts0"
+	assert.True(t, f.Matches(shell))
+	assert.False(t, f.Matches(daemon))
+
+	// anything with a real tty
+	f = AuditFilter{Tty: TTY_NONE, Invert: true}
+	assert.True(t, f.Matches(shell))
+	assert.False(t, f.Matches(daemon))
+
+	// events without a syscall record never match
+	f = AuditFilter{Tty: "pts0"}
+	assert.False(t, f.Matches(NewAuditMessageGroup(&AuditMessage{Type: 1112, Data: "tty=pts0", Seq: 3})))
+	assert.False(t, f.signatureOnly())
+}
+
+func TestAuditFilter_Matches_pid(t *testing.T) {
+	kernel := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=c000003e syscall=2 ppid=2 pid=45", Seq: 1})
+	daemon := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=c000003e syscall=2 ppid=1 pid=812", Seq: 2})
+	daemon.AddMessage(&AuditMessage{Type: 1309, Data: "argc=1 pid=3", Seq: 2})
+
+	pid, _ := ParsePidRange("<100")
+	f := AuditFilter{Pid: pid}
+	assert.True(t, f.Matches(kernel))
+	assert.False(t, f.Matches(daemon), "only the syscall record is tested")
+	assert.Equal(t, "pid `<=99`", f.String())
+
+	ppid, _ := ParsePidRange("1")
+	f = AuditFilter{Ppid: ppid}
+	assert.False(t, f.Matches(kernel))
+	assert.True(t, f.Matches(daemon))
+	assert.Equal(t, "ppid `1`", f.String())
+
+	// both have to match
+	f.Pid, _ = ParsePidRange("800-900")
+	assert.True(t, f.Matches(daemon))
+	f.Pid, _ = ParsePidRange(">900")
+	assert.False(t, f.Matches(daemon))
+
+	// events without a syscall record never match
+	assert.False(t, f.Matches(NewAuditMessageGroup(&AuditMessage{Type: 1305, Data: "ppid=1 pid=1000", Seq: 3})))
+}
+
+func TestParsePidRange(t *testing.T) {
+	for s, expected := range map[string]PidRange{
+		"1":          {Min: 1, Max: 1},
+		" 42 ":       {Min: 42, Max: 42},
+		"<100":       {Min: 0, Max: 99},
+		"<=100":      {Min: 0, Max: 100},
+		">1000":      {Min: 1001, Max: math.MaxUint64},
+		">=1000":     {Min: 1000, Max: math.MaxUint64},
+		"300-400":    {Min: 300, Max: 400},
+		"300 - 400":  {Min: 300, Max: 400},
+		"4194304":    {Min: 4194304, Max: 4194304},
+		"<= 4194304": {Min: 0, Max: 4194304},
+	} {
+		r, err := ParsePidRange(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, &expected, r, s)
+	}
+
+	assert.Equal(t, "1", (&PidRange{Min: 1, Max: 1}).String())
+	assert.Equal(t, "<=99", (&PidRange{Max: 99}).String())
+	assert.Equal(t, ">=1001", (&PidRange{Min: 1001, Max: math.MaxUint64}).String())
+	assert.Equal(t, "300-400", (&PidRange{Min: 300, Max: 400}).String())
+
+	for _, s := range []string{"", "nope", "-1", "<0", ">", "400-300", "1-", "<<1", "99999999999"} {
+		_, err := ParsePidRange(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestAuditMarshaller_SetFilters(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{{Syscall: "2"}}, nil)
+
+	m.SetFilters([]AuditFilter{{Syscall: "59", Include: true}})
+	assert.Equal(t, 0, len(m.filters))
+	assert.Equal(t, 1, len(m.includes["59"]))
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): syscall=59"),
+	})
+	m.Consume(new1320("1"))
+	assert.Contains(t, w.String(), "syscall=59")
+}
+
+func TestAuditMarshaller_Heartbeat(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{{Syscall: "2"}}, nil)
+	m.SetFields(map[string]string{"host": "box"})
+
+	// filtered events are counted too
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): syscall=2"),
+	})
+	m.Consume(new1320("1"))
+	assert.Equal(t, "", w.String())
+
+	started := time.Unix(10000000, 0)
+	lost := uint32(3)
+	hb := NewHeartbeat(started, started.Add(90*time.Second+250*time.Millisecond))
+	hb.KernelLost = &lost
+	m.Heartbeat(hb)
+	assert.Equal(t, "{\"type\":\"heartbeat\",\"timestamp\":\"10000090.250\",\"uptime_seconds\":90,\"events_processed\":1,\"kernel_lost\":3,\"fields\":{\"host\":\"box\"}}\n", w.String())
+
+	// the count starts over
+	w.Reset()
+	m.Heartbeat(NewHeartbeat(started, started))
+	assert.Contains(t, w.String(), "\"events_processed\":0")
+
+	// the same timestamp format as events
+	w.Reset()
+	m.SetParseTimestamp(true)
+	m.Heartbeat(NewHeartbeat(started, started.Add(250*time.Millisecond)))
+	assert.Contains(t, w.String(), "\"timestamp\":\"1970-04-26T17:46:40.250Z\"")
+
+	// nothing is written once closed
+	assert.Nil(t, m.Close())
+	w.Reset()
+	m.Heartbeat(NewHeartbeat(started, started))
+	assert.Equal(t, "", w.String())
+}
+
+func TestAuditMarshaller_Alert(t *testing.T) {
+	w := &bytes.Buffer{}
+	routed := NewAuditWriter(w, 1)
+	routed.SetMessageTypes([]uint16{1307}, nil)
+	m := NewAuditMarshaller([]*AuditWriter{routed}, false, false, 0, []AuditFilter{}, nil)
+
+	limit := uint32(50)
+	alert := NewAlert("sustained_rate", "crit", "too much", time.Unix(10000000, 250*int64(time.Millisecond)))
+	alert.EventsPerSecond = 900
+	alert.KernelRateLimit = &limit
+
+	// routing does not apply
+	m.Alert(alert)
+	assert.Equal(
+		t,
+		"{\"type\":\"alert\",\"timestamp\":\"10000000.250\",\"alert\":\"sustained_rate\",\"severity\":\"crit\",\"message\":\"too much\",\"events_per_second\":900,\"kernel_rate_limit\":50}\n",
+		w.String(),
+	)
+
+	// nothing is written once closed
+	assert.Nil(t, m.Close())
+	w.Reset()
+	m.Alert(NewAlert("sustained_rate", "info", "calm", time.Now()))
+	assert.Equal(t, "", w.String())
+}
+
+func TestAuditMarshaller_SelfTest(t *testing.T) {
+	w := &bytes.Buffer{}
+	routed := NewAuditWriter(&bytes.Buffer{}, 1)
+	routed.SetMessageTypes([]uint16{1307}, nil)
+	writers := []*AuditWriter{NewAuditWriter(w, 1), NewAuditWriter(&FailWriter{}, 1), routed}
+	m := NewAuditMarshaller(writers, false, false, 0, []AuditFilter{}, nil)
+	m.SetFields(map[string]string{"host": "box"})
+
+	// transformed and written like any event, routing applies
+	failed, err := m.SelfTest(NewSelfTestEvent(time.Unix(10000000, 0)))
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]error{1: errors.New("derp")}, failed)
+	assert.Contains(t, w.String(), "\"timestamp\":\"10000000.000\"")
+	assert.Contains(t, w.String(), "key=\\\"go-audit-selftest\\\"")
+	assert.Contains(t, w.String(), "\"fields\":{\"host\":\"box\"}")
+	assert.Equal(t, "", routed.Writer().(*bytes.Buffer).String())
+
+	// buffered outputs are flushed
+	w.Reset()
+	m = NewAuditMarshaller([]*AuditWriter{NewAuditWriter(NewBufferedWriter(w, 1<<20, 0), 1)}, false, false, 0, []AuditFilter{}, nil)
+	failed, err = m.SelfTest(NewSelfTestEvent(time.Now()))
+	assert.Nil(t, err)
+	assert.Empty(t, failed)
+	assert.Contains(t, w.String(), "go-audit-selftest")
+
+	// the filters apply
+	w.Reset()
+	m = NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{{Key: SELFTEST_KEY}}, nil)
+	_, err = m.SelfTest(NewSelfTestEvent(time.Now()))
+	assert.Equal(t, ErrSelfTestFiltered, err)
+	assert.Equal(t, "", w.String())
+}
+
+func TestAuditMarshaller_completionTimeout(t *testing.T) {
+	lb, elb := hookLogger()
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetCompletionTimeout(time.Millisecond*10, false)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+
+	// The sweeper writes the event without needing another message
+	m.Sweep(time.Millisecond * 5)
+	time.Sleep(time.Millisecond * 50)
+
+	m.lock.Lock()
+	assert.Equal(t, 0, len(m.msgs))
+	m.lock.Unlock()
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{}}\n", w.String())
+
+	// Incomplete events can be dropped instead
+	m.SetCompletionTimeout(time.Millisecond*10, true)
+	w.Reset()
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:2): hi there"),
+	})
+	time.Sleep(time.Millisecond * 50)
+
+	m.lock.Lock()
+	assert.Equal(t, 0, len(m.msgs))
+	m.lock.Unlock()
+	assert.Equal(t, "", w.String())
+	assert.Equal(t, "", lb.String())
+	assert.Equal(t, "Dropping incomplete event 2 after waiting 10ms for the rest of it\n", elb.String())
+}
+
+func TestAuditMarshaller_InFlight(t *testing.T) {
+	lb, _ := hookLogger()
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)}, false, false, 0, []AuditFilter{}, nil)
+	n, oldest := m.InFlight()
+	assert.Equal(t, 0, n)
+	assert.True(t, oldest.IsZero())
+
+	before := time.Now()
+	for _, data := range []string{"audit(10000001:1): hi there", "audit(10000001:2): hi there", "audit(10000001:1): again"} {
+		m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1300)}, Data: []byte(data)})
+	}
+
+	n, oldest = m.InFlight()
+	assert.Equal(t, 2, n)
+	assert.False(t, oldest.Before(before))
+	assert.Equal(t, uint64(2), metrics.InFlight.Value())
+
+	// one tick at a time, logInFlight returns once the ticks run out
+	tick := func() {
+		ticks := make(chan time.Time, 1)
+		ticks <- time.Now()
+		close(ticks)
+		m.logInFlight(ticks)
+	}
+
+	tick()
+	assert.Contains(t, lb.String(), "2 events in flight, the oldest received ")
+
+	// completing an event drains it
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(EVENT_EOE)}, Data: []byte("audit(10000001:1): ")})
+	n, _ = m.InFlight()
+	assert.Equal(t, 1, n)
+	assert.Equal(t, uint64(1), metrics.InFlight.Value())
+
+	// closing writes out the rest and stops the log
+	assert.Nil(t, m.Close())
+	lb.Reset()
+	tick()
+	assert.Equal(t, "", lb.String())
+}
+
+func TestAuditMarshaller_Close(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+	assert.Equal(t, "", w.String())
+
+	// Pending events are written out on close
+	assert.Nil(t, m.Close())
+	assert.Equal(t, 0, len(m.msgs))
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{}}\n", w.String())
+
+	// Nothing is consumed once closed
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:2): hi there"),
+	})
+	assert.Equal(t, 0, len(m.msgs))
+	assert.Nil(t, m.Close())
+}
+
+func TestAuditMarshaller_SetRateLimit(t *testing.T) {
+	_, elb := hookLogger()
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetRateLimit(1)
+
+	for _, seq := range []string{"1", "2", "3"} {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(10000001:" + seq + "): hi there"),
+		})
+		m.Consume(new1320(seq))
+	}
+
+	// Only the first event fits in the limit, the rest are dropped and reported
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{}}\n", w.String())
+	assert.Equal(t, 0, len(m.msgs))
+	assert.Contains(t, elb.String(), "Dropped ")
+
+	// Disabled again
+	m.SetRateLimit(0)
+	assert.Nil(t, m.limiter)
+}
+
+func TestAuditMarshaller_SetDedupeWindow(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetDedupeWindow(time.Minute)
+
+	now := time.Now()
+	m.deduper.now = func() time.Time { return now }
+
+	for i, data := range []string{"hi there", "hi there", "something else", "hi there"} {
+		seq := strconv.Itoa(i + 1)
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(1000000" + seq + ":" + seq + "): " + data),
+		})
+		m.Consume(new1320(seq))
+	}
+
+	// Repeats are held back, even with a different timestamp and sequence
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{}}\n"+
+			"{\"sequence\":3,\"timestamp\":\"10000003\",\"messages\":[{\"type\":1300,\"data\":\"something else\"}],\"uid_map\":{}}\n",
+		w.String(),
+	)
+
+	// Once the window closes the last repeat is written with the count
+	w.Reset()
+	now = now.Add(time.Minute)
+	m.flushOld()
+	assert.Equal(
+		t,
+		"{\"sequence\":4,\"timestamp\":\"10000004\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"repeat_count\":2}\n",
+		w.String(),
+	)
+	assert.Equal(t, 0, len(m.deduper.seen))
+
+	// Disabled again
+	m.SetDedupeWindow(0)
+	assert.Nil(t, m.deduper)
+}
+
+func TestAuditMarshaller_SetMaxAge(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetMaxAge(time.Minute)
+
+	before := metrics.TooOld.Value()
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10) + ".000"
+	fresh := strconv.FormatInt(time.Now().Unix(), 10) + ".000"
+
+	for i, ts := range []string{stale, fresh} {
+		seq := strconv.Itoa(i + 1)
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(" + ts + ":" + seq + "): hi there"),
+		})
+		m.Consume(new1320(seq))
+	}
+
+	assert.Equal(t, "{\"sequence\":2,\"timestamp\":\""+fresh+"\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{}}\n", w.String())
+	assert.Equal(t, before+1, metrics.TooOld.Value())
+}
+
+func TestAuditMarshaller_SetMaxEventBytes(t *testing.T) {
+	_, elb := hookLogger()
+	defer hookLogger()
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetMaxEventBytes(200, false)
+	before := metrics.Oversized.Value()
+
+	// A huge argv, the execve record is cut short and the path record after it is thrown away
+	execve := "argc=2 a0=\"rm\" a1=\"" + strings.Repeat("A", 1<<20) + "\""
+	consume := func(seq string) {
+		for _, msg := range []struct {
+			t    uint16
+			data string
+		}{{1300, "syscall=59 exit=0"}, {1309, execve}, {1302, "item=0 name=\"/bin/rm\""}} {
+			m.Consume(&syscall.NetlinkMessage{
+				Header: syscall.NlMsghdr{Type: msg.t},
+				Data:   []byte("audit(10000001:" + seq + "): " + msg.data),
+			})
+		}
+	}
+
+	consume("1")
+	assert.Equal(t, 200, m.msgs[1].Size)
+	m.Consume(new1320("1"))
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"syscall=59 exit=0\"},{\"type\":1309,\"data\":\"argc=2 a0=\\\"rm\\\" a1=\\\""+strings.Repeat("A", 33)+"\"}],\"uid_map\":{},\"truncated\":true}\n",
+		w.String(),
+	)
+	assert.Equal(t, before+1, metrics.Oversized.Value())
+
+	// Dropped events are freed as soon as they go over and the rest of their messages are ignored
+	w.Reset()
+	m.SetMaxEventBytes(200, true)
+	consume("2")
+	assert.Nil(t, m.msgs[2].Msgs)
+	m.Consume(new1320("2"))
+	assert.Equal(t, "", w.String())
+	assert.Equal(t, 0, len(m.msgs))
+	assert.Contains(t, elb.String(), "Dropping event 2, it is over message_tracking.max_event_bytes of 200 bytes")
+
+	// The assembled event is checked too, extra fields go first
+	m.SetMaxEventBytes(140, false)
+	m.SetReassembleExecve(true)
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1309}, Data: []byte("audit(10000001:3): argc=2 a0=\"ls\" a1=\"/tmp\"")})
+	m.Consume(new1320("3"))
+	assert.Equal(
+		t,
+		"{\"sequence\":3,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1309,\"data\":\"argc=2 a0=\\\"ls\\\" a1=\\\"/tmp\\\"\"}],\"uid_map\":{},\"truncated\":true}\n",
+		w.String(),
+	)
+
+	// and it is dropped when that is not enough
+	w.Reset()
+	m.SetMaxEventBytes(60, false)
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1309}, Data: []byte("audit(10000001:4): argc=2 a0=\"ls\" a1=\"/tmp\"")})
+	m.Consume(new1320("4"))
+	assert.Equal(t, "", w.String())
+	assert.Contains(t, elb.String(), "Dropping event 4, it is over message_tracking.max_event_bytes of 60 bytes once assembled")
+}
+
+func TestAuditMarshaller_SetParseTimestamp(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetParseTimestamp(true)
+
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(1516650001.123:4567): syscall=59")})
+	m.Consume(new1320("4567"))
+	assert.Equal(
+		t,
+		"{\"sequence\":4567,\"timestamp\":\"2018-01-22T19:40:01.123Z\",\"audit_timestamp\":\"1516650001.123\",\"serial\":4567,"+
+			"\"messages\":[{\"type\":1300,\"data\":\"syscall=59\"}],\"uid_map\":{}}\n",
+		w.String(),
+	)
+
+	// structured events too
+	w.Reset()
+	m.SetStructured(true)
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(1516650001.123:4568): syscall=59")})
+	m.Consume(new1320("4568"))
+	assert.Contains(t, w.String(), "\"timestamp\":\"2018-01-22T19:40:01.123Z\",\"audit_timestamp\":\"1516650001.123\",\"serial\":4568,")
+
+	// off by default
+	w.Reset()
+	m.SetStructured(false)
+	m.SetParseTimestamp(false)
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(1516650001.123:4569): syscall=59")})
+	m.Consume(new1320("4569"))
+	assert.Contains(t, w.String(), "\"timestamp\":\"1516650001.123\",\"messages\"")
+}
+
+func TestAuditMarshaller_SetEmitSeq(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{{Syscall: "2"}}, nil)
+	m.SetMaxEventBytes(200, true)
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	m.SetEmitSeq(true)
+	epoch := m.emitSeq.Epoch
+	assert.True(t, epoch >= before)
+
+	consume := func(seq, data string) {
+		m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + seq + "): " + data)})
+		m.Consume(new1320(seq))
+	}
+
+	// filtered and oversized events are not numbered, they leave no gap
+	consume("1", "syscall=59")
+	consume("2", "syscall=2")
+	consume("3", "syscall=59 "+strings.Repeat("a", 200))
+	consume("4", "syscall=59")
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], "\"_emit_seq\":{\"epoch\":"+strconv.FormatInt(epoch, 10)+",\"seq\":1}")
+	assert.Contains(t, lines[1], "\"sequence\":4")
+	assert.Contains(t, lines[1], "\"_emit_seq\":{\"epoch\":"+strconv.FormatInt(epoch, 10)+",\"seq\":2}")
+
+	// heartbeats carry the last number written
+	w.Reset()
+	m.Heartbeat(NewHeartbeat(time.Now(), time.Now()))
+	assert.Contains(t, w.String(), "\"_emit_seq\":{\"epoch\":"+strconv.FormatInt(epoch, 10)+",\"seq\":2}")
+
+	// off by default
+	w.Reset()
+	m.SetEmitSeq(false)
+	consume("5", "syscall=59")
+	m.Heartbeat(NewHeartbeat(time.Now(), time.Now()))
+	assert.NotContains(t, w.String(), "_emit_seq")
+}
+
+func TestAuditMarshaller_SetIntegrity(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	integrity := regexp.MustCompile(`,"_integrity":\{("prev":"([0-9a-f]*)",)?"hmac":"([0-9a-f]{64})"\}\}$`)
+
+	// Checks every line the way a collector would, returns the hmac of the last one
+	verify := func(lines []string, prev string, chain bool) string {
+		for _, line := range lines {
+			m := integrity.FindStringSubmatch(line)
+			if !assert.NotNil(t, m, line) {
+				return ""
+			}
+
+			if chain {
+				assert.Equal(t, prev, m[2])
+			} else {
+				assert.Equal(t, "", m[1])
+			}
+
+			content := strings.TrimSuffix(line, m[0]) + "}"
+			assert.Equal(t, Sign(key, m[2], []byte(content)), m[3])
+			prev = m[3]
+		}
+
+		return prev
+	}
+
+	for _, structured := range []bool{false, true} {
+		w := &bytes.Buffer{}
+		m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{{Syscall: "2"}}, nil)
+		m.SetStructured(structured)
+		m.SetEmitSeq(true)
+		m.SetIntegrity(key, true)
+
+		consume := func(seq, data string) {
+			m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + seq + "): " + data)})
+			m.Consume(new1320(seq))
+		}
+
+		// filtered events are not part of the chain, the first event has no prev
+		consume("1", "syscall=59 exe=\"/bin/<sh>\"")
+		consume("2", "syscall=2")
+		consume("3", "syscall=59")
+		lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+		assert.Equal(t, 2, len(lines))
+		assert.NotContains(t, lines[0], "\"prev\"")
+		last := verify(lines, "", true)
+
+		// heartbeats are left alone
+		w.Reset()
+		m.Heartbeat(NewHeartbeat(time.Now(), time.Now()))
+		assert.NotContains(t, w.String(), "_integrity")
+
+		// changing an event or taking one out breaks the chain
+		w.Reset()
+		consume("4", "syscall=59")
+		consume("5", "syscall=59")
+		lines = strings.Split(strings.TrimSpace(w.String()), "\n")
+		verify(lines, last, true)
+
+		tampered := strings.Replace(lines[1], "\"sequence\":5", "\"sequence\":6", 1)
+		mt := integrity.FindStringSubmatch(tampered)
+		assert.NotEqual(t, Sign(key, mt[2], []byte(strings.TrimSuffix(tampered, mt[0])+"}")), mt[3])
+		assert.NotEqual(t, last, mt[2], "without event 4 the chain is broken")
+
+		// without chaining every event is signed on its own
+		w.Reset()
+		m.SetIntegrity(key, false)
+		consume("6", "syscall=59")
+		consume("7", "syscall=59")
+		verify(strings.Split(strings.TrimSpace(w.String()), "\n"), "", false)
+
+		// off
+		w.Reset()
+		m.SetIntegrity(nil, true)
+		consume("8", "syscall=59")
+		assert.NotContains(t, w.String(), "_integrity")
+	}
+}
+
+func TestAuditMarshaller_SetIncludeRaw(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetIncludeRaw(true)
+	m.SetDecodeHex(true)
+
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:1): syscall=59")})
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1327}, Data: []byte("audit(10000001:1): proctitle=6C73")})
+	m.Consume(new1320("1"))
+
+	// the raw payload keeps the header and is left alone by transforms
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"syscall=59\"},"+
+			"{\"type\":1327,\"data\":\"proctitle=6C73\",\"extra\":{\"proctitle\":\"ls\"}}],\"uid_map\":{},"+
+			"\"_raw\":[\""+base64.StdEncoding.EncodeToString([]byte("audit(10000001:1): syscall=59"))+"\",\""+
+			base64.StdEncoding.EncodeToString([]byte("audit(10000001:1): proctitle=6C73"))+"\"]}\n",
+		w.String(),
+	)
+
+	// off by default
+	w.Reset()
+	m.SetIncludeRaw(false)
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:2): syscall=59")})
+	m.Consume(new1320("2"))
+	assert.NotContains(t, w.String(), "_raw")
+}
+
+func TestAuditMarshaller_SetJoinSplitFields(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetJoinSplitFields(true)
+	m.SetDecodeHex(true)
+
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1302}, Data: []byte("audit(10000001:1): item=0 name_len=8 name[0]=2F746D70")})
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1302}, Data: []byte("audit(10000001:1): name[1]=2F612062")})
+	m.Consume(new1320("1"))
+
+	// joined before decoding so the whole name is decoded
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1302,\"data\":\"item=0 name=2F746D702F612062\",\"extra\":{\"name\":\"/tmp/a b\"}}],\"uid_map\":{}}\n",
+		w.String(),
+	)
+}
+
+func TestAuditMarshaller_SetDeadLetter(t *testing.T) {
+	w := &bytes.Buffer{}
+	dl := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetDeadLetter(NewAuditWriter(dl, 1))
+
+	// no audit header
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("garbage")})
+
+	// no fields, the message is still part of its event
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1307}, Data: []byte("audit(10000001:1): hi there")})
+	m.Consume(new1320("1"))
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1307,\"data\":\"hi there\"}],\"uid_map\":{}}\n", w.String())
+
+	// messages that parse are left alone
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:2): syscall=59")})
+	m.Consume(new1320("2"))
+
+	lines := strings.Split(strings.TrimSpace(dl.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var letters []DeadLetter
+	for _, line := range lines {
+		var l DeadLetter
+		assert.Nil(t, json.Unmarshal([]byte(line), &l))
+		assert.NotEmpty(t, l.Time)
+		l.Time = ""
+		letters = append(letters, l)
+	}
+
+	assert.Equal(t, []DeadLetter{
+		{Type: 1300, Error: "Could not parse the audit header", Raw: []byte("garbage")},
+		{Type: 1307, Error: "No key=value fields found", Raw: []byte("audit(10000001:1): hi there")},
+	}, letters)
+}
+
+func TestAuditMarshaller_SetRequiredRecords(t *testing.T) {
+	w := &bytes.Buffer{}
+	dl := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetDeadLetter(NewAuditWriter(dl, 1))
+	m.SetRequiredRecords([]uint16{1300, 1327})
+
+	// everything is there
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:1): syscall=59")})
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1327}, Data: []byte("audit(10000001:1): proctitle=6C73")})
+	m.Consume(new1320("1"))
+	assert.Contains(t, w.String(), "\"sequence\":1")
+	assert.Equal(t, "", dl.String())
+
+	// the proctitle was lost
+	w.Reset()
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:2): syscall=59")})
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1307}, Data: []byte("audit(10000001:2): cwd=\"/\"")})
+	m.Consume(new1320("2"))
+	assert.Equal(t, "", w.String())
+
+	var letters []DeadLetter
+	for _, line := range strings.Split(strings.TrimSpace(dl.String()), "\n") {
+		var l DeadLetter
+		assert.Nil(t, json.Unmarshal([]byte(line), &l))
+		l.Time = ""
+		letters = append(letters, l)
+	}
+
+	assert.Equal(t, []DeadLetter{
+		{Type: 1300, Seq: 2, Error: "Event is missing required records PROCTITLE", Raw: []byte("audit(10000001:2): syscall=59")},
+		{Type: 1307, Seq: 2, Error: "Event is missing required records PROCTITLE", Raw: []byte("audit(10000001:2): cwd=\"/\"")},
+	}, letters)
+
+	// every missing record is named
+	dl.Reset()
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1307}, Data: []byte("audit(10000001:3): cwd=\"/\"")})
+	m.Consume(new1320("3"))
+	assert.Contains(t, dl.String(), "Event is missing required records SYSCALL, PROCTITLE")
+	assert.Equal(t, "", w.String())
+}
+
+func TestAuditMarshaller_SetDebugRing(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{{Syscall: "49", Regex: regexp.MustCompile("drop")}}, nil)
+	m.SetDebugRing(2)
+	m.SetDecodeHex(true)
+
+	get := func(query string) (int, []DebugEvent) {
+		rec := httptest.NewRecorder()
+		m.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/events"+query, nil))
+
+		var events []DebugEvent
+		if rec.Code == 200 {
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &events))
+			for i := range events {
+				assert.NotEmpty(t, events[i].Time)
+				events[i].Time = ""
+			}
+		}
+		return rec.Code, events
+	}
+
+	// nothing yet
+	code, events := get("")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []DebugEvent{}, events)
+
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:1): syscall=59")})
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1327}, Data: []byte("audit(10000001:1): proctitle=6C73")})
+	m.Consume(new1320("1"))
+
+	// the transformed event is what was written, the raw messages are left alone
+	code, events = get("")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []DebugEvent{{
+		Seq:   1,
+		Raw:   []string{"audit(10000001:1): syscall=59", "audit(10000001:1): proctitle=6C73"},
+		Event: json.RawMessage(strings.TrimSpace(w.String())),
+	}}, events)
+
+	// filtered events are kept with why they were dropped
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:2): syscall=49 drop")})
+	m.Consume(new1320("2"))
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:3): syscall=59")})
+	m.Consume(new1320("3"))
+
+	// only the last 2 are kept, oldest first
+	code, events = get("")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, DebugEvent{Seq: 2, Raw: []string{"audit(10000001:2): syscall=49 drop"}, Dropped: "filtered"}, events[0])
+	assert.Equal(t, 3, events[1].Seq)
+	assert.Contains(t, string(events[1].Event), "\"sequence\":3")
+
+	code, events = get("?n=1")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, 3, events[0].Seq)
+
+	code, _ = get("?n=lots")
+	assert.Equal(t, 400, code)
+
+	// raw payloads are not written unless asked for
+	assert.NotContains(t, w.String(), "_raw")
+
+	// off
+	m.SetDebugRing(0)
+	code, _ = get("")
+	assert.Equal(t, 404, code)
+}
+
+func TestAuditMarshaller_write_routing(t *testing.T) {
+	all := &bytes.Buffer{}
+	cwd := &bytes.Buffer{}
+	routed := NewAuditWriter(cwd, 1)
+	routed.SetMessageTypes([]uint16{1307}, nil)
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(all, 1), routed}, false, false, 0, []AuditFilter{}, nil)
+
+	for i, typ := range []uint16{1300, 1307} {
+		seq := strconv.Itoa(i + 1)
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: typ},
+			Data:   []byte("audit(10000001:" + seq + "): hi there"),
+		})
+		m.Consume(new1320(seq))
+	}
+
+	assert.Equal(t, 2, strings.Count(all.String(), "\n"))
+	assert.Equal(t, "{\"sequence\":2,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1307,\"data\":\"hi there\"}],\"uid_map\":{}}\n", cwd.String())
+}
+
+func TestAuditMarshaller_write_circuitBreaker(t *testing.T) {
+	_, elb := hookLogger()
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	w := NewAuditWriter(&FailWriter{}, 1)
+	w.SetCircuitBreaker(1, time.Minute)
+	m := NewAuditMarshaller([]*AuditWriter{w}, false, false, 0, []AuditFilter{}, nil)
+
+	// The only output failing does not take us down when it has a circuit breaker
+	for _, seq := range []string{"1", "2"} {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(10000001:" + seq + "): hi there"),
+		})
+		m.Consume(new1320(seq))
+	}
+
+	assert.Equal(t, 1, strings.Count(elb.String(), "Failed to write message to output #1"))
+}
+
+func TestAuditMarshaller_SetFailureHandler(t *testing.T) {
+	_, _ = hookLogger()
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	flaky := &flakyWriter{fail: true}
+	bad := NewAuditWriter(flaky, 1)
+	bad.SetName("bad")
+	good := NewAuditWriter(&bytes.Buffer{}, 1)
+	good.SetName("good")
+	m := NewAuditMarshaller([]*AuditWriter{good, bad}, false, false, 0, []AuditFilter{}, nil)
+
+	failures := []string{}
+	m.SetFailureHandler(func(output string, n int) {
+		failures = append(failures, output+" "+strconv.Itoa(n))
+	})
+
+	write := func(seq string) {
+		m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + seq + "): hi there")})
+		m.Consume(new1320(seq))
+	}
+
+	write("1")
+	write("2")
+	assert.Equal(t, []string{"bad 1", "bad 2"}, failures)
+
+	// a write that goes through starts the count over
+	flaky.fail = false
+	write("3")
+	flaky.fail = true
+	write("4")
+	assert.Equal(t, []string{"bad 1", "bad 2", "bad 1"}, failures)
+}
+
+func TestAuditMarshaller_dropMessage_include(t *testing.T) {
+	m := NewAuditMarshaller(
+		[]*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)},
+		false,
+		false,
+		0,
+		[]AuditFilter{
+			{Syscall: "59", Include: true},
+			{Key: "keep", Include: true},
+			{Syscall: "59", Uid: "1000"},
+		},
+		nil,
+	)
+
+	group := func(data string) *AuditMessageGroup {
+		return NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: data, Seq: 1})
+	}
+
+	// only groups matching an include filter are kept
+	assert.False(t, m.dropMessage(group("syscall=59 uid=0")))
+	assert.False(t, m.dropMessage(group("syscall=2 uid=0 key=\"keep\"")))
+	assert.True(t, m.dropMessage(group("syscall=2 uid=0")))
+
+	// exclude wins
+	assert.True(t, m.dropMessage(group("syscall=59 uid=1000")))
+	assert.True(t, m.dropMessage(group("syscall=59 uid=1000 key=\"keep\"")))
+}
+
+func TestAuditMarshaller_dropMessage_invert(t *testing.T) {
+	group := func(data string) *AuditMessageGroup {
+		return NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: data, Seq: 1})
+	}
+
+	// an inverted exclude drops everything that fails it, including other syscalls
+	m := NewAuditMarshaller(
+		[]*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)},
+		false,
+		false,
+		0,
+		[]AuditFilter{{Syscall: "59", Uid: "0", Invert: true}},
+		nil,
+	)
+
+	assert.False(t, m.dropMessage(group("syscall=59 uid=0")))
+	assert.True(t, m.dropMessage(group("syscall=59 uid=1000")))
+	assert.True(t, m.dropMessage(group("syscall=2 uid=0")))
+	assert.True(t, m.dropMessage(group("uid=0")))
+
+	// an inverted include keeps everything that fails it, alongside the other includes, and exclude still wins
+	m.SetFilters([]AuditFilter{
+		{Key: "backup", Include: true, Invert: true},
+		{Syscall: "59", Include: true},
+		{Uid: "1000"},
+	})
+
+	assert.False(t, m.dropMessage(group("syscall=2 uid=0")))
+	assert.True(t, m.dropMessage(group("syscall=2 uid=0 key=\"backup\"")))
+	assert.False(t, m.dropMessage(group("syscall=59 uid=0 key=\"backup\"")))
+	assert.True(t, m.dropMessage(group("syscall=2 uid=1000")))
+
+	// an inverted sample keeps a fraction of everything that fails it
+	m.SetFilters([]AuditFilter{{Syscall: "59", Invert: true, Sample: 0.5}})
+	kept := 0
+	for i := 1; i <= 200; i++ {
+		g := group("syscall=2")
+		g.Seq = i
+		if m.samples.keep(g) {
+			kept++
+			assert.Equal(t, 0.5, g.SampleRate)
+		}
+
+		g = group("syscall=59")
+		g.Seq = i
+		assert.True(t, m.samples.keep(g))
+	}
+
+	assert.InDelta(t, 100, kept, 30)
+}
+
+func TestAuditMarshaller_dropMessage_fieldPresence(t *testing.T) {
+	group := func(data ...string) *AuditMessageGroup {
+		g := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: data[0], Seq: 1})
+		for _, d := range data[1:] {
+			g.AddMessage(&AuditMessage{Type: 1307, Data: d, Seq: 1})
+		}
+		return g
+	}
+
+	// events without a tty, whatever the other records have
+	m := NewAuditMarshaller(
+		[]*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)},
+		false,
+		false,
+		0,
+		[]AuditFilter{{Syscall: "59", MissingFields: []string{"tty"}}},
+		nil,
+	)
+
+	assert.True(t, m.dropMessage(group("syscall=59 uid=0")))
+	assert.False(t, m.dropMessage(group("syscall=59 uid=0 tty=(none)")))
+	assert.False(t, m.dropMessage(group("syscall=59 uid=0", "tty=pts0")))
+	assert.False(t, m.dropMessage(group("syscall=2 uid=0")))
+
+	// keep only events with every listed field, any value will do
+	m.SetFilters([]AuditFilter{{HasFields: []string{"tty", "ses"}, Include: true}})
+	assert.False(t, m.dropMessage(group("syscall=59 tty=pts0 ses=4294967295")))
+	assert.False(t, m.dropMessage(group("syscall=59 tty=pts0", "ses=1")))
+	assert.True(t, m.dropMessage(group("syscall=59 tty=pts0")))
+	assert.True(t, m.dropMessage(group("syscall=59")))
+}
+
+func TestAuditMarshaller_filterHits(t *testing.T) {
+	lb, _ := hookLogger()
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	group := func(data string) *AuditMessageGroup {
+		return NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: data, Seq: 1})
+	}
+
+	hits := func(name string) uint64 {
+		return metrics.FilterHits.With(name).Value()
+	}
+
+	unnamed := hits("3")
+	m := NewAuditMarshaller(
+		[]*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)},
+		false,
+		false,
+		0,
+		[]AuditFilter{
+			{Name: "hits-uid", Uid: "0"},
+			{Name: "hits-execve", Syscall: "59"},
+			{Syscall: "2", Include: true},
+			{Name: "hits-never", Key: "nope", Include: true},
+			{Name: "hits-sample", Syscall: "2", Sample: 0.5},
+		},
+		nil,
+	)
+
+	// cached decisions count too, dropping for want of an include filter counts for none
+	for i := 0; i < 2; i++ {
+		assert.True(t, m.dropMessage(group("syscall=3 uid=0")))
+		assert.True(t, m.dropMessage(group("syscall=59 uid=1")))
+		assert.False(t, m.dropMessage(group("syscall=2 uid=1")))
+		assert.True(t, m.dropMessage(group("syscall=3 uid=1")))
+	}
+
+	// a group is only counted once, by the filter that decided it
+	assert.True(t, m.dropMessage(group("syscall=59 uid=0")))
+	m.samples.keep(group("syscall=2 uid=1"))
+
+	assert.Equal(t, uint64(2), hits("hits-uid"))
+	assert.Equal(t, uint64(3), hits("hits-execve"))
+	assert.Equal(t, unnamed+2, hits("3"))
+	assert.Equal(t, uint64(0), hits("hits-never"))
+	assert.Equal(t, uint64(1), hits("hits-sample"))
+
+	// every filter is logged at shutdown, even those that never hit
+	m.Close()
+	assert.Contains(t, lb.String(), "Filter hits-execve matched 3 events, syscall `59`\n")
+	assert.Contains(t, lb.String(), "Filter hits-never matched 0 events, key `nope`\n")
+}
+
+func TestAuditFilter_String_invert(t *testing.T) {
+	f := AuditFilter{Syscall: "59", Uid: "0", Invert: true}
+	assert.Equal(t, "anything but syscall `59`, uid `0`", f.String())
+	assert.True(t, f.Invert)
+
+	f = AuditFilter{HasFields: []string{"tty", "ses"}, MissingFields: []string{"auid"}}
+	assert.Equal(t, "has field `tty`, has field `ses`, missing field `auid`", f.String())
+}
+
+func TestAuditMarshaller_sample(t *testing.T) {
+	run := func() string {
+		w := &bytes.Buffer{}
+		filters := []AuditFilter{{Syscall: "2", Sample: 0.1}, {Syscall: "59"}}
+		m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, filters, nil)
+
+		for i := 1; i <= 2000; i++ {
+			seq := strconv.Itoa(i)
+			m.Consume(&syscall.NetlinkMessage{
+				Header: syscall.NlMsghdr{Type: uint16(1300)},
+				Data:   []byte("audit(10000001:" + seq + "): syscall=2"),
+			})
+			m.Consume(new1320(seq))
+		}
+
+		// Not sampled
+		m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1300)}, Data: []byte("audit(10000002:1): syscall=3")})
+		m.Consume(new1320("1"))
+		m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(1300)}, Data: []byte("audit(10000002:2): syscall=59")})
+		m.Consume(new1320("2"))
+
+		return w.String()
+	}
+
+	out := run()
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	sampled := lines[:len(lines)-1]
+
+	// Roughly 1 in 10 is kept and marked with the rate
+	assert.InDelta(t, 200, len(sampled), 50)
+	for _, line := range sampled {
+		assert.Contains(t, line, `"data":"syscall=2"`)
+		assert.Contains(t, line, `"sample_rate":0.1`)
+	}
+
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000002\",\"messages\":[{\"type\":1300,\"data\":\"syscall=3\"}],\"uid_map\":{}}", lines[len(lines)-1])
+
+	// The same events are kept every time
+	assert.Equal(t, out, run())
+
+	// Sampling filters are not drop filters
+	m := NewAuditMarshaller(nil, false, false, 0, []AuditFilter{{Syscall: "2", Sample: 0.1}}, nil)
+	assert.False(t, m.dropMessage(NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=2", Seq: 1})))
+}
+
+func TestAuditMarshaller_SetFields(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetFields(map[string]string{"host": "box", "env": "prod"})
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+	m.Consume(new1320("1"))
+
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"fields\":{\"env\":\"prod\",\"host\":\"box\"}}\n",
+		w.String(),
+	)
+
+	// No fields leaves the event untouched
+	m.SetFields(map[string]string{})
+	assert.Nil(t, m.fields)
+}
+
+func TestAuditMarshaller_SetDecodeHex(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetDecodeHex(true)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1327)},
+		Data:   []byte("audit(10000001:1): proctitle=6C73002D6C61"),
+	})
+	m.Consume(new1320("1"))
+
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1327,\"data\":\"proctitle=6C73002D6C61\",\"extra\":{\"proctitle\":\"ls -la\"}}],\"uid_map\":{}}\n",
+		w.String(),
+	)
+}
+
+func TestAuditMarshaller_SetReassembleExecve(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetReassembleExecve(true)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1309)},
+		Data:   []byte("audit(10000001:1): argc=2 a0=\"ls\" a1=\"-la\""),
+	})
+	m.Consume(new1320("1"))
+
+	assert.Contains(t, w.String(), "\"extra\":{\"cmdline\":\"ls -la\"}")
+
+	// the arguments can go once they are in the cmdline
+	w.Reset()
+	m.SetDropExecveArgs(true)
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1309)},
+		Data:   []byte("audit(10000001:2): argc=2 a0=\"ls\" a1=\"-la\""),
+	})
+	m.Consume(new1320("2"))
+	assert.Contains(t, w.String(), "{\"type\":1309,\"data\":\"argc=2\",\"extra\":{\"cmdline\":\"ls -la\"}}")
+
+	// but not when they were not reassembled
+	w.Reset()
+	m.SetReassembleExecve(false)
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1309)},
+		Data:   []byte("audit(10000001:3): argc=2 a0=\"ls\" a1=\"-la\""),
+	})
+	m.Consume(new1320("3"))
+	assert.Contains(t, w.String(), "{\"type\":1309,\"data\":\"argc=2 a0=\\\"ls\\\" a1=\\\"-la\\\"\"}")
+}
+
+func TestAuditMarshaller_SetParseSELinux(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetParseSELinux(true)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): syscall=2 subj=unconfined_u:unconfined_r:unconfined_t:s0"),
+	})
+	m.Consume(new1320("1"))
+
+	assert.Contains(t, w.String(), "\"extra\":{\"subj_level\":\"s0\",\"subj_role\":\"unconfined_r\",\"subj_type\":\"unconfined_t\",\"subj_user\":\"unconfined_u\"}")
+}
+
+func TestAuditMarshaller_SetStructured(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, nil)
+	m.SetStructured(true)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1307)},
+		Data:   []byte("audit(10000001:1): cwd=\"/\""),
+	})
+	m.Consume(new1320("1"))
+
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"records\":{\"cwd\":{\"cwd\":\"/\"}},\"uid_map\":{}}\n", w.String())
+}
+
+func TestAuditMarshaller_resolveIds(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, false, false, 0, []AuditFilter{}, NewIdResolver(10, time.Minute))
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:   uint32(44),
+			Type:  uint16(1300),
+			Flags: uint16(0),
+			Seq:   uint32(0),
+			Pid:   uint32(0),
+		},
+		Data: []byte("audit(10000001:1): syscall=59 uid=0 gid=0"),
+	})
+
+	m.Consume(new1320("1"))
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"syscall=59 uid=0 gid=0\",\"extra\":{\"gid_name\":\"root\",\"uid_name\":\"root\"}}],\"uid_map\":{\"0\":\"root\"}}\n",
+		w.String(),
+	)
+}
+
 func TestAuditMarshaller_completeMessage(t *testing.T) {
 	//TODO: cant test because completeMessage calls exit
 	t.Skip()
 	return
 	lb, elb := hookLogger()
-	m := NewAuditMarshaller(NewAuditWriter(&FailWriter{}, 1), false, false, 0, []AuditFilter{})
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&FailWriter{}, 1)}, false, false, 0, []AuditFilter{}, nil)
 
 	m.Consume(&syscall.NetlinkMessage{
 		Header: syscall.NlMsghdr{
@@ -161,3 +1630,24 @@ type FailWriter struct{}
 func (f *FailWriter) Write(p []byte) (n int, err error) {
 	return 0, errors.New("derp")
 }
+
+// Fails every write while fail is set
+type flakyWriter struct {
+	fail bool
+}
+
+func (f *flakyWriter) Write(p []byte) (n int, err error) {
+	if f.fail {
+		return 0, errors.New("derp")
+	}
+
+	return len(p), nil
+}
+
+// Hooks the package loggers writers so you can assert their contents
+func hookLogger() (lb *bytes.Buffer, elb *bytes.Buffer) {
+	lb = &bytes.Buffer{}
+	elb = &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+	return
+}
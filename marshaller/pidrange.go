@@ -0,0 +1,103 @@
+package marshaller
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+// A range of process ids to match, both ends are included
+type PidRange struct {
+	Min uint64
+	Max uint64
+}
+
+// Parses an exact pid like `1`, a bound like `<100`, `<=100`, `>1000` or `>=1000`, or a range like `300-400`
+func ParsePidRange(s string) (*PidRange, error) {
+	s = strings.TrimSpace(s)
+
+	var bound func(v uint64) (*PidRange, error)
+	switch {
+	case strings.HasPrefix(s, "<="):
+		s, bound = s[2:], func(v uint64) (*PidRange, error) { return &PidRange{Max: v}, nil }
+	case strings.HasPrefix(s, ">="):
+		s, bound = s[2:], func(v uint64) (*PidRange, error) { return &PidRange{Min: v, Max: math.MaxUint64}, nil }
+	case strings.HasPrefix(s, "<"):
+		s, bound = s[1:], func(v uint64) (*PidRange, error) {
+			if v == 0 {
+				return nil, errors.New("Nothing is below 0")
+			}
+			return &PidRange{Max: v - 1}, nil
+		}
+	case strings.HasPrefix(s, ">"):
+		s, bound = s[1:], func(v uint64) (*PidRange, error) { return &PidRange{Min: v + 1, Max: math.MaxUint64}, nil }
+	}
+
+	if bound != nil {
+		v, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		return bound(v)
+	}
+
+	if i := strings.Index(s, "-"); i > 0 {
+		min, err := strconv.ParseUint(strings.TrimSpace(s[:i]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		max, err := strconv.ParseUint(strings.TrimSpace(s[i+1:]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		if min > max {
+			return nil, errors.New("The start of the range is after its end")
+		}
+
+		return &PidRange{Min: min, Max: max}, nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PidRange{Min: v, Max: v}, nil
+}
+
+func (r *PidRange) Contains(pid uint64) bool {
+	return pid >= r.Min && pid <= r.Max
+}
+
+// Writes the range back the way it would be configured
+func (r *PidRange) String() string {
+	switch {
+	case r.Min == r.Max:
+		return strconv.FormatUint(r.Min, 10)
+	case r.Min == 0:
+		return "<=" + strconv.FormatUint(r.Max, 10)
+	case r.Max == math.MaxUint64:
+		return ">=" + strconv.FormatUint(r.Min, 10)
+	}
+
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Checks a pid field of the syscall record against the range, groups without one never match
+func matchesPid(msg *AuditMessageGroup, name string, r *PidRange) bool {
+	for _, m := range msg.Msgs {
+		if m.Type != EVENT_SYSCALL {
+			continue
+		}
+
+		pid, err := strconv.ParseUint(m.Fields()[name], 10, 64)
+		return err == nil && r.Contains(pid)
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+package marshaller
+
+import (
+	"fmt"
+	"strings"
+	"github.com/Xeralux/go-audit/metrics"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+// Sets the record types every event must have, an event missing one is dropped and each of its messages is dead
+// lettered with the records it lacks. Empty to not check, like before
+func (a *AuditMarshaller) SetRequiredRecords(types []uint16) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.required = types
+}
+
+// The names of the required record types the group has no message of, the way auditd logs them
+func (a *AuditMarshaller) missingRecords(msg *AuditMessageGroup) []string {
+	var missing []string
+	for _, t := range a.required {
+		found := false
+		for _, m := range msg.Msgs {
+			if m.Type == t {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, strings.ToUpper(RecordTypeName(t)))
+		}
+	}
+
+	return missing
+}
+
+// Drops an event missing required records, its messages go to the dead letter output as they were received
+// The payload is only kept with transform.include_raw, otherwise it is put back together from the audit header
+func (a *AuditMarshaller) dropMissingRecords(msg *AuditMessageGroup, missing []string) {
+	metrics.MissingRecords.Inc()
+	a.remember(msg, a.rawMessages(msg), nil, "missing records")
+
+	reason := "Event is missing required records " + strings.Join(missing, ", ")
+	for _, m := range msg.Msgs {
+		raw := m.Raw
+		if raw == nil {
+			raw = []byte(fmt.Sprintf("audit(%s:%d): %s", m.AuditTime, m.Seq, m.Data))
+		}
+
+		a.writeEventDeadLetter(msg.Seq, m.Type, raw, reason)
+	}
+}
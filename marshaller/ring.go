@@ -0,0 +1,146 @@
+package marshaller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+// An event as seen by the marshaller, kept around for debugging
+type DebugEvent struct {
+	Time    string          `json:"time"`              // When the event was done with, RFC 3339
+	Seq     int             `json:"sequence"`          // Audit sequence of the event
+	Raw     []string        `json:"raw"`               // The netlink payload of each message, in the order received
+	Event   json.RawMessage `json:"event,omitempty"`   // What was handed to the outputs, after every transform
+	Dropped string          `json:"dropped,omitempty"` // Why the event was not written, empty when it was
+}
+
+// Holds the last events in memory, the oldest is overwritten once it is full
+type debugRing struct {
+	lock   sync.Mutex
+	events []*DebugEvent
+	next   int
+	full   bool
+}
+
+func newDebugRing(size int) *debugRing {
+	return &debugRing{events: make([]*DebugEvent, size)}
+}
+
+func (r *debugRing) add(e *DebugEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// The last n events held, oldest first. n <= 0 gets everything
+func (r *debugRing) last(n int) []*DebugEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var events []*DebugEvent
+	if r.full {
+		events = append(events, r.events[r.next:]...)
+	}
+	events = append(events, r.events[:r.next]...)
+
+	if n > 0 && n < len(events) {
+		events = events[len(events)-n:]
+	}
+
+	return events
+}
+
+// Keeps the last size events, raw and transformed, to be served by DebugHandler. 0 turns it off
+// The netlink payload of every message is held on to while this is on, like transform.include_raw does
+func (a *AuditMarshaller) SetDebugRing(size int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if size <= 0 {
+		a.ring = nil
+		return
+	}
+
+	a.ring = newDebugRing(size)
+}
+
+// Serves the events in the debug ring as a json array, oldest first. `?n=10` limits it to the last 10
+func (a *AuditMarshaller) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.lock.Lock()
+		ring := a.ring
+		a.lock.Unlock()
+
+		if ring == nil {
+			http.Error(w, "The debug ring is disabled, set debug.ring_size to enable it", http.StatusNotFound)
+			return
+		}
+
+		n := 0
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "n must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		events := ring.last(n)
+		if events == nil {
+			events = []*DebugEvent{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(events); err != nil {
+			logger.Err("Failed to serve the debug ring. Error: %v", err)
+		}
+	})
+}
+
+// Adds an event to the debug ring, if there is one. v is what was written, dropped why it was not
+func (a *AuditMarshaller) remember(msg *AuditMessageGroup, raw []string, v interface{}, dropped string) {
+	if a.ring == nil {
+		return
+	}
+
+	e := &DebugEvent{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Seq:     msg.Seq,
+		Raw:     raw,
+		Dropped: dropped,
+	}
+
+	if v != nil {
+		event, err := json.Marshal(v)
+		if err != nil {
+			logger.Err("Failed to encode event %d for the debug ring. Error: %v", msg.Seq, err)
+		}
+		e.Event = event
+	}
+
+	a.ring.add(e)
+}
+
+// The netlink payload of each message in a group, nil unless the debug ring is on
+func (a *AuditMarshaller) rawMessages(msg *AuditMessageGroup) []string {
+	if a.ring == nil {
+		return nil
+	}
+
+	raw := make([]string, 0, len(msg.Msgs))
+	for _, m := range msg.Msgs {
+		raw = append(raw, string(m.Raw))
+	}
+
+	return raw
+}
@@ -0,0 +1,77 @@
+package marshaller
+
+import (
+	"hash/fnv"
+	"strconv"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+// Keeps a fraction of the groups matching a sampling filter, see AuditFilter.Sample, and drops the rest
+// Whether a group is kept depends only on its timestamp and serial, so replaying the same log keeps the same events
+type sampler struct {
+	filters map[string][]AuditFilter // Sampling filters keyed by syscall, filters for any syscall are under ""
+}
+
+// Collects the sampling filters, nil if there are none
+func newSampler(filters []AuditFilter) *sampler {
+	s := &sampler{filters: make(map[string][]AuditFilter)}
+	found := false
+	for _, f := range filters {
+		if f.Sample > 0 {
+			s.filters[f.bucket()] = append(s.filters[f.bucket()], f)
+			found = true
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	return s
+}
+
+// Decides if a group is kept, groups no sampling filter matches always are
+// The first matching filter sets the fraction kept and kept groups are marked with it as their sample rate
+func (s *sampler) keep(msg *AuditMessageGroup) bool {
+	rate, ok := s.rate(msg)
+	if !ok {
+		return true
+	}
+
+	if sampleHash(msg) >= rate {
+		return false
+	}
+
+	msg.SampleRate = rate
+	return true
+}
+
+// Finds the fraction kept by the first sampling filter for the group's syscall, then by those for any syscall
+func (s *sampler) rate(msg *AuditMessageGroup) (float64, bool) {
+	f := firstMatch(s.filters, msg)
+	if f == nil {
+		return 0, false
+	}
+
+	f.hit()
+	return f.Sample, true
+}
+
+// Spreads the timestamp and serial of the group evenly over [0, 1)
+func sampleHash(msg *AuditMessageGroup) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(msg.AuditTime))
+	h.Write([]byte{':'})
+	h.Write([]byte(strconv.Itoa(msg.Seq)))
+
+	// fnv barely changes the high bits for serials that only differ at the end, mix them in before using those
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	// The top 53 bits fit a float64 exactly
+	return float64(x>>11) / (1 << 53)
+}
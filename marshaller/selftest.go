@@ -0,0 +1,73 @@
+package marshaller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+const SELFTEST_KEY = "go-audit-selftest" // Rule key of the self-test event, to tell it apart downstream
+
+var ErrSelfTestFiltered = errors.New("The self-test event was dropped by the filters")
+
+// A synthetic syscall event for the startup self-test, go-audit executing itself, with SELFTEST_KEY as its rule key
+func NewSelfTestEvent(now time.Time) *AuditMessageGroup {
+	exe, _ := os.Executable()
+	auditTime := fmt.Sprintf("%d.%03d", now.Unix(), now.Nanosecond()/int(time.Millisecond))
+
+	return NewAuditMessageGroup(&AuditMessage{
+		Type: EVENT_SYSCALL,
+		Data: fmt.Sprintf(
+			"audit(%s:0): arch=c000003e syscall=59 success=yes exit=0 pid=%d ppid=%d uid=%d gid=%d comm=\"go-audit\" exe=%q key=%q",
+			auditTime, os.Getpid(), os.Getppid(), os.Getuid(), os.Getgid(), exe, SELFTEST_KEY,
+		),
+		AuditTime: auditTime,
+	})
+}
+
+// Runs an event through the filters, transforms and outputs like one from the kernel and flushes every output so a
+// buffered one really sends it. Returns why it did not reach an output by the index of the output, an output that
+// spooled it counts as not reached. Outputs that do not want the event by their routing are not tested
+// It is not sampled, deduplicated, rate limited or numbered, the filters dropping it is ErrSelfTestFiltered
+func (a *AuditMarshaller) SelfTest(msg *AuditMessageGroup) (map[int]error, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return nil, errors.New("The self-test can not run once closed")
+	}
+
+	if a.dropMessage(msg) {
+		return nil, ErrSelfTestFiltered
+	}
+
+	a.transform(msg)
+
+	a.emitLock.Lock()
+	defer a.emitLock.Unlock()
+
+	v := a.encodable(msg)
+	failed := map[int]error{}
+	for i, w := range a.writers {
+		if !w.Wants(msg) {
+			continue
+		}
+
+		err := w.Encode(msg.Seq, v)
+		if err == nil {
+			err = w.Flush()
+		}
+
+		if err == nil && w.Spooling() {
+			err = errors.New("It was spooled, the output is down or still replaying its spool")
+		}
+
+		if err != nil {
+			failed[i] = err
+		}
+	}
+
+	return failed, nil
+}
@@ -0,0 +1,97 @@
+package marshaller
+
+import (
+	"encoding/json"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+// Adds a message to a group without letting the group grow past maxEventBytes
+// Once a group is over the limit the rest of its messages are thrown away as they arrive
+func (a *AuditMarshaller) addMessage(msg *AuditMessageGroup, am *AuditMessage) {
+	if msg.Truncated {
+		return
+	}
+
+	msg.AddMessage(am)
+	a.limitSize(msg)
+}
+
+// Cuts the data of the last message of the group down to what fits in maxEventBytes, or frees every message
+// of the group right away when oversized events are dropped. The group is kept until it completes so the
+// rest of its messages do not start a new one
+func (a *AuditMarshaller) limitSize(msg *AuditMessageGroup) {
+	if a.maxEventBytes <= 0 || msg.Size <= a.maxEventBytes {
+		return
+	}
+
+	metrics.Oversized.Inc()
+	msg.Truncated = true
+
+	if a.dropOversized {
+		logger.Warning("Dropping event %d, it is over message_tracking.max_event_bytes of %d bytes", msg.Seq, a.maxEventBytes)
+		msg.Msgs = nil
+		return
+	}
+
+	last := msg.Msgs[len(msg.Msgs)-1]
+	last.Truncate(len(last.Data) - (msg.Size - a.maxEventBytes))
+	msg.Size = a.maxEventBytes
+}
+
+// Checks the assembled event, transforms included, against maxEventBytes and returns what should be written
+// An event over the limit loses the extra fields of its messages and its raw payloads, then data from the end like
+// it would have while being assembled. Returns nil when the event is dropped instead
+func (a *AuditMarshaller) limitEvent(msg *AuditMessageGroup, v interface{}) interface{} {
+	if a.maxEventBytes <= 0 {
+		return v
+	}
+
+	size := encodedSize(v)
+	if size <= a.maxEventBytes {
+		return v
+	}
+
+	if !msg.Truncated {
+		metrics.Oversized.Inc()
+	}
+
+	if !a.dropOversized {
+		for _, m := range msg.Msgs {
+			m.Extra = nil
+		}
+
+		msg.Raw = nil
+		msg.Truncated = true
+		v = a.encodable(msg)
+
+		// Escaping makes the data take more room once encoded, keep cutting until it fits
+		for size = encodedSize(v); size > a.maxEventBytes && len(msg.Msgs) > 0; size = encodedSize(v) {
+			last := msg.Msgs[len(msg.Msgs)-1]
+			if over := size - a.maxEventBytes; over < len(last.Data) {
+				last.Truncate(len(last.Data) - over)
+			} else {
+				msg.Msgs = msg.Msgs[:len(msg.Msgs)-1]
+			}
+
+			v = a.encodable(msg)
+		}
+
+		if size <= a.maxEventBytes && len(msg.Msgs) > 0 {
+			return v
+		}
+	}
+
+	logger.Warning("Dropping event %d, it is over message_tracking.max_event_bytes of %d bytes once assembled", msg.Seq, a.maxEventBytes)
+	return nil
+}
+
+func encodedSize(v interface{}) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+
+	return len(b)
+}
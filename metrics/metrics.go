@@ -0,0 +1,307 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+// The metrics go-audit keeps track of
+var (
+	EventsReceived   = NewCounter("go_audit_events_received_total", "Messages received from netlink")
+	NetlinkReceived  = NewCounter("go_audit_netlink_received_total", "Messages read from netlink, including those dropped before they were processed")
+	NetlinkOverflows = NewCounter("go_audit_netlink_overflows_total", "Times the netlink receive buffer overflowed and the kernel dropped events")
+	QueueDropped     = NewCounterVec("go_audit_queue_dropped_total", "Messages dropped because the processing queue was too full for their priority", "priority")
+	QueueDepth       = NewGauge("go_audit_queue_depth", "Messages received from netlink waiting to be processed")
+	InFlight         = NewGauge("go_audit_events_in_flight", "Events being assembled, waiting for their end or the completion timeout")
+	EventsWritten    = NewCounterVec("go_audit_events_written_total", "Message groups written to an output", "output")
+	EventsFiltered   = NewCounter("go_audit_events_filtered_total", "Message groups dropped by a filter")
+	FilterHits       = NewCounterVec("go_audit_filter_hits_total", "Message groups each filter dropped, kept or sampled, by the name of the filter or its position when it has none", "filter")
+	Sampled          = NewCounter("go_audit_sampled_total", "Message groups dropped by a sampling filter, the ones kept carry sample_rate")
+	OutOfOrder       = NewCounter("go_audit_out_of_order_total", "Messages that arrived after a later sequence")
+	Missed           = NewCounter("go_audit_missed_total", "Sequences that never arrived")
+	RateLimited      = NewCounter("go_audit_rate_limited_total", "Events dropped for going over the rate limit")
+	Incomplete       = NewCounter("go_audit_incomplete_total", "Events that timed out before their end was seen")
+	Deduplicated     = NewCounter("go_audit_deduplicated_total", "Repeated events suppressed by the dedupe window")
+	Oversized        = NewCounter("go_audit_oversized_total", "Events over message_tracking.max_event_bytes, truncated or dropped")
+	TooOld           = NewCounter("go_audit_too_old_total", "Events dropped for being older than max_age")
+	DeadLettered     = NewCounter("go_audit_dead_letters_total", "Messages that could not be parsed or were part of an event missing required records, they are written to output.deadletter.path when set")
+	MissingRecords   = NewCounter("go_audit_missing_records_total", "Events dropped for missing a record type of transform.require_records")
+	Heartbeats       = NewCounter("go_audit_heartbeats_total", "Heartbeat events written")
+	Alerts           = NewCounter("go_audit_alerts_total", "Alert events written")
+	Protecting       = NewGauge("go_audit_protecting", "1 while the kernel rate_limit is tightened because of a sustained event rate")
+	WriteRetries     = NewCounterVec("go_audit_write_retries_total", "Failed writes that were retried", "output")
+	CircuitOpen      = NewGaugeVec("go_audit_output_circuit_open", "1 while writes to an output are skipped after repeated failures", "output")
+	CircuitDropped   = NewCounterVec("go_audit_output_circuit_dropped_total", "Events not written to an output because its circuit was open", "output")
+	Spooled          = NewCounterVec("go_audit_spooled_total", "Events written to the disk spool of an output instead of the output", "output")
+	SpoolBytes       = NewGaugeVec("go_audit_spool_bytes", "Bytes of spooled events waiting to be replayed to an output", "output")
+	SpoolDropped     = NewCounterVec("go_audit_spool_dropped_bytes_total", "Bytes of the oldest spooled events dropped because the spool was full", "output")
+	KernelLost       = NewGauge("go_audit_kernel_lost", "Events the kernel reports it has lost, this is a running total kept by the kernel")
+	KernelBacklog    = NewGauge("go_audit_kernel_backlog", "Events waiting in the kernel to be sent to us")
+	MarshalLatency   = NewHistogram(
+		"go_audit_marshal_latency_seconds",
+		"Time from receiving the first message of a group until it was written to every output",
+		[]float64{.005, .01, .05, .1, .5, 1, 2, 2.5, 5, 10},
+	)
+)
+
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+type entry struct {
+	name   string
+	help   string
+	kind   string
+	metric metric
+}
+
+var lock sync.Mutex
+var registry []entry
+
+func register(name, help, kind string, m metric) {
+	lock.Lock()
+	defer lock.Unlock()
+	registry = append(registry, entry{name: name, help: help, kind: kind, metric: m})
+}
+
+// A value that only goes up
+type Counter struct {
+	v uint64
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	register(name, help, "counter", c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+// A value that can be set to anything
+type Gauge struct {
+	v uint64
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	register(name, help, "gauge", g)
+	return g
+}
+
+func (g *Gauge) Set(v uint64) {
+	atomic.StoreUint64(&g.v, v)
+}
+
+func (g *Gauge) Value() uint64 {
+	return atomic.LoadUint64(&g.v)
+}
+
+func (g *Gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, g.Value())
+}
+
+// A set of counters partitioned by the value of a single label
+type CounterVec struct {
+	lock     sync.Mutex
+	label    string
+	counters map[string]*Counter
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	register(name, help, "counter", c)
+	return c
+}
+
+// Gets the counter for a label value, creating it if needed
+func (c *CounterVec) With(value string) *Counter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if counter, ok := c.counters[value]; ok {
+		return counter
+	}
+
+	counter := &Counter{}
+	c.counters[value] = counter
+	return counter
+}
+
+func (c *CounterVec) write(w io.Writer, name string) {
+	c.lock.Lock()
+	values := make([]string, 0, len(c.counters))
+	for v := range c.counters {
+		values = append(values, v)
+	}
+	c.lock.Unlock()
+
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, c.label, strconv.Quote(v), c.With(v).Value())
+	}
+}
+
+// A set of gauges partitioned by the value of a single label
+type GaugeVec struct {
+	lock   sync.Mutex
+	label  string
+	gauges map[string]*Gauge
+}
+
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	g := &GaugeVec{label: label, gauges: make(map[string]*Gauge)}
+	register(name, help, "gauge", g)
+	return g
+}
+
+// Gets the gauge for a label value, creating it if needed
+func (g *GaugeVec) With(value string) *Gauge {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if gauge, ok := g.gauges[value]; ok {
+		return gauge
+	}
+
+	gauge := &Gauge{}
+	g.gauges[value] = gauge
+	return gauge
+}
+
+func (g *GaugeVec) write(w io.Writer, name string) {
+	g.lock.Lock()
+	values := make([]string, 0, len(g.gauges))
+	for v := range g.gauges {
+		values = append(values, v)
+	}
+	g.lock.Unlock()
+
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, g.label, strconv.Quote(v), g.With(v).Value())
+	}
+}
+
+// Counts observations into cumulative buckets
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Buckets are the upper bounds, in increasing order, an implicit +Inf bucket is always added
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(name, help, "histogram", h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writes every metric in the prometheus text exposition format
+func WriteTo(w io.Writer) {
+	lock.Lock()
+	entries := make([]entry, len(registry))
+	copy(entries, registry)
+	lock.Unlock()
+
+	for _, e := range entries {
+		fmt.Fprintf(w, "# HELP %s %s\n", e.name, e.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", e.name, e.kind)
+		e.metric.write(w, e.name)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteTo(w)
+	})
+}
+
+// Other handlers served next to /metrics, debugging aids and the like
+var handlers = http.NewServeMux()
+
+// Serves a handler on the metrics server next to /metrics, it can be added before or after Serve
+func Handle(pattern string, handler http.Handler) {
+	handlers.Handle(pattern, handler)
+}
+
+// Starts serving /metrics, and anything added with Handle, on the address in the background
+// Errors binding to the address are returned, anything after that is logged
+func Serve(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Could not listen for metrics on %s. Error: %v", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	mux.Handle("/", handlers)
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logger.Err("Metrics server stopped. Error: %v", err)
+		}
+	}()
+
+	logger.Info("Serving metrics on http://%s/metrics", l.Addr())
+	return nil
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec_With(t *testing.T) {
+	c := &CounterVec{label: "output", counters: make(map[string]*Counter)}
+	c.With("file").Inc()
+	c.With("file").Add(2)
+	c.With("http").Inc()
+
+	assert.Equal(t, uint64(3), c.With("file").Value())
+
+	b := &bytes.Buffer{}
+	c.write(b, "test_total")
+	assert.Equal(t, "test_total{output=\"file\"} 3\ntest_total{output=\"http\"} 1\n", b.String())
+}
+
+func TestGauge_Set(t *testing.T) {
+	g := &Gauge{}
+	g.Set(10)
+	g.Set(3)
+	assert.Equal(t, uint64(3), g.Value())
+
+	b := &bytes.Buffer{}
+	g.write(b, "test")
+	assert.Equal(t, "test 3\n", b.String())
+}
+
+func TestGaugeVec_With(t *testing.T) {
+	g := &GaugeVec{label: "output", gauges: make(map[string]*Gauge)}
+	g.With("syslog").Set(1)
+	g.With("file").Set(0)
+
+	b := &bytes.Buffer{}
+	g.write(b, "test")
+	assert.Equal(t, "test{output=\"file\"} 0\ntest{output=\"syslog\"} 1\n", b.String())
+}
+
+func TestHistogram_Observe(t *testing.T) {
+	h := &Histogram{buckets: []float64{.1, 1}, counts: make([]uint64, 2)}
+	h.Observe(.05)
+	h.Observe(.5)
+	h.Observe(5)
+
+	b := &bytes.Buffer{}
+	h.write(b, "test_seconds")
+	assert.Equal(
+		t,
+		"test_seconds_bucket{le=\"0.1\"} 1\n"+
+			"test_seconds_bucket{le=\"1\"} 2\n"+
+			"test_seconds_bucket{le=\"+Inf\"} 3\n"+
+			"test_seconds_sum 5.55\n"+
+			"test_seconds_count 3\n",
+		b.String(),
+	)
+}
+
+func TestServe(t *testing.T) {
+	// bad address
+	assert.Contains(t, Serve("nope").Error(), "Could not listen for metrics on nope.")
+
+	EventsReceived.Inc()
+	b := &bytes.Buffer{}
+	WriteTo(b)
+	assert.Contains(t, b.String(), "# HELP go_audit_events_received_total Messages received from netlink\n")
+	assert.Contains(t, b.String(), "# TYPE go_audit_events_received_total counter\n")
+	assert.Contains(t, b.String(), "# TYPE go_audit_marshal_latency_seconds histogram\n")
+
+	assert.Nil(t, Serve("127.0.0.1:0"))
+
+	// Serve the handler directly since the listener picked a random port
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "go_audit_events_received_total ")
+}
+
+func TestHandle(t *testing.T) {
+	Handle("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	assert.Nil(t, Serve(address))
+
+	resp, err := http.Get("http://" + address + "/test")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hi", string(body))
+
+	// metrics are still there
+	resp, err = http.Get("http://" + address + "/metrics")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Get("http://" + address + "/nope")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+}
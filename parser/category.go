@@ -0,0 +1,52 @@
+package parser
+
+// Categories of events by the types of their messages, see TypeCategory
+const (
+	CATEGORY_LOGIN   = "login"   // User space authentication, accounting and session messages, like USER_LOGIN
+	CATEGORY_SYSCALL = "syscall" // Syscall events, like file access and execs
+	CATEGORY_CONFIG  = "config"  // Changes to the audit configuration, rules and the audit daemon
+	CATEGORY_ANOM    = "anom"    // Anomalies the kernel or user space detected and the responses to them
+	CATEGORY_OTHER   = "other"   // Anything else, and what is not an event at all like heartbeats
+)
+
+// Every category, anomalies first, an event with messages of several categories is in the first one
+var Categories = []string{CATEGORY_ANOM, CATEGORY_CONFIG, CATEGORY_LOGIN, CATEGORY_SYSCALL, CATEGORY_OTHER}
+
+const CONFIG_CHANGE_TYPE = 1305 // A rule or setting was changed, logged among the syscall records
+
+// Puts a message type in a category by the ranges of include/uapi/linux/audit.h and libaudit
+func TypeCategory(t uint16) string {
+	switch {
+	case t == CONFIG_CHANGE_TYPE:
+		return CATEGORY_CONFIG
+	case t >= 1000 && t < 1100, t >= 1200 && t < 1300:
+		// Commands to the kernel and messages from the audit daemon
+		return CATEGORY_CONFIG
+	case t >= 1100 && t < 1200:
+		return CATEGORY_LOGIN
+	case t >= 1300 && t < 1400:
+		return CATEGORY_SYSCALL
+	case t >= 1700 && t < 1800, t >= 2100 && t < 2300:
+		// Kernel anomalies, user space anomalies and the responses to them
+		return CATEGORY_ANOM
+	}
+
+	return CATEGORY_OTHER
+}
+
+// The category of the group, with messages of several categories the first one in Categories wins so a config
+// change or an anomaly is not lost among the syscall records that came with it
+func (amg *AuditMessageGroup) Category() string {
+	found := map[string]bool{}
+	for _, msg := range amg.Msgs {
+		found[TypeCategory(msg.Type)] = true
+	}
+
+	for _, c := range Categories {
+		if found[c] {
+			return c
+		}
+	}
+
+	return CATEGORY_OTHER
+}
@@ -0,0 +1,62 @@
+package parser
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Pids are reused, container ids are only cached long enough to cover the bursts of events a process causes
+const CONTAINER_CACHE_TTL = 5 * time.Second
+
+// Where the cgroups of a pid are read from, swapped out in tests
+var procDir = "/proc"
+
+// Container runtimes name the cgroup of a container after its 64 character id, like /docker/<id>,
+// /kubepods/burstable/pod<uid>/<id> or /kubepods.slice/.../cri-containerd-<id>.scope
+var containerIdPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// Adds a `container_id` extra field to every message with a `pid` of a process running in a container
+// The id comes from the cgroups of the process, which is only possible while it is still running. Nothing is added
+// for processes that have exited or are not in a container
+func (amg *AuditMessageGroup) ResolveContainer(containers *IdResolver) {
+	for _, msg := range amg.Msgs {
+		pid, ok := msg.Fields()["pid"]
+		if !ok {
+			continue
+		}
+
+		if id := containers.Container(pid); id != "" {
+			msg.SetExtra("container_id", id)
+		}
+	}
+}
+
+// Reads the container id out of /proc/<pid>/cgroup, the last id of the last cgroup that has one wins
+func lookupContainer(pid string) (string, error) {
+	if strings.ContainsAny(pid, "/.") {
+		return "", nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(procDir, pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+
+	id := ""
+	for _, line := range strings.Split(string(b), "\n") {
+		// hierarchy-id:controllers:path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 3 {
+			continue
+		}
+
+		if ids := containerIdPattern.FindAllString(parts[2], -1); len(ids) > 0 {
+			id = ids[len(ids)-1]
+		}
+	}
+
+	return id, nil
+}
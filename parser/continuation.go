@@ -0,0 +1,167 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A field the kernel split into parts, from its `<name>_len` on
+type splitField struct {
+	name  string
+	parts map[int]string // As logged, quoted or hex encoded, by index
+}
+
+// Puts back together every field the kernel split because it was too long for one record, like a long execve
+// argument or a very long path. A split field is logged as `<name>_len=N` followed by `<name>[0]`, `<name>[1]`, ...
+// and the parts may carry on in the next records of the same type, up to the next `<name>_len` of that type
+// The joined value replaces `<name>_len` in the record that had it and the parts are taken out, hex encoded parts
+// stay encoded. Records left with nothing once their parts are taken out are removed
+func (amg *AuditMessageGroup) JoinSplitFields() {
+	// The split fields each record starts, the ones still taking parts by record type and name and the split field
+	// every part of each record belongs to
+	started := map[*AuditMessage][]*splitField{}
+	open := map[uint16]map[string]*splitField{}
+	owners := map[*AuditMessage]map[string]*splitField{}
+
+	for _, msg := range amg.Msgs {
+		splitFields(msg.Data, func(key, value string, quote byte) {
+			if name := strings.TrimSuffix(key, "_len"); name != key && name != "" {
+				f := &splitField{name: name, parts: map[int]string{}}
+				if open[msg.Type] == nil {
+					open[msg.Type] = map[string]*splitField{}
+				}
+
+				open[msg.Type][name] = f
+				started[msg] = append(started[msg], f)
+				return
+			}
+
+			name, i, ok := splitPart(key)
+			if !ok || open[msg.Type][name] == nil {
+				return
+			}
+
+			if quote != 0 {
+				value = string(quote) + value + string(quote)
+			}
+
+			open[msg.Type][name].parts[i] = value
+			if owners[msg] == nil {
+				owners[msg] = map[string]*splitField{}
+			}
+
+			owners[msg][key] = open[msg.Type][name]
+		})
+	}
+
+	if len(started) == 0 {
+		return
+	}
+
+	msgs := amg.Msgs[:0]
+	for _, msg := range amg.Msgs {
+		if started[msg] == nil && owners[msg] == nil {
+			msgs = append(msgs, msg)
+			continue
+		}
+
+		data := joinRecord(msg.Data, started[msg], owners[msg])
+		amg.Size -= len(msg.Data) - len(data)
+		msg.Data = data
+		msg.fields = nil
+
+		if data != "" {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	amg.Msgs = msgs
+}
+
+// The data of a record with the split fields it starts joined in place of their `<name>_len` and the parts it holds
+// taken out. Split fields without a first part are left as they are, parts and all
+func joinRecord(data string, started []*splitField, owners map[string]*splitField) string {
+	var kept []string
+	splitFields(data, func(key, value string, quote byte) {
+		for _, f := range started {
+			if key != f.name+"_len" {
+				continue
+			}
+
+			if v, ok := f.join(); ok {
+				kept = append(kept, f.name+"="+v)
+				return
+			}
+		}
+
+		if f := owners[key]; f != nil {
+			if _, ok := f.parts[0]; ok {
+				return
+			}
+		}
+
+		if quote != 0 {
+			value = string(quote) + value + string(quote)
+		}
+
+		kept = append(kept, key+"="+value)
+	})
+
+	return strings.Join(kept, " ")
+}
+
+// Puts the field back together from its parts, a missing part ends the value early
+// Quoted parts are joined into one quoted value, false if there is not even a first part
+func (f *splitField) join() (string, bool) {
+	keys := make(map[string]string, len(f.parts))
+	for i, part := range f.parts {
+		keys[f.name+"["+strconv.Itoa(i)+"]"] = part
+	}
+
+	return joinParts(f.name, keys)
+}
+
+// Puts a split field back together from the parts in fields, a missing part ends the value early
+// Quoted parts are joined into one quoted value, false if there is not even a first part
+func joinParts(name string, fields map[string]string) (string, bool) {
+	first, ok := fields[name+"[0]"]
+	if !ok {
+		return "", false
+	}
+
+	var quote string
+	if len(first) > 1 && (first[0] == '"' || first[0] == '\'') {
+		quote = first[:1]
+	}
+
+	value := &strings.Builder{}
+	for i := 0; ; i++ {
+		part, ok := fields[name+"["+strconv.Itoa(i)+"]"]
+		if !ok {
+			break
+		}
+
+		if quote != "" {
+			part = strings.TrimSuffix(strings.TrimPrefix(part, quote), quote)
+		}
+
+		value.WriteString(part)
+	}
+
+	return quote + value.String() + quote, true
+}
+
+// Splits a part of a split field, like `name[2]`, into its name and index
+func splitPart(key string) (string, int, bool) {
+	open := strings.IndexByte(key, '[')
+	if open < 1 || !strings.HasSuffix(key, "]") {
+		return "", 0, false
+	}
+
+	i, err := strconv.Atoi(key[open+1 : len(key)-1])
+	if err != nil || i < 0 {
+		return "", 0, false
+	}
+
+	return key[:open], i, true
+}
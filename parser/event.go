@@ -0,0 +1,172 @@
+package parser
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Names for the record types of an event, from include/uapi/linux/audit.h
+var recordTypes = map[uint16]string{
+	1300: "syscall",
+	1302: "path",
+	1303: "ipc",
+	1304: "socketcall",
+	1305: "config_change",
+	1306: "sockaddr",
+	1307: "cwd",
+	1309: "execve",
+	1311: "ipc_set_perm",
+	1312: "mq_open",
+	1313: "mq_sendrecv",
+	1314: "mq_notify",
+	1315: "mq_getsetattr",
+	1316: "kernel_other",
+	1317: "fd_pair",
+	1318: "obj_pid",
+	1319: "tty",
+	1320: "eoe",
+	1321: "bprm_fcaps",
+	1322: "capset",
+	1323: "mmap",
+	1324: "netfilter_pkt",
+	1325: "netfilter_cfg",
+	1326: "seccomp",
+	1327: "proctitle",
+	1328: "feature_change",
+	1329: "replace",
+	1330: "kern_module",
+	1331: "fanotify",
+}
+
+// Record types by the name auditd logs them under, like SYSCALL or PATH
+var recordTypesByName = func() map[string]uint16 {
+	byName := make(map[string]uint16, len(recordTypes))
+	for t, name := range recordTypes {
+		byName[strings.ToUpper(name)] = t
+	}
+
+	return byName
+}()
+
+// A message group assembled into a single object, each record is keyed by its type name
+// Records that show up more than once are an array, path records are always an array ordered by their item index
+type AuditEvent struct {
+	Seq         int                    `json:"sequence"`
+	AuditTime   string                 `json:"timestamp"`
+	OrigTime    string                 `json:"audit_timestamp,omitempty"`
+	Serial      int                    `json:"serial,omitempty"`
+	Records     map[string]interface{} `json:"records"`
+	UidMap      map[string]string      `json:"uid_map"`
+	Fields      map[string]string      `json:"fields,omitempty"`
+	RepeatCount int                    `json:"repeat_count,omitempty"`
+	SampleRate  float64                `json:"sample_rate,omitempty"`
+	Truncated   bool                   `json:"truncated,omitempty"`
+	Raw         []string               `json:"_raw,omitempty"`
+	EmitSeq     *EmitSeq               `json:"_emit_seq,omitempty"`
+	Integrity   *Integrity             `json:"_integrity,omitempty"`
+	group       *AuditMessageGroup
+}
+
+// Assembles the messages of the group into a single event
+func (amg *AuditMessageGroup) Event() *AuditEvent {
+	e := &AuditEvent{
+		Seq:         amg.Seq,
+		AuditTime:   amg.AuditTime,
+		OrigTime:    amg.OrigAuditTime,
+		Serial:      amg.Serial,
+		Records:     make(map[string]interface{}, len(amg.Msgs)),
+		UidMap:      amg.UidMap,
+		Fields:      amg.Fields,
+		RepeatCount: amg.RepeatCount,
+		SampleRate:  amg.SampleRate,
+		Truncated:   amg.Truncated,
+		Raw:         amg.Raw,
+		EmitSeq:     amg.EmitSeq,
+		Integrity:   amg.Integrity,
+		group:       amg,
+	}
+
+	var paths []map[string]interface{}
+	for _, msg := range amg.Msgs {
+		record := msg.record()
+		name := RecordTypeName(msg.Type)
+
+		if name == "path" {
+			paths = append(paths, record)
+			continue
+		}
+
+		switch existing := e.Records[name].(type) {
+		case nil:
+			e.Records[name] = record
+		case map[string]interface{}:
+			e.Records[name] = []map[string]interface{}{existing, record}
+		case []map[string]interface{}:
+			e.Records[name] = append(existing, record)
+		}
+	}
+
+	if len(paths) > 0 {
+		sort.SliceStable(paths, func(i, j int) bool {
+			return itemIndex(paths[i]) < itemIndex(paths[j])
+		})
+		e.Records["path"] = paths
+	}
+
+	return e
+}
+
+// The message group the event was assembled from
+func (e *AuditEvent) Group() *AuditMessageGroup {
+	return e.group
+}
+
+// Returns the name used for a record type in assembled events, unknown types are named after their id
+func RecordTypeName(t uint16) string {
+	if name, ok := recordTypes[t]; ok {
+		return name
+	}
+
+	return "type_" + strconv.Itoa(int(t))
+}
+
+// Returns the record type for the name auditd logs it under, types auditd has no name for are logged as UNKNOWN[1234]
+func RecordType(name string) (uint16, bool) {
+	if t, ok := recordTypesByName[name]; ok {
+		return t, true
+	}
+
+	if strings.HasPrefix(name, "UNKNOWN[") && strings.HasSuffix(name, "]") {
+		if t, err := strconv.ParseUint(name[8:len(name)-1], 10, 16); err == nil {
+			return uint16(t), true
+		}
+	}
+
+	return 0, false
+}
+
+// Copies the fields of the message, along with any extra fields under `extra`
+func (am *AuditMessage) record() map[string]interface{} {
+	fields := am.Fields()
+	record := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		record[k] = v
+	}
+
+	if len(am.Extra) > 0 {
+		record["extra"] = am.Extra
+	}
+
+	return record
+}
+
+// Path records without a usable item go last
+func itemIndex(record map[string]interface{}) int {
+	item, _ := record["item"].(string)
+	if i, err := strconv.Atoi(item); err == nil {
+		return i
+	}
+
+	return int(^uint(0) >> 1)
+}
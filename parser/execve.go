@@ -0,0 +1,153 @@
+package parser
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const EXECVE_TYPE = 1309 // Record type holding the arguments of an execve
+
+// Adds a `cmdline` extra field to the first execve record of the group with every argument in order
+// The kernel logs each argument as `aN`, or splits long ones into `aN_len` followed by `aN[0]`, `aN[1]`, ...
+// and a long argument list may be spread over several execve records
+// Arguments that contain spaces or quotes are quoted in the result so they can be told apart
+func (amg *AuditMessageGroup) ReassembleExecve() {
+	var first *AuditMessage
+	argc := -1
+	args := map[string]string{}
+
+	for _, msg := range amg.Msgs {
+		if msg.Type != EXECVE_TYPE {
+			continue
+		}
+
+		if first == nil {
+			first = msg
+		}
+
+		splitFields(msg.Data, func(key, value string, quote byte) {
+			if key == "argc" {
+				argc, _ = strconv.Atoi(value)
+				return
+			}
+
+			// Kept as logged, quoted or hex encoded, until the parts of split arguments are joined
+			if quote != 0 {
+				value = string(quote) + value + string(quote)
+			}
+
+			args[key] = value
+		})
+	}
+
+	if first == nil || argc < 0 {
+		return
+	}
+
+	cmdline := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		name := "a" + strconv.Itoa(i)
+		arg, ok := args[name]
+		if !ok {
+			arg, _ = joinParts(name, args)
+		}
+
+		cmdline = append(cmdline, quoteArg(decodeArg(arg)))
+	}
+
+	first.SetExtra("cmdline", strings.Join(cmdline, " "))
+}
+
+// Removes the arguments from the execve records of the group once ReassembleExecve has put them in `cmdline`
+// The first record keeps its argc and the cmdline, the records holding nothing but arguments are removed
+// Nothing is removed from a group without a cmdline, the arguments would be lost otherwise
+func (amg *AuditMessageGroup) DropExecveArgs() {
+	var first *AuditMessage
+	for _, msg := range amg.Msgs {
+		if msg.Type == EXECVE_TYPE {
+			first = msg
+			break
+		}
+	}
+
+	if first == nil {
+		return
+	}
+
+	if _, ok := first.Extra["cmdline"]; !ok {
+		return
+	}
+
+	msgs := amg.Msgs[:0]
+	for _, msg := range amg.Msgs {
+		if msg.Type == EXECVE_TYPE {
+			data := withoutArgs(msg.Data)
+			amg.Size -= len(msg.Data) - len(data)
+			msg.Data = data
+			msg.fields = nil
+
+			if msg != first && data == "" {
+				continue
+			}
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	amg.Msgs = msgs
+}
+
+// The data of an execve record with every aN, aN_len and aN[i] field taken out
+func withoutArgs(data string) string {
+	var kept []string
+	splitFields(data, func(key, value string, quote byte) {
+		if isExecveArg(key) {
+			return
+		}
+
+		if quote != 0 {
+			value = string(quote) + value + string(quote)
+		}
+
+		kept = append(kept, key+"="+value)
+	})
+
+	return strings.Join(kept, " ")
+}
+
+func isExecveArg(key string) bool {
+	i := 1
+	for i < len(key) && key[i] >= '0' && key[i] <= '9' {
+		i++
+	}
+
+	if key == "" || key[0] != 'a' || i == 1 {
+		return false
+	}
+
+	rest := key[i:]
+	return rest == "" || rest == "_len" || (strings.HasPrefix(rest, "[") && strings.HasSuffix(rest, "]"))
+}
+
+// Quoted arguments lose their quotes, unquoted ones are hex encoded, anything that does not decode is kept as is
+func decodeArg(value string) string {
+	if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+
+	dec, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+
+	return string(dec)
+}
+
+func quoteArg(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\") {
+		return strconv.Quote(arg)
+	}
+
+	return arg
+}
@@ -0,0 +1,243 @@
+package parser
+
+import (
+	"encoding/hex"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fields the kernel hex encodes when they contain spaces or other special characters
+var hexFields = map[string]bool{
+	"proctitle": true,
+	"cmdline":   true,
+	"name":      true,
+}
+
+// Calls fn for every key=value pair in the data of an audit message
+// Quoted values are given without their quotes, the quote character (or 0) is passed along so callers
+// can tell plain values from hex encoded ones, which the kernel never quotes
+func splitFields(data string, fn func(key, value string, quote byte)) {
+	i := 0
+	for i < len(data) {
+		// Skip any separators
+		for i < len(data) && data[i] == spaceChar {
+			i++
+		}
+
+		start := i
+		for i < len(data) && data[i] != '=' && data[i] != spaceChar {
+			i++
+		}
+
+		// Not a key=value pair, ignore it
+		if i >= len(data) || data[i] != '=' {
+			continue
+		}
+
+		key := data[start:i]
+		i++
+
+		var quote byte
+		if i < len(data) && (data[i] == '"' || data[i] == '\'') {
+			quote = data[i]
+			i++
+			start = i
+			for i < len(data) && data[i] != quote {
+				i++
+			}
+
+			fn(key, data[start:i], quote)
+			i++
+			continue
+		}
+
+		start = i
+		for i < len(data) && data[i] != spaceChar {
+			i++
+		}
+
+		fn(key, data[start:i], quote)
+	}
+}
+
+// Parses the key=value pairs found in audit message data
+// Single quoted values, like the `msg='...'` of user space messages, contain their own pairs which are
+// included as well but never override a top level field
+func ParseFields(data string) map[string]string {
+	fields := make(map[string]string)
+	var nested []string
+
+	splitFields(data, func(key, value string, quote byte) {
+		fields[key] = value
+		if quote == '\'' {
+			nested = append(nested, value)
+		}
+	})
+
+	for _, n := range nested {
+		splitFields(n, func(key, value string, quote byte) {
+			if _, ok := fields[key]; !ok {
+				fields[key] = value
+			}
+		})
+	}
+
+	return fields
+}
+
+// Returns the parsed key=value pairs of the message
+func (am *AuditMessage) Fields() map[string]string {
+	if am.fields == nil {
+		am.fields = ParseFields(am.Data)
+	}
+
+	return am.fields
+}
+
+// Cuts the data of the message down to its first n bytes
+func (am *AuditMessage) Truncate(n int) {
+	if n < len(am.Data) {
+		am.Data = am.Data[:n]
+		am.fields = nil
+	}
+}
+
+// Adds an extra field to the message, extra fields are derived by go-audit and are kept apart
+// from the kernel provided data
+func (am *AuditMessage) SetExtra(key, value string) {
+	if am.Extra == nil {
+		am.Extra = make(map[string]string, 2)
+	}
+
+	am.Extra[key] = value
+}
+
+// Finds the first message in the group containing the field and returns its value
+func (amg *AuditMessageGroup) Field(name string) (string, bool) {
+	for _, msg := range amg.Msgs {
+		if v, ok := msg.Fields()[name]; ok {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// Like Field but for text fields, like `exe` and `comm`, which the kernel hex encodes instead of quoting
+// when they contain spaces or other special characters. Encoded values are decoded
+func (amg *AuditMessageGroup) TextField(name string) (string, bool) {
+	var value string
+	found := false
+
+	for _, msg := range amg.Msgs {
+		splitFields(msg.Data, func(key, v string, quote byte) {
+			if found || key != name {
+				return
+			}
+
+			found = true
+			value = v
+			if quote == 0 {
+				if dec, err := hex.DecodeString(v); err == nil {
+					value = string(dec)
+				}
+			}
+		})
+
+		if found {
+			break
+		}
+	}
+
+	return value, found
+}
+
+// Returns the rule keys of the group, every key once in the order they were logged
+// A rule with several keys is logged unquoted and hex encoded, with the keys separated by 0x01,
+// some kernels and records repeat the `key` field instead so every one of them is read
+func (amg *AuditMessageGroup) Keys() []string {
+	var keys []string
+
+	add := func(k string) {
+		if k == "" {
+			return
+		}
+
+		for _, seen := range keys {
+			if seen == k {
+				return
+			}
+		}
+
+		keys = append(keys, k)
+	}
+
+	for _, msg := range amg.Msgs {
+		splitFields(msg.Data, func(key, value string, quote byte) {
+			if key != "key" {
+				return
+			}
+
+			if quote == 0 {
+				dec, err := hex.DecodeString(value)
+				if err != nil {
+					// (null) when the rule has no key
+					return
+				}
+
+				value = string(dec)
+			}
+
+			for _, k := range strings.Split(value, "\x01") {
+				add(k)
+			}
+		})
+	}
+
+	return keys
+}
+
+// Adds a decoded copy of every hex encoded field to the extra fields of its message, under the same name
+// Values that are not valid hex or do not decode to printable text are copied as is
+func (amg *AuditMessageGroup) DecodeHex() {
+	for _, msg := range amg.Msgs {
+		splitFields(msg.Data, func(key, value string, quote byte) {
+			if !hexFields[key] {
+				return
+			}
+
+			// The kernel quotes values it did not encode
+			if quote != 0 {
+				return
+			}
+
+			msg.SetExtra(key, decodeHex(key, value))
+		})
+	}
+}
+
+// Decodes a hex encoded value, falling back to the original value if it can not be made readable
+func decodeHex(key, value string) string {
+	dec, err := hex.DecodeString(value)
+	if err != nil || len(dec) == 0 {
+		return value
+	}
+
+	// Arguments in the process title are NUL separated
+	if key == "proctitle" || key == "cmdline" {
+		dec = []byte(strings.Replace(strings.TrimRight(string(dec), "\x00"), "\x00", " ", -1))
+	}
+
+	if !utf8.Valid(dec) {
+		return value
+	}
+
+	for _, r := range string(dec) {
+		if !unicode.IsPrint(r) && r != '\t' {
+			return value
+		}
+	}
+
+	return string(dec)
+}
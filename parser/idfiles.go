@@ -0,0 +1,143 @@
+package parser
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// Where the local user and group databases are read from when resolving ids from files
+const (
+	PASSWD_FILE = "/etc/passwd"
+	GROUP_FILE  = "/etc/group"
+)
+
+// A snapshot of the names in the passwd and group files, ids are looked up without going through nss
+type IdFiles struct {
+	users  map[string]string
+	groups map[string]string
+}
+
+// Reads the passwd and group files, both are `name:password:id:...` lines
+func LoadIdFiles(passwd, group string) (*IdFiles, error) {
+	users, err := readIdFile(passwd)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := readIdFile(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IdFiles{users: users, groups: groups}, nil
+}
+
+// Maps the id of every entry to its name, the first entry wins when an id shows up more than once like getpwuid does
+// Comments, blank lines and the `+` and `-` lines of nis compat mode are skipped
+func readIdFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to read %s. Error: %s", path, err))
+	}
+	defer f.Close()
+
+	names := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' || text[0] == '+' || text[0] == '-' {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 4)
+		if len(parts) < 3 || parts[0] == "" {
+			return nil, errors.New(fmt.Sprintf("Failed to parse line %d of %s", line, path))
+		}
+
+		if _, ok := names[parts[2]]; !ok {
+			names[parts[2]] = parts[0]
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to read %s. Error: %s", path, err))
+	}
+
+	return names, nil
+}
+
+func (f *IdFiles) Users() int {
+	return len(f.users)
+}
+
+func (f *IdFiles) Groups() int {
+	return len(f.groups)
+}
+
+// Resolves user and group ids from the snapshot instead of nss, forgetting every name cached so far
+// Ids missing from the snapshot are looked up with nss when fallback is set, they are unknown otherwise
+func (r *IdResolver) UseFiles(files *IdFiles, fallback bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.lookupUser = snapshotLookup(files.users, fallback, lookupUser)
+	r.lookupGroup = snapshotLookup(files.groups, fallback, lookupGroup)
+
+	r.order.Init()
+	r.entries = make(map[string]*list.Element, r.size)
+	r.gen++
+}
+
+// Names the uid_map of events from the snapshot instead of nss, like UseFiles does for an IdResolver
+// A nil snapshot goes back to nss. Either way every name mapped so far is forgotten
+func UseUidFiles(files *IdFiles, fallback bool) {
+	lookup := lookupUser
+	if files != nil {
+		lookup = snapshotLookup(files.users, fallback, lookupUser)
+	}
+
+	uidLock.Lock()
+	defer uidLock.Unlock()
+
+	uidLookup = lookup
+	uidMap = map[string]string{}
+}
+
+func snapshotLookup(names map[string]string, fallback bool, nss func(string) (string, error)) func(string) (string, error) {
+	return func(id string) (string, error) {
+		if name, ok := names[id]; ok {
+			return name, nil
+		}
+
+		if fallback {
+			return nss(id)
+		}
+
+		return "", errors.New(fmt.Sprintf("%s was not found", id))
+	}
+}
+
+// Looks up a user name with nss, through cgo when it is available
+func lookupUser(uid string) (string, error) {
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return "", err
+	}
+
+	return u.Username, nil
+}
+
+// Looks up a group name with nss, through cgo when it is available
+func lookupGroup(gid string) (string, error) {
+	g, err := user.LookupGroupId(gid)
+	if err != nil {
+		return "", err
+	}
+
+	return g.Name, nil
+}
@@ -2,14 +2,17 @@ package parser
 
 import (
 	"bytes"
-	"os/user"
+	"encoding/base64"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 var uidMap = map[string]string{}
+var uidLookup = lookupUser // How names missing from uidMap are found, see UseUidFiles
+var uidLock sync.Mutex     // Guards uidMap and uidLookup, never held while looking a name up
 var headerEndChar = []byte{")"[0]}
 var headerSepChar = byte(':')
 var spaceChar = byte(' ')
@@ -21,28 +24,58 @@ const (
 )
 
 type AuditMessage struct {
-	Type      uint16 `json:"type"`
-	Data      string `json:"data"`
-	Seq       int    `json:"-"`
-	AuditTime string `json:"-"`
+	Type      uint16            `json:"type"`
+	Data      string            `json:"data"`
+	Extra     map[string]string `json:"extra,omitempty"`
+	Seq       int               `json:"-"`
+	AuditTime string            `json:"-"`
+	Raw       []byte            `json:"-"` // The netlink payload as received, header included, only kept when asked for
+	fields    map[string]string
 }
 
 type AuditMessageGroup struct {
 	Seq           int               `json:"sequence"`
 	AuditTime     string            `json:"timestamp"`
+	OrigAuditTime string            `json:"audit_timestamp,omitempty"` // The timestamp as the kernel wrote it, only set once it was parsed
+	Serial        int               `json:"serial,omitempty"`          // The serial of the event, only set once the timestamp was parsed
 	CompleteAfter time.Time         `json:"-"`
+	Received      time.Time         `json:"-"`
 	Msgs          []*AuditMessage   `json:"messages"`
 	UidMap        map[string]string `json:"uid_map"`
+	Fields        map[string]string `json:"fields,omitempty"`       // Added by go-audit, kept apart from the kernel provided data
+	RepeatCount   int               `json:"repeat_count,omitempty"` // Identical events suppressed before this one by the dedupe window
+	SampleRate    float64           `json:"sample_rate,omitempty"`  // The fraction of events like this one that a sampling filter kept
+	Truncated     bool              `json:"truncated,omitempty"`    // Some of the data was thrown away to keep the event under a size limit
+	Raw           []string          `json:"_raw,omitempty"`         // The base64 encoded netlink payload of each message, in the order received
+	EmitSeq       *EmitSeq          `json:"_emit_seq,omitempty"`    // Where the event falls in everything written since go-audit started
+	Integrity     *Integrity        `json:"_integrity,omitempty"`   // Signs everything before it, it must stay the last field written
+	Size          int               `json:"-"`                      // Bytes of message data in the group
 	Syscall       string            `json:"-"`
 }
 
+// Numbers the events go-audit writes so events lost after they left go-audit can be told apart from ones the kernel lost
+// Seq goes up by one for every event written and starts over at 1 along with Epoch when go-audit starts
+type EmitSeq struct {
+	Epoch int64  `json:"epoch"` // Milliseconds since the unix epoch when go-audit started
+	Seq   uint64 `json:"seq"`
+}
+
+// An HMAC-SHA256 of an event, hex encoded, over Prev followed by the json of the event without its _integrity
+// Prev is the HMAC of the event written before it when events are chained, empty for the first event of a run
+type Integrity struct {
+	Prev string `json:"prev,omitempty"`
+	HMAC string `json:"hmac"`
+}
+
 // Creates a new message group from the details parsed from the message
 func NewAuditMessageGroup(am *AuditMessage) *AuditMessageGroup {
 	//TODO: allocating 6 msgs per group is lame and we _should_ know ahead of time roughly how many we need
+	now := time.Now()
 	amg := &AuditMessageGroup{
 		Seq:           am.Seq,
 		AuditTime:     am.AuditTime,
-		CompleteAfter: time.Now().Add(COMPLETE_AFTER),
+		CompleteAfter: now.Add(COMPLETE_AFTER),
+		Received:      now,
 		UidMap:        make(map[string]string, 2), // Usually only 2 individual uids per execve
 		Msgs:          make([]*AuditMessage, 0, 6),
 	}
@@ -84,9 +117,40 @@ func parseAuditHeader(msg *syscall.NetlinkMessage) (time string, seq int) {
 	return time, seq
 }
 
+// Gets the audit sequence id of a netlink message without taking the header off, 0 if it does not have one
+func MessageSeq(nlm *syscall.NetlinkMessage) int {
+	headerStop := bytes.Index(nlm.Data, headerEndChar)
+	if headerStop < HEADER_MIN_LENGTH || string(nlm.Data[:HEADER_START_POS]) != "audit(" {
+		return 0
+	}
+
+	sep := bytes.IndexByte(nlm.Data[:headerStop], headerSepChar)
+	if sep < 0 {
+		return 0
+	}
+
+	seq, err := strconv.Atoi(string(nlm.Data[sep+1 : headerStop]))
+	if err != nil || seq < 0 {
+		return 0
+	}
+
+	return seq
+}
+
+// Sets Raw to the base64 encoded raw payload of every message that kept one
+func (amg *AuditMessageGroup) EncodeRaw() {
+	amg.Raw = nil
+	for _, msg := range amg.Msgs {
+		if msg.Raw != nil {
+			amg.Raw = append(amg.Raw, base64.StdEncoding.EncodeToString(msg.Raw))
+		}
+	}
+}
+
 // Add a new message to the current message group
 func (amg *AuditMessageGroup) AddMessage(am *AuditMessage) {
 	amg.Msgs = append(amg.Msgs, am)
+	amg.Size += len(am.Data)
 	//TODO: need to find more message types that won't contain uids, also make these constants
 	switch am.Type {
 	case 1309, 1307, 1306:
@@ -99,6 +163,17 @@ func (amg *AuditMessageGroup) AddMessage(am *AuditMessage) {
 	}
 }
 
+// Looks up the usernames of the uids in a message before it is added to a group, AddMessage then finds them cached
+// Lets a caller that adds messages under a lock do the slow part, asking nss or the passwd file, outside of it
+func LookupUids(am *AuditMessage) {
+	switch am.Type {
+	case 1309, 1307, 1306:
+		return
+	}
+
+	(&AuditMessageGroup{UidMap: make(map[string]string)}).mapUids(am)
+}
+
 // Find all `uid=` occurrences in a message and adds the username to the UidMap object
 func (amg *AuditMessageGroup) mapUids(am *AuditMessage) {
 	data := am.Data
@@ -140,6 +215,36 @@ func (amg *AuditMessageGroup) mapUids(am *AuditMessage) {
 
 }
 
+// Parses the audit timestamp of the group, `seconds.milliseconds` since the epoch
+// False means the group has no usable timestamp
+func (amg *AuditMessageGroup) Time() (time.Time, bool) {
+	secs, millis := amg.AuditTime, "0"
+	if amg.OrigAuditTime != "" {
+		secs = amg.OrigAuditTime
+	}
+
+	if dot := strings.IndexByte(secs, '.'); dot >= 0 {
+		secs, millis = secs[:dot], secs[dot+1:]
+	}
+
+	s, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	// The kernel always prints 3 digits, pad anything shorter so .5 is still half a second
+	if len(millis) > 3 {
+		return time.Time{}, false
+	}
+
+	ms, err := strconv.ParseInt((millis + "00")[:3], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(s, ms*int64(time.Millisecond)), true
+}
+
 func (amg *AuditMessageGroup) findSyscall(am *AuditMessage) {
 	data := am.Data
 	start := 0
@@ -166,19 +271,24 @@ func (amg *AuditMessageGroup) findSyscall(am *AuditMessage) {
 
 // Gets a username for a user id
 func getUsername(uid string) string {
-	uname := "UNKNOWN_USER"
-
-	// Make sure we have a uid element to work with.
-	// Give a default value in case we don't find something.
-	if lUser, ok := uidMap[uid]; ok {
-		uname = lUser
-	} else {
-		lUser, err := user.LookupId(uid)
-		if err == nil {
-			uname = lUser.Username
-		}
-		uidMap[uid] = uname
+	uidLock.Lock()
+	uname, ok := uidMap[uid]
+	lookup := uidLookup
+	uidLock.Unlock()
+
+	if ok {
+		return uname
 	}
 
+	// Give a default value in case we don't find something
+	uname = "UNKNOWN_USER"
+	if name, err := lookup(uid); err == nil {
+		uname = name
+	}
+
+	uidLock.Lock()
+	uidMap[uid] = uname
+	uidLock.Unlock()
+
 	return uname
 }
@@ -1,7 +1,16 @@
 package parser
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -33,6 +42,16 @@ func TestNewAuditMessage(t *testing.T) {
 	assert.Equal(t, "hi there", am.Data)
 }
 
+func TestMessageSeq(t *testing.T) {
+	msg := &syscall.NetlinkMessage{Data: []byte("audit(10000001:99): hi there")}
+	assert.Equal(t, 99, MessageSeq(msg))
+	assert.Equal(t, "audit(10000001:99): hi there", string(msg.Data), "the header is left alone")
+
+	for _, data := range []string{"", "hi there", "audit(10000001): hi", "audit(10000001:x): hi", "audit(10000001:-1): hi"} {
+		assert.Equal(t, 0, MessageSeq(&syscall.NetlinkMessage{Data: []byte(data)}), data)
+	}
+}
+
 func TestAuditMessageGroup_AddMessage(t *testing.T) {
 	uidMap = make(map[string]string, 0)
 	uidMap["0"] = "hi"
@@ -94,6 +113,59 @@ func TestNewAuditMessageGroup(t *testing.T) {
 	assert.Equal(t, m, amg.Msgs[0], "First message should be the original")
 }
 
+func TestAuditMessageGroup_Time(t *testing.T) {
+	amg := &AuditMessageGroup{AuditTime: "1500000000.123"}
+	ts, ok := amg.Time()
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1500000000, 123000000), ts)
+
+	amg.AuditTime = "1500000000"
+	ts, ok = amg.Time()
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1500000000, 0), ts)
+
+	for _, bad := range []string{"", "abc", "1500000000.x", "1500000000.1234"} {
+		amg.AuditTime = bad
+		_, ok = amg.Time()
+		assert.False(t, ok, bad)
+	}
+}
+
+func TestAuditMessageGroup_ParseTimestamp(t *testing.T) {
+	amg := &AuditMessageGroup{Seq: 4567, AuditTime: "1516650001.123"}
+	assert.Nil(t, amg.ParseTimestamp())
+	assert.Equal(t, "2018-01-22T19:40:01.123Z", amg.AuditTime)
+	assert.Equal(t, "1516650001.123", amg.OrigAuditTime)
+	assert.Equal(t, 4567, amg.Serial)
+
+	// the original is still what the time is read from
+	ts, ok := amg.Time()
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1516650001, 123000000), ts)
+
+	// doing it again changes nothing
+	assert.Nil(t, amg.ParseTimestamp())
+	assert.Equal(t, "2018-01-22T19:40:01.123Z", amg.AuditTime)
+	assert.Equal(t, "1516650001.123", amg.OrigAuditTime)
+
+	// milliseconds are always written, a clock that was never set is taken as is
+	amg = &AuditMessageGroup{Seq: 1, AuditTime: "0.5"}
+	assert.Nil(t, amg.ParseTimestamp())
+	assert.Equal(t, "1970-01-01T00:00:00.500Z", amg.AuditTime)
+
+	amg = &AuditMessageGroup{Seq: 1, AuditTime: "1516650001"}
+	assert.Nil(t, amg.ParseTimestamp())
+	assert.Equal(t, "2018-01-22T19:40:01.000Z", amg.AuditTime)
+
+	for _, bad := range []string{"", "abc", "-1.000", "1516650001.1234"} {
+		amg = &AuditMessageGroup{Seq: 2, AuditTime: bad}
+		assert.EqualError(t, amg.ParseTimestamp(), "Could not parse timestamp `"+bad+"` of event 2")
+		assert.Equal(t, bad, amg.AuditTime)
+		assert.Equal(t, "", amg.OrigAuditTime)
+		assert.Equal(t, 0, amg.Serial)
+	}
+}
+
 func Test_getUsername(t *testing.T) {
 	uidMap = make(map[string]string, 0)
 	assert.Equal(t, "root", getUsername("0"), "0 should be root you animal")
@@ -140,8 +212,671 @@ func TestAuditMessageGroup_mapUids(t *testing.T) {
 	assert.Equal(t, "derp", amg.UidMap["99999"])
 }
 
+func TestLookupUids(t *testing.T) {
+	defer UseUidFiles(nil, false)
+	lookups := 0
+	uidMap = make(map[string]string)
+	uidLookup = func(uid string) (string, error) {
+		lookups++
+		return "user" + uid, nil
+	}
+
+	LookupUids(&AuditMessage{Type: 1309, Data: "argc=1 a0=\"uid=5\""})
+	assert.Equal(t, 0, lookups, "Execve arguments should not be looked up")
+
+	m := &AuditMessage{Type: 1300, Data: "auid=1000 uid=0 euid=0"}
+	LookupUids(m)
+	assert.Equal(t, 2, lookups)
+
+	// Adding the message afterwards finds the names cached
+	amg := NewAuditMessageGroup(m)
+	assert.Equal(t, 2, lookups)
+	assert.Equal(t, map[string]string{"1000": "user1000", "0": "user0"}, amg.UidMap)
+}
+
 func Benchmark_getUsername(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = getUsername("0")
 	}
 }
+
+func TestParseFields(t *testing.T) {
+	f := ParseFields(`arch=c000003e syscall=59 success=yes comm="ls -l" exe="/bin/ls" key=(null) proctitle=6C73 bare`)
+	assert.Equal(t, map[string]string{
+		"arch":      "c000003e",
+		"syscall":   "59",
+		"success":   "yes",
+		"comm":      "ls -l",
+		"exe":       "/bin/ls",
+		"key":       "(null)",
+		"proctitle": "6C73",
+	}, f)
+
+	// Nested user space message fields never override the top level ones
+	f = ParseFields(`pid=1 uid=0 auid=1000 msg='op=PAM:session_open acct="root" exe="/bin/su" pid=2 res=success'`)
+	assert.Equal(t, "1", f["pid"])
+	assert.Equal(t, "root", f["acct"])
+	assert.Equal(t, "success", f["res"])
+	assert.Equal(t, "/bin/su", f["exe"])
+
+	// Cached on the message
+	m := &AuditMessage{Data: "a=1"}
+	assert.Equal(t, "1", m.Fields()["a"])
+	m.Data = "a=2"
+	assert.Equal(t, "1", m.Fields()["a"])
+}
+
+func TestAuditMessageGroup_Keys(t *testing.T) {
+	group := func(data string) *AuditMessageGroup {
+		return NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: data})
+	}
+
+	assert.Equal(t, []string{"mykey"}, group(`syscall=2 key="mykey"`).Keys())
+	assert.Equal(t, []string{"abcd"}, group(`syscall=2 key="abcd"`).Keys())
+	assert.Equal(t, []string{"one", "two"}, group(`syscall=2 key=6F6E650174776F`).Keys())
+	assert.Nil(t, group(`syscall=2 key=(null)`).Keys())
+	assert.Nil(t, group(`syscall=2`).Keys())
+
+	// A rule with two keys, as the repeated field some records use and across the messages of the group
+	assert.Equal(t, []string{"one", "two"}, group(`syscall=2 key="one" key="two"`).Keys())
+	assert.Equal(t, []string{"one", "two"}, group(`syscall=2 key=6F6E650174776F key="two" key=(null)`).Keys())
+
+	amg := group(`syscall=2 key="one"`)
+	amg.AddMessage(&AuditMessage{Type: 1305, Data: `op=add_rule key=74776F016F6E65 list=4 res=1`})
+	assert.Equal(t, []string{"one", "two"}, amg.Keys())
+}
+
+func TestAuditMessageGroup_TextField(t *testing.T) {
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: `syscall=59 comm="ls" exe=2F746D702F6120622F6C73 tty=(none)`})
+
+	v, ok := amg.TextField("comm")
+	assert.True(t, ok)
+	assert.Equal(t, "ls", v)
+
+	v, ok = amg.TextField("exe")
+	assert.True(t, ok)
+	assert.Equal(t, "/tmp/a b/ls", v)
+
+	v, ok = amg.TextField("tty")
+	assert.True(t, ok)
+	assert.Equal(t, "(none)", v)
+
+	_, ok = amg.TextField("cwd")
+	assert.False(t, ok)
+}
+
+func TestAuditMessageGroup_DecodeHex(t *testing.T) {
+	amg := &AuditMessageGroup{
+		Msgs: []*AuditMessage{
+			{Type: 1327, Data: "proctitle=6C73002D6C6100"},
+			{Type: 1302, Data: "item=0 name=2F746D702F6120622063 nametype=NORMAL"},
+			{Type: 1302, Data: "item=1 name=\"/bin/ls\""},
+			{Type: 1302, Data: "item=2 name=(null)"},
+			{Type: 1302, Data: "item=3 name=2F746D702F01 cmdline=ABC"},
+		},
+	}
+
+	amg.DecodeHex()
+	assert.Equal(t, map[string]string{"proctitle": "ls -la"}, amg.Msgs[0].Extra)
+	assert.Equal(t, map[string]string{"name": "/tmp/a b c"}, amg.Msgs[1].Extra)
+
+	// quoted values were never encoded
+	assert.Nil(t, amg.Msgs[2].Extra)
+
+	// not hex, non printable and odd length values are kept as is
+	assert.Equal(t, map[string]string{"name": "(null)"}, amg.Msgs[3].Extra)
+	assert.Equal(t, map[string]string{"name": "2F746D702F01", "cmdline": "ABC"}, amg.Msgs[4].Extra)
+}
+
+func TestAuditMessageGroup_ReassembleExecve(t *testing.T) {
+	// An argument with a space is hex encoded
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59"})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=3 a0="ls" a1="-la" a2=2F746D702F612066696C65`})
+	amg.ReassembleExecve()
+	assert.Nil(t, amg.Msgs[0].Extra)
+	assert.Equal(t, map[string]string{"cmdline": `ls -la "/tmp/a file"`}, amg.Msgs[1].Extra)
+
+	// A long argument is split into parts, and the argument list over several records
+	long := strings.Repeat("x", 7500)
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1309, Data: `argc=3 a0="echo" a1_len=15000 a1[0]="` + long + `"`})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `a1[1]="` + long + `"`})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `a2=6F6E650A74776F`})
+	amg.ReassembleExecve()
+	assert.Equal(t, `echo `+long+long+` "one\ntwo"`, amg.Msgs[0].Extra["cmdline"])
+	assert.Nil(t, amg.Msgs[1].Extra)
+
+	// The same once the split argument was joined
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1309, Data: `argc=2 a0="echo" a1_len=15000 a1[0]="` + long + `"`})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `a1[1]="` + long + `"`})
+	amg.JoinSplitFields()
+	amg.ReassembleExecve()
+	assert.Equal(t, 1, len(amg.Msgs))
+	assert.Equal(t, `echo `+long+long, amg.Msgs[0].Extra["cmdline"])
+
+	// Nothing to do
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=2"})
+	amg.ReassembleExecve()
+	assert.Nil(t, amg.Msgs[0].Extra)
+}
+
+func TestAuditMessageGroup_JoinSplitFields(t *testing.T) {
+	// An openat of a very long path, the kernel split the name of the first PATH record and carried it on in the next
+	// record. The cwd has a space so it is hex encoded, and split too
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "split_path.log"))
+	assert.Nil(t, err)
+
+	var amg *AuditMessageGroup
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		typ, _ := strconv.Atoi(parts[0])
+		am := NewAuditMessage(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(typ)}, Data: []byte(parts[1])})
+		if amg == nil {
+			amg = NewAuditMessageGroup(am)
+		} else {
+			amg.AddMessage(am)
+		}
+	}
+
+	dirs := make([]string, 0, 799)
+	for i := 1; i < 800; i++ {
+		dirs = append(dirs, fmt.Sprintf("d%03d", i))
+	}
+	path := "/srv/archive/" + strings.Join(dirs, "/") + "/report.pdf"
+	cwd := "/home/alice/My Documents/" + strings.Repeat("x", 200)
+
+	assert.Equal(t, 5, len(amg.Msgs))
+	amg.JoinSplitFields()
+	assert.Equal(t, 4, len(amg.Msgs), "the record holding nothing but parts is removed")
+	assert.Equal(t, `item=0 name="`+path+`" inode=1 dev=fd:00 mode=0100644 nametype=NORMAL`, amg.Msgs[2].Data)
+	assert.Equal(t, path, amg.Msgs[2].Fields()["name"])
+	assert.Equal(t, strings.ToUpper(hex.EncodeToString([]byte(cwd))), amg.Msgs[1].Fields()["cwd"], "hex values stay encoded")
+	v, _ := amg.TextField("cwd")
+	assert.Equal(t, cwd, v)
+	assert.Equal(t, `item=1 name="/srv/archive" inode=2 dev=fd:00 mode=040755 nametype=PARENT`, amg.Msgs[3].Data)
+
+	size := 0
+	for _, msg := range amg.Msgs {
+		size += len(msg.Data)
+	}
+	assert.Equal(t, size, amg.Size)
+
+	// Each split field takes the parts up to the next one of the same name and record type
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1302, Data: `item=0 name_len=4 name[0]="ab" name[1]="cd"`})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: `item=1 name_len=4 name[0]="ef"`})
+	amg.AddMessage(&AuditMessage{Type: 1307, Data: `name[1]="xx"`})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: `name[1]="gh"`})
+	amg.JoinSplitFields()
+	assert.Equal(t, 3, len(amg.Msgs))
+	assert.Equal(t, `item=0 name="abcd"`, amg.Msgs[0].Data)
+	assert.Equal(t, `item=1 name="efgh"`, amg.Msgs[1].Data)
+	assert.Equal(t, `name[1]="xx"`, amg.Msgs[2].Data, "parts of another record type are left alone")
+
+	// Without a first part nothing is joined, a missing part ends the value early
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1302, Data: `name_len=4 name[1]="cd"`})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=1 a0_len=6 a0[0]=6162 a0[2]=6566`})
+	amg.JoinSplitFields()
+	assert.Equal(t, `name_len=4 name[1]="cd"`, amg.Msgs[0].Data)
+	assert.Equal(t, `argc=1 a0=6162`, amg.Msgs[1].Data)
+
+	// Nothing to do
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=2  a0=1"})
+	amg.JoinSplitFields()
+	assert.Equal(t, "syscall=2  a0=1", amg.Msgs[0].Data)
+}
+
+func TestAuditMessageGroup_DropExecveArgs(t *testing.T) {
+	long := strings.Repeat("x", 7500)
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59 a0=7ffd a1=0"})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=3 a0="echo" a1_len=15000 a1[0]="` + long + `"`})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `a1[1]="` + long + `"`})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `a2=6F6E650A74776F`})
+	amg.AddMessage(&AuditMessage{Type: 1307, Data: `cwd="/a10"`})
+
+	// the arguments are only dropped once they are in the cmdline
+	amg.DropExecveArgs()
+	assert.Equal(t, 5, len(amg.Msgs))
+
+	amg.ReassembleExecve()
+	amg.DropExecveArgs()
+	assert.Equal(t, 3, len(amg.Msgs))
+	assert.Equal(t, "syscall=59 a0=7ffd a1=0", amg.Msgs[0].Data, "the syscall record is left alone")
+	assert.Equal(t, "argc=3", amg.Msgs[1].Data)
+	assert.Equal(t, map[string]string{"argc": "3"}, amg.Msgs[1].Fields())
+	assert.Equal(t, `echo `+long+long+` "one\ntwo"`, amg.Msgs[1].Extra["cmdline"])
+	assert.Equal(t, `cwd="/a10"`, amg.Msgs[2].Data)
+	assert.Equal(t, len("syscall=59 a0=7ffd a1=0")+len("argc=3")+len(`cwd="/a10"`), amg.Size)
+
+	// Nothing to do
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=2"})
+	amg.DropExecveArgs()
+	assert.Equal(t, "syscall=2", amg.Msgs[0].Data)
+
+	for key, arg := range map[string]bool{"a0": true, "a12": true, "a1_len": true, "a1[0]": true, "a": false, "argc": false, "arch": false, "a1x": false} {
+		assert.Equal(t, arg, isExecveArg(key), key)
+	}
+}
+
+func TestAuditMessageGroup_ParseSELinux(t *testing.T) {
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=2 subj=system_u:system_r:sshd_t:s0-s0:c0.c1023 key=(null)"})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: "item=0 name=\"/etc/shadow\" obj=system_u:object_r:shadow_t"})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: "item=1 name=\"/tmp\" obj=(null)"})
+	amg.AddMessage(&AuditMessage{Type: 1300, Data: "syscall=2 subj=unlabeled"})
+	amg.AddMessage(&AuditMessage{Type: 1300, Data: "syscall=2 subj=docker-default"})
+	amg.AddMessage(&AuditMessage{Type: 1107, Data: "pid=1 msg='avc: denied { read } scontext=user_u:user_r:user_t:s0 tcontext=system_u:object_r:etc_t:s0'"})
+	amg.ParseSELinux()
+
+	assert.Equal(t, map[string]string{"subj_user": "system_u", "subj_role": "system_r", "subj_type": "sshd_t", "subj_level": "s0-s0:c0.c1023"}, amg.Msgs[0].Extra)
+	assert.Equal(t, map[string]string{"obj_user": "system_u", "obj_role": "object_r", "obj_type": "shadow_t"}, amg.Msgs[1].Extra)
+	assert.Nil(t, amg.Msgs[2].Extra)
+	assert.Nil(t, amg.Msgs[3].Extra)
+	assert.Equal(t, map[string]string{"subj_profile": "docker-default"}, amg.Msgs[4].Extra)
+	assert.Equal(t, "user_t", amg.Msgs[5].Extra["scontext_type"])
+	assert.Equal(t, "etc_t", amg.Msgs[5].Extra["tcontext_type"])
+}
+
+func TestAuditMessageGroup_DecodeSaddr(t *testing.T) {
+	hosts := NewIdResolver(10, time.Hour)
+	hosts.lookupHost = func(ip string) (string, error) {
+		if ip == "127.0.0.1" {
+			return "localhost", nil
+		}
+		return "", errors.New("nope")
+	}
+
+	amg := &AuditMessageGroup{
+		Msgs: []*AuditMessage{
+			{Type: 1306, Data: "saddr=020000357F0000010000000000000000"},
+			{Type: 1306, Data: "saddr=0A0001BB00000000200106B8000000000000000000000001000000002F"},
+			{Type: 1306, Data: "saddr=01002F72756E2F73797374656D642F6A6F75726E616C2F736F636B657400"},
+			{Type: 1306, Data: "saddr=0100006E7363640000"},
+			{Type: 1306, Data: "saddr=10000000000000000000"},
+			{Type: 1306, Data: "saddr=0200"},
+			{Type: 1300, Data: "syscall=42"},
+		},
+	}
+
+	err := amg.DecodeSaddr(hosts)
+	assert.Equal(t, map[string]string{"family": "inet", "addr": "127.0.0.1", "port": "53", "host": "localhost"}, amg.Msgs[0].Extra)
+	assert.Equal(t, map[string]string{"family": "inet6", "addr": "2001:6b8::1", "port": "443"}, amg.Msgs[1].Extra)
+	assert.Equal(t, map[string]string{"family": "unix", "addr": "/run/systemd/journal/socket"}, amg.Msgs[2].Extra)
+	assert.Equal(t, map[string]string{"family": "unix", "addr": "@nscd"}, amg.Msgs[3].Extra)
+
+	// netlink and anything else we do not know is skipped, truncated addresses are left alone and reported
+	assert.Nil(t, amg.Msgs[4].Extra)
+	assert.Nil(t, amg.Msgs[5].Extra)
+	assert.Nil(t, amg.Msgs[6].Extra)
+	assert.EqualError(t, err, "Could not decode saddr 0200 of message 0. Error: truncated inet address of 2 bytes")
+
+	// resolving is optional
+	amg = &AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1306, Data: "saddr=020000357F0000010000000000000000"}}}
+	assert.Nil(t, amg.DecodeSaddr(nil))
+	assert.Equal(t, map[string]string{"family": "inet", "addr": "127.0.0.1", "port": "53"}, amg.Msgs[0].Extra)
+
+	amg = &AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1306, Data: "saddr=zz"}}}
+	assert.EqualError(t, amg.DecodeSaddr(nil), "Could not decode saddr zz of message 0. Error: not hex encoded")
+	assert.Nil(t, amg.Msgs[0].Extra)
+}
+
+func TestHasSyscall(t *testing.T) {
+	assert.True(t, HasSyscall(ARCH_X86_64, "open"))
+	assert.True(t, HasSyscall(ARCH_I386, "open"))
+	assert.True(t, HasSyscall("C00000B7", "openat"))
+	assert.False(t, HasSyscall(ARCH_AARCH64, "open"))
+	assert.False(t, HasSyscall(ARCH_X86_64, "nope"))
+	assert.False(t, HasSyscall("c0000028", "open"))
+}
+
+func TestAuditMessageGroup_ResolveSyscall(t *testing.T) {
+	amg := &AuditMessageGroup{
+		Msgs: []*AuditMessage{
+			{Type: 1300, Data: "arch=c000003e syscall=257 success=yes"},
+			{Type: 1300, Data: "arch=40000003 syscall=11 success=yes"},
+			{Type: 1326, Data: "auid=1000 arch=C00000B7 syscall=221 compat=0"},
+			{Type: 1300, Data: "arch=c000003e syscall=9999"},
+			{Type: 1300, Data: "arch=c0000028 syscall=11"},
+			{Type: 1302, Data: "item=0 name=\"/etc/passwd\""},
+		},
+	}
+
+	err := amg.ResolveSyscall()
+	assert.Equal(t, map[string]string{"syscall_name": "openat"}, amg.Msgs[0].Extra)
+	assert.Equal(t, map[string]string{"syscall_name": "execve"}, amg.Msgs[1].Extra)
+	assert.Equal(t, map[string]string{"syscall_name": "execve"}, amg.Msgs[2].Extra)
+
+	// unknown numbers and architectures are left alone and reported
+	assert.Nil(t, amg.Msgs[3].Extra)
+	assert.Nil(t, amg.Msgs[4].Extra)
+	assert.Nil(t, amg.Msgs[5].Extra)
+	assert.EqualError(t, err, "Could not name syscall 9999 of message 0. Error: unknown for arch `c000003e`")
+
+	_, err = SyscallName("c0000028", "11")
+	assert.EqualError(t, err, "no syscall table for arch `c0000028`")
+}
+
+func TestAuditMessageGroup_Event(t *testing.T) {
+	amg := NewAuditMessageGroup(&AuditMessage{
+		Type:      1300,
+		Seq:       24287,
+		AuditTime: "1364481363.243",
+		Data:      `arch=c000003e syscall=59 success=yes exit=0 items=2 ppid=2686 pid=3538 auid=500 uid=500 comm="cat" exe="/bin/cat" key="sshd_config"`,
+	})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=2 a0="cat" a1="/etc/ssh/sshd_config"`})
+	amg.AddMessage(&AuditMessage{Type: 1307, Data: `cwd="/home/shadowman"`})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: `item=1 name="/lib64/ld-linux-x86-64.so.2" inode=2 nametype=NORMAL`})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: `item=0 name="/bin/cat" inode=1 nametype=NORMAL`})
+	amg.AddMessage(&AuditMessage{Type: 1327, Data: `proctitle=636174002F6574632F7373682F737368645F636F6E666967`})
+	amg.DecodeHex()
+	amg.UidMap = map[string]string{"500": "shadowman"}
+
+	b, err := json.Marshal(amg.Event())
+	assert.Nil(t, err)
+	assert.Equal(
+		t,
+		`{"sequence":24287,"timestamp":"1364481363.243","records":{`+
+			`"cwd":{"cwd":"/home/shadowman"},`+
+			`"execve":{"a0":"cat","a1":"/etc/ssh/sshd_config","argc":"2"},`+
+			`"path":[{"inode":"1","item":"0","name":"/bin/cat","nametype":"NORMAL"},{"inode":"2","item":"1","name":"/lib64/ld-linux-x86-64.so.2","nametype":"NORMAL"}],`+
+			`"proctitle":{"extra":{"proctitle":"cat /etc/ssh/sshd_config"},"proctitle":"636174002F6574632F7373682F737368645F636F6E666967"},`+
+			`"syscall":{"arch":"c000003e","auid":"500","comm":"cat","exe":"/bin/cat","exit":"0","items":"2","key":"sshd_config","pid":"3538","ppid":"2686","success":"yes","syscall":"59","uid":"500"}`+
+			`},"uid_map":{"500":"shadowman"}}`,
+		string(b),
+	)
+
+	// Repeated records become an array, unknown types are named by id
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1306, Data: "saddr=01"})
+	amg.AddMessage(&AuditMessage{Type: 1306, Data: "saddr=02"})
+	amg.AddMessage(&AuditMessage{Type: 1306, Data: "saddr=03"})
+	amg.AddMessage(&AuditMessage{Type: 1399, Data: "a=1"})
+
+	e := amg.Event()
+	assert.Equal(t, 3, len(e.Records["sockaddr"].([]map[string]interface{})))
+	assert.Equal(t, map[string]interface{}{"a": "1"}, e.Records["type_1399"])
+}
+
+func TestIdResolver(t *testing.T) {
+	lookups := 0
+	r := NewIdResolver(2, time.Hour)
+	r.lookupUser = func(uid string) (string, error) {
+		lookups++
+		if uid == "1" {
+			return "", errors.New("nope")
+		}
+		return "user" + uid, nil
+	}
+	r.lookupGroup = func(gid string) (string, error) {
+		lookups++
+		return "group" + gid, nil
+	}
+
+	assert.Equal(t, "user0", r.User("0"))
+	assert.Equal(t, "user0", r.User("0"))
+	assert.Equal(t, 1, lookups, "Expected the name to be cached")
+
+	assert.Equal(t, "UNKNOWN_USER", r.User("1"))
+	assert.Equal(t, 2, lookups)
+
+	// Users and groups are cached apart, the least recently used entry is evicted
+	assert.Equal(t, "group0", r.Group("0"))
+	assert.Equal(t, 3, lookups)
+	assert.Equal(t, 2, r.order.Len())
+	r.User("0")
+	assert.Equal(t, 4, lookups, "Expected user 0 to have been evicted")
+
+	// Expired entries are looked up again
+	r.entries["u0"].Value.(*idCacheEntry).expires = time.Now().Add(-time.Second)
+	r.User("0")
+	assert.Equal(t, 5, lookups, "Expected the expired name to be looked up again")
+}
+
+func TestIdResolver_slowLookup(t *testing.T) {
+	r := NewIdResolver(10, time.Hour)
+	r.lookupUser = func(uid string) (string, error) { return "user" + uid, nil }
+
+	started, release := make(chan struct{}), make(chan struct{})
+	r.lookupHost = func(ip string) (string, error) {
+		close(started)
+		<-release
+		return "slow.example.com", nil
+	}
+
+	done := make(chan string)
+	go func() { done <- r.Host("10.0.0.1") }()
+	<-started
+
+	// A slow reverse lookup does not hold up ids that need no lookup of their own
+	assert.Equal(t, "user0", r.User("0"))
+
+	close(release)
+	assert.Equal(t, "slow.example.com", <-done)
+	assert.Equal(t, "slow.example.com", r.Host("10.0.0.1"), "Expected the name to be cached")
+
+	// A lookup that raced a flush of the cache is not cached
+	started, release = make(chan struct{}), make(chan struct{})
+	go func() { done <- r.Host("10.0.0.2") }()
+	<-started
+	r.UseFiles(&IdFiles{users: map[string]string{}, groups: map[string]string{}}, false)
+	close(release)
+	<-done
+	_, ok := r.entries["h10.0.0.2"]
+	assert.False(t, ok)
+}
+
+func TestLoadIdFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit.etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwd := filepath.Join(dir, "passwd")
+	group := filepath.Join(dir, "group")
+	ioutil.WriteFile(passwd, []byte("# local users\nroot:x:0:0:root:/root:/bin/bash\n\nbob:x:1000:1000::/home/bob:/bin/sh\ntoor:x:0:0::/root:/bin/sh\n+@netgroup\n"), 0644)
+	ioutil.WriteFile(group, []byte("root:x:0:\nwheel:x:10:bob\n"), 0644)
+
+	files, err := LoadIdFiles(passwd, group)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, files.Users())
+	assert.Equal(t, 2, files.Groups())
+	assert.Equal(t, map[string]string{"0": "root", "1000": "bob"}, files.users, "the first entry for an id wins")
+	assert.Equal(t, map[string]string{"0": "root", "10": "wheel"}, files.groups)
+
+	_, err = LoadIdFiles(filepath.Join(dir, "nope"), group)
+	assert.EqualError(t, err, "Failed to read "+filepath.Join(dir, "nope")+". Error: open "+filepath.Join(dir, "nope")+": no such file or directory")
+
+	ioutil.WriteFile(group, []byte("root:x:0:\nwheel\n"), 0644)
+	_, err = LoadIdFiles(passwd, group)
+	assert.EqualError(t, err, "Failed to parse line 2 of "+group)
+}
+
+func TestIdResolver_UseFiles(t *testing.T) {
+	nss := 0
+	r := NewIdResolver(10, time.Hour)
+	r.lookupUser = func(uid string) (string, error) { return "old" + uid, nil }
+	assert.Equal(t, "old0", r.User("0"))
+
+	files := &IdFiles{users: map[string]string{"0": "root"}, groups: map[string]string{"10": "wheel"}}
+	r.UseFiles(files, false)
+
+	// the cache is flushed so names come from the files from now on
+	assert.Equal(t, "root", r.User("0"))
+	assert.Equal(t, "wheel", r.Group("10"))
+	assert.Equal(t, "UNKNOWN_USER", r.User("1000"))
+	assert.Equal(t, "UNKNOWN_GROUP", r.Group("1000"))
+
+	// the uid_map is named from the files too
+	defer UseUidFiles(nil, false)
+	uidMap = map[string]string{"0": "old"}
+	UseUidFiles(files, false)
+	assert.Equal(t, "root", getUsername("0"))
+	assert.Equal(t, "UNKNOWN_USER", getUsername("1000"))
+
+	// missing ids fall back to nss when asked to
+	lookup := snapshotLookup(files.users, true, func(uid string) (string, error) {
+		nss++
+		return "nss" + uid, nil
+	})
+
+	name, err := lookup("0")
+	assert.Nil(t, err)
+	assert.Equal(t, "root", name)
+
+	name, err = lookup("1000")
+	assert.Nil(t, err)
+	assert.Equal(t, "nss1000", name)
+	assert.Equal(t, 1, nss)
+
+	_, err = snapshotLookup(files.users, false, nil)("1000")
+	assert.EqualError(t, err, "1000 was not found")
+}
+
+func TestAuditMessageGroup_ResolveIds(t *testing.T) {
+	r := NewIdResolver(10, time.Hour)
+	r.lookupUser = func(uid string) (string, error) { return "user" + uid, nil }
+	r.lookupGroup = func(gid string) (string, error) { return "group" + gid, nil }
+
+	amg := &AuditMessageGroup{
+		Msgs: []*AuditMessage{
+			{Type: 1300, Data: "syscall=59 auid=1000 uid=0 gid=10 euid=0 comm=\"id\""},
+			{Type: 1302, Data: "item=0 name=\"/bin/id\" ouid=2 ogid=3"},
+			{Type: 1307, Data: "cwd=\"/\""},
+		},
+	}
+
+	amg.ResolveIds(r)
+	assert.Equal(t, map[string]string{"auid_name": "user1000", "uid_name": "user0", "euid_name": "user0", "gid_name": "group10"}, amg.Msgs[0].Extra)
+	assert.Equal(t, map[string]string{"ouid_name": "user2", "ogid_name": "group3"}, amg.Msgs[1].Extra)
+	assert.Nil(t, amg.Msgs[2].Extra)
+}
+
+func TestAuditMessageGroup_ResolveIds_unset(t *testing.T) {
+	lookups := 0
+	r := NewIdResolver(10, time.Hour)
+	r.lookupUser = func(uid string) (string, error) {
+		lookups++
+		return "user" + uid, nil
+	}
+
+	// The kernel logs (uid_t)-1 unsigned on every architecture, user space messages may log it signed
+	for _, unset := range []string{"4294967295", "-1", "unset"} {
+		amg := &AuditMessageGroup{
+			Msgs: []*AuditMessage{
+				{Type: 1300, Data: "syscall=59 auid=" + unset + " uid=0 ses=" + unset},
+				{Type: 1300, Data: "syscall=59 auid=1000 ses=3"},
+			},
+		}
+
+		amg.ResolveIds(r)
+		assert.Equal(t, map[string]string{"auid_name": "unset", "uid_name": "user0", "ses": "unset"}, amg.Msgs[0].Extra, unset)
+		assert.Equal(t, map[string]string{"auid_name": "user1000"}, amg.Msgs[1].Extra, unset)
+	}
+
+	assert.Equal(t, 2, lookups, "Expected unset ids to never be looked up")
+	assert.Equal(t, 2, r.order.Len(), "Expected unset ids to never be cached")
+}
+
+func TestAuditMessageGroup_ResolveContainer(t *testing.T) {
+	containers := NewIdResolver(10, time.Hour)
+	containers.lookupContainer = func(pid string) (string, error) {
+		if pid == "1234" {
+			return "c0ffee", nil
+		}
+		return "", errors.New("gone")
+	}
+
+	amg := &AuditMessageGroup{
+		Msgs: []*AuditMessage{
+			{Type: 1300, Data: "syscall=59 ppid=1 pid=1234"},
+			{Type: 1300, Data: "syscall=59 pid=99"},
+			{Type: 1302, Data: "item=0 name=\"/bin/ls\""},
+		},
+	}
+
+	amg.ResolveContainer(containers)
+	assert.Equal(t, map[string]string{"container_id": "c0ffee"}, amg.Msgs[0].Extra)
+
+	// exited processes and records without a pid are left alone
+	assert.Nil(t, amg.Msgs[1].Extra)
+	assert.Nil(t, amg.Msgs[2].Extra)
+}
+
+func Test_lookupContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit.proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer func(old string) { procDir = old }(procDir)
+	procDir = dir
+
+	id := strings.Repeat("0123456789abcdef", 4)
+	for pid, cgroup := range map[string]string{
+		"1": "0::/init.scope\n",
+		"2": "12:pids:/docker/" + id + "\n1:name=systemd:/docker/" + id + "\n",
+		"3": "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1b2c.slice/cri-containerd-" + id + ".scope\n",
+		"4": "11:memory:/kubepods/besteffort/pod6f9a-11e9/" + id + "\n",
+	} {
+		os.Mkdir(filepath.Join(dir, pid), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, pid, "cgroup"), []byte(cgroup), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// not in a container
+	c, err := lookupContainer("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", c)
+
+	for _, pid := range []string{"2", "3", "4"} {
+		c, err = lookupContainer(pid)
+		assert.Nil(t, err)
+		assert.Equal(t, id, c, "pid "+pid)
+	}
+
+	// exited
+	_, err = lookupContainer("5")
+	assert.NotNil(t, err)
+
+	// never leaves /proc
+	c, err = lookupContainer("../1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", c)
+}
+
+func TestTypeCategory(t *testing.T) {
+	for typ, category := range map[uint16]string{
+		1000: CATEGORY_CONFIG,
+		1112: CATEGORY_LOGIN,
+		1206: CATEGORY_CONFIG,
+		1300: CATEGORY_SYSCALL,
+		1302: CATEGORY_SYSCALL,
+		1305: CATEGORY_CONFIG,
+		1400: CATEGORY_OTHER,
+		1701: CATEGORY_ANOM,
+		2100: CATEGORY_ANOM,
+		2205: CATEGORY_ANOM,
+		2300: CATEGORY_OTHER,
+	} {
+		assert.Equal(t, category, TypeCategory(typ), "type %d", typ)
+	}
+}
+
+func TestAuditMessageGroup_Category(t *testing.T) {
+	amg := &AuditMessageGroup{}
+	assert.Equal(t, CATEGORY_OTHER, amg.Category())
+
+	amg.Msgs = []*AuditMessage{{Type: 1300}, {Type: 1302}}
+	assert.Equal(t, CATEGORY_SYSCALL, amg.Category())
+
+	// A config change wins over the syscall that made it
+	amg.Msgs = append(amg.Msgs, &AuditMessage{Type: 1305})
+	assert.Equal(t, CATEGORY_CONFIG, amg.Category())
+
+	// Anything wins over other
+	amg.Msgs = []*AuditMessage{{Type: 1400}, {Type: 1112}}
+	assert.Equal(t, CATEGORY_LOGIN, amg.Category())
+
+	// Anomalies win over everything
+	amg.Msgs = []*AuditMessage{{Type: 1300}, {Type: 1305}, {Type: 1701}}
+	assert.Equal(t, CATEGORY_ANOM, amg.Category())
+}
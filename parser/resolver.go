@@ -0,0 +1,172 @@
+package parser
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields holding a user id or group id that can be resolved to a name
+var userIdFields = []string{"uid", "auid", "euid", "suid", "fsuid", "ouid", "iuid"}
+var groupIdFields = []string{"gid", "egid", "sgid", "fsgid", "ogid", "igid"}
+
+// Longest a reverse lookup of an address may take before the address is treated as having no name
+const HOST_LOOKUP_TIMEOUT = time.Second
+
+// Written in place of a name for ids and sessions that were never set, like the auid of a daemon started at boot
+const UNSET_ID = "unset"
+
+// The ways an unset id, (uid_t)-1, shows up. The kernel logs it unsigned, user space messages may log it
+// signed and newer kernels can log the word itself
+var unsetIds = map[string]bool{
+	"4294967295": true,
+	"-1":         true,
+	UNSET_ID:     true,
+}
+
+type idCacheEntry struct {
+	key     string
+	name    string
+	expires time.Time
+}
+
+// Resolves user and group ids, or addresses, to names
+// Results are kept in an LRU cache and expire after the ttl so renamed or deleted accounts are eventually refreshed
+type IdResolver struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+	gen     int // Bumped whenever the cache is flushed, a lookup that raced it is not cached
+
+	lookupUser  func(string) (string, error)
+	lookupGroup func(string) (string, error)
+	lookupHost  func(string) (string, error)
+
+	lookupContainer func(string) (string, error)
+}
+
+func NewIdResolver(size int, ttl time.Duration) *IdResolver {
+	if size < 1 {
+		size = 1
+	}
+
+	return &IdResolver{
+		size:        size,
+		ttl:         ttl,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element, size),
+		lookupUser:  lookupUser,
+		lookupGroup: lookupGroup,
+		lookupHost: func(ip string) (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), HOST_LOOKUP_TIMEOUT)
+			defer cancel()
+
+			names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+			if err != nil || len(names) == 0 {
+				return "", err
+			}
+			return strings.TrimSuffix(names[0], "."), nil
+		},
+		lookupContainer: lookupContainer,
+	}
+}
+
+// Gets the username for a user id
+func (r *IdResolver) User(uid string) string {
+	return r.resolve("u"+uid, uid, "UNKNOWN_USER", &r.lookupUser)
+}
+
+// Gets the group name for a group id
+func (r *IdResolver) Group(gid string) string {
+	return r.resolve("g"+gid, gid, "UNKNOWN_GROUP", &r.lookupGroup)
+}
+
+// Gets the name of an address, empty when it has none. Failed lookups are cached too so an address without a name
+// only slows events down once per cache_ttl
+func (r *IdResolver) Host(ip string) string {
+	return r.resolve("h"+ip, ip, "", &r.lookupHost)
+}
+
+// Gets the id of the container a pid runs in, empty when it is not in one or has already exited
+func (r *IdResolver) Container(pid string) string {
+	return r.resolve("c"+pid, pid, "", &r.lookupContainer)
+}
+
+// Unset ids are never looked up or cached
+// The lookup itself runs without the lock so a slow one, like reverse dns, only holds up the events that need it
+func (r *IdResolver) resolve(key, id, unknown string, lookupFn *func(string) (string, error)) string {
+	if unsetIds[id] {
+		return UNSET_ID
+	}
+
+	r.lock.Lock()
+	lookup, gen := *lookupFn, r.gen
+	now := time.Now()
+	if e, ok := r.entries[key]; ok {
+		entry := e.Value.(*idCacheEntry)
+		if r.ttl <= 0 || now.Before(entry.expires) {
+			r.order.MoveToFront(e)
+			r.lock.Unlock()
+			return entry.name
+		}
+
+		r.order.Remove(e)
+		delete(r.entries, key)
+	}
+	r.lock.Unlock()
+
+	name, err := lookup(id)
+	if err != nil {
+		name = unknown
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if gen != r.gen {
+		// UseFiles flushed the cache while we looked, the name may be from before it
+		return name
+	}
+
+	if e, ok := r.entries[key]; ok {
+		// Someone else looked it up at the same time
+		r.order.Remove(e)
+	}
+
+	r.entries[key] = r.order.PushFront(&idCacheEntry{key: key, name: name, expires: now.Add(r.ttl)})
+	if r.order.Len() > r.size {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.entries, oldest.Value.(*idCacheEntry).key)
+	}
+
+	return name
+}
+
+// Adds a `<field>_name` extra field for every user or group id field in the group's messages
+// An unset login session, `ses`, gets an extra `ses` field of unset to go along with its unset `auid`
+func (amg *AuditMessageGroup) ResolveIds(r *IdResolver) {
+	for _, msg := range amg.Msgs {
+		fields := msg.Fields()
+		if unsetIds[fields["ses"]] {
+			msg.SetExtra("ses", UNSET_ID)
+		}
+
+		for _, f := range userIdFields {
+			if id, ok := fields[f]; ok {
+				msg.SetExtra(f+"_name", r.User(id))
+			}
+		}
+
+		for _, f := range groupIdFields {
+			if id, ok := fields[f]; ok {
+				msg.SetExtra(f+"_name", r.Group(id))
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Address families of the sockaddr structures we know how to read, see socket.h
+const (
+	AF_UNIX  = 1
+	AF_INET  = 2
+	AF_INET6 = 10
+)
+
+// Adds the family, address and port of every hex encoded `saddr` field, a raw sockaddr structure, to the extra
+// fields of its message as `family`, `addr` and `port`. Unix sockets have their path as `addr` and no port, abstract
+// sockets start with an @. When hosts is set the address is resolved to a name and added as `host`
+// Families other than unix, inet and inet6 are skipped. Returns the first saddr that could not be read, its message
+// is left alone
+func (amg *AuditMessageGroup) DecodeSaddr(hosts *IdResolver) error {
+	var first error
+
+	for _, msg := range amg.Msgs {
+		saddr, ok := msg.Fields()["saddr"]
+		if !ok {
+			continue
+		}
+
+		family, addr, port, err := parseSaddr(saddr)
+		if err != nil {
+			if first == nil {
+				first = errors.New(fmt.Sprintf("Could not decode saddr %s of message %d. Error: %s", saddr, msg.Seq, err))
+			}
+			continue
+		}
+
+		if family == "" {
+			continue
+		}
+
+		msg.SetExtra("family", family)
+		msg.SetExtra("addr", addr)
+		if port != "" {
+			msg.SetExtra("port", port)
+		}
+
+		if hosts != nil && family != "unix" {
+			if host := hosts.Host(addr); host != "" {
+				msg.SetExtra("host", host)
+			}
+		}
+	}
+
+	return first
+}
+
+// Reads a hex encoded sockaddr, returns an empty family for families we do not know
+// The family is in host byte order, the port and address in network byte order
+func parseSaddr(saddr string) (family, addr, port string, err error) {
+	raw, err := hex.DecodeString(saddr)
+	if err != nil {
+		return "", "", "", errors.New("not hex encoded")
+	}
+
+	if len(raw) < 2 {
+		return "", "", "", errors.New(fmt.Sprintf("truncated at %d bytes", len(raw)))
+	}
+
+	switch binary.LittleEndian.Uint16(raw) {
+	case AF_UNIX:
+		// Abstract socket names start with a NUL instead of ending with one
+		path := string(raw[2:])
+		if strings.HasPrefix(path, "\x00") {
+			return "unix", "@" + strings.TrimRight(path[1:], "\x00"), "", nil
+		}
+
+		if i := strings.IndexByte(path, 0); i >= 0 {
+			path = path[:i]
+		}
+
+		return "unix", path, "", nil
+
+	case AF_INET:
+		if len(raw) < 8 {
+			return "", "", "", errors.New(fmt.Sprintf("truncated inet address of %d bytes", len(raw)))
+		}
+
+		return "inet", net.IP(raw[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(raw[2:4]))), nil
+
+	case AF_INET6:
+		if len(raw) < 24 {
+			return "", "", "", errors.New(fmt.Sprintf("truncated inet6 address of %d bytes", len(raw)))
+		}
+
+		return "inet6", net.IP(raw[8:24]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(raw[2:4]))), nil
+	}
+
+	return "", "", "", nil
+}
@@ -0,0 +1,47 @@
+package parser
+
+import (
+	"strings"
+)
+
+// Fields holding the security context of the subject or object of an event
+var contextFields = []string{"subj", "obj", "scontext", "tcontext"}
+
+// Adds the parts of every security context in the group to the extra fields of its message
+// SELinux contexts, user:role:type:level, become `<field>_user`, `<field>_role`, `<field>_type` and `<field>_level`
+// where the level keeps any categories, s0-s0:c0.c1023. Anything else is taken to be an AppArmor profile and
+// becomes `<field>_profile`. Contexts that are missing, like `(null)` or `unlabeled`, are skipped
+func (amg *AuditMessageGroup) ParseSELinux() {
+	for _, msg := range amg.Msgs {
+		fields := msg.Fields()
+		for _, name := range contextFields {
+			context, ok := fields[name]
+			if !ok || !labeled(context) {
+				continue
+			}
+
+			parts := strings.SplitN(context, ":", 4)
+			if len(parts) < 3 {
+				msg.SetExtra(name+"_profile", context)
+				continue
+			}
+
+			msg.SetExtra(name+"_user", parts[0])
+			msg.SetExtra(name+"_role", parts[1])
+			msg.SetExtra(name+"_type", parts[2])
+			if len(parts) == 4 {
+				msg.SetExtra(name+"_level", parts[3])
+			}
+		}
+	}
+}
+
+// The kernel logs these when there is no context to report
+func labeled(context string) bool {
+	switch context {
+	case "", "?", "(null)", "(none)", "unlabeled":
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,36 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RFC 3339 in UTC with the milliseconds the kernel gives us, always 3 digits so the timestamps sort as text
+const TIMESTAMP_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+// Formats a time the way ParseTimestamp does
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(TIMESTAMP_FORMAT)
+}
+
+// Replaces the `seconds.milliseconds` audit timestamp of the group with an RFC 3339 one
+// The original is kept as OrigAuditTime and the serial of the event is copied to Serial
+// The serial restarts when the machine boots, it is only unique together with the timestamp
+// The time is the kernel clock as is, a skewed or stepped clock is not corrected so events keep the order they had
+// Groups without a usable timestamp are left alone, doing it again changes nothing
+func (amg *AuditMessageGroup) ParseTimestamp() error {
+	if amg.OrigAuditTime != "" {
+		return nil
+	}
+
+	t, ok := amg.Time()
+	if !ok || t.Unix() < 0 {
+		return errors.New(fmt.Sprintf("Could not parse timestamp `%s` of event %d", amg.AuditTime, amg.Seq))
+	}
+
+	amg.OrigAuditTime = amg.AuditTime
+	amg.AuditTime = FormatTimestamp(t)
+	amg.Serial = amg.Seq
+	return nil
+}
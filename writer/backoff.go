@@ -0,0 +1,51 @@
+package writer
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	BACKOFF_FIXED       = "fixed"       // Wait the same delay before every retry
+	BACKOFF_EXPONENTIAL = "exponential" // Double the delay after every retry
+)
+
+const DEFAULT_RETRY_DELAY = time.Second // What AuditWriter waits between attempts without options
+
+// How long an AuditWriter waits between the attempts at writing an event
+type Backoff struct {
+	Strategy   string        // BACKOFF_FIXED or BACKOFF_EXPONENTIAL, empty is fixed
+	Delay      time.Duration // Wait before the first retry, and every retry when fixed
+	MaxDelay   time.Duration // Longest wait between two exponential retries, 0 for no limit
+	Jitter     float64       // Moves every wait by up to this fraction of it either way, 0 for none
+	MaxElapsed time.Duration // No retry is started that would end its wait past this long after the first attempt, 0 for no limit
+}
+
+// Settings for an AuditWriter beyond its writer and attempts
+type WriterOptions struct {
+	Backoff Backoff
+}
+
+// The wait before a retry, the first retry is 0
+func (b Backoff) delay(retry int) time.Duration {
+	d := b.Delay
+	if b.Strategy == BACKOFF_EXPONENTIAL {
+		for i := 0; i < retry && d < time.Duration(1<<62); i++ {
+			if b.MaxDelay > 0 && d >= b.MaxDelay {
+				break
+			}
+
+			d *= 2
+		}
+
+		if b.MaxDelay > 0 && d > b.MaxDelay {
+			d = b.MaxDelay
+		}
+	}
+
+	if b.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(d))
+	}
+
+	return d
+}
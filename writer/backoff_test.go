@@ -0,0 +1,61 @@
+package writer
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fails every write and records the waits between them on a fake clock
+func newRetryingWriter(attempts int, b Backoff) (*AuditWriter, *[]time.Duration) {
+	waits := &[]time.Duration{}
+	now := time.Unix(1000, 0)
+
+	a := NewAuditWriter(&countingWriter{err: errors.New("down")}, attempts, WriterOptions{Backoff: b})
+	a.now = func() time.Time { return now }
+	a.sleep = func(d time.Duration) {
+		*waits = append(*waits, d)
+		now = now.Add(d)
+	}
+
+	return a, waits
+}
+
+func TestBackoff_delay(t *testing.T) {
+	fixed := Backoff{Strategy: BACKOFF_FIXED, Delay: time.Second}
+	exp := Backoff{Strategy: BACKOFF_EXPONENTIAL, Delay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for i, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		assert.Equal(t, time.Second, fixed.delay(i), "fixed retry %d", i)
+		assert.Equal(t, want*time.Millisecond, exp.delay(i), "exponential retry %d", i)
+	}
+
+	// No limit keeps doubling without overflowing
+	exp.MaxDelay = 0
+	assert.Equal(t, 1600*time.Millisecond, exp.delay(4))
+	assert.True(t, exp.delay(1000) > 0)
+
+	// Jitter stays within its fraction of the delay
+	exp.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := exp.delay(2)
+		assert.True(t, d >= 200*time.Millisecond && d <= 600*time.Millisecond, d.String())
+	}
+}
+
+func TestAuditWriter_backoff(t *testing.T) {
+	// The default waits a second between attempts
+	a := NewAuditWriter(&countingWriter{}, 3)
+	assert.Equal(t, Backoff{Strategy: BACKOFF_FIXED, Delay: time.Second}, a.Backoff())
+
+	// Exponential waits double between attempts, none after the last one
+	a, waits := newRetryingWriter(5, Backoff{Strategy: BACKOFF_EXPONENTIAL, Delay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond})
+	assert.EqualError(t, a.Encode(1, "x"), "down")
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}, *waits)
+
+	// The time budget stops retrying before the attempts run out
+	a, waits = newRetryingWriter(10, Backoff{Strategy: BACKOFF_EXPONENTIAL, Delay: time.Second, MaxElapsed: 5 * time.Second})
+	assert.EqualError(t, a.Encode(1, "x"), "down")
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *waits)
+}
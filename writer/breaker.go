@@ -0,0 +1,75 @@
+package writer
+
+import (
+	"errors"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+)
+
+// Returned instead of writing while the circuit of an output is open
+var ErrCircuitOpen = errors.New("Output circuit is open, skipping the write")
+
+// Stops writing to an output that keeps failing so a sick downstream can not hold up reading from netlink
+// Once the cooldown passes the next event is written as a probe with a single attempt, success closes the circuit
+// and failure opens it for another cooldown
+type circuitBreaker struct {
+	name      string
+	failures  int           // Consecutive failed events before the circuit opens
+	cooldown  time.Duration // How long to skip writes before probing again
+	failed    int
+	open      bool
+	openUntil time.Time
+	now       func() time.Time
+}
+
+func newCircuitBreaker(name string, failures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		name:     name,
+		failures: failures,
+		cooldown: cooldown,
+		now:      time.Now,
+	}
+}
+
+// Decides if the next event should be written, probe is true when it is the first try after a cooldown
+func (c *circuitBreaker) allow() (allowed bool, probe bool) {
+	if !c.open {
+		return true, false
+	}
+
+	if c.now().Before(c.openUntil) {
+		return false, false
+	}
+
+	return true, true
+}
+
+func (c *circuitBreaker) success() {
+	c.failed = 0
+	if !c.open {
+		return
+	}
+
+	c.open = false
+	metrics.CircuitOpen.With(c.name).Set(0)
+	logger.Info("Output %s recovered, closing its circuit", c.name)
+}
+
+func (c *circuitBreaker) failure() {
+	c.failed++
+	if c.open {
+		c.openUntil = c.now().Add(c.cooldown)
+		logger.Warning("Output %s is still failing, skipping writes for another %v", c.name, c.cooldown)
+		return
+	}
+
+	if c.failed < c.failures {
+		return
+	}
+
+	c.open = true
+	c.openUntil = c.now().Add(c.cooldown)
+	metrics.CircuitOpen.With(c.name).Set(1)
+	logger.Warning("Output %s failed %d events in a row, opening its circuit and skipping writes for %v", c.name, c.failed, c.cooldown)
+}
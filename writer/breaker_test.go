@@ -0,0 +1,71 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type flakyWriter struct {
+	fail   bool
+	writes int
+}
+
+func (f *flakyWriter) Write(p []byte) (int, error) {
+	f.writes++
+	if f.fail {
+		return 0, errors.New("derp")
+	}
+
+	return len(p), nil
+}
+
+func TestAuditWriter_SetCircuitBreaker(t *testing.T) {
+	lb := &bytes.Buffer{}
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(lb, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	f := &flakyWriter{fail: true}
+	w := NewAuditWriter(f, 1)
+	w.SetName("breaker_test")
+	w.SetCircuitBreaker(2, time.Minute)
+	assert.True(t, w.HasCircuitBreaker())
+
+	now := time.Now()
+	w.breaker.now = func() time.Time { return now }
+
+	// Opens after 2 failures in a row
+	assert.EqualError(t, w.Encode(1, "a"), "derp")
+	assert.EqualError(t, w.Encode(2, "a"), "derp")
+	assert.Equal(t, uint64(1), metrics.CircuitOpen.With("breaker_test").Value())
+	assert.Contains(t, elb.String(), "Output breaker_test failed 2 events in a row, opening its circuit and skipping writes for 1m0s")
+
+	// Writes are skipped while open
+	assert.Equal(t, ErrCircuitOpen, w.Encode(3, "a"))
+	assert.Equal(t, 2, f.writes)
+	assert.Equal(t, uint64(1), metrics.CircuitDropped.With("breaker_test").Value())
+
+	// A failed probe opens it again
+	now = now.Add(time.Minute)
+	assert.EqualError(t, w.Encode(4, "a"), "derp")
+	assert.Equal(t, ErrCircuitOpen, w.Encode(5, "a"))
+	assert.Contains(t, elb.String(), "Output breaker_test is still failing, skipping writes for another 1m0s")
+
+	// A good probe closes it
+	now = now.Add(time.Minute)
+	f.fail = false
+	assert.Nil(t, w.Encode(6, "a"))
+	assert.Nil(t, w.Encode(7, "a"))
+	assert.Equal(t, uint64(0), metrics.CircuitOpen.With("breaker_test").Value())
+	assert.Contains(t, lb.String(), "Output breaker_test recovered, closing its circuit")
+
+	// Disabled
+	w.SetCircuitBreaker(0, time.Minute)
+	assert.False(t, w.HasCircuitBreaker())
+}
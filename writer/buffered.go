@@ -0,0 +1,137 @@
+package writer
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+// Implemented by writers that can rotate what they write to
+type rotator interface {
+	Rotate() error
+}
+
+// An io.Writer that collects events in memory and writes them to the underlying writer in large chunks
+// The buffer is written once the next event would not fit or once it has waited flushInterval, whichever is first
+// Events are never split, an event larger than the buffer is written on its own
+type BufferedWriter struct {
+	w             io.Writer
+	size          int
+	flushInterval time.Duration
+
+	lock   sync.Mutex
+	buf    bytes.Buffer
+	oldest time.Time
+}
+
+func NewBufferedWriter(w io.Writer, size int, flushInterval time.Duration) *BufferedWriter {
+	b := &BufferedWriter{
+		w:             w,
+		size:          size,
+		flushInterval: flushInterval,
+	}
+
+	b.buf.Grow(size)
+
+	if flushInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(flushInterval)
+				b.flushStale()
+			}
+		}()
+	}
+
+	return b
+}
+
+// Buffers the event, writing out what is already buffered first if the event does not fit
+// If that fails the event is not kept so that a retry from AuditWriter does not duplicate it
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.buf.Len() > 0 && b.buf.Len()+len(p) > b.size {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p) >= b.size {
+		return b.w.Write(p)
+	}
+
+	if b.buf.Len() == 0 {
+		b.oldest = time.Now()
+	}
+
+	return b.buf.Write(p)
+}
+
+// Writes out anything buffered
+func (b *BufferedWriter) Flush() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.flush()
+}
+
+// Writes out anything buffered and rotates the underlying writer, if it supports rotating
+// Flushing first makes sure buffered events end up in the file they were written before
+func (b *BufferedWriter) Rotate() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := b.flush(); err != nil {
+		return err
+	}
+
+	if r, ok := b.w.(rotator); ok {
+		return r.Rotate()
+	}
+
+	return nil
+}
+
+// Writes out anything buffered and closes the underlying writer
+func (b *BufferedWriter) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := b.flush(); err != nil {
+		return err
+	}
+
+	if c, ok := b.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// Writes out the buffer if it has been waiting longer than the flush interval
+func (b *BufferedWriter) flushStale() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.buf.Len() == 0 || time.Since(b.oldest) < b.flushInterval {
+		return
+	}
+
+	if err := b.flush(); err != nil {
+		logger.Err("Failed to flush output buffer, will retry on the next write. Error: %v", err)
+	}
+}
+
+// The lock must be held by the caller, a partial write keeps the rest for the next attempt
+func (b *BufferedWriter) flush() error {
+	if b.buf.Len() == 0 {
+		return nil
+	}
+
+	n, err := b.w.Write(b.buf.Bytes())
+	b.buf.Next(n)
+	return err
+}
@@ -0,0 +1,118 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// Records every write made to it
+type countingWriter struct {
+	writes [][]byte
+	err    error
+	closed bool
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	c.writes = append(c.writes, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func (c *countingWriter) Rotate() error {
+	c.writes = append(c.writes, []byte("rotated"))
+	return nil
+}
+
+func (c *countingWriter) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestBufferedWriter_Write(t *testing.T) {
+	c := &countingWriter{}
+	b := NewBufferedWriter(c, 10, 0)
+
+	// Buffered until the next event does not fit
+	b.Write([]byte("aaaa\n"))
+	b.Write([]byte("bbbb\n"))
+	assert.Equal(t, 0, len(c.writes))
+
+	b.Write([]byte("cc\n"))
+	assert.Equal(t, [][]byte{[]byte("aaaa\nbbbb\n")}, c.writes)
+
+	// Events larger than the buffer are written on their own, after what was buffered
+	b.Write([]byte("dddddddddddd\n"))
+	assert.Equal(t, [][]byte{[]byte("aaaa\nbbbb\n"), []byte("cc\n"), []byte("dddddddddddd\n")}, c.writes)
+
+	// A failed flush does not keep the event so a retry will not duplicate it
+	b.Write([]byte("eeee\n"))
+	c.err = errors.New("nope")
+	n, err := b.Write([]byte("ffffff\n"))
+	assert.EqualError(t, err, "nope")
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "eeee\n", b.buf.String())
+
+	c.err = nil
+	b.Write([]byte("ffffff\n"))
+	assert.Equal(t, "eeee\n", string(c.writes[3]))
+
+	// Rotating flushes first
+	assert.Nil(t, b.Rotate())
+	assert.Equal(t, "ffffff\n", string(c.writes[4]))
+	assert.Equal(t, "rotated", string(c.writes[5]))
+
+	// Closing flushes and closes
+	b.Write([]byte("g\n"))
+	assert.Nil(t, b.Close())
+	assert.Equal(t, "g\n", string(c.writes[6]))
+	assert.True(t, c.closed)
+}
+
+func TestBufferedWriter_flushInterval(t *testing.T) {
+	c := &countingWriter{}
+	b := NewBufferedWriter(c, 1024, time.Millisecond*10)
+	b.Write([]byte("a\n"))
+
+	time.Sleep(time.Millisecond * 50)
+	b.lock.Lock()
+	assert.Equal(t, [][]byte{[]byte("a\n")}, c.writes)
+	b.lock.Unlock()
+}
+
+type writeCounter int
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	*w++
+	return len(p), nil
+}
+
+// Compares the writes reaching the underlying writer, which are write syscalls for files and stdout,
+// with and without a buffer for ~600 byte events like a typical execve
+// Without a buffer every event is a write, with 64KB it is one write per ~109 events
+func BenchmarkBufferedWriter(b *testing.B) {
+	event := append(bytes.Repeat([]byte("x"), 599), '\n')
+
+	for _, size := range []int{0, 64 * 1024} {
+		b.Run("size="+strconv.Itoa(size), func(b *testing.B) {
+			var c writeCounter
+			var w io.Writer = &c
+			if size > 0 {
+				w = NewBufferedWriter(&c, size, 0)
+			}
+
+			for i := 0; i < b.N; i++ {
+				w.Write(event)
+			}
+
+			b.ReportMetric(float64(c)/float64(b.N), "writes/event")
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package writer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+// An io.Writer that batches json events and indexes them with the elasticsearch _bulk api
+type ElasticsearchWriter struct {
+	urls          []string // Tried in order, moving on to the next when one can not be reached
+	index         string   // Index name, may contain date patterns like %Y.%m.%d
+	username      string
+	password      string
+	apiKey        string
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+
+	lock    sync.Mutex
+	batch   [][]byte
+	oldest  time.Time
+	current int // The url that worked last
+}
+
+// The parts of a bulk response we care about
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Index  string `json:"_index"`
+	Status int    `json:"status"`
+	Error  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+func NewElasticsearchWriter(urls []string, index, username, password, apiKey string, timeout time.Duration, insecure bool, batchSize int, flushInterval time.Duration) *ElasticsearchWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	e := &ElasticsearchWriter{
+		urls:     urls,
+		index:    index,
+		username: username,
+		password: password,
+		apiKey:   apiKey,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+			},
+		},
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		batch:         make([][]byte, 0, batchSize),
+	}
+
+	if flushInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(flushInterval)
+				e.flushStale()
+			}
+		}()
+	}
+
+	return e
+}
+
+// Adds an event to the current batch, the batch is sent once it is full
+// If sending fails the event is removed from the batch so that a retry from AuditWriter does not duplicate it
+func (e *ElasticsearchWriter) Write(p []byte) (int, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if len(e.batch) == 0 {
+		e.oldest = time.Now()
+	}
+
+	// The index is picked now so an event lands in the index for the day it was written
+	action := fmt.Sprintf("{\"index\":{\"_index\":%q}}\n", IndexName(e.index, time.Now()))
+
+	// The encoder reuses its buffer, we must keep our own copy
+	e.batch = append(e.batch, append([]byte(action), bytes.TrimSpace(p)...))
+	if len(e.batch) < e.batchSize {
+		return len(p), nil
+	}
+
+	if err := e.send(); err != nil {
+		e.batch = e.batch[:len(e.batch)-1]
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Sends any pending events
+func (e *ElasticsearchWriter) Flush() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.send()
+}
+
+// Sends the current batch if it has been waiting longer than the flush interval
+func (e *ElasticsearchWriter) flushStale() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if len(e.batch) == 0 || time.Since(e.oldest) < e.flushInterval {
+		return
+	}
+
+	if err := e.send(); err != nil {
+		logger.Err("Failed to flush elasticsearch batch, will retry on the next write. Error: %v", err)
+	}
+}
+
+// Sends the current batch to the first url that can be reached, the lock must be held by the caller
+// Responses other than 2xx, like 429 when elasticsearch is overloaded, are returned as errors to be retried
+// Documents that were rejected individually are logged and dropped, retrying them will not help
+func (e *ElasticsearchWriter) send() error {
+	if len(e.batch) == 0 {
+		return nil
+	}
+
+	body := bytes.Join(e.batch, []byte{'\n'})
+	body = append(body, '\n')
+
+	var resp *http.Response
+	err := fmt.Errorf("No elasticsearch urls to send to")
+	for i := 0; i < len(e.urls); i++ {
+		url := e.urls[(e.current+i)%len(e.urls)]
+		if resp, err = e.post(url, body); err == nil {
+			e.current = (e.current + i) % len(e.urls)
+			break
+		}
+
+		logger.Err("Failed to reach elasticsearch at %s. Error: %v", url, err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response from elasticsearch: %s", resp.Status)
+	}
+
+	e.logRejected(respBody)
+	e.batch = e.batch[:0]
+	return nil
+}
+
+func (e *ElasticsearchWriter) post(url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", strings.TrimRight(url, "/")+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.apiKey)
+	} else if e.username != "" {
+		req.SetBasicAuth(e.username, e.password)
+	}
+
+	return e.client.Do(req)
+}
+
+// Logs every document elasticsearch refused to index
+func (e *ElasticsearchWriter) logRejected(body []byte) {
+	resp := bulkResponse{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		logger.Err("Could not parse the elasticsearch bulk response. Error: %v", err)
+		return
+	}
+
+	if !resp.Errors {
+		return
+	}
+
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Status < 200 || result.Status > 299 {
+				logger.Err(
+					"Elasticsearch rejected event %d of %d for index %s with status %d. Error: %s: %s",
+					i+1,
+					len(resp.Items),
+					result.Index,
+					result.Status,
+					result.Error.Type,
+					result.Error.Reason,
+				)
+			}
+		}
+	}
+}
+
+// Expands the date patterns in an index name, %Y year, %m month, %d day, %H hour and %% for a literal %
+// Dates are in UTC so every host agrees on when the index rolls over
+func IndexName(pattern string, t time.Time) string {
+	t = t.UTC()
+	return strings.NewReplacer(
+		"%Y", fmt.Sprintf("%04d", t.Year()),
+		"%m", fmt.Sprintf("%02d", int(t.Month())),
+		"%d", fmt.Sprintf("%02d", t.Day()),
+		"%H", fmt.Sprintf("%02d", t.Hour()),
+		"%%", "%",
+	).Replace(pattern)
+}
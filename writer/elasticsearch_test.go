@@ -0,0 +1,98 @@
+package writer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+func TestElasticsearchWriter_Write(t *testing.T) {
+	elb := &bytes.Buffer{}
+	logger.AuditLoggerNew(log.New(&bytes.Buffer{}, "", 0), log.New(elb, "", 0), nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+	defer logger.AuditLoggerNew(nil, nil, nil, logger.FORMAT_TEXT, logger.LEVEL_DEBUG)
+
+	var bodies []string
+	status := http.StatusOK
+	response := `{"errors":false,"items":[]}`
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer s.Close()
+
+	// The first url can not be reached
+	e := NewElasticsearchWriter([]string{"http://127.0.0.1:1", s.URL + "/"}, "audit", "user", "pass", "", time.Second, false, 2, 0)
+
+	n, err := e.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, 0, len(bodies))
+
+	_, err = e.Write([]byte("{\"b\":2}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"{\"index\":{\"_index\":\"audit\"}}\n{\"a\":1}\n{\"index\":{\"_index\":\"audit\"}}\n{\"b\":2}\n"}, bodies)
+	assert.Contains(t, elb.String(), "Failed to reach elasticsearch at http://127.0.0.1:1.")
+	assert.Equal(t, 1, e.current)
+
+	// Overloaded responses are errors and the failed event is not kept
+	status = http.StatusTooManyRequests
+	e.Write([]byte("{\"c\":3}\n"))
+	_, err = e.Write([]byte("{\"d\":4}\n"))
+	assert.EqualError(t, err, "Unexpected response from elasticsearch: 429 Too Many Requests")
+	assert.Equal(t, 1, len(e.batch))
+
+	// Rejected documents are logged and dropped
+	status = http.StatusOK
+	response = `{"errors":true,"items":[{"index":{"_index":"audit","status":201}},{"index":{"_index":"audit","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`
+	elb.Reset()
+	_, err = e.Write([]byte("{\"d\":4}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Elasticsearch rejected event 2 of 2 for index audit with status 400. Error: mapper_parsing_exception: failed to parse\n", elb.String())
+	assert.Equal(t, 0, len(e.batch))
+
+	// Flush sends partial batches
+	response = `{"errors":false,"items":[]}`
+	e.Write([]byte("{\"e\":5}\n"))
+	assert.Nil(t, e.Flush())
+	assert.Equal(t, "{\"index\":{\"_index\":\"audit\"}}\n{\"e\":5}\n", bodies[len(bodies)-1])
+}
+
+func TestElasticsearchWriter_apiKey(t *testing.T) {
+	auth := ""
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer s.Close()
+
+	e := NewElasticsearchWriter([]string{s.URL}, "audit", "user", "pass", "secret", time.Second, false, 1, 0)
+	_, err := e.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ApiKey secret", auth)
+}
+
+func TestIndexName(t *testing.T) {
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.FixedZone("EST", -5*60*60))
+	assert.Equal(t, "audit-2016.01.02", IndexName("audit-%Y.%m.%d", now))
+	assert.Equal(t, "audit-2016.01.02.08", IndexName("audit-%Y.%m.%d.%H", now))
+	assert.Equal(t, "audit-%Y", IndexName("audit-%%Y", now))
+	assert.Equal(t, "audit", IndexName("audit", now))
+}
@@ -0,0 +1,287 @@
+package writer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+const (
+	ROTATE_TIME_FORMAT = "20060102T150405.000000000"
+	COMPRESS_SUFFIX    = ".gz"
+	COMPRESS_TMP       = ".tmp" // Added to a backup while it is being compressed
+)
+
+// An io.Writer that appends to a file and rotates it once it grows too large or too old
+// The rotated file is renamed with a timestamp suffix and a fresh file is opened with the same mode and owner
+type RotatingFile struct {
+	path        string
+	mode        os.FileMode
+	uid         int
+	gid         int
+	maxSize     int64
+	maxAge      time.Duration
+	maxBackups  int
+	compress    bool           // Gzip backups after rotating
+	compressing sync.WaitGroup // Tracks background compression so Close can wait for it
+
+	lock   sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// Takes over an already opened file, a maxSize, maxAge or maxBackups of 0 disables that limit
+// With compress set backups are gzipped in the background, any compression that was cut short is redone
+// A uid or gid of -1 leaves that part of the owner of new files alone
+func NewRotatingFile(f *os.File, mode os.FileMode, uid, gid int, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*RotatingFile, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RotatingFile{
+		path:       f.Name(),
+		mode:       mode,
+		uid:        uid,
+		gid:        gid,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+		f:          f,
+		size:       st.Size(),
+		opened:     time.Now(),
+	}
+
+	if compress {
+		r.recover()
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.shouldRotate(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			// Keep writing to the current file rather than losing events
+			logger.Err("Failed to rotate %s. Error: %v", r.path, err)
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotates the file now regardless of the limits
+func (r *RotatingFile) Rotate() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.rotate()
+}
+
+// Closes the file once any background compression is done
+func (r *RotatingFile) Close() error {
+	r.compressing.Wait()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.f.Close()
+}
+
+func (r *RotatingFile) shouldRotate(next int64) bool {
+	// Never rotate an empty file, a single event larger than the limit would rotate forever
+	if r.size == 0 {
+		return false
+	}
+
+	if r.maxSize > 0 && r.size+next > r.maxSize {
+		return true
+	}
+
+	if r.maxAge > 0 && time.Since(r.opened) >= r.maxAge {
+		return true
+	}
+
+	return false
+}
+
+// The lock must be held by the caller
+func (r *RotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().Format(ROTATE_TIME_FORMAT)
+	if err := os.Rename(r.path, backup); err != nil {
+		return fmt.Errorf("Could not rename to %s. Error: %v", backup, err)
+	}
+
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, r.mode)
+	if err != nil {
+		return fmt.Errorf("Could not open a new file. Error: %v", err)
+	}
+
+	if err := f.Chmod(r.mode); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not set file permissions. Error: %v", err)
+	}
+
+	if r.uid < 0 && r.gid < 0 {
+		// Nothing to chown, the new file keeps the owner it was created with
+	} else if err := f.Chown(r.uid, r.gid); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not chown file. Error: %v", err)
+	}
+
+	r.f.Close()
+	r.f = f
+	r.size = 0
+	r.opened = time.Now()
+
+	if r.compress {
+		r.compressing.Add(1)
+		go func() {
+			defer r.compressing.Done()
+			r.compressBackup(backup)
+		}()
+	}
+
+	r.prune()
+	return nil
+}
+
+// Gzips a backup to `<backup>.gz` and removes the original
+// The gzip is written to a temporary file first so a crash never leaves a truncated `.gz` behind
+func (r *RotatingFile) compressBackup(backup string) {
+	if err := gzipFile(backup, backup+COMPRESS_SUFFIX, r.mode); err != nil {
+		logger.Err("Failed to compress %s. Error: %v", backup, err)
+		return
+	}
+
+	if err := os.Remove(backup); err != nil {
+		logger.Err("Failed to remove %s after compressing it. Error: %v", backup, err)
+	}
+}
+
+func gzipFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + COMPRESS_TMP
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// Cleans up after compression that was interrupted, partial gzips are removed and their backups compressed again
+func (r *RotatingFile) recover() {
+	tmps, _ := filepath.Glob(r.path + ".*" + COMPRESS_SUFFIX + COMPRESS_TMP)
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			logger.Err("Failed to remove partially compressed %s. Error: %v", tmp, err)
+		}
+	}
+
+	for _, b := range r.backups() {
+		if strings.HasSuffix(b, COMPRESS_SUFFIX) {
+			continue
+		}
+
+		// The backup may have been compressed just before we died, before the original was removed
+		if _, err := os.Stat(b + COMPRESS_SUFFIX); err == nil {
+			os.Remove(b)
+			continue
+		}
+
+		r.compressing.Add(1)
+		go func(b string) {
+			defer r.compressing.Done()
+			r.compressBackup(b)
+		}(b)
+	}
+}
+
+// Removes the oldest backups beyond maxBackups
+func (r *RotatingFile) prune() {
+	if r.maxBackups < 1 {
+		return
+	}
+
+	backups := r.backups()
+	if len(backups) <= r.maxBackups {
+		return
+	}
+
+	for _, b := range backups[:len(backups)-r.maxBackups] {
+		if err := os.Remove(b); err != nil {
+			logger.Err("Failed to remove old backup %s. Error: %v", b, err)
+		}
+
+		// A compressed copy may have been finished in the meantime
+		if !strings.HasSuffix(b, COMPRESS_SUFFIX) {
+			os.Remove(b + COMPRESS_SUFFIX)
+		}
+	}
+}
+
+// Returns all backups of the file, oldest first
+func (r *RotatingFile) backups() []string {
+	matches, _ := filepath.Glob(r.path + ".*")
+	backups := []string{}
+
+	prefix := len(r.path) + 1
+	for _, m := range matches {
+		if len(m) < prefix+len(ROTATE_TIME_FORMAT) {
+			continue
+		}
+
+		// Only the rotated file itself or its finished gzip, while compressing both may exist for a moment
+		suffix := m[prefix+len(ROTATE_TIME_FORMAT):]
+		if suffix != "" && suffix != COMPRESS_SUFFIX {
+			continue
+		}
+
+		if suffix == COMPRESS_SUFFIX {
+			if _, err := os.Stat(strings.TrimSuffix(m, COMPRESS_SUFFIX)); err == nil {
+				continue
+			}
+		}
+
+		if _, err := time.Parse(ROTATE_TIME_FORMAT, m[prefix:prefix+len(ROTATE_TIME_FORMAT)]); err == nil {
+			backups = append(backups, m)
+		}
+	}
+
+	sort.Strings(backups)
+	return backups
+}
@@ -0,0 +1,132 @@
+package writer
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "audit.log")
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRotatingFile(f, 0600, os.Getuid(), os.Getgid(), 10, 0, 2, false)
+	assert.Nil(t, err)
+
+	// Under the size limit
+	r.Write([]byte("12345\n"))
+	assert.Equal(t, 0, len(r.backups()))
+
+	// Would go over the limit, the old file is rotated first
+	r.Write([]byte("67890\n"))
+	assert.Equal(t, 1, len(r.backups()))
+
+	b, _ := ioutil.ReadFile(r.backups()[0])
+	assert.Equal(t, "12345\n", string(b))
+	b, _ = ioutil.ReadFile(p)
+	assert.Equal(t, "67890\n", string(b))
+
+	st, _ := os.Stat(p)
+	assert.Equal(t, os.FileMode(0600), st.Mode())
+
+	// Only the newest backups are kept
+	r.Write([]byte("abcde\n"))
+	r.Write([]byte("fghij\n"))
+	backups := r.backups()
+	assert.Equal(t, 2, len(backups))
+	b, _ = ioutil.ReadFile(backups[0])
+	assert.Equal(t, "67890\n", string(b))
+	b, _ = ioutil.ReadFile(backups[1])
+	assert.Equal(t, "abcde\n", string(b))
+
+	// Age based rotation
+	r.maxSize = 0
+	r.maxAge = time.Hour
+	r.Write([]byte("klmno\n"))
+	assert.Equal(t, "abcde\n", readFile(r.backups()[1]))
+
+	r.opened = time.Now().Add(-time.Hour)
+	r.Write([]byte("pqrst\n"))
+	assert.Equal(t, "fghij\nklmno\n", readFile(r.backups()[1]))
+	assert.Equal(t, "pqrst\n", readFile(p))
+
+	assert.Nil(t, r.Close())
+}
+
+func TestRotatingFile_compress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "audit.log")
+
+	// Leftovers from compression that was interrupted
+	old := p + "." + time.Now().Add(-time.Hour).Format(ROTATE_TIME_FORMAT)
+	ioutil.WriteFile(old, []byte("old\n"), 0600)
+	ioutil.WriteFile(old+COMPRESS_SUFFIX+COMPRESS_TMP, []byte("partial"), 0600)
+
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRotatingFile(f, 0600, os.Getuid(), os.Getgid(), 10, 0, 0, true)
+	assert.Nil(t, err)
+
+	r.Write([]byte("12345\n"))
+	r.Write([]byte("67890\n"))
+	r.compressing.Wait()
+
+	backups := r.backups()
+	assert.Equal(t, 2, len(backups))
+	assert.Equal(t, old+COMPRESS_SUFFIX, backups[0])
+	assert.Equal(t, "old\n", readGzip(t, backups[0]))
+	assert.Equal(t, "12345\n", readGzip(t, backups[1]))
+
+	// Only finished gzips are left behind
+	matches, _ := filepath.Glob(p + ".*")
+	assert.Equal(t, 2, len(matches))
+	for _, m := range matches {
+		assert.True(t, strings.HasSuffix(m, COMPRESS_SUFFIX), m)
+	}
+
+	assert.Nil(t, r.Close())
+}
+
+func readGzip(t *testing.T, p string) string {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadAll(gz)
+	return string(b)
+}
+
+func readFile(p string) string {
+	b, _ := ioutil.ReadFile(p)
+	return string(b)
+}
@@ -0,0 +1,449 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+const (
+	FORMAT_JSON   = "json"
+	FORMAT_LOGFMT = "logfmt"
+	FORMAT_CEF    = "cef"
+)
+
+// Turns an event, or anything else written to an output like a heartbeat, into the bytes to write for it
+// Every formatted event ends with a newline
+type Formatter interface {
+	Format(v interface{}) ([]byte, error)
+}
+
+// Writes events as json, the default
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
+
+// Writes events as a single line of key=value pairs, nested values are flattened into dotted keys like
+// records.syscall.exe="/bin/ls" or records.path.0.name=/etc/passwd. Events are always assembled by record type
+type LogfmtFormatter struct{}
+
+func (LogfmtFormatter) Format(v interface{}) ([]byte, error) {
+	if e := eventOf(v); e != nil {
+		v = e
+	}
+
+	pairs, err := flatten(v)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bytes.Buffer{}
+	for i, p := range pairs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+
+		b.WriteString(p[0])
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(p[1]))
+	}
+
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// Values are quoted when they are empty or have spaces, equal signs, quotes or anything unprintable
+func logfmtValue(v string) string {
+	quoted := strconv.Quote(v)
+	if v == "" || strings.ContainsAny(v, " =") || quoted != "\""+v+"\"" {
+		return quoted
+	}
+
+	return v
+}
+
+// Writes events in the ArcSight Common Event Format, CEF:0|vendor|product|version|signature|name|severity|extensions
+// The signature and name come from the type of the first record, see cefSignatures, with the syscall added to the
+// name if there is one, and the common audit fields are mapped to CEF extensions. Anything that is not an event, like
+// a heartbeat, has its `type` as signature and name and its fields flattened into extensions
+type CEFFormatter struct {
+	Vendor   string
+	Product  string
+	Version  string
+	Severity int
+}
+
+func (c *CEFFormatter) Format(v interface{}) ([]byte, error) {
+	var signature, name string
+	var ext [][2]string
+
+	if g := groupOf(v); g != nil {
+		signature, name, ext = cefEvent(g)
+	} else {
+		pairs, err := flatten(v)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range pairs {
+			if p[0] == "type" {
+				signature, name = p[1], p[1]
+				continue
+			}
+
+			ext = append(ext, p)
+		}
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(
+		b,
+		"CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeader(c.Vendor),
+		cefHeader(c.Product),
+		cefHeader(c.Version),
+		cefHeader(signature),
+		cefHeader(name),
+		c.Severity,
+	)
+
+	for i, p := range ext {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+
+		b.WriteString(p[0])
+		b.WriteByte('=')
+		b.WriteString(cefExtension(p[1]))
+	}
+
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// Maps the common fields of an event to their CEF extensions, fields the event does not have, or has as ?, which
+// audit uses for unknown, are left out
+func cefEvent(g *AuditMessageGroup) (signature, name string, ext [][2]string) {
+	userSpace := false
+	if len(g.Msgs) > 0 {
+		t := g.Msgs[0].Type
+		userSpace = userSpaceType(t)
+		if s, ok := cefSignatures[t]; ok {
+			signature, name = s.id, s.name
+		} else {
+			signature, name = strconv.Itoa(int(t)), RecordTypeName(t)
+		}
+	}
+
+	add := func(key, value string) {
+		if value != "" && value != "?" {
+			ext = append(ext, [2]string{key, value})
+		}
+	}
+
+	if t, ok := g.Time(); ok {
+		add("rt", strconv.FormatInt(t.UnixNano()/1e6, 10))
+	}
+
+	add("externalId", strconv.Itoa(g.Seq))
+
+	syscall := groupValue(g, "syscall_name")
+	if syscall == "" {
+		syscall = g.Syscall
+	}
+
+	if syscall != "" {
+		name += " " + syscall
+	}
+
+	uid := groupValue(g, "uid")
+	add("suid", uid)
+	if user := groupValue(g, "uid_name"); user != "" {
+		add("suser", user)
+	} else {
+		add("suser", g.UidMap[uid])
+	}
+
+	add("spid", groupValue(g, "pid"))
+	add("sproc", groupText(g, "comm"))
+	add("fname", groupText(g, "name"))
+
+	// A user space message, like a login, has the remote end of the session and the account it was for
+	if userSpace {
+		add("src", groupValue(g, "addr"))
+		add("shost", groupValue(g, "hostname"))
+		add("duser", groupValue(g, "acct"))
+	} else {
+		add("dst", groupValue(g, "addr"))
+		add("dpt", groupValue(g, "port"))
+		add("dhost", groupValue(g, "host"))
+	}
+
+	// Syscalls say if they succeeded, user space messages give their result
+	outcome := groupValue(g, "success")
+	if outcome == "" {
+		outcome = groupValue(g, "res")
+	}
+
+	switch outcome {
+	case "yes", "success":
+		add("outcome", "success")
+	case "no", "failed":
+		add("outcome", "failure")
+	}
+
+	if g.RepeatCount > 0 {
+		add("cnt", strconv.Itoa(g.RepeatCount))
+	}
+
+	if g.SampleRate > 0 {
+		add("cfp1Label", "sample_rate")
+		add("cfp1", strconv.FormatFloat(g.SampleRate, 'g', -1, 64))
+	}
+
+	if g.EmitSeq != nil {
+		add("cn1Label", "emit_seq")
+		add("cn1", strconv.FormatUint(g.EmitSeq.Seq, 10))
+		add("cn2Label", "emit_epoch")
+		add("cn2", strconv.FormatInt(g.EmitSeq.Epoch, 10))
+	}
+
+	// User space messages keep the exe inside their msg, where it is never hex encoded
+	exe := groupText(g, "exe")
+	if exe == "" {
+		exe = groupValue(g, "exe")
+	}
+
+	for i, custom := range [][2]string{
+		{"auid", groupValue(g, "auid")},
+		{"exe", exe},
+		{"key", strings.Join(g.Keys(), ",")},
+		{"syscall", g.Syscall},
+		{"terminal", groupValue(g, "terminal")},
+	} {
+		if custom[1] != "" {
+			add(fmt.Sprintf("cs%dLabel", i+1), custom[0])
+			add(fmt.Sprintf("cs%d", i+1), custom[1])
+		}
+	}
+
+	return signature, name, ext
+}
+
+// The first value of a field, or of an extra field, in the group
+func groupValue(g *AuditMessageGroup, name string) string {
+	if v, ok := g.Field(name); ok {
+		return v
+	}
+
+	for _, m := range g.Msgs {
+		if v, ok := m.Extra[name]; ok {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// Like groupValue for text fields, like `exe`, which are decoded when hex encoded
+func groupText(g *AuditMessageGroup, name string) string {
+	v, _ := g.TextField(name)
+	return v
+}
+
+func cefHeader(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "|", "\\|", "\n", " ", "\r", " ").Replace(v)
+}
+
+func cefExtension(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "=", "\\=", "\n", "\\n", "\r", "\\r").Replace(v)
+}
+
+// Writes events with a text/template, it is given what would be written as json, the message group or the assembled
+// event, or anything else like a heartbeat. Besides the exported fields of those, like {{.Seq}}, templates can use
+//
+//	json   the value as json, {{json .}} writes the same as the json format
+//	field  the first value of a field of the event, like {{field . "exe"}}, empty if it has none
+//	text   like field for text fields like exe, which are decoded when hex encoded
+//	keys   the rule keys of the event joined with commas
+//	quote  the value as a quoted string
+//
+// A newline is added to the output when the template does not end with one
+type TemplateFormatter struct {
+	t *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"field": func(v interface{}, name string) string {
+		if g := groupOf(v); g != nil {
+			return groupValue(g, name)
+		}
+
+		return ""
+	},
+	"text": func(v interface{}, name string) string {
+		if g := groupOf(v); g != nil {
+			return groupText(g, name)
+		}
+
+		return ""
+	},
+	"keys": func(v interface{}) string {
+		if g := groupOf(v); g != nil {
+			return strings.Join(g.Keys(), ",")
+		}
+
+		return ""
+	},
+	"quote": strconv.Quote,
+}
+
+// Parses the template, an error here is an error in the template itself
+func NewTemplateFormatter(text string) (*TemplateFormatter, error) {
+	t, err := template.New("output").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TemplateFormatter{t: t}, nil
+}
+
+func (f *TemplateFormatter) Format(v interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	if err := f.t.Execute(b, v); err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasSuffix(b.Bytes(), []byte{'\n'}) {
+		b.WriteByte('\n')
+	}
+
+	return b.Bytes(), nil
+}
+
+// Creates the formatter for a format name, the cef header is only used for cef
+func NewFormatter(format string, cef *CEFFormatter) (Formatter, error) {
+	switch format {
+	case FORMAT_JSON:
+		return JSONFormatter{}, nil
+	case FORMAT_LOGFMT:
+		return LogfmtFormatter{}, nil
+	case FORMAT_CEF:
+		return cef, nil
+	}
+
+	return nil, fmt.Errorf("Unknown output format `%s`, must be json, logfmt or cef", format)
+}
+
+func eventOf(v interface{}) *AuditEvent {
+	switch e := v.(type) {
+	case *AuditMessageGroup:
+		return e.Event()
+	case *AuditEvent:
+		return e
+	}
+
+	return nil
+}
+
+func groupOf(v interface{}) *AuditMessageGroup {
+	switch e := v.(type) {
+	case *AuditMessageGroup:
+		return e
+	case *AuditEvent:
+		return e.Group()
+	}
+
+	return nil
+}
+
+// The category of the event, other for anything that is not one like heartbeats and alerts
+func categoryOf(v interface{}) string {
+	if g := groupOf(v); g != nil {
+		return g.Category()
+	}
+
+	return CATEGORY_OTHER
+}
+
+// Flattens the json form of v into dotted keys and their values, keys are sorted except for the type, sequence
+// and timestamp of an event which go first
+func flatten(v interface{}) ([][2]string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var generic interface{}
+	if err := d.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var pairs [][2]string
+	flattenInto(&pairs, "", generic)
+
+	first := map[string]int{"type": 1, "sequence": 2, "timestamp": 3}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		fi, fj := first[pairs[i][0]], first[pairs[j][0]]
+		if fi == 0 || fj == 0 {
+			return fi != 0 && fj == 0
+		}
+
+		return fi < fj
+	})
+
+	return pairs, nil
+}
+
+func flattenInto(pairs *[][2]string, prefix string, v interface{}) {
+	key := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+
+		return prefix + "." + k
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		for _, k := range keys {
+			flattenInto(pairs, key(k), t[k])
+		}
+
+	case []interface{}:
+		for i, lv := range t {
+			flattenInto(pairs, key(strconv.Itoa(i)), lv)
+		}
+
+	case nil:
+		// Nothing to write
+
+	default:
+		*pairs = append(*pairs, [2]string{prefix, fmt.Sprint(t)})
+	}
+}
@@ -0,0 +1,150 @@
+package writer
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+var update = flag.Bool("update", false, "Rewrite the expected output in testdata")
+
+// An assembled open of /etc/shadow by cat, the same event is written in every format
+func formatEvent() *AuditEvent {
+	msgs := []*AuditMessage{}
+	for _, m := range []struct {
+		t    uint16
+		data string
+	}{
+		{1300, `audit(1500000000.123:4242): arch=c000003e syscall=2 success=no exit=-13 a0=7ffd a1=0 ppid=1000 pid=1234 auid=1000 uid=1000 gid=1000 euid=1000 comm="cat" exe="/usr/bin/cat" key="shadow"`},
+		{1307, `audit(1500000000.123:4242): cwd="/home/bob"`},
+		{1302, `audit(1500000000.123:4242): item=0 name="/etc/shadow" inode=1 mode=0100640 nametype=NORMAL`},
+		{1327, `audit(1500000000.123:4242): proctitle=636174002F6574632F736861646F77`},
+	} {
+		msgs = append(msgs, NewAuditMessage(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: m.t},
+			Data:   []byte(m.data),
+		}))
+	}
+
+	amg := NewAuditMessageGroup(msgs[0])
+	for _, m := range msgs[1:] {
+		amg.AddMessage(m)
+	}
+
+	// The uid map depends on the users of the host
+	amg.UidMap = map[string]string{"1000": "bob"}
+	amg.Fields = map[string]string{"host": "web-1"}
+	amg.EmitSeq = &EmitSeq{Epoch: 1500000000000, Seq: 42}
+	return amg.Event()
+}
+
+// A failed ssh login by alice, as sshd reports it through pam
+func loginEvent() *AuditEvent {
+	amg := NewAuditMessageGroup(NewAuditMessage(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: 1112},
+		Data:   []byte(`audit(1500000000.456:4243): pid=2345 uid=0 auid=4294967295 ses=4294967295 msg='op=login acct="alice" exe="/usr/sbin/sshd" hostname=203.0.113.7 addr=203.0.113.7 terminal=ssh res=failed'`),
+	}))
+
+	amg.UidMap = map[string]string{"0": "root"}
+	return amg.Event()
+}
+
+func testFormat(t *testing.T, f Formatter, golden string) {
+	b, err := f.Format(formatEvent())
+	assert.Nil(t, err)
+	assertGolden(t, b, golden)
+}
+
+// Compares formatted output to the file in testdata, go test -update rewrites it
+func assertGolden(t *testing.T, b []byte, golden string) {
+	path := filepath.Join("testdata", golden)
+	if *update {
+		assert.Nil(t, ioutil.WriteFile(path, b, 0644))
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(expected), string(b))
+}
+
+func TestJSONFormatter(t *testing.T) {
+	testFormat(t, JSONFormatter{}, "format.json")
+}
+
+func TestLogfmtFormatter(t *testing.T) {
+	testFormat(t, LogfmtFormatter{}, "format.logfmt")
+
+	b, err := LogfmtFormatter{}.Format(map[string]interface{}{"a": "two words", "b": "", "c": "x=y", "d": "tab\there"})
+	assert.Nil(t, err)
+	assert.Equal(t, "a=\"two words\" b=\"\" c=\"x=y\" d=\"tab\\there\"\n", string(b))
+}
+
+func TestCEFFormatter(t *testing.T) {
+	testFormat(t, &CEFFormatter{Vendor: "Xeralux", Product: "go-audit", Version: "1", Severity: 5}, "format.cef")
+
+	// header and extension values are escaped
+	b, err := (&CEFFormatter{Vendor: "A|B", Product: "p\\q", Version: "1"}).Format(map[string]interface{}{"type": "heartbeat", "note": "a=b\nc"})
+	assert.Nil(t, err)
+	assert.Equal(t, "CEF:0|A\\|B|p\\\\q|1|heartbeat|heartbeat|0|note=a\\=b\\nc\n", string(b))
+
+	// sampled events say by how much
+	g := &AuditMessageGroup{Seq: 1, Msgs: []*AuditMessage{{Type: 1300, Data: "syscall=2"}}, SampleRate: 0.01}
+	b, err = (&CEFFormatter{}).Format(g)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), " cfp1Label=sample_rate cfp1=0.01")
+
+	// types without a signature go by their number
+	g = &AuditMessageGroup{Seq: 1, Msgs: []*AuditMessage{{Type: 1302, Data: "name=\"/etc/passwd\" inode=?"}}}
+	b, err = (&CEFFormatter{}).Format(g)
+	assert.Nil(t, err)
+	assert.Equal(t, "CEF:0||||1302|path|0|externalId=1 fname=/etc/passwd\n", string(b))
+}
+
+func TestCEFFormatter_login(t *testing.T) {
+	b, err := (&CEFFormatter{Vendor: "Xeralux", Product: "go-audit", Version: "1", Severity: 5}).Format(loginEvent())
+	assert.Nil(t, err)
+	assertGolden(t, b, "login.cef")
+}
+
+func TestTemplateFormatter(t *testing.T) {
+	// the same as the json format
+	f, err := NewTemplateFormatter("{{json .}}")
+	assert.Nil(t, err)
+	testFormat(t, f, "format.json")
+
+	f, err = NewTemplateFormatter(`seq={{.Seq}} syscall={{field . "syscall"}} exe={{quote (text . "exe")}} key={{keys .}} cwd={{field . "nope"}}`)
+	assert.Nil(t, err)
+	b, err := f.Format(formatEvent())
+	assert.Nil(t, err)
+	assert.Equal(t, "seq=4242 syscall=2 exe=\"/usr/bin/cat\" key=shadow cwd=\n", string(b))
+
+	// anything that is not an event has no fields
+	b, err = f.Format(map[string]interface{}{"Seq": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, "seq=1 syscall= exe=\"\" key= cwd=\n", string(b))
+
+	// errors
+	_, err = NewTemplateFormatter("{{nope .}}")
+	assert.EqualError(t, err, "template: output:1: function \"nope\" not defined")
+
+	f, err = NewTemplateFormatter("{{.Nope}}")
+	assert.Nil(t, err)
+	_, err = f.Format(formatEvent())
+	assert.Contains(t, err.Error(), "can't evaluate field Nope")
+}
+
+func TestNewFormatter(t *testing.T) {
+	cef := &CEFFormatter{}
+	for format, expected := range map[string]Formatter{"json": JSONFormatter{}, "logfmt": LogfmtFormatter{}, "cef": cef} {
+		f, err := NewFormatter(format, cef)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, f)
+	}
+
+	_, err := NewFormatter("xml", cef)
+	assert.EqualError(t, err, "Unknown output format `xml`, must be json, logfmt or cef")
+}
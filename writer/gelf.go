@@ -0,0 +1,293 @@
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+const (
+	GELF_VERSION          = "1.1"
+	GELF_LEVEL            = 6    // Informational, as syslog counts them
+	GELF_CHUNK_SIZE       = 1420 // Largest datagram to send by default, fits the MTU of most networks
+	GELF_MIN_CHUNK_SIZE   = 128
+	GELF_MAX_CHUNKS       = 128 // Graylog drops messages split into more chunks than this
+	GELF_CHUNK_HEADER     = 12  // Magic bytes, message id, chunk number and chunk count
+	GELF_COMPRESSION_GZIP = "gzip"
+	GELF_COMPRESSION_ZLIB = "zlib"
+	GELF_COMPRESSION_NONE = "none"
+)
+
+var gelfMagic = []byte{0x1e, 0x0f}
+
+// Characters graylog does not allow in the name of a field
+var gelfFieldChars = regexp.MustCompile(`[^\w.\-]`)
+
+// Formats events as GELF messages, the fields of the assembled event become additional fields named after their
+// dotted keys with underscores, like _syscall_exe or _path_0_name. The short message is the type of the first
+// record along with the syscall and exe, if there are any. Anything that is not an event, like a heartbeat, has its
+// `type` as short message
+type GELFFormatter struct {
+	Host string
+}
+
+// An empty host is looked up with os.Hostname
+func NewGELFFormatter(host string) *GELFFormatter {
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	return &GELFFormatter{Host: host}
+}
+
+func (g *GELFFormatter) Format(v interface{}) ([]byte, error) {
+	msg := map[string]interface{}{
+		"version": GELF_VERSION,
+		"host":    g.Host,
+		"level":   GELF_LEVEL,
+	}
+
+	short := ""
+	if group := groupOf(v); group != nil {
+		short = gelfShortMessage(group)
+		if t, ok := group.Time(); ok {
+			msg["timestamp"] = float64(t.UnixNano()/1e6) / 1e3
+		}
+
+		v = eventOf(v)
+	}
+
+	pairs, err := flatten(v)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pairs {
+		if p[0] == "type" && short == "" {
+			short = p[1]
+		}
+
+		// _id is reserved by graylog
+		if name := gelfField(p[0]); name != "_id" {
+			msg[name] = p[1]
+		}
+	}
+
+	if short == "" {
+		short = "go-audit"
+	}
+
+	msg["short_message"] = short
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
+
+func gelfShortMessage(g *AuditMessageGroup) string {
+	parts := []string{}
+	if len(g.Msgs) > 0 {
+		parts = append(parts, RecordTypeName(g.Msgs[0].Type))
+	}
+
+	syscall := groupValue(g, "syscall_name")
+	if syscall == "" {
+		syscall = g.Syscall
+	}
+
+	for _, p := range []string{syscall, groupText(g, "exe")} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// The additional field for a dotted key of the event, records are left out of the name since every field is in one
+func gelfField(key string) string {
+	key = strings.TrimPrefix(key, "records.")
+	return "_" + gelfFieldChars.ReplaceAllString(strings.Replace(key, ".", "_", -1), "_")
+}
+
+// An io.Writer that sends GELF messages to graylog over udp or tcp
+// Over udp every message is a datagram, compressed unless compression is none, and split into chunks when it is
+// larger than the chunk size. Over tcp messages are sent uncompressed and ended with a null byte, with the
+// reconnects and buffering of SocketWriter
+type GELFWriter struct {
+	conn        net.Conn      // The udp socket, nil over tcp
+	stream      *SocketWriter // The tcp connection, nil over udp
+	compression string
+	chunkSize   int
+}
+
+// Checks the settings of a GELF writer, an empty compression is gzip over udp and none over tcp
+func CheckGELF(protocol, compression string, chunkSize int) error {
+	switch protocol {
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("Unknown gelf protocol `%s`, must be udp or tcp", protocol)
+	}
+
+	switch compression {
+	case "", GELF_COMPRESSION_NONE:
+	case GELF_COMPRESSION_GZIP, GELF_COMPRESSION_ZLIB:
+		if protocol == "tcp" {
+			return fmt.Errorf("Gelf over tcp can not be compressed, %s provided", compression)
+		}
+	default:
+		return fmt.Errorf("Unknown gelf compression `%s`, must be gzip, zlib or none", compression)
+	}
+
+	if chunkSize < GELF_MIN_CHUNK_SIZE {
+		return fmt.Errorf("Gelf chunk size must be at least %d, %d provided", GELF_MIN_CHUNK_SIZE, chunkSize)
+	}
+
+	return nil
+}
+
+// Connects to graylog, the timeout, maxBuffered and backoff only apply to tcp, see NewTCPWriter
+func NewGELFWriter(protocol, address, compression string, chunkSize int, timeout time.Duration, maxBuffered int, backoff time.Duration) (*GELFWriter, error) {
+	if err := CheckGELF(protocol, compression, chunkSize); err != nil {
+		return nil, err
+	}
+
+	g := &GELFWriter{compression: compression, chunkSize: chunkSize}
+	if protocol == "tcp" {
+		stream, err := NewTCPWriter(address, nil, timeout, maxBuffered, backoff)
+		if err != nil {
+			return nil, err
+		}
+
+		g.stream = stream
+		g.compression = GELF_COMPRESSION_NONE
+		return g, nil
+	}
+
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	g.conn = conn
+	if g.compression == "" {
+		g.compression = GELF_COMPRESSION_GZIP
+	}
+
+	return g, nil
+}
+
+// Sends a formatted message, the newline the formatter ends it with is not sent
+func (g *GELFWriter) Write(p []byte) (int, error) {
+	msg := bytes.TrimSuffix(p, []byte{'\n'})
+	if g.stream != nil {
+		if _, err := g.stream.Write(append(append([]byte{}, msg...), 0)); err != nil {
+			return 0, err
+		}
+
+		return len(p), nil
+	}
+
+	b, err := g.compress(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(b) <= g.chunkSize {
+		if _, err := g.conn.Write(b); err != nil {
+			return 0, err
+		}
+
+		return len(p), nil
+	}
+
+	if err := g.sendChunks(b); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Splits a message too large for one datagram into chunks, all of them sharing a random message id
+func (g *GELFWriter) sendChunks(b []byte) error {
+	size := g.chunkSize - GELF_CHUNK_HEADER
+	count := (len(b) + size - 1) / size
+	if count > GELF_MAX_CHUNKS {
+		return fmt.Errorf("Gelf message of %d bytes needs %d chunks, at most %d are allowed", len(b), count, GELF_MAX_CHUNKS)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 0, g.chunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(b) {
+			end = len(b)
+		}
+
+		chunk = append(chunk[:0], gelfMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, b[i*size:end]...)
+		if _, err := g.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *GELFWriter) compress(p []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	switch g.compression {
+	case GELF_COMPRESSION_GZIP:
+		w := gzip.NewWriter(buf)
+		w.Write(p)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+	case GELF_COMPRESSION_ZLIB:
+		w := zlib.NewWriter(buf)
+		w.Write(p)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+	default:
+		return p, nil
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Sends any messages buffered while reconnecting over tcp
+func (g *GELFWriter) Flush() error {
+	if g.stream != nil {
+		return g.stream.Flush()
+	}
+
+	return nil
+}
+
+func (g *GELFWriter) Close() error {
+	if g.stream != nil {
+		return g.stream.Close()
+	}
+
+	return g.conn.Close()
+}
@@ -0,0 +1,159 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+func TestGELFFormatter(t *testing.T) {
+	testFormat(t, &GELFFormatter{Host: "web-1"}, "format.gelf")
+
+	// anything that is not an event goes by its type
+	b, err := (&GELFFormatter{Host: "web-1"}).Format(map[string]interface{}{"type": "heartbeat", "id": 1, "a b": "c"})
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"_a_b\":\"c\",\"_type\":\"heartbeat\",\"host\":\"web-1\",\"level\":6,\"short_message\":\"heartbeat\",\"version\":\"1.1\"}\n", string(b))
+
+	// groups are assembled first
+	g := &AuditMessageGroup{Seq: 1, AuditTime: "1500000000.5", Msgs: []*AuditMessage{{Type: 1300, Data: "syscall=59 exe=\"/bin/ls\""}}}
+	b, err = (&GELFFormatter{Host: "web-1"}).Format(g)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "\"_syscall_exe\":\"/bin/ls\"")
+	assert.Contains(t, string(b), "\"short_message\":\"syscall /bin/ls\"")
+	assert.Contains(t, string(b), "\"timestamp\":1500000000.5")
+
+	assert.NotEqual(t, "", NewGELFFormatter("").Host)
+	assert.Equal(t, "web-1", NewGELFFormatter("web-1").Host)
+}
+
+func TestCheckGELF(t *testing.T) {
+	assert.Nil(t, CheckGELF("udp", "", GELF_CHUNK_SIZE))
+	assert.Nil(t, CheckGELF("udp", "zlib", GELF_CHUNK_SIZE))
+	assert.Nil(t, CheckGELF("tcp", "none", GELF_CHUNK_SIZE))
+	assert.EqualError(t, CheckGELF("http", "", GELF_CHUNK_SIZE), "Unknown gelf protocol `http`, must be udp or tcp")
+	assert.EqualError(t, CheckGELF("udp", "lz4", GELF_CHUNK_SIZE), "Unknown gelf compression `lz4`, must be gzip, zlib or none")
+	assert.EqualError(t, CheckGELF("tcp", "gzip", GELF_CHUNK_SIZE), "Gelf over tcp can not be compressed, gzip provided")
+	assert.EqualError(t, CheckGELF("udp", "", 100), "Gelf chunk size must be at least 128, 100 provided")
+}
+
+func TestGELFWriter_udp(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	read := func() []byte {
+		l.SetReadDeadline(time.Now().Add(time.Second * 2))
+		b := make([]byte, 65536)
+		n, _, err := l.ReadFrom(b)
+		assert.Nil(t, err)
+		return b[:n]
+	}
+
+	// gzip by default
+	w, err := NewGELFWriter("udp", l.LocalAddr().String(), "", GELF_MIN_CHUNK_SIZE, time.Second, 0, 0)
+	assert.Nil(t, err)
+
+	n, err := w.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+
+	gz, err := gzip.NewReader(bytes.NewReader(read()))
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(gz)
+	assert.Equal(t, "{\"a\":1}", string(b))
+
+	// too large for a datagram, it is chunked
+	w.compression = GELF_COMPRESSION_NONE
+	msg := "{\"a\":\"" + strings.Repeat("x", 300) + "\"}"
+	_, err = w.Write([]byte(msg + "\n"))
+	assert.Nil(t, err)
+
+	whole := []byte{}
+	var id []byte
+	for i := 0; i < 3; i++ {
+		chunk := read()
+		assert.True(t, len(chunk) <= GELF_MIN_CHUNK_SIZE)
+		assert.Equal(t, gelfMagic, chunk[:2])
+		if id == nil {
+			id = chunk[2:10]
+		}
+
+		assert.Equal(t, id, chunk[2:10])
+		assert.Equal(t, []byte{byte(i), 3}, chunk[10:12])
+		whole = append(whole, chunk[GELF_CHUNK_HEADER:]...)
+	}
+
+	assert.Equal(t, msg, string(whole))
+
+	// messages needing too many chunks are an error, they are retried like any other failed write
+	_, err = w.Write([]byte(strings.Repeat("x", GELF_MAX_CHUNKS*(GELF_MIN_CHUNK_SIZE-GELF_CHUNK_HEADER)+1)))
+	assert.EqualError(t, err, "Gelf message of 14849 bytes needs 129 chunks, at most 128 are allowed")
+
+	// zlib
+	w.compression = GELF_COMPRESSION_ZLIB
+	_, err = w.Write([]byte("{\"a\":2}\n"))
+	assert.Nil(t, err)
+
+	zr, err := zlib.NewReader(bytes.NewReader(read()))
+	assert.Nil(t, err)
+	b, _ = ioutil.ReadAll(zr)
+	assert.Equal(t, "{\"a\":2}", string(b))
+
+	assert.Nil(t, w.Flush())
+	assert.Nil(t, w.Close())
+}
+
+func TestGELFWriter_tcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	msgs := make(chan string, 10)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		r := bufio.NewReader(c)
+		for {
+			msg, err := r.ReadString(0)
+			if err != nil {
+				return
+			}
+
+			msgs <- msg
+		}
+	}()
+
+	w, err := NewGELFWriter("tcp", l.Addr().String(), "", GELF_CHUNK_SIZE, time.Second, 10, time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, GELF_COMPRESSION_NONE, w.compression)
+
+	// messages are ended with a null byte instead of a newline
+	n, err := w.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, "{\"a\":1}\x00", <-msgs)
+
+	assert.Nil(t, w.Close())
+
+	// bad settings and unreachable addresses
+	_, err = NewGELFWriter("tcp", l.Addr().String(), "gzip", GELF_CHUNK_SIZE, time.Second, 10, time.Millisecond)
+	assert.EqualError(t, err, "Gelf over tcp can not be compressed, gzip provided")
+
+	_, err = NewGELFWriter("tcp", "127.0.0.1:1", "", GELF_CHUNK_SIZE, time.Second, 10, time.Millisecond)
+	assert.NotNil(t, err)
+}
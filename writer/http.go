@@ -0,0 +1,221 @@
+package writer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+// How long an idle keep-alive connection to the collector is kept around
+const HTTP_IDLE_CONN_TIMEOUT = 90 * time.Second
+
+// An io.Writer that batches json events and POSTs them, as a json array, to a remote collector
+// Connections are kept alive and reused across batches. With more than 1 request in flight full batches are sent in
+// the background, a failed batch is put back and reported on the next Write so it goes through the AuditWriter
+// attempts path. Batches may then reach the collector out of order
+type HTTPWriter struct {
+	url           string
+	method        string
+	headers       map[string]string
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+	inFlight      chan struct{}  // Holds a token for every request being sent in the background
+	sending       sync.WaitGroup // Background requests that have not finished yet
+
+	lock   sync.Mutex
+	batch  [][]byte
+	oldest time.Time
+	err    error // Why the last background request failed, its events are back in batch
+}
+
+func NewHTTPWriter(url, method string, headers map[string]string, timeout time.Duration, insecure bool, batchSize int, flushInterval time.Duration, maxIdleConns, maxInFlight int) *HTTPWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+
+	// Every request in flight needs a connection of its own, there is no point closing the ones we will need again
+	if maxIdleConns < maxInFlight {
+		maxIdleConns = maxInFlight
+	}
+
+	h := &HTTPWriter{
+		url:     url,
+		method:  method,
+		headers: headers,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     &tls.Config{InsecureSkipVerify: insecure},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConns:        maxIdleConns,
+				MaxIdleConnsPerHost: maxIdleConns,
+				IdleConnTimeout:     HTTP_IDLE_CONN_TIMEOUT,
+			},
+		},
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		inFlight:      make(chan struct{}, maxInFlight),
+		batch:         make([][]byte, 0, batchSize),
+	}
+
+	if flushInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(flushInterval)
+				h.flushStale()
+			}
+		}()
+	}
+
+	return h
+}
+
+// Adds an event to the current batch, the batch is sent once it is full
+// If sending fails the event is removed from the batch so that a retry from AuditWriter does not duplicate it
+func (h *HTTPWriter) Write(p []byte) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// The last background request failed, send its events now so the caller can retry on failure
+	if h.err != nil {
+		if err := h.send(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(h.batch) == 0 {
+		h.oldest = time.Now()
+	}
+
+	// The encoder reuses its buffer, we must keep our own copy
+	h.batch = append(h.batch, bytes.TrimSpace(append([]byte{}, p...)))
+	if len(h.batch) < h.batchSize {
+		return len(p), nil
+	}
+
+	if cap(h.inFlight) > 1 {
+		h.sendBackground()
+		return len(p), nil
+	}
+
+	if err := h.send(); err != nil {
+		h.batch = h.batch[:len(h.batch)-1]
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Waits for the requests in flight and sends any pending events
+func (h *HTTPWriter) Flush() error {
+	h.sending.Wait()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.send()
+}
+
+// Sends the current batch if it has been waiting longer than the flush interval
+func (h *HTTPWriter) flushStale() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.batch) == 0 || time.Since(h.oldest) < h.flushInterval {
+		return
+	}
+
+	if err := h.send(); err != nil {
+		logger.Err("Failed to flush http batch, will retry on the next write. Error: %v", err)
+	}
+}
+
+// Hands the current batch to a background request, waiting for one of the requests in flight to finish if we are
+// at the limit. The lock must be held by the caller
+func (h *HTTPWriter) sendBackground() {
+	batch := h.batch
+	h.batch = make([][]byte, 0, h.batchSize)
+
+	h.inFlight <- struct{}{}
+	h.sending.Add(1)
+
+	go func() {
+		defer h.sending.Done()
+
+		err := h.post(batch)
+		<-h.inFlight
+		if err == nil {
+			return
+		}
+
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		logger.Err("Failed to send http batch of %d events, will retry on the next write. Error: %v", len(batch), err)
+		if len(h.batch) == 0 {
+			h.oldest = time.Now()
+		}
+
+		h.batch = append(batch, h.batch...)
+		h.err = err
+	}()
+}
+
+// POSTs the current batch, the lock must be held by the caller
+func (h *HTTPWriter) send() error {
+	if err := h.post(h.batch); err != nil {
+		return err
+	}
+
+	h.batch = h.batch[:0]
+	h.err = nil
+	return nil
+}
+
+// POSTs the events as a json array
+func (h *HTTPWriter) post(batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body := &bytes.Buffer{}
+	body.WriteByte('[')
+	body.Write(bytes.Join(batch, []byte{','}))
+	body.WriteByte(']')
+
+	req, err := http.NewRequest(h.method, h.url, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	// Drain the body so the connection can be reused
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response from %s: %s", h.url, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package writer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPWriter_Write(t *testing.T) {
+	var bodies []string
+	status := http.StatusOK
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "yes", r.Header.Get("X-Test"))
+		w.WriteHeader(status)
+	}))
+	defer s.Close()
+
+	h := NewHTTPWriter(s.URL, "PUT", map[string]string{"X-Test": "yes"}, time.Second, false, 2, 0, 1, 1)
+
+	// Batch is not full yet
+	n, err := h.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, 0, len(bodies))
+
+	// Full batch is sent as a json array
+	_, err = h.Write([]byte("{\"b\":2}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"[{\"a\":1},{\"b\":2}]"}, bodies)
+
+	// Non 2xx responses are errors and the failed event is not kept
+	status = http.StatusServiceUnavailable
+	h.Write([]byte("{\"c\":3}\n"))
+	_, err = h.Write([]byte("{\"d\":4}\n"))
+	assert.EqualError(t, err, "Unexpected response from "+s.URL+": 503 Service Unavailable")
+	assert.Equal(t, 1, len(h.batch))
+
+	// A retry sends the pending events without duplicates
+	status = http.StatusOK
+	_, err = h.Write([]byte("{\"d\":4}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "[{\"c\":3},{\"d\":4}]", bodies[len(bodies)-1])
+
+	// Flush sends partial batches
+	h.Write([]byte("{\"e\":5}\n"))
+	assert.Nil(t, h.Flush())
+	assert.Equal(t, "[{\"e\":5}]", bodies[len(bodies)-1])
+	assert.Equal(t, 0, len(h.batch))
+}
+
+func TestHTTPWriter_maxInFlight(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	status := http.StatusOK
+	release := make(chan bool)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		b, _ := ioutil.ReadAll(r.Body)
+
+		lock.Lock()
+		defer lock.Unlock()
+		bodies = append(bodies, string(b))
+		w.WriteHeader(status)
+	}))
+	defer s.Close()
+
+	h := NewHTTPWriter(s.URL, "POST", nil, time.Second, false, 1, 0, 0, 2)
+
+	// Full batches are sent in the background, up to 2 at a time
+	_, err := h.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	_, err = h.Write([]byte("{\"b\":2}\n"))
+	assert.Nil(t, err)
+
+	// The third write waits for a request to finish
+	written := make(chan bool)
+	go func() {
+		h.Write([]byte("{\"c\":3}\n"))
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("Write did not wait for a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release <- true
+	<-written
+	release <- true
+	release <- true
+	assert.Nil(t, h.Flush())
+	assert.ElementsMatch(t, []string{"[{\"a\":1}]", "[{\"b\":2}]", "[{\"c\":3}]"}, bodies)
+
+	// A failed background request is put back and reported on the next write
+	lock.Lock()
+	status = http.StatusServiceUnavailable
+	lock.Unlock()
+
+	h.Write([]byte("{\"d\":4}\n"))
+	release <- true
+	h.sending.Wait()
+
+	go func() { release <- true }()
+	_, err = h.Write([]byte("{\"e\":5}\n"))
+	assert.EqualError(t, err, "Unexpected response from "+s.URL+": 503 Service Unavailable")
+	assert.Equal(t, 1, len(h.batch))
+
+	lock.Lock()
+	status = http.StatusOK
+	lock.Unlock()
+
+	go func() { release <- true }()
+	assert.Nil(t, h.Flush())
+	assert.Equal(t, "[{\"d\":4}]", bodies[len(bodies)-1])
+	assert.Equal(t, 0, len(h.batch))
+}
+
+// Compares sending batches of 10 ~600 byte events over a kept alive connection with a new connection for each batch
+func BenchmarkHTTPWriter(b *testing.B) {
+	event := append(append([]byte("{\"a\":\""), bytes.Repeat([]byte("x"), 590)...), '"', '}', '\n')
+
+	for _, keepAlive := range []bool{true, false} {
+		b.Run("keepalive="+strconv.FormatBool(keepAlive), func(b *testing.B) {
+			var conns int64
+			s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+			}))
+			s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt64(&conns, 1)
+				}
+			}
+			s.Start()
+			defer s.Close()
+
+			h := NewHTTPWriter(s.URL, "POST", nil, time.Second, false, 10, 0, 2, 1)
+			h.client.Transport.(*http.Transport).DisableKeepAlives = !keepAlive
+
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if _, err := h.Write(event); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			h.Flush()
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "events/s")
+			b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/event")
+		})
+	}
+}
@@ -0,0 +1,594 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+const (
+	KAFKA_KEY_NONE     = ""
+	KAFKA_KEY_SEQUENCE = "sequence"
+	KAFKA_KEY_HOSTNAME = "hostname"
+
+	kafkaApiProduce  = 0
+	kafkaApiMetadata = 3
+)
+
+var kafkaCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaMessage struct {
+	key   []byte
+	value []byte
+}
+
+type kafkaPartition struct {
+	id     int32
+	leader int32
+}
+
+// An io.Writer that produces each event as a message to a kafka topic
+// Messages are buffered and sent by a background flusher, a failed flush is reported on the next Write
+// so it goes through the AuditWriter attempts path
+type KafkaWriter struct {
+	brokers       []string
+	topic         string
+	keyMode       string
+	hostname      string
+	clientId      string
+	acks          int16
+	timeout       time.Duration
+	batchSize     int
+	maxBuffered   int
+	flushInterval time.Duration
+
+	lock       sync.Mutex
+	buffer     []kafkaMessage
+	err        error
+	conns      map[int32]*kafkaConn
+	leaders    map[int32]string
+	partitions []kafkaPartition
+	next       int
+	correlate  int32
+	flushNow   chan bool
+	seq        int // Sequence of the event being written, see SetSequence
+}
+
+func NewKafkaWriter(brokers []string, topic, keyMode string, acks int, timeout time.Duration, batchSize, maxBuffered int, flushInterval time.Duration) (*KafkaWriter, error) {
+	switch keyMode {
+	case KAFKA_KEY_NONE, KAFKA_KEY_SEQUENCE, KAFKA_KEY_HOSTNAME:
+	default:
+		return nil, fmt.Errorf("Unknown kafka partition key `%s`", keyMode)
+	}
+
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	if maxBuffered < batchSize {
+		maxBuffered = batchSize
+	}
+
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	hostname, _ := os.Hostname()
+
+	k := &KafkaWriter{
+		brokers:       brokers,
+		topic:         topic,
+		keyMode:       keyMode,
+		hostname:      hostname,
+		clientId:      "go-audit",
+		acks:          int16(acks),
+		timeout:       timeout,
+		batchSize:     batchSize,
+		maxBuffered:   maxBuffered,
+		flushInterval: flushInterval,
+		conns:         make(map[int32]*kafkaConn),
+		flushNow:      make(chan bool, 1),
+	}
+
+	if err := k.refreshMetadata(); err != nil {
+		return nil, err
+	}
+
+	go k.flusher()
+	return k, nil
+}
+
+// Sets the sequence of the event about to be written, it is the partition key in sequence mode
+func (k *KafkaWriter) SetSequence(seq int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.seq = seq
+}
+
+// Buffers an event to be produced
+func (k *KafkaWriter) Write(p []byte) (int, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	// The last background flush failed, try again now so the caller can retry on failure
+	if k.err != nil {
+		if err := k.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(k.buffer) >= k.maxBuffered {
+		return 0, fmt.Errorf("Kafka buffer is full with %d messages", len(k.buffer))
+	}
+
+	value := bytes.TrimSpace(append([]byte{}, p...))
+	k.buffer = append(k.buffer, kafkaMessage{key: k.key(), value: value})
+
+	if len(k.buffer) >= k.batchSize {
+		select {
+		case k.flushNow <- true:
+		default:
+		}
+	}
+
+	return len(p), nil
+}
+
+// Synchronously produces all buffered messages
+func (k *KafkaWriter) Flush() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.flush()
+}
+
+// Produces all buffered messages and closes any broker connections
+func (k *KafkaWriter) Close() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	err := k.flush()
+	k.closeConns()
+	return err
+}
+
+func (k *KafkaWriter) flusher() {
+	t := time.NewTicker(k.flushInterval)
+	for {
+		select {
+		case <-t.C:
+		case <-k.flushNow:
+		}
+
+		k.lock.Lock()
+		if err := k.flush(); err != nil {
+			logger.Err("Failed to produce messages to kafka. Error: %v", err)
+		}
+		k.lock.Unlock()
+	}
+}
+
+// Picks the partition key for the event being written based on the configured mode
+// The sequence comes from SetSequence so it works for every format, anything without one, like a heartbeat, has no key
+func (k *KafkaWriter) key() []byte {
+	switch k.keyMode {
+	case KAFKA_KEY_HOSTNAME:
+		return []byte(k.hostname)
+
+	case KAFKA_KEY_SEQUENCE:
+		if k.seq > 0 {
+			return []byte(strconv.Itoa(k.seq))
+		}
+	}
+
+	return nil
+}
+
+func (k *KafkaWriter) partition(key []byte) kafkaPartition {
+	if key == nil {
+		k.next++
+		return k.partitions[k.next%len(k.partitions)]
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+	return k.partitions[h.Sum32()%uint32(len(k.partitions))]
+}
+
+// Produces all buffered messages, the lock must be held by the caller
+func (k *KafkaWriter) flush() (err error) {
+	defer func() { k.err = err }()
+
+	if len(k.buffer) == 0 {
+		return nil
+	}
+
+	if len(k.partitions) == 0 {
+		if err = k.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+
+	// Group messages by partition, then by leader
+	byLeader := make(map[int32]map[int32][]kafkaMessage)
+	for _, m := range k.buffer {
+		p := k.partition(m.key)
+		if _, ok := byLeader[p.leader]; !ok {
+			byLeader[p.leader] = make(map[int32][]kafkaMessage)
+		}
+		byLeader[p.leader][p.id] = append(byLeader[p.leader][p.id], m)
+	}
+
+	// Only what was not acked is kept for the next attempt, partitions that made it are not produced twice
+	var unacked []kafkaMessage
+	for leader, parts := range byLeader {
+		rejected, perr := k.produce(leader, parts)
+		if perr == nil {
+			continue
+		}
+
+		err = perr
+		for id, msgs := range parts {
+			if rejected == nil || rejected[id] {
+				unacked = append(unacked, msgs...)
+			}
+		}
+	}
+
+	if err != nil {
+		// Leadership may have moved, start fresh on the next attempt
+		k.closeConns()
+		k.partitions = nil
+		k.buffer = unacked
+		return err
+	}
+
+	k.buffer = k.buffer[:0]
+	return nil
+}
+
+// Produces the messages of each partition to their leader
+// When the leader rejects some partitions those are returned along with the error, a nil set means none were acked
+func (k *KafkaWriter) produce(leader int32, parts map[int32][]kafkaMessage) (map[int32]bool, error) {
+	c, err := k.conn(leader)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &kafkaEncoder{}
+	req.int16(-1) // transactional_id
+	req.int16(k.acks)
+	req.int32(int32(k.timeout / time.Millisecond))
+	req.int32(1)
+	req.string(k.topic)
+	req.int32(int32(len(parts)))
+	for id, msgs := range parts {
+		req.int32(id)
+		req.bytes(kafkaRecordBatch(msgs))
+	}
+
+	if k.acks == 0 {
+		return nil, c.send(k.nextCorrelation(), kafkaApiProduce, 3, req.Bytes(), false, nil)
+	}
+
+	rejected := make(map[int32]bool)
+	var rejectErr error
+	err = c.send(k.nextCorrelation(), kafkaApiProduce, 3, req.Bytes(), true, func(d *kafkaDecoder) error {
+		for t := d.int32(); t > 0; t-- {
+			d.string()
+			for p := d.int32(); p > 0; p-- {
+				id := d.int32()
+				code := d.int16()
+				d.int64()
+				d.int64()
+				if code != 0 {
+					rejected[id] = true
+					if rejectErr == nil {
+						rejectErr = fmt.Errorf("Kafka rejected messages for partition %d with error code %d", id, code)
+					}
+				}
+			}
+		}
+		return d.err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rejectErr != nil {
+		return rejected, rejectErr
+	}
+
+	return nil, nil
+}
+
+func (k *KafkaWriter) refreshMetadata() error {
+	var lastErr error
+
+	for _, broker := range k.brokers {
+		c, err := dialKafka(broker, k.clientId, k.timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		req := &kafkaEncoder{}
+		req.int32(1)
+		req.string(k.topic)
+
+		leaders := make(map[int32]string)
+		partitions := []kafkaPartition{}
+		err = c.send(k.nextCorrelation(), kafkaApiMetadata, 1, req.Bytes(), true, func(d *kafkaDecoder) error {
+			for b := d.int32(); b > 0; b-- {
+				id := d.int32()
+				host := d.string()
+				port := d.int32()
+				d.nullableString()
+				leaders[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+			}
+
+			d.int32()
+			for t := d.int32(); t > 0; t-- {
+				code := d.int16()
+				d.string()
+				d.bool()
+				if code != 0 {
+					return fmt.Errorf("Kafka metadata for topic %s returned error code %d", k.topic, code)
+				}
+
+				for p := d.int32(); p > 0; p-- {
+					d.int16()
+					part := kafkaPartition{id: d.int32(), leader: d.int32()}
+					d.int32Array()
+					d.int32Array()
+					partitions = append(partitions, part)
+				}
+			}
+			return d.err
+		})
+		c.Close()
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if len(partitions) == 0 {
+			lastErr = fmt.Errorf("Kafka topic %s has no partitions", k.topic)
+			continue
+		}
+
+		k.leaders = leaders
+		k.partitions = partitions
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("No kafka brokers were configured")
+	}
+
+	return fmt.Errorf("Failed to fetch kafka metadata. Error: %v", lastErr)
+}
+
+func (k *KafkaWriter) conn(leader int32) (*kafkaConn, error) {
+	if c, ok := k.conns[leader]; ok {
+		return c, nil
+	}
+
+	addr, ok := k.leaders[leader]
+	if !ok {
+		return nil, fmt.Errorf("Unknown kafka broker %d", leader)
+	}
+
+	c, err := dialKafka(addr, k.clientId, k.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	k.conns[leader] = c
+	return c, nil
+}
+
+func (k *KafkaWriter) closeConns() {
+	for id, c := range k.conns {
+		c.Close()
+		delete(k.conns, id)
+	}
+}
+
+func (k *KafkaWriter) nextCorrelation() int32 {
+	k.correlate++
+	return k.correlate
+}
+
+// Builds a v2 record batch (magic 2) containing the messages
+func kafkaRecordBatch(msgs []kafkaMessage) []byte {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	records := &kafkaEncoder{}
+	for i, m := range msgs {
+		r := &kafkaEncoder{}
+		r.int8(0)
+		r.varint(0)
+		r.varint(int64(i))
+		if m.key == nil {
+			r.varint(-1)
+		} else {
+			r.varint(int64(len(m.key)))
+			r.Write(m.key)
+		}
+		r.varint(int64(len(m.value)))
+		r.Write(m.value)
+		r.varint(0)
+
+		records.varint(int64(r.Len()))
+		records.Write(r.Bytes())
+	}
+
+	// Everything after the crc is covered by it
+	body := &kafkaEncoder{}
+	body.int16(0)
+	body.int32(int32(len(msgs) - 1))
+	body.int64(now)
+	body.int64(now)
+	body.int64(-1)
+	body.int16(-1)
+	body.int32(-1)
+	body.int32(int32(len(msgs)))
+	body.Write(records.Bytes())
+
+	batch := &kafkaEncoder{}
+	batch.int64(0)
+	batch.int32(int32(4 + 1 + 4 + body.Len()))
+	batch.int32(0)
+	batch.int8(2)
+	batch.int32(int32(crc32.Checksum(body.Bytes(), kafkaCrcTable)))
+	batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+type kafkaConn struct {
+	net.Conn
+	r        *bufio.Reader
+	clientId string
+	timeout  time.Duration
+}
+
+func dialKafka(addr, clientId string, timeout time.Duration) (*kafkaConn, error) {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafkaConn{Conn: c, r: bufio.NewReader(c), clientId: clientId, timeout: timeout}, nil
+}
+
+// Sends a request and optionally reads and decodes the response
+func (c *kafkaConn) send(correlation int32, api, version int16, body []byte, wait bool, decode func(*kafkaDecoder) error) error {
+	req := &kafkaEncoder{}
+	req.int16(api)
+	req.int16(version)
+	req.int32(correlation)
+	req.string(c.clientId)
+	req.Write(body)
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(req.Len()))
+
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	if _, err := c.Write(append(size, req.Bytes()...)); err != nil {
+		return err
+	}
+
+	if !wait {
+		return nil
+	}
+
+	if _, err := io.ReadFull(c.r, size); err != nil {
+		return err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return err
+	}
+
+	d := &kafkaDecoder{b: resp}
+	if d.int32() != correlation {
+		return errors.New("Kafka response did not match the request")
+	}
+
+	return decode(d)
+}
+
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) { e.WriteByte(byte(v)) }
+
+func (e *kafkaEncoder) int16(v int16) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.WriteString(v)
+}
+
+func (e *kafkaEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.Write(v)
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	e.Write(b[:binary.PutVarint(b, v)])
+}
+
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.b) {
+		d.err = errors.New("Kafka response was truncated")
+		if n < 0 || n > 8 {
+			n = 0
+		}
+		return make([]byte, n)
+	}
+
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) bool() bool { return d.take(1)[0] != 0 }
+
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.take(2))) }
+
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.take(4))) }
+
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.take(8))) }
+
+func (d *kafkaDecoder) string() string {
+	return string(d.take(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() {
+	d.take(int(d.int32()) * 4)
+}
@@ -0,0 +1,251 @@
+package writer
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// A tiny kafka broker that understands just enough to accept produce requests
+type fakeKafka struct {
+	l             net.Listener
+	lock          sync.Mutex
+	values        map[int32][]string
+	keys          map[int32][]string
+	failCode      int16
+	failPartition int32 // Only this partition fails with failCode, -1 for all of them
+}
+
+func newFakeKafka(t *testing.T) *fakeKafka {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeKafka{l: l, values: make(map[int32][]string), keys: make(map[int32][]string), failPartition: -1}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(t, c)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeKafka) serve(t *testing.T, c net.Conn) {
+	defer c.Close()
+	for {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(c, size); err != nil {
+			return
+		}
+
+		req := make([]byte, binary.BigEndian.Uint32(size))
+		io.ReadFull(c, req)
+
+		d := &kafkaDecoder{b: req}
+		api := d.int16()
+		d.int16()
+		correlation := d.int32()
+		assert.Equal(t, "go-audit", d.string())
+
+		resp := &kafkaEncoder{}
+		resp.int32(correlation)
+
+		switch api {
+		case kafkaApiMetadata:
+			host, port, _ := net.SplitHostPort(f.l.Addr().String())
+			p, _ := strconv.Atoi(port)
+			resp.int32(1)
+			resp.int32(0)
+			resp.string(host)
+			resp.int32(int32(p))
+			resp.int16(-1)
+			resp.int32(0)
+			resp.int32(1)
+			resp.int16(0)
+			resp.string("audit")
+			resp.int8(0)
+			resp.int32(2)
+			for i := int32(0); i < 2; i++ {
+				resp.int16(0)
+				resp.int32(i)
+				resp.int32(0)
+				resp.int32(0)
+				resp.int32(0)
+			}
+
+		case kafkaApiProduce:
+			d.int16()
+			d.int16()
+			d.int32()
+			d.int32()
+			topic := d.string()
+			parts := d.int32()
+
+			resp.int32(1)
+			resp.string(topic)
+			resp.int32(parts)
+			for ; parts > 0; parts-- {
+				id := d.int32()
+				f.readBatch(t, id, d.take(int(d.int32())))
+				resp.int32(id)
+				if f.failPartition < 0 || f.failPartition == id {
+					resp.int16(f.failCode)
+				} else {
+					resp.int16(0)
+				}
+				resp.int64(0)
+				resp.int64(-1)
+			}
+			resp.int32(0)
+		}
+
+		binary.BigEndian.PutUint32(size, uint32(resp.Len()))
+		c.Write(append(size, resp.Bytes()...))
+	}
+}
+
+func (f *fakeKafka) readBatch(t *testing.T, partition int32, b []byte) {
+	d := &kafkaDecoder{b: b}
+	d.int64()
+	d.int32()
+	d.int32()
+	assert.Equal(t, byte(2), d.take(1)[0], "Expected magic 2")
+	crc := uint32(d.int32())
+	assert.Equal(t, crc32.Checksum(d.b, kafkaCrcTable), crc, "Bad record batch crc")
+
+	d.take(2 + 4 + 8 + 8 + 8 + 2 + 4)
+	count := d.int32()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for ; count > 0; count-- {
+		varint := func() int64 {
+			v, n := binary.Varint(d.b)
+			d.b = d.b[n:]
+			return v
+		}
+
+		varint()
+		d.take(1)
+		varint()
+		varint()
+		if kl := varint(); kl >= 0 {
+			f.keys[partition] = append(f.keys[partition], string(d.take(int(kl))))
+		}
+		f.values[partition] = append(f.values[partition], string(d.take(int(varint()))))
+		varint()
+	}
+}
+
+func TestKafkaWriter_Write(t *testing.T) {
+	f := newFakeKafka(t)
+	defer f.l.Close()
+
+	// bad key mode
+	k, err := NewKafkaWriter([]string{f.l.Addr().String()}, "audit", "nope", 1, time.Second, 10, 10, time.Hour)
+	assert.EqualError(t, err, "Unknown kafka partition key `nope`")
+	assert.Nil(t, k)
+
+	// unreachable brokers
+	k, err = NewKafkaWriter([]string{"127.0.0.1:1"}, "audit", "", 1, time.Second, 10, 10, time.Hour)
+	assert.Contains(t, err.Error(), "Failed to fetch kafka metadata.")
+	assert.Nil(t, k)
+
+	k, err = NewKafkaWriter([]string{f.l.Addr().String()}, "audit", KAFKA_KEY_SEQUENCE, 1, time.Second, 10, 10, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(k.partitions))
+
+	// Keep the background flusher out of the way
+	k.maxBuffered = 3
+
+	// Messages are buffered until flushed, keyed by the sequence they were written with whatever the format
+	k.SetSequence(1)
+	k.Write([]byte("{\"sequence\":1,\"a\":1}\n"))
+	k.Write([]byte("sequence=1 a=2\n"))
+	k.SetSequence(2)
+	k.Write([]byte("{\"sequence\":2,\"a\":3}\n"))
+	assert.Equal(t, 3, len(k.buffer))
+	assert.Equal(t, []byte("1"), k.buffer[1].key)
+
+	k.SetSequence(3)
+	_, err = k.Write([]byte("{\"sequence\":3,\"a\":4}\n"))
+	assert.EqualError(t, err, "Kafka buffer is full with 3 messages")
+
+	assert.Nil(t, k.Flush())
+	assert.Equal(t, 0, len(k.buffer))
+
+	total := 0
+	for p, keys := range f.keys {
+		total += len(keys)
+		// Same sequence always lands on the same partition
+		for i, key := range keys {
+			if key == "1" {
+				assert.Contains(t, f.values[p][i], "sequence")
+				assert.Contains(t, f.values[p][i], "1")
+			}
+		}
+	}
+	assert.Equal(t, 3, total)
+
+	// Produce errors are surfaced on the next write
+	p := k.partition([]byte("4")).id
+	f.failCode = 6
+	k.SetSequence(4)
+	k.Write([]byte("{\"sequence\":4,\"a\":5}\n"))
+	assert.EqualError(t, k.Flush(), "Kafka rejected messages for partition "+strconv.Itoa(int(p))+" with error code 6")
+	_, err = k.Write([]byte("{\"sequence\":5,\"a\":6}\n"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(k.buffer))
+
+	f.failCode = 0
+	_, err = k.Write([]byte("{\"sequence\":5,\"a\":6}\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, k.Close())
+	assert.Equal(t, 0, len(k.buffer))
+}
+
+func TestKafkaWriter_flush_partial(t *testing.T) {
+	f := newFakeKafka(t)
+	defer f.l.Close()
+
+	k, err := NewKafkaWriter([]string{f.l.Addr().String()}, "audit", KAFKA_KEY_SEQUENCE, 1, time.Second, 10, 10, time.Hour)
+	assert.Nil(t, err)
+
+	// Two sequences that land on different partitions of the same leader
+	seqs := map[int32]int{}
+	for seq := 1; len(seqs) < 2; seq++ {
+		seqs[k.partition([]byte(strconv.Itoa(seq))).id] = seq
+	}
+
+	for _, id := range []int32{0, 1} {
+		k.SetSequence(seqs[id])
+		k.Write([]byte("event " + strconv.Itoa(seqs[id]) + "\n"))
+	}
+
+	// Only the rejected partition is produced again
+	f.failCode = 6
+	f.failPartition = 1
+	assert.EqualError(t, k.Flush(), "Kafka rejected messages for partition 1 with error code 6")
+	assert.Equal(t, 1, len(k.buffer))
+	assert.Equal(t, "event "+strconv.Itoa(seqs[1]), string(k.buffer[0].value))
+
+	f.failCode = 0
+	assert.Nil(t, k.Flush())
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	assert.Equal(t, []string{"event " + strconv.Itoa(seqs[0])}, f.values[0])
+	assert.Equal(t, []string{"event " + strconv.Itoa(seqs[1]), "event " + strconv.Itoa(seqs[1])}, f.values[1])
+}
@@ -0,0 +1,479 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+const NATS_MAX_PENDING_ACKS = 16 // Acks waiting to be picked up, late acks for publishes that timed out count too
+
+// What the server tells us about itself when we connect
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// The reply to a JetStream publish
+type natsPubAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// An io.Writer that publishes each event as a message to a NATS subject
+// With jetstream every publish waits for the stream to acknowledge it, a missing or negative ack is returned as an
+// error so it goes through the AuditWriter attempts path. Without it messages are fire and forget, Flush makes sure
+// the server has seen everything published so far
+// If the connection is lost the next write will dial again
+type NATSWriter struct {
+	address   string
+	subject   string
+	jetstream bool
+	username  string
+	password  string
+	token     string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	lock  sync.Mutex
+	conn  *natsConn
+	inbox string // Prefix of the subjects JetStream acks are sent to
+	next  int
+}
+
+// A connection to the server, a background reader answers pings and hands acks over
+type natsConn struct {
+	conn       net.Conn
+	maxPayload int
+	wlock      sync.Mutex // Writes come from both the writer and the reader, which answers pings
+	pongs      chan bool
+	acks       chan natsMsg
+	done       chan bool // Closed once the reader stops, err says why
+	err        error
+}
+
+type natsMsg struct {
+	subject string
+	data    []byte
+}
+
+// Connects to the server at rawUrl, like nats://host:4222. A tls:// url or a tlsConfig enables TLS, as does a server
+// that requires it. Credentials in the url are used unless username, password or token are set
+func NewNATSWriter(rawUrl, subject string, jetstream bool, username, password, token string, tlsConfig *tls.Config, timeout time.Duration) (*NATSWriter, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown nats url scheme `%s`, must be nats or tls", u.Scheme)
+	}
+
+	if u.User != nil && username == "" && password == "" && token == "" {
+		if p, ok := u.User.Password(); ok {
+			username, password = u.User.Username(), p
+		} else {
+			token = u.User.Username()
+		}
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	if tlsConfig != nil && tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	n := &NATSWriter{
+		address:   address,
+		subject:   subject,
+		jetstream: jetstream,
+		username:  username,
+		password:  password,
+		token:     token,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+		inbox:     "_INBOX.go-audit." + hex.EncodeToString(id),
+	}
+
+	if n.conn, err = n.connect(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Publishes the event, with jetstream this waits for the ack
+func (n *NATSWriter) Write(p []byte) (int, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// Do not waste an attempt on a connection we already know is gone
+	if n.conn != nil {
+		select {
+		case <-n.conn.done:
+			n.drop(n.conn.err)
+		default:
+		}
+	}
+
+	if n.conn == nil {
+		conn, err := n.connect()
+		if err != nil {
+			return 0, err
+		}
+		n.conn = conn
+	}
+
+	payload := bytes.TrimRight(p, "\n")
+	if n.conn.maxPayload > 0 && len(payload) > n.conn.maxPayload {
+		// The server would drop the connection over this, retrying will not help either
+		return 0, fmt.Errorf("Event of %d bytes is over the nats max_payload of %d bytes", len(payload), n.conn.maxPayload)
+	}
+
+	var reply string
+	if n.jetstream {
+		n.next++
+		reply = n.inbox + "." + strconv.Itoa(n.next)
+	}
+
+	if err := n.conn.publish(n.subject, reply, payload, n.timeout); err != nil {
+		n.drop(err)
+		return 0, err
+	}
+
+	if n.jetstream {
+		if err := n.waitAck(reply); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Makes sure the server has processed everything published so far
+func (n *NATSWriter) Flush() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.conn == nil {
+		return nil
+	}
+
+	if err := n.conn.ping(n.timeout); err != nil {
+		n.drop(err)
+		return err
+	}
+
+	return nil
+}
+
+// Flushes what was published and closes the connection
+func (n *NATSWriter) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.conn == nil {
+		return nil
+	}
+
+	err := n.conn.ping(n.timeout)
+	n.conn.conn.Close()
+	n.conn = nil
+	return err
+}
+
+// Waits for the JetStream ack of the publish with the reply subject, acks for earlier publishes that timed out
+// are skipped. The lock must be held by the caller
+func (n *NATSWriter) waitAck(reply string) error {
+	var timeout <-chan time.Time
+	if n.timeout > 0 {
+		timer := time.NewTimer(n.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case msg := <-n.conn.acks:
+			if msg.subject != reply {
+				continue
+			}
+
+			ack := natsPubAck{}
+			if err := json.Unmarshal(msg.data, &ack); err != nil {
+				return fmt.Errorf("Could not parse the jetstream ack. Error: %v", err)
+			}
+
+			if ack.Error != nil {
+				return fmt.Errorf("Jetstream rejected the message with code %d. Error: %s", ack.Error.Code, ack.Error.Description)
+			}
+
+			return nil
+
+		case <-n.conn.done:
+			err := n.conn.err
+			n.drop(err)
+			return err
+
+		case <-timeout:
+			return fmt.Errorf("No jetstream ack for subject %s within %v", n.subject, n.timeout)
+		}
+	}
+}
+
+// Drops the connection so the next write dials again, the lock must be held by the caller
+func (n *NATSWriter) drop(err error) {
+	if n.conn == nil {
+		return
+	}
+
+	logger.Err("Lost connection to nats at %s. Error: %v", n.address, err)
+	n.conn.conn.Close()
+	n.conn = nil
+}
+
+// Dials the server and goes through the handshake, INFO, CONNECT and a PING to make sure we were accepted
+func (n *NATSWriter) connect() (*natsConn, error) {
+	dialer := &net.Dialer{Timeout: n.timeout}
+	conn, err := dialer.Dial("tcp", n.address)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(n.timeout))
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("Expected INFO from nats, got %s", strings.TrimSpace(line))
+	}
+
+	info := natsInfo{}
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Could not parse the nats INFO. Error: %v", err)
+	}
+
+	tlsConfig := n.tlsConfig
+	if info.TLSRequired && tlsConfig == nil {
+		host, _, _ := net.SplitHostPort(n.address)
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	if tlsConfig != nil {
+		tc := tls.Client(conn, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tc
+		r = bufio.NewReader(conn)
+	}
+
+	connect := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "go-audit",
+		"lang":     "go",
+		"version":  "1",
+		"protocol": 1,
+	}
+
+	if n.token != "" {
+		connect["auth_token"] = n.token
+	} else if n.username != "" {
+		connect["user"] = n.username
+		connect["pass"] = n.password
+	}
+
+	b, _ := json.Marshal(connect)
+	cmd := "CONNECT " + string(b) + "\r\nPING\r\n"
+	if n.jetstream {
+		cmd += "SUB " + n.inbox + ".* 1\r\n"
+	}
+
+	if _, err := io.WriteString(conn, cmd); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The server answers a bad CONNECT with an error instead of the PONG
+	line, err = r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if line = strings.TrimSpace(line); line != "PONG" {
+		conn.Close()
+		return nil, fmt.Errorf("Nats did not accept the connection: %s", line)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	c := &natsConn{
+		conn:       conn,
+		maxPayload: info.MaxPayload,
+		pongs:      make(chan bool, 1),
+		acks:       make(chan natsMsg, NATS_MAX_PENDING_ACKS),
+		done:       make(chan bool),
+	}
+
+	go c.read(r)
+	return c, nil
+}
+
+// Sends a PUB, reply is empty unless we want an answer
+func (c *natsConn) publish(subject, reply string, payload []byte, timeout time.Duration) error {
+	header := "PUB " + subject + " "
+	if reply != "" {
+		header += reply + " "
+	}
+
+	buf := make([]byte, 0, len(header)+len(payload)+16)
+	buf = append(buf, header+strconv.Itoa(len(payload))+"\r\n"...)
+	buf = append(buf, payload...)
+	buf = append(buf, "\r\n"...)
+
+	return c.write(buf, timeout)
+}
+
+// Round trips a PING, the server handles commands in order so everything sent before has been processed
+func (c *natsConn) ping(timeout time.Duration) error {
+	// Forget a stray pong from an earlier ping that timed out
+	select {
+	case <-c.pongs:
+	default:
+	}
+
+	if err := c.write([]byte("PING\r\n"), timeout); err != nil {
+		return err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-c.pongs:
+		return nil
+	case <-c.done:
+		return c.err
+	case <-expired:
+		return errors.New("No PONG from nats within " + timeout.String())
+	}
+}
+
+func (c *natsConn) write(p []byte, timeout time.Duration) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	_, err := c.conn.Write(p)
+	return err
+}
+
+// Handles everything the server sends until the connection fails
+func (c *natsConn) read(r *bufio.Reader) {
+	defer close(c.done)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			if err := c.write([]byte("PONG\r\n"), 0); err != nil {
+				c.err = err
+				return
+			}
+
+		case line == "PONG":
+			select {
+			case c.pongs <- true:
+			default:
+			}
+
+		case strings.HasPrefix(line, "-ERR"):
+			c.err = fmt.Errorf("Nats error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+			logger.Err("%v", c.err)
+
+			// Everything but permission errors closes the connection
+			if !strings.Contains(strings.ToLower(line), "permissions violation") {
+				c.conn.Close()
+				return
+			}
+
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply] <size>
+			parts := strings.Fields(line)
+			size, err := strconv.Atoi(parts[len(parts)-1])
+			if err != nil || len(parts) < 4 {
+				c.err = fmt.Errorf("Malformed nats message: %s", line)
+				c.conn.Close()
+				return
+			}
+
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				c.err = err
+				return
+			}
+
+			// An ack nobody waits for anymore is dropped
+			select {
+			case c.acks <- natsMsg{subject: parts[1], data: data[:size]}:
+			default:
+			}
+		}
+	}
+}
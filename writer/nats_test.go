@@ -0,0 +1,191 @@
+package writer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// A tiny nats server that understands just enough to accept publishes and ack them like jetstream
+type fakeNATS struct {
+	l       net.Listener
+	lock    sync.Mutex
+	connect []string
+	msgs    []string
+	ack     string // Sent in reply to publishes with a reply subject, empty to never ack
+	reject  string // Sent instead of the PONG of the handshake when set
+	conns   []net.Conn
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeNATS{l: l, ack: `{"stream":"AUDIT","seq":1}`}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			f.lock.Lock()
+			f.conns = append(f.conns, c)
+			f.lock.Unlock()
+			go f.serve(c)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeNATS) url() string {
+	return "nats://" + f.l.Addr().String()
+}
+
+func (f *fakeNATS) serve(c net.Conn) {
+	defer c.Close()
+	io.WriteString(c, "INFO {\"server_id\":\"fake\",\"max_payload\":64}\r\n")
+
+	sid := ""
+	accepted := false
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		parts := strings.Fields(line)
+		f.lock.Lock()
+		switch parts[0] {
+		case "CONNECT":
+			f.connect = append(f.connect, strings.TrimSpace(line[len("CONNECT "):]))
+		case "PING":
+			// the first ping of a connection is the end of the handshake
+			if f.reject != "" && !accepted {
+				io.WriteString(c, f.reject+"\r\n")
+				f.lock.Unlock()
+				return
+			}
+			accepted = true
+			io.WriteString(c, "PONG\r\n")
+		case "SUB":
+			sid = parts[2]
+		case "PUB":
+			size, _ := strconv.Atoi(parts[len(parts)-1])
+			payload := make([]byte, size+2)
+			io.ReadFull(r, payload)
+			f.msgs = append(f.msgs, parts[1]+" "+string(payload[:size]))
+
+			if len(parts) == 4 && f.ack != "" {
+				fmt.Fprintf(c, "MSG %s %s %d\r\n%s\r\n", parts[2], sid, len(f.ack), f.ack)
+			}
+		}
+		f.lock.Unlock()
+	}
+}
+
+func (f *fakeNATS) received() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string{}, f.msgs...)
+}
+
+func TestNATSWriter(t *testing.T) {
+	f := newFakeNATS(t)
+	defer f.l.Close()
+
+	_, err := NewNATSWriter("http://"+f.l.Addr().String(), "audit", false, "", "", "", nil, time.Second)
+	assert.EqualError(t, err, "Unknown nats url scheme `http`, must be nats or tls")
+
+	// credentials in the url are used
+	n, err := NewNATSWriter("nats://user:pass@"+f.l.Addr().String(), "audit", false, "", "", "", nil, time.Second)
+	assert.Nil(t, err)
+	assert.Contains(t, f.connect[0], `"pass":"pass","pedantic":false,"protocol":1,"user":"user"`)
+
+	_, err = n.Write([]byte("{\"sequence\":1}\n"))
+	assert.Nil(t, err)
+	_, err = n.Write([]byte("{\"sequence\":2}\n"))
+	assert.Nil(t, err)
+
+	// events over the max payload of the server are refused up front
+	_, err = n.Write([]byte(strings.Repeat("x", 65)))
+	assert.EqualError(t, err, "Event of 65 bytes is over the nats max_payload of 64 bytes")
+
+	// once the flush returns the server has everything
+	assert.Nil(t, n.Flush())
+	assert.Equal(t, []string{"audit {\"sequence\":1}", "audit {\"sequence\":2}"}, f.received())
+	assert.Nil(t, n.Close())
+	assert.Nil(t, n.Close())
+}
+
+func TestNATSWriter_jetstream(t *testing.T) {
+	f := newFakeNATS(t)
+	defer f.l.Close()
+
+	n, err := NewNATSWriter(f.url(), "audit", true, "", "", "s3cr3t", nil, 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Contains(t, f.connect[0], `"auth_token":"s3cr3t"`)
+
+	// the fake acks everything with the same body, the reply subject is what ties an ack to its publish
+	_, err = n.Write([]byte("{\"sequence\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"audit {\"sequence\":1}"}, f.received())
+
+	f.lock.Lock()
+	f.ack = `{"error":{"code":503,"description":"no stream"}}`
+	f.lock.Unlock()
+	_, err = n.Write([]byte("{\"sequence\":2}\n"))
+	assert.EqualError(t, err, "Jetstream rejected the message with code 503. Error: no stream")
+
+	f.lock.Lock()
+	f.ack = ""
+	f.lock.Unlock()
+	_, err = n.Write([]byte("{\"sequence\":3}\n"))
+	assert.EqualError(t, err, "No jetstream ack for subject audit within 100ms")
+	assert.Nil(t, n.Close())
+}
+
+func TestNATSWriter_reconnect(t *testing.T) {
+	f := newFakeNATS(t)
+	defer f.l.Close()
+
+	n, err := NewNATSWriter(f.url(), "audit", true, "", "", "", nil, time.Second)
+	assert.Nil(t, err)
+
+	// the server answers pings from its side
+	f.lock.Lock()
+	io.WriteString(f.conns[0], "PING\r\n")
+	f.lock.Unlock()
+	assert.Nil(t, n.Flush())
+
+	// the next write dials again once the server goes away
+	f.lock.Lock()
+	f.conns[0].Close()
+	f.lock.Unlock()
+	<-n.conn.done
+
+	_, err = n.Write([]byte("{\"sequence\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(f.connect))
+	assert.Equal(t, []string{"audit {\"sequence\":1}"}, f.received())
+	assert.Nil(t, n.Close())
+
+	// a server refusing the connection
+	f.lock.Lock()
+	f.reject = "-ERR 'Authorization Violation'"
+	f.lock.Unlock()
+	_, err = NewNATSWriter(f.url(), "audit", false, "", "", "", nil, time.Second)
+	assert.EqualError(t, err, "Nats did not accept the connection: -ERR 'Authorization Violation'")
+}
@@ -0,0 +1,511 @@
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+const (
+	S3_MIN_PART_SIZE = 5 * 1024 * 1024 // S3 refuses smaller multipart parts, except for the last one
+	S3_SUFFIX        = ".gz"
+)
+
+// An io.Writer that rolls events into gzipped objects and uploads them to S3, or anything speaking its api
+// An object is uploaded once its events reach maxBytes, before compressing, or once its oldest event has waited
+// flushInterval. Objects larger than a part are sent with a multipart upload. Failed uploads are retried up to
+// attempts, after that the events of the object go to the spool of the output if it has one, otherwise they are kept
+// and tried again with the next upload
+type S3Writer struct {
+	endpoint      *url.URL
+	bucket        string
+	prefix        string // Prepended to object names, may contain date patterns like %Y/%m/%d
+	region        string
+	accessKey     string
+	secretKey     string
+	sessionToken  string
+	pathStyle     bool // Put the bucket in the path instead of the host name, for most non AWS endpoints
+	client        *http.Client
+	attempts      int
+	maxBytes      int
+	partSize      int
+	flushInterval time.Duration
+
+	lock   sync.Mutex
+	events []s3Event
+	size   int
+	oldest time.Time
+	seq    int    // Sequence of the event being written, see SetSequence
+	spool  *Spool // Takes the events of objects that could not be uploaded, nil without spooling
+}
+
+// Events are kept as written until their object is uploaded, so they can be spooled if it never is
+type s3Event struct {
+	seq int
+	p   []byte
+}
+
+type s3InitiateUpload struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func NewS3Writer(endpoint, region, bucket, prefix, accessKey, secretKey, sessionToken string, pathStyle bool, timeout time.Duration, insecure bool, attempts, maxBytes, partSize int, flushInterval time.Duration) (*S3Writer, error) {
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("Endpoint %s must be a url like https://s3.example.com", endpoint)
+	}
+
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	if partSize < 1 {
+		partSize = S3_MIN_PART_SIZE
+	}
+
+	s := &S3Writer{
+		endpoint:     u,
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: sessionToken,
+		pathStyle:    pathStyle,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+			},
+		},
+		attempts:      attempts,
+		maxBytes:      maxBytes,
+		partSize:      partSize,
+		flushInterval: flushInterval,
+	}
+
+	if flushInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(flushInterval)
+				s.flushStale()
+			}
+		}()
+	}
+
+	return s, nil
+}
+
+// Sets the sequence of the event about to be written, it is kept with the event in case it has to be spooled
+func (s *S3Writer) SetSequence(seq int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq = seq
+}
+
+// Sends the events of objects that could not be uploaded to the spool
+func (s *S3Writer) SetSpool(spool *Spool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.spool = spool
+}
+
+// Adds an event to the current object, the object is uploaded once it is full
+// If uploading fails the event is removed from the object so that a retry from AuditWriter does not duplicate it
+func (s *S3Writer) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.events) == 0 {
+		s.oldest = time.Now()
+	}
+
+	// The encoder reuses its buffer, we must keep our own copy
+	s.events = append(s.events, s3Event{seq: s.seq, p: append([]byte{}, p...)})
+	s.size += len(p)
+	if s.size < s.maxBytes {
+		return len(p), nil
+	}
+
+	if err := s.roll(); err != nil {
+		s.events = s.events[:len(s.events)-1]
+		s.size -= len(p)
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Uploads the current object, even if it is not full
+func (s *S3Writer) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.roll()
+}
+
+// Uploads the current object if its oldest event has been waiting longer than the flush interval
+func (s *S3Writer) flushStale() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.events) == 0 || time.Since(s.oldest) < s.flushInterval {
+		return
+	}
+
+	if err := s.roll(); err != nil {
+		logger.Err("Failed to upload s3 object, will retry on the next write. Error: %v", err)
+	}
+}
+
+// Compresses and uploads the current object, retrying up to attempts before falling back to the spool
+// The lock must be held by the caller
+func (s *S3Writer) roll() error {
+	if len(s.events) == 0 {
+		return nil
+	}
+
+	key, err := s.objectKey(s.oldest)
+	if err != nil {
+		return err
+	}
+
+	body, err := s.compress()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < s.attempts; i++ {
+		if i > 0 {
+			logger.Err("Failed to upload s3 object %s, retrying in 1 second. Error: %v", key, err)
+			time.Sleep(time.Second * 1)
+		}
+
+		if err = s.upload(key, body); err == nil {
+			logger.Debug("Uploaded %d events to s3 object %s", len(s.events), key)
+			s.reset()
+			return nil
+		}
+	}
+
+	if s.spool == nil {
+		return err
+	}
+
+	logger.Err("Failed to upload s3 object %s, spooling its %d events to disk. Error: %v", key, len(s.events), err)
+	for i, e := range s.events {
+		if err := s.spool.Append(e.seq, e.p); err != nil {
+			// Keep what did not make it to the spool, what did will be replayed
+			s.events = s.events[i:]
+			s.size = 0
+			for _, e := range s.events {
+				s.size += len(e.p)
+			}
+
+			return err
+		}
+	}
+
+	s.reset()
+	return nil
+}
+
+// The lock must be held by the caller
+func (s *S3Writer) reset() {
+	s.events = s.events[:0]
+	s.size = 0
+}
+
+// The lock must be held by the caller
+func (s *S3Writer) compress() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	for _, e := range s.events {
+		if _, err := gz.Write(e.p); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Names an object after the prefix, expanded for the time its first event was written, that time and a random
+// suffix so hosts sharing a prefix do not overwrite each other
+func (s *S3Writer) objectKey(t time.Time) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return IndexName(s.prefix, t) + t.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix) + S3_SUFFIX, nil
+}
+
+// Sends objects that fit in a part with a single request, larger ones with a multipart upload
+func (s *S3Writer) upload(key string, body []byte) error {
+	if len(body) <= s.partSize {
+		_, _, err := s.do("PUT", key, nil, body, "application/gzip")
+		return err
+	}
+
+	_, resp, err := s.do("POST", key, map[string]string{"uploads": ""}, nil, "application/gzip")
+	if err != nil {
+		return err
+	}
+
+	initiate := s3InitiateUpload{}
+	if err := xml.Unmarshal(resp, &initiate); err != nil || initiate.UploadId == "" {
+		return fmt.Errorf("Could not find the upload id in the s3 response: %s", resp)
+	}
+
+	complete := s3CompleteUpload{}
+	for n, off := 1, 0; off < len(body); n, off = n+1, off+s.partSize {
+		end := off + s.partSize
+		if end > len(body) {
+			end = len(body)
+		}
+
+		header, _, err := s.do("PUT", key, map[string]string{"partNumber": strconv.Itoa(n), "uploadId": initiate.UploadId}, body[off:end], "")
+		if err != nil {
+			s.abort(key, initiate.UploadId)
+			return err
+		}
+
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: n, ETag: header.Get("ETag")})
+	}
+
+	x, err := xml.Marshal(complete)
+	if err != nil {
+		s.abort(key, initiate.UploadId)
+		return err
+	}
+
+	// Completing can fail after s3 has already answered 200, the error is in the body then
+	_, resp, err = s.do("POST", key, map[string]string{"uploadId": initiate.UploadId}, x, "application/xml")
+	if err == nil {
+		err = parseS3Error(resp)
+	}
+
+	if err != nil {
+		s.abort(key, initiate.UploadId)
+		return err
+	}
+
+	return nil
+}
+
+// Throws away the parts of a failed multipart upload so they are not stored, and billed, forever
+func (s *S3Writer) abort(key, uploadId string) {
+	if _, _, err := s.do("DELETE", key, map[string]string{"uploadId": uploadId}, nil, ""); err != nil {
+		logger.Err("Failed to abort the multipart upload of s3 object %s. Error: %v", key, err)
+	}
+}
+
+// Sends a signed request for the object, responses other than 2xx are returned as errors
+func (s *S3Writer) do(method, key string, query map[string]string, body []byte, contentType string) (http.Header, []byte, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if s.accessKey != "" {
+		signV4(req, body, s.region, s.accessKey, s.secretKey, s.sessionToken, time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if err := parseS3Error(respBody); err != nil {
+			return nil, nil, fmt.Errorf("Unexpected response from s3: %s, %v", resp.Status, err)
+		}
+
+		return nil, nil, fmt.Errorf("Unexpected response from s3: %s", resp.Status)
+	}
+
+	return resp.Header, respBody, nil
+}
+
+func (s *S3Writer) objectURL(key string, query map[string]string) string {
+	u := *s.endpoint
+	path := strings.TrimRight(u.Path, "/")
+	if s.pathStyle {
+		path += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+
+	u.Path = path + "/" + key
+	u.RawPath = s3Escape(path, true) + "/" + s3Escape(key, true)
+	u.RawQuery = canonicalQuery(query)
+	return u.String()
+}
+
+// Returns the error in an s3 error response, nil if it is not one
+func parseS3Error(body []byte) error {
+	if !bytes.Contains(body, []byte("<Error>")) {
+		return nil
+	}
+
+	e := s3Error{}
+	if err := xml.Unmarshal(body, &e); err != nil {
+		return fmt.Errorf("s3 error: %s", body)
+	}
+
+	return fmt.Errorf("%s: %s", e.Code, e.Message)
+}
+
+// Signs the request with AWS signature version 4, body must be what the request sends
+// The host and every header already set on the request are signed
+func signV4(req *http.Request, body []byte, region, accessKey, secretKey, sessionToken string, now time.Time) {
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := &strings.Builder{}
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set(
+		"Authorization",
+		fmt.Sprintf(
+			"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+			accessKey,
+			scope,
+			signedHeaders,
+			hex.EncodeToString(hmacSHA256(key, toSign)),
+		),
+	)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sorts and escapes the query the way signature version 4 expects, so what is sent is exactly what was signed
+func canonicalQuery(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, s3Escape(k, false)+"="+s3Escape(query[k], false))
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// Percent encodes everything but the unreserved characters, and / if slash is set
+func s3Escape(s string, slash bool) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || slash && c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(b, "%%%02X", c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package writer
+
+import (
+	"io"
+	"strings"
+	"sync"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+const SHARD_PLACEHOLDER = "%{msgtype_category}" // Replaced with the category of each shard in a sharded path
+
+// An io.Writer that splits events over one writer per category of their message types, see AuditMessageGroup.Category
+// AuditWriter sets the category of every event before writing it, anything that is not an event, like heartbeats, and
+// events replayed from the spool go to the other shard
+type ShardedFile struct {
+	shards map[string]io.Writer
+
+	lock  sync.Mutex
+	shard string // Category of the events being written
+}
+
+// Takes a writer for every category in Categories
+func NewShardedFile(shards map[string]io.Writer) *ShardedFile {
+	return &ShardedFile{shards: shards}
+}
+
+// Sets the category of the events written from now on
+func (s *ShardedFile) SetShard(category string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.shard = category
+}
+
+// Writes to the shard of the category that was set, an unknown category goes to the other shard
+func (s *ShardedFile) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	w, ok := s.shards[s.shard]
+	if !ok {
+		w = s.shards[CATEGORY_OTHER]
+	}
+	s.lock.Unlock()
+
+	return w.Write(p)
+}
+
+// Returns the writer of a category
+func (s *ShardedFile) Shard(category string) io.Writer {
+	return s.shards[category]
+}
+
+// Writes out anything a shard has buffered, every shard is flushed even if one fails
+func (s *ShardedFile) Flush() error {
+	var err error
+	for _, w := range s.shards {
+		if f, ok := w.(flusher); ok {
+			if ferr := f.Flush(); ferr != nil {
+				err = ferr
+			}
+		}
+	}
+
+	return err
+}
+
+// Closes every shard, even if one fails
+func (s *ShardedFile) Close() error {
+	var err error
+	for _, w := range s.shards {
+		if c, ok := w.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+
+	return err
+}
+
+// The path of the shard for a category
+func ShardPath(pattern, category string) string {
+	return strings.Replace(pattern, SHARD_PLACEHOLDER, category, -1)
+}
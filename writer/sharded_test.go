@@ -0,0 +1,65 @@
+package writer
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+func newTestShards() (*ShardedFile, map[string]*countingWriter) {
+	writers := map[string]*countingWriter{}
+	shards := map[string]io.Writer{}
+	for _, c := range Categories {
+		writers[c] = &countingWriter{}
+		shards[c] = writers[c]
+	}
+
+	return NewShardedFile(shards), writers
+}
+
+func TestShardedFile_Write(t *testing.T) {
+	s, writers := newTestShards()
+	w := NewAuditWriter(s, 1)
+
+	syscall := &AuditMessageGroup{Seq: 1, Msgs: []*AuditMessage{{Type: 1300}}}
+	config := &AuditMessageGroup{Seq: 2, Msgs: []*AuditMessage{{Type: 1300}, {Type: 1305}}}
+	assert.Nil(t, w.Write(syscall))
+	assert.Nil(t, w.Write(config))
+	assert.Nil(t, w.Encode(3, syscall.Event()))
+
+	assert.Equal(t, 2, len(writers[CATEGORY_SYSCALL].writes))
+	assert.Equal(t, 1, len(writers[CATEGORY_CONFIG].writes))
+	assert.Contains(t, string(writers[CATEGORY_CONFIG].writes[0]), "\"sequence\":2")
+
+	// Anything that is not an event goes to other
+	assert.Nil(t, w.Encode(0, map[string]string{"type": "heartbeat"}))
+	assert.Equal(t, 1, len(writers[CATEGORY_OTHER].writes))
+
+	// As does an unknown category
+	s.SetShard("nope")
+	s.Write([]byte("x"))
+	assert.Equal(t, 2, len(writers[CATEGORY_OTHER].writes))
+	assert.Empty(t, writers[CATEGORY_LOGIN].writes)
+	assert.Empty(t, writers[CATEGORY_ANOM].writes)
+
+	// Errors come from the shard written to
+	writers[CATEGORY_SYSCALL].err = errors.New("full")
+	assert.EqualError(t, w.Write(syscall), "full")
+	assert.Nil(t, w.Write(config))
+}
+
+func TestShardedFile_Close(t *testing.T) {
+	s, writers := newTestShards()
+	assert.Nil(t, s.Close())
+
+	for c, w := range writers {
+		assert.True(t, w.closed, c)
+	}
+}
+
+func TestShardPath(t *testing.T) {
+	assert.Equal(t, "/var/log/audit-login.log", ShardPath("/var/log/audit-%{msgtype_category}.log", CATEGORY_LOGIN))
+	assert.Equal(t, "/var/log/audit.log", ShardPath("/var/log/audit.log", CATEGORY_LOGIN))
+}
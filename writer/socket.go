@@ -0,0 +1,215 @@
+package writer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"github.com/Xeralux/go-audit/logger"
+)
+
+const SOCKET_MAX_BACKOFF = time.Second * 30 // Upper bound on the wait between reconnect attempts
+
+// An io.Writer that sends newline delimited json events over a tcp or unix socket
+// When the connection is lost events are buffered, up to maxBuffered, while we reconnect in the background
+type SocketWriter struct {
+	network     string
+	address     string
+	tlsConfig   *tls.Config
+	timeout     time.Duration
+	backoff     time.Duration
+	maxBuffered int
+
+	lock         sync.Mutex
+	conn         net.Conn
+	buffer       [][]byte
+	err          error // Why we were last disconnected
+	reconnecting bool
+	closed       bool
+}
+
+// Connects to the tcp address, tlsConfig may be nil for a plain text connection
+func NewTCPWriter(address string, tlsConfig *tls.Config, timeout time.Duration, maxBuffered int, backoff time.Duration) (*SocketWriter, error) {
+	return newSocketWriter("tcp", address, tlsConfig, timeout, maxBuffered, backoff)
+}
+
+// Connects to the unix socket at path, sockType is either stream or dgram
+// With dgram every event is sent as a single datagram
+func NewUnixSocketWriter(path, sockType string, timeout time.Duration, maxBuffered int, backoff time.Duration) (*SocketWriter, error) {
+	switch sockType {
+	case "stream":
+		return newSocketWriter("unix", path, nil, timeout, maxBuffered, backoff)
+	case "dgram":
+		return newSocketWriter("unixgram", path, nil, timeout, maxBuffered, backoff)
+	}
+
+	return nil, fmt.Errorf("Unknown unix socket type `%s`, must be stream or dgram", sockType)
+}
+
+func newSocketWriter(network, address string, tlsConfig *tls.Config, timeout time.Duration, maxBuffered int, backoff time.Duration) (*SocketWriter, error) {
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	t := &SocketWriter{
+		network:     network,
+		address:     address,
+		tlsConfig:   tlsConfig,
+		timeout:     timeout,
+		backoff:     backoff,
+		maxBuffered: maxBuffered,
+	}
+
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	t.conn = conn
+	return t, nil
+}
+
+// Sends the event, or buffers it if we are not connected
+// An error is only returned when the event could not be buffered either
+func (t *SocketWriter) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return 0, errors.New("Socket writer is closed")
+	}
+
+	if t.conn != nil {
+		if err := t.send(); err == nil {
+			if _, err = t.write(p); err == nil {
+				return len(p), nil
+			}
+		}
+	}
+
+	if len(t.buffer) >= t.maxBuffered {
+		return 0, fmt.Errorf("Socket buffer is full with %d messages. Error: %v", len(t.buffer), t.err)
+	}
+
+	// The encoder reuses its buffer, we must keep our own copy
+	t.buffer = append(t.buffer, append([]byte{}, p...))
+	return len(p), nil
+}
+
+// Sends any buffered events if we are connected
+func (t *SocketWriter) Flush() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conn == nil {
+		return fmt.Errorf("Not connected to %s. Error: %v", t.address, t.err)
+	}
+
+	return t.send()
+}
+
+func (t *SocketWriter) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	if t.conn == nil {
+		return nil
+	}
+
+	t.send()
+	return t.conn.Close()
+}
+
+func (t *SocketWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: t.timeout}
+	if t.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", t.address, t.tlsConfig)
+	}
+
+	return dialer.Dial(t.network, t.address)
+}
+
+// Writes to the connection, dropping it and starting to reconnect on failure
+// The lock must be held by the caller
+func (t *SocketWriter) write(p []byte) (int, error) {
+	if t.timeout > 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	}
+
+	n, err := t.conn.Write(p)
+	if err != nil {
+		logger.Err("Lost connection to %s. Error: %v", t.address, err)
+		t.conn.Close()
+		t.conn = nil
+		t.err = err
+		t.reconnect()
+	}
+
+	return n, err
+}
+
+// Sends the buffered events in order, the lock must be held by the caller
+func (t *SocketWriter) send() error {
+	for len(t.buffer) > 0 {
+		if _, err := t.write(t.buffer[0]); err != nil {
+			return err
+		}
+
+		t.buffer = t.buffer[1:]
+	}
+
+	return nil
+}
+
+// Starts reconnecting in the background, the lock must be held by the caller
+func (t *SocketWriter) reconnect() {
+	if t.reconnecting {
+		return
+	}
+
+	t.reconnecting = true
+	go func() {
+		wait := t.backoff
+		for {
+			logger.Warning("Reconnecting to %s in %v", t.address, wait)
+			time.Sleep(wait)
+
+			conn, err := t.dial()
+
+			t.lock.Lock()
+			if t.closed {
+				if conn != nil {
+					conn.Close()
+				}
+				t.reconnecting = false
+				t.lock.Unlock()
+				return
+			}
+
+			if err == nil {
+				logger.Info("Reconnected to %s", t.address)
+				t.conn = conn
+				t.reconnecting = false
+
+				// A failed send starts a new reconnect
+				if err := t.send(); err != nil {
+					logger.Err("Failed to send buffered events to %s. Error: %v", t.address, err)
+				}
+
+				t.lock.Unlock()
+				return
+			}
+
+			t.err = err
+			t.lock.Unlock()
+
+			wait *= 2
+			if wait > SOCKET_MAX_BACKOFF {
+				wait = SOCKET_MAX_BACKOFF
+			}
+		}
+	}()
+}
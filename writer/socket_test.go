@@ -0,0 +1,149 @@
+package writer
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocketWriter_Write(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				s := bufio.NewScanner(c)
+				for s.Scan() {
+					lines <- s.Text()
+				}
+			}()
+		}
+	}()
+
+	// unreachable address
+	w, err := NewTCPWriter("127.0.0.1:1", nil, time.Second, 10, time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Nil(t, w)
+
+	w, err = NewTCPWriter(l.Addr().String(), nil, time.Second, 2, time.Millisecond*10)
+	assert.Nil(t, err)
+
+	n, err := w.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, "{\"a\":1}", <-lines)
+
+	// Losing the connection buffers the event until we reconnect
+	w.conn.Close()
+	_, err = w.Write([]byte("{\"a\":2}\n"))
+	assert.Nil(t, err)
+
+	select {
+	case line := <-lines:
+		assert.Equal(t, "{\"a\":2}", line)
+	case <-time.After(time.Second * 2):
+		t.Fatal("Buffered event was never sent")
+	}
+
+	_, err = w.Write([]byte("{\"a\":3}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"a\":3}", <-lines)
+
+	// Errors surface once the buffer is full
+	w.lock.Lock()
+	w.conn.Close()
+	w.conn = nil
+	w.reconnecting = true
+	w.lock.Unlock()
+
+	w.Write([]byte("{\"a\":4}\n"))
+	w.Write([]byte("{\"a\":5}\n"))
+	_, err = w.Write([]byte("{\"a\":6}\n"))
+	assert.Contains(t, err.Error(), "Socket buffer is full with 2 messages.")
+	assert.Contains(t, w.Flush().Error(), "Not connected to "+l.Addr().String())
+
+	assert.Nil(t, w.Close())
+	_, err = w.Write([]byte("{\"a\":7}\n"))
+	assert.EqualError(t, err, "Socket writer is closed")
+}
+
+func TestNewUnixSocketWriter(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "go-audit.test.unix.sock")
+	os.Remove(path)
+
+	// bad type
+	w, err := NewUnixSocketWriter(path, "seqpacket", time.Second, 10, time.Millisecond)
+	assert.EqualError(t, err, "Unknown unix socket type `seqpacket`, must be stream or dgram")
+	assert.Nil(t, w)
+
+	// nothing listening
+	w, err = NewUnixSocketWriter(path, "stream", time.Second, 10, time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Nil(t, w)
+
+	// stream
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 10)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		s := bufio.NewScanner(c)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+
+	w, err = NewUnixSocketWriter(path, "stream", time.Second, 10, time.Millisecond)
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"a\":1}", <-lines)
+	w.Close()
+	l.Close()
+	os.Remove(path)
+
+	// dgram, one datagram per event
+	addr, _ := net.ResolveUnixAddr("unixgram", path)
+	c, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer c.Close()
+
+	w, err = NewUnixSocketWriter(path, "dgram", time.Second, 10, time.Millisecond)
+	assert.Nil(t, err)
+	defer w.Close()
+
+	w.Write([]byte("{\"a\":1}\n"))
+	w.Write([]byte("{\"a\":2}\n"))
+
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"a\":1}\n", string(buf[:n]))
+	n, err = c.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"a\":2}\n", string(buf[:n]))
+}
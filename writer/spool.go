@@ -0,0 +1,299 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
+)
+
+const (
+	SPOOL_SUFFIX      = ".spool"
+	SPOOL_OFFSET_FILE = "offset" // Remembers how far into the oldest segment we have replayed, across restarts
+	SPOOL_SEGMENTS    = 16       // The spool is split into this many files so the oldest events can be dropped
+)
+
+// An on disk queue of events that could not be written to an output, kept in the order they were written
+// Events are appended to numbered segment files, once the spool grows over maxBytes the oldest segment is dropped
+// Anything left in the spool is picked up again after a restart
+type Spool struct {
+	dir          string
+	name         string // The output this spool belongs to, for logs and metrics
+	maxBytes     int64
+	segmentBytes int64
+
+	lock     sync.Mutex
+	segments []*spoolSegment // Oldest first, the last one is appended to
+	size     int64
+	offset   int64 // Read position in the oldest segment
+	w        *os.File
+	r        *os.File
+	rb       *bufio.Reader
+	peeked   []byte // The record handed out by Peek, waiting for Advance
+}
+
+type spoolSegment struct {
+	id   uint64
+	size int64
+}
+
+// Opens the spool in dir, creating it if needed, and picks up any segments a previous run left behind
+func OpenSpool(dir, name string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:          dir,
+		name:         name,
+		maxBytes:     maxBytes,
+		segmentBytes: maxBytes / SPOOL_SEGMENTS,
+	}
+
+	if s.segmentBytes < 1 {
+		s.segmentBytes = 1
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+SPOOL_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(n), SPOOL_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		st, err := os.Stat(n)
+		if err != nil {
+			return nil, err
+		}
+
+		s.segments = append(s.segments, &spoolSegment{id: id, size: st.Size()})
+		s.size += st.Size()
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, SPOOL_OFFSET_FILE)); err == nil && len(s.segments) > 0 {
+		if offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && offset <= s.segments[0].size {
+			s.offset = offset
+		}
+	}
+
+	if s.size > 0 {
+		logger.Info("Found %d bytes of spooled events for output %s", s.size-s.offset, name)
+	}
+
+	metrics.SpoolBytes.With(name).Set(uint64(s.size - s.offset))
+	return s, nil
+}
+
+// Appends an event with its sequence, dropping the oldest segments if the spool grows too large
+func (s *Spool) Append(seq int, p []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	last := len(s.segments) - 1
+	if s.w == nil || last < 0 || s.segments[last].size >= s.segmentBytes {
+		if err := s.openSegment(); err != nil {
+			return err
+		}
+		last = len(s.segments) - 1
+	}
+
+	record := append([]byte(strconv.Itoa(seq)+" "), p...)
+	if len(record) == 0 || record[len(record)-1] != '\n' {
+		record = append(record, '\n')
+	}
+
+	n, err := s.w.Write(record)
+	s.segments[last].size += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	for s.size > s.maxBytes && len(s.segments) > 1 {
+		dropped := s.segments[0].size - s.offset
+		if err := s.removeOldest(); err != nil {
+			return err
+		}
+
+		metrics.SpoolDropped.With(s.name).Add(uint64(dropped))
+		logger.Warning("Spool for output %s is over %d bytes, dropped %d bytes of the oldest events", s.name, s.maxBytes, dropped)
+	}
+
+	metrics.SpoolBytes.With(s.name).Set(uint64(s.size - s.offset))
+	return nil
+}
+
+// True when everything spooled has been replayed
+func (s *Spool) Empty() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.size-s.offset == 0
+}
+
+// Returns the oldest event that has not been replayed yet, io.EOF if there is none
+// It stays in the spool until Advance is called
+func (s *Spool) Peek() (seq int, p []byte, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.peeked == nil {
+		if s.peeked, err = s.readRecord(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// Records are the sequence, a space and the event with its newline
+	sep := bytes.IndexByte(s.peeked, ' ')
+	if sep < 0 {
+		return 0, s.peeked, nil
+	}
+
+	seq, _ = strconv.Atoi(string(s.peeked[:sep]))
+	return seq, s.peeked[sep+1:], nil
+}
+
+// Marks the event returned by Peek as replayed
+func (s *Spool) Advance() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.offset += int64(len(s.peeked))
+	s.peeked = nil
+
+	// Start from a clean slate once everything has been replayed
+	if s.offset == s.size && len(s.segments) > 0 {
+		metrics.SpoolBytes.With(s.name).Set(0)
+		return s.removeOldest()
+	}
+
+	metrics.SpoolBytes.With(s.name).Set(uint64(s.size - s.offset))
+	return ioutil.WriteFile(filepath.Join(s.dir, SPOOL_OFFSET_FILE), []byte(strconv.FormatInt(s.offset, 10)), 0600)
+}
+
+// Reads the record at the current offset, moving on to the next segment once one is done
+// The lock must be held by the caller
+func (s *Spool) readRecord() ([]byte, error) {
+	for len(s.segments) > 0 && s.offset >= s.segments[0].size {
+		// Only move past a finished segment if it is not still being appended to
+		if len(s.segments) == 1 {
+			return nil, io.EOF
+		}
+
+		if err := s.removeOldest(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.segments) == 0 {
+		return nil, io.EOF
+	}
+
+	if s.r == nil {
+		r, err := os.Open(s.segmentPath(s.segments[0].id))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = r.Seek(s.offset, io.SeekStart); err != nil {
+			r.Close()
+			return nil, err
+		}
+
+		s.r = r
+		s.rb = bufio.NewReader(r)
+	}
+
+	line, err := s.rb.ReadBytes('\n')
+	if err != nil {
+		// A partial record, most likely cut short by a crash, start over from the offset next time
+		s.closeReader()
+		return nil, io.EOF
+	}
+
+	return line, nil
+}
+
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closeReader()
+	if s.w == nil {
+		return nil
+	}
+
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
+
+// The lock must be held by the caller
+func (s *Spool) openSegment() error {
+	var id uint64
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1].id + 1
+	}
+
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if s.w != nil {
+		s.w.Close()
+	}
+
+	s.w = f
+	s.segments = append(s.segments, &spoolSegment{id: id})
+	return nil
+}
+
+// The lock must be held by the caller
+func (s *Spool) removeOldest() error {
+	s.closeReader()
+	s.peeked = nil
+
+	oldest := s.segments[0]
+	if len(s.segments) == 1 && s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+
+	if err := os.Remove(s.segmentPath(oldest.id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.segments = s.segments[1:]
+	s.size -= oldest.size
+	s.offset = 0
+	return ioutil.WriteFile(filepath.Join(s.dir, SPOOL_OFFSET_FILE), []byte("0"), 0600)
+}
+
+func (s *Spool) closeReader() {
+	if s.r != nil {
+		s.r.Close()
+	}
+
+	s.r = nil
+	s.rb = nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, SPOOL_SUFFIX))
+}
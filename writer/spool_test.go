@@ -0,0 +1,118 @@
+package writer
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, "test", 1024)
+	assert.Nil(t, err)
+	assert.True(t, s.Empty())
+
+	_, _, err = s.Peek()
+	assert.Equal(t, io.EOF, err)
+
+	assert.Nil(t, s.Append(1, []byte("{\"one\":1}\n")))
+	assert.Nil(t, s.Append(2, []byte("{\"two\":2}")))
+	assert.False(t, s.Empty())
+
+	// Peek leaves the event in place until it is advanced past
+	seq, p, err := s.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, seq)
+	assert.Equal(t, "{\"one\":1}\n", string(p))
+
+	seq, _, _ = s.Peek()
+	assert.Equal(t, 1, seq)
+	assert.Nil(t, s.Advance())
+
+	// What is left survives a restart
+	assert.Nil(t, s.Close())
+	s, err = OpenSpool(dir, "test", 1024)
+	assert.Nil(t, err)
+
+	seq, p, err = s.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, seq)
+	assert.Equal(t, "{\"two\":2}\n", string(p))
+	assert.Nil(t, s.Advance())
+	assert.True(t, s.Empty())
+
+	// Fully replayed segments are removed
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+SPOOL_SUFFIX))
+	assert.Equal(t, 0, len(files))
+	assert.Nil(t, s.Close())
+}
+
+func TestSpool_full(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 16 byte segments, every event gets its own
+	s, err := OpenSpool(dir, "test", 16*SPOOL_SEGMENTS)
+	assert.Nil(t, err)
+
+	for i := 1; i <= SPOOL_SEGMENTS+4; i++ {
+		assert.Nil(t, s.Append(i, []byte("0123456789abcd\n")))
+	}
+
+	// The oldest events were dropped to stay under the limit, records 1-9 are 17 bytes and the rest 18
+	seq, _, err := s.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, 7, seq)
+	assert.True(t, s.size <= 16*SPOOL_SEGMENTS)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+SPOOL_SUFFIX))
+	assert.Equal(t, 14, len(files))
+	assert.Nil(t, s.Close())
+}
+
+func TestAuditWriter_SetSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, "spool_test", 1024)
+	assert.Nil(t, err)
+
+	c := &countingWriter{err: errors.New("derp")}
+	w := NewAuditWriter(c, 1)
+	w.SetName("spool_test")
+	w.SetSpool(s, time.Hour)
+
+	// Failed events are spooled instead of failing
+	assert.Nil(t, w.Encode(1, "one"))
+	assert.False(t, s.Empty())
+
+	// Later events wait their turn even though the output is back
+	c.err = nil
+	assert.Nil(t, w.Encode(2, "two"))
+	assert.Equal(t, 0, len(c.writes))
+
+	w.replay()
+	assert.True(t, s.Empty())
+	assert.Equal(t, [][]byte{[]byte("\"one\"\n"), []byte("\"two\"\n")}, c.writes)
+
+	// Back to writing directly
+	assert.Nil(t, w.Encode(3, "three"))
+	assert.Equal(t, 3, len(c.writes))
+	assert.Nil(t, w.Close())
+}
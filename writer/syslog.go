@@ -0,0 +1,223 @@
+package writer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RFC5424_TIME_FORMAT = "2006-01-02T15:04:05.000000Z07:00"
+	RFC5424_MSG_ID      = "audit"
+	RFC5424_SD_ID       = "audit@32473" // 32473 is the enterprise number reserved for examples, see RFC 5612
+	SYSLOG_NETWORK_TLS  = "tls"         // Not a network net.Dial knows, tcp wrapped in TLS
+)
+
+// Where the local syslog daemon listens when no network is set
+var syslogLocalPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Implemented by writers that want to know the sequence of the event being written
+type sequencer interface {
+	SetSequence(seq int)
+}
+
+// An io.Writer that sends each event as a syslog message, BSD style like log/syslog by default or RFC 5424
+// In RFC 5424 format the audit sequence of the event is included as structured data
+// A network of tls connects over tcp with TLS, presenting a client certificate when the tls config has one
+// Writes give up after the timeout so a stuck syslog daemon can not hold up go-audit, log/syslog would wait forever
+// If the connection is lost, or a write timed out, the next write will dial again
+type SyslogWriter struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	priority  syslog.Priority
+	rfc5424   bool
+	timeout   time.Duration
+	hostname  string
+	appName   string
+	procId    string
+
+	// The hostname was configured rather than looked up, so it is sent to the local syslog daemon too
+	fixedHostname bool
+
+	lock sync.Mutex
+	conn net.Conn
+	seq  int
+}
+
+// A timeout of 0 waits forever, like log/syslog does, the tls config is only used when the network is tls
+// An empty hostname is looked up with os.Hostname, set one for a stable identity where the hostname is random
+func NewSyslogWriter(network, address string, tlsConfig *tls.Config, priority syslog.Priority, tag, hostname string, rfc5424 bool, timeout time.Duration) (*SyslogWriter, error) {
+	if priority < 0 || priority > syslog.LOG_LOCAL7|syslog.LOG_DEBUG {
+		return nil, fmt.Errorf("Invalid syslog priority %d", priority)
+	}
+
+	fixedHostname := hostname != ""
+	if !fixedHostname {
+		var err error
+		if hostname, err = os.Hostname(); err != nil || hostname == "" {
+			hostname = "-"
+		}
+	}
+
+	if tag == "" {
+		tag = "-"
+	}
+
+	w := &SyslogWriter{
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+		priority:  priority,
+		rfc5424:   rfc5424,
+		timeout:   timeout,
+		hostname:  hostname,
+		appName:   tag,
+		procId:    strconv.Itoa(os.Getpid()),
+
+		fixedHostname: fixedHostname,
+	}
+
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Sets the sequence to put in the structured data of the next message
+func (w *SyslogWriter) SetSequence(seq int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.seq = seq
+}
+
+// Frames the event and sends it, dropping the connection on failure so the next attempt dials again
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.conn == nil {
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+	}
+
+	now := time.Now()
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(now.Add(w.timeout))
+	}
+
+	msg := w.formatBSD(p, now)
+	if w.rfc5424 {
+		msg = w.format(p, now)
+	}
+
+	if _, err := w.conn.Write(msg); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *SyslogWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// The lock must be held by the caller
+// Without a network the local syslog daemon is looked for in the same places log/syslog looks
+func (w *SyslogWriter) connect() error {
+	if w.network == SYSLOG_NETWORK_TLS {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: w.timeout}, "tcp", w.address, w.tlsConfig)
+		if err != nil {
+			return err
+		}
+
+		w.conn = conn
+		return nil
+	}
+
+	if w.network != "" {
+		conn, err := net.DialTimeout(w.network, w.address, w.timeout)
+		if err != nil {
+			return err
+		}
+
+		w.conn = conn
+		return nil
+	}
+
+	for _, network := range []string{"unixgram", "unix"} {
+		for _, path := range syslogLocalPaths {
+			if conn, err := net.DialTimeout(network, path, w.timeout); err == nil {
+				w.conn = conn
+				return nil
+			}
+		}
+	}
+
+	return errors.New("Unix syslog delivery error")
+}
+
+// Builds the message the way log/syslog does, the local syslog daemon gets neither the hostname nor a full timestamp
+// unless the hostname was configured, then the daemon is told who we are instead of filling in its own
+func (w *SyslogWriter) formatBSD(p []byte, now time.Time) []byte {
+	nl := ""
+	if !bytes.HasSuffix(p, []byte("\n")) {
+		nl = "\n"
+	}
+
+	if w.network == "" && w.fixedHostname {
+		return []byte(fmt.Sprintf("<%d>%s %s %s[%s]: %s%s", w.priority, now.Format(time.Stamp), w.hostname, w.appName, w.procId, p, nl))
+	}
+
+	if w.network == "" {
+		return []byte(fmt.Sprintf("<%d>%s %s[%s]: %s%s", w.priority, now.Format(time.Stamp), w.appName, w.procId, p, nl))
+	}
+
+	return []byte(fmt.Sprintf("<%d>%s %s %s[%s]: %s%s", w.priority, now.Format(time.RFC3339), w.hostname, w.appName, w.procId, p, nl))
+}
+
+// Builds the RFC 5424 message, stream connections get a trailing newline to separate messages
+func (w *SyslogWriter) format(p []byte, now time.Time) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(
+		b,
+		"<%d>1 %s %s %s %s %s [%s sequence=\"%d\"] ",
+		w.priority,
+		now.Format(RFC5424_TIME_FORMAT),
+		w.hostname,
+		w.appName,
+		w.procId,
+		RFC5424_MSG_ID,
+		RFC5424_SD_ID,
+		w.seq,
+	)
+
+	b.Write(bytes.TrimRight(p, "\n"))
+	switch w.network {
+	case "tcp", "tcp4", "tcp6", "unix", SYSLOG_NETWORK_TLS:
+		b.WriteByte('\n')
+	}
+
+	return b.Bytes()
+}
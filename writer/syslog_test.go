@@ -0,0 +1,267 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/syslog"
+	"math/big"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+func TestSyslogWriter_formatBSD(t *testing.T) {
+	w := &SyslogWriter{
+		network:  "udp",
+		priority: syslog.LOG_LOCAL0 | syslog.LOG_WARNING,
+		hostname: "box",
+		appName:  "go-audit",
+		procId:   "10",
+	}
+
+	now := time.Date(2016, 1, 2, 3, 4, 5, 6000, time.UTC)
+	assert.Equal(t, "<132>2016-01-02T03:04:05Z box go-audit[10]: {\"a\":1}\n", string(w.formatBSD([]byte("{\"a\":1}\n"), now)))
+	assert.Equal(t, "<132>2016-01-02T03:04:05Z box go-audit[10]: {\"a\":1}\n", string(w.formatBSD([]byte("{\"a\":1}"), now)))
+
+	// The local syslog daemon knows who we are
+	w.network = ""
+	assert.Equal(t, "<132>Jan  2 03:04:05 go-audit[10]: {\"a\":1}\n", string(w.formatBSD([]byte("{\"a\":1}\n"), now)))
+
+	// Unless the hostname was configured
+	w.fixedHostname = true
+	assert.Equal(t, "<132>Jan  2 03:04:05 box go-audit[10]: {\"a\":1}\n", string(w.formatBSD([]byte("{\"a\":1}\n"), now)))
+}
+
+func TestSyslogWriter_format(t *testing.T) {
+	w := &SyslogWriter{
+		network:  "udp",
+		priority: syslog.LOG_LOCAL0 | syslog.LOG_WARNING,
+		hostname: "box",
+		appName:  "go-audit",
+		procId:   "10",
+		seq:      1234,
+	}
+
+	now := time.Date(2016, 1, 2, 3, 4, 5, 6000, time.UTC)
+	assert.Equal(
+		t,
+		"<132>1 2016-01-02T03:04:05.000006Z box go-audit 10 audit [audit@32473 sequence=\"1234\"] {\"a\":1}",
+		string(w.format([]byte("{\"a\":1}\n"), now)),
+	)
+
+	// Stream connections need a separator
+	w.network = "tcp"
+	assert.Equal(
+		t,
+		"<132>1 2016-01-02T03:04:05.000006Z box go-audit 10 audit [audit@32473 sequence=\"1234\"] {\"a\":1}\n",
+		string(w.format([]byte("{\"a\":1}\n"), now)),
+	)
+}
+
+func TestSyslogWriter_Write(t *testing.T) {
+	// bad priority
+	w, err := NewSyslogWriter("tcp", "127.0.0.1:1", nil, -1, "go-audit", "", true, time.Second)
+	assert.EqualError(t, err, "Invalid syslog priority -1")
+	assert.Nil(t, w)
+
+	// refused
+	w, err = NewSyslogWriter("tcp", "127.0.0.1:1", nil, syslog.LOG_LOCAL0, "go-audit", "", true, time.Second)
+	assert.NotNil(t, err)
+	assert.Nil(t, w)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				s := bufio.NewScanner(c)
+				for s.Scan() {
+					lines <- s.Text()
+				}
+			}()
+		}
+	}()
+
+	w, err = NewSyslogWriter("tcp", l.Addr().String(), nil, syslog.LOG_LOCAL0|syslog.LOG_WARNING, "go-audit", "", true, time.Second)
+	assert.Nil(t, err)
+
+	aw := NewAuditWriter(w, 1)
+	assert.Nil(t, aw.Write(&AuditMessageGroup{Seq: 42, AuditTime: "10000001"}))
+	assert.Regexp(
+		t,
+		regexp.MustCompile(`^<132>1 \S+ \S+ go-audit \d+ audit \[audit@32473 sequence="42"\] \{"sequence":42,"timestamp":"10000001",`),
+		<-lines,
+	)
+
+	// A lost connection is dialed again on the next write
+	w.conn.Close()
+	w.conn = nil
+	_, err = w.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasSuffix([]byte(<-lines), []byte("] {\"a\":1}")))
+
+	assert.Nil(t, w.Close())
+	assert.Nil(t, w.Close())
+
+	// A configured hostname replaces the one of the machine
+	w, err = NewSyslogWriter("tcp", l.Addr().String(), nil, syslog.LOG_LOCAL0|syslog.LOG_WARNING, "audit-thing", "audit-box", true, time.Second)
+	assert.Nil(t, err)
+	assert.True(t, w.fixedHostname)
+
+	_, err = w.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^<132>1 \S+ audit-box audit-thing \d+ audit `), <-lines)
+	assert.Nil(t, w.Close())
+}
+
+func TestSyslogWriter_Write_timeout(t *testing.T) {
+	// A syslog daemon that accepts connections and never reads from them
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	w, err := NewSyslogWriter("tcp", l.Addr().String(), nil, syslog.LOG_LOCAL0, "go-audit", "", false, 50*time.Millisecond)
+	assert.Nil(t, err)
+
+	// Writes pile up in the socket buffers until one times out instead of blocking forever
+	event := bytes.Repeat([]byte("a"), 1<<16)
+	for i := 0; i < 1024 && err == nil; i++ {
+		_, err = w.Write(event)
+	}
+
+	if assert.NotNil(t, err) {
+		nerr, ok := err.(net.Error)
+		assert.True(t, ok && nerr.Timeout())
+	}
+
+	assert.Nil(t, w.conn, "the next write should dial again")
+	assert.Nil(t, w.Close())
+}
+
+func TestSyslogWriter_Write_tls(t *testing.T) {
+	ca, caKey := testCertificate(t, nil, nil, "ca")
+	server, _ := testCertificate(t, ca, caKey, "server")
+	client, _ := testCertificate(t, ca, caKey, "client")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	// A syslog server that insists on a client certificate signed by the ca
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{*server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				s := bufio.NewScanner(c)
+				for s.Scan() {
+					lines <- s.Text()
+				}
+			}()
+		}
+	}()
+
+	// the server certificate has to be trusted
+	w, err := NewSyslogWriter(SYSLOG_NETWORK_TLS, l.Addr().String(), &tls.Config{Certificates: []tls.Certificate{*client}}, syslog.LOG_LOCAL0, "go-audit", "box", true, time.Second)
+	assert.NotNil(t, err)
+	assert.Nil(t, w)
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{*client}, RootCAs: pool, ServerName: "server"}
+	w, err = NewSyslogWriter(SYSLOG_NETWORK_TLS, l.Addr().String(), tlsConfig, syslog.LOG_LOCAL0|syslog.LOG_WARNING, "go-audit", "box", true, time.Second)
+	assert.Nil(t, err)
+
+	w.SetSequence(7)
+	_, err = w.Write([]byte("{\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^<132>1 \S+ box go-audit \d+ audit \[audit@32473 sequence="7"\] \{"a":1\}$`), <-lines)
+
+	// messages are newline delimited like over tcp, a lost connection is dialed again
+	w.conn.Close()
+	w.conn = nil
+	_, err = w.Write([]byte("{\"a\":2}\n"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasSuffix([]byte(<-lines), []byte("] {\"a\":2}")))
+	assert.Nil(t, w.Close())
+}
+
+// Creates a certificate for name, signed by the parent or self signed when there is none
+func testCertificate(t *testing.T, parent *tls.Certificate, parentKey *ecdsa.PrivateKey, name string) (*tls.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parentKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, key
+}
@@ -1,39 +1,434 @@
 package writer
 
 import (
-	"encoding/json"
 	"io"
+	"sync"
 	"time"
 	"github.com/Xeralux/go-audit/logger"
+	"github.com/Xeralux/go-audit/metrics"
 	. "github.com/Xeralux/go-audit/parser"
 )
 
+// Implemented by writers that buffer events
+type flusher interface {
+	Flush() error
+}
+
+// Implemented by writers that can lose more than the event being written, they spool the rest themselves
+type spooler interface {
+	SetSpool(spool *Spool)
+}
+
+// Implemented by writers that split events by the category of their message types, see ShardedFile
+type sharder interface {
+	SetShard(category string)
+}
+
 type AuditWriter struct {
-	e        *json.Encoder
+	format   Formatter
 	w        io.Writer
 	attempts int
+	name     string          // Identifies the output in metrics
+	include  map[uint16]bool // Only events with a message of one of these types are written, nil for any
+	exclude  map[uint16]bool // Events with a message of one of these types are never written
+	keys     map[string]bool // Only events with one of these rule keys are written, nil for any
+	skipKeys map[string]bool // Events with one of these rule keys are never written
+	breaker  *circuitBreaker // Skips writes while the output keeps failing, nil when disabled
+	spool    *Spool          // Keeps events that could not be written until the output recovers, nil when disabled
+	backoff  Backoff         // How long to wait between attempts
+	sleep    func(time.Duration)
+	now      func() time.Time
+
+	lock   sync.Mutex // Guards writing once a spool is being replayed in the background
+	closed bool
 }
 
-func NewAuditWriter(w io.Writer, attempts int) *AuditWriter {
-	return &AuditWriter{
-		e:        json.NewEncoder(w),
+// Writes events to w, trying each one up to attempts times. Only the first options are used, without any it waits
+// DEFAULT_RETRY_DELAY between attempts
+func NewAuditWriter(w io.Writer, attempts int, opts ...WriterOptions) *AuditWriter {
+	a := &AuditWriter{
+		format:   JSONFormatter{},
 		w:        w,
 		attempts: attempts,
+		backoff:  Backoff{Strategy: BACKOFF_FIXED, Delay: DEFAULT_RETRY_DELAY},
+		sleep:    time.Sleep,
+		now:      time.Now,
+	}
+
+	if len(opts) > 0 {
+		a.backoff = opts[0].Backoff
+	}
+
+	return a
+}
+
+// How long the writer waits between attempts
+func (a *AuditWriter) Backoff() Backoff {
+	return a.backoff
+}
+
+// Returns the underlying io.Writer events are being written to
+func (a *AuditWriter) Writer() io.Writer {
+	return a.w
+}
+
+// Sets how events are formatted before they are written, json by default
+func (a *AuditWriter) SetFormat(f Formatter) {
+	a.format = f
+}
+
+// Sets the name the output is reported as in metrics
+func (a *AuditWriter) SetName(name string) {
+	a.name = name
+}
+
+func (a *AuditWriter) Name() string {
+	return a.name
+}
+
+// Opens the circuit of this output after failures events in a row could not be written
+// While open every write fails right away with ErrCircuitOpen, once cooldown passes the next event is tried again
+// A failures of 0 or less disables the circuit breaker
+func (a *AuditWriter) SetCircuitBreaker(failures int, cooldown time.Duration) {
+	if failures <= 0 {
+		a.breaker = nil
+		return
+	}
+
+	a.breaker = newCircuitBreaker(a.name, failures, cooldown)
+}
+
+// Outputs with a circuit breaker deal with their own failures by dropping events while they are sick
+func (a *AuditWriter) HasCircuitBreaker() bool {
+	return a.breaker != nil
+}
+
+// Spools events that can not be written to disk, they are replayed in the background every interval
+func (a *AuditWriter) SetSpool(spool *Spool, interval time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.spool = spool
+	if s, ok := a.w.(spooler); ok {
+		s.SetSpool(spool)
 	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			a.lock.Lock()
+			closed := a.closed
+			a.lock.Unlock()
+
+			if closed {
+				return
+			}
+
+			a.replay()
+		}
+	}()
 }
 
-func (a *AuditWriter) Write(msg *AuditMessageGroup) (err error) {
-	for i := 0; i < a.attempts; i++ {
-		err = a.e.Encode(msg)
+// Routes events to this output by their message types, an empty include list allows any type
+func (a *AuditWriter) SetMessageTypes(include, exclude []uint16) {
+	a.include = typeSet(include)
+	a.exclude = typeSet(exclude)
+}
+
+// Routes events to this output by their rule keys, an empty include list allows any key and events without one
+func (a *AuditWriter) SetKeys(include, exclude []string) {
+	a.keys = keySet(include)
+	a.skipKeys = keySet(exclude)
+}
+
+// Checks the message types and rule keys of the group against the routing of this output
+// The group is wanted if any of its messages and any of its keys is included, and none of either is excluded
+func (a *AuditWriter) Wants(msg *AuditMessageGroup) bool {
+	included := a.include == nil
+	for _, m := range msg.Msgs {
+		if a.exclude[m.Type] {
+			return false
+		}
+
+		if a.include[m.Type] {
+			included = true
+		}
+	}
+
+	if !included {
+		return false
+	}
+
+	if a.keys == nil && a.skipKeys == nil {
+		return true
+	}
+
+	included = a.keys == nil
+	for _, k := range msg.Keys() {
+		if a.skipKeys[k] {
+			return false
+		}
+
+		if a.keys[k] {
+			included = true
+		}
+	}
+
+	return included
+}
+
+func typeSet(types []uint16) map[uint16]bool {
+	if len(types) == 0 {
+		return nil
+	}
+
+	set := make(map[uint16]bool, len(types))
+	for _, t := range types {
+		set[t] = true
+	}
+
+	return set
+}
+
+func keySet(keys []string) map[string]bool {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
+	}
+
+	return set
+}
+
+func (a *AuditWriter) Write(msg *AuditMessageGroup) error {
+	return a.Encode(msg.Seq, msg)
+}
+
+// Writes any json encodable form of the event with the given sequence, in the format of the output, retrying up to the configured attempts
+// With a spool, events that can not be written are spooled instead and so are all events after them until the
+// spool has been replayed, this keeps events in order
+func (a *AuditWriter) Encode(seq int, v interface{}) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.spool != nil && !a.spool.Empty() {
+		return a.spoolEvent(seq, v, nil)
+	}
+
+	err := a.encode(seq, v)
+	if err == nil {
+		return nil
+	}
+
+	if a.spool == nil {
+		if err == ErrCircuitOpen {
+			metrics.CircuitDropped.With(a.name).Inc()
+		}
+
+		return err
+	}
+
+	logger.Warning("Output %s is unavailable, spooling events to disk until it recovers", a.name)
+	return a.spoolEvent(seq, v, err)
+}
+
+// The lock must be held by the caller
+func (a *AuditWriter) encode(seq int, v interface{}) (err error) {
+	if s, ok := a.w.(sequencer); ok {
+		s.SetSequence(seq)
+	}
+
+	if s, ok := a.w.(sharder); ok {
+		s.SetShard(categoryOf(v))
+	}
+
+	attempts := a.attempts
+	if a.breaker != nil {
+		allowed, probe := a.breaker.allow()
+		if !allowed {
+			return ErrCircuitOpen
+		}
+
+		if probe {
+			attempts = 1
+		}
+	}
+
+	// An event that can not be formatted will never be written, there is no point retrying it
+	p, err := a.format.Format(v)
+	if err != nil {
+		return err
+	}
+
+	started := a.now()
+	for i := 0; i < attempts; i++ {
+		_, err = a.w.Write(p)
 		if err == nil {
+			metrics.EventsWritten.With(a.name).Inc()
+			break
+		}
+
+		// There is no point waiting after the last attempt
+		if i+1 >= attempts {
 			break
 		}
 
-		if i != a.attempts {
-			// We have to reset the encoder because write errors are kept internally and can not be retried
-			a.e = json.NewEncoder(a.w)
-			logger.Err("Failed to write message, retrying in 1 second. Error: %v", err)
-			time.Sleep(time.Second * 1)
+		wait := a.backoff.delay(i)
+		if a.backoff.MaxElapsed > 0 && a.now().Sub(started)+wait > a.backoff.MaxElapsed {
+			logger.Err("Failed to write message, giving up after %d attempts to stay within %v. Error: %v", i+1, a.backoff.MaxElapsed, err)
+			break
+		}
+
+		metrics.WriteRetries.With(a.name).Inc()
+		logger.Err("Failed to write message, retrying in %v. Error: %v", wait, err)
+		a.sleep(wait)
+	}
+
+	if a.breaker != nil {
+		if err == nil {
+			a.breaker.success()
+		} else {
+			a.breaker.failure()
+		}
+	}
+
+	return err
+}
+
+// Saves the event to be replayed later, cause is the write error that sent it there if any
+// The lock must be held by the caller
+func (a *AuditWriter) spoolEvent(seq int, v interface{}, cause error) error {
+	b, err := a.format.Format(v)
+	if err == nil {
+		err = a.spool.Append(seq, b)
+	}
+
+	if err != nil {
+		logger.Err("Failed to spool an event for output %s. Error: %v", a.name, err)
+		if cause != nil {
+			return cause
+		}
+
+		return err
+	}
+
+	metrics.Spooled.With(a.name).Inc()
+	return nil
+}
+
+// Writes spooled events to the output in order until the spool is empty or a write fails
+// The lock is taken for each event so new events are not held up while a large spool is replayed
+func (a *AuditWriter) replay() {
+	for a.replayOne() {
+	}
+}
+
+// Returns true if an event was replayed and there may be more
+func (a *AuditWriter) replayOne() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.breaker != nil {
+		if allowed, _ := a.breaker.allow(); !allowed {
+			return false
+		}
+	}
+
+	seq, p, err := a.spool.Peek()
+	if err == io.EOF {
+		return false
+	}
+
+	if err != nil {
+		logger.Err("Failed to read the spool for output %s. Error: %v", a.name, err)
+		return false
+	}
+
+	if s, ok := a.w.(sequencer); ok {
+		s.SetSequence(seq)
+	}
+
+	// Spooled events are only bytes by now, there is no telling their category
+	if s, ok := a.w.(sharder); ok {
+		s.SetShard(CATEGORY_OTHER)
+	}
+
+	if _, err := a.w.Write(p); err != nil {
+		if a.breaker != nil {
+			a.breaker.failure()
+		}
+
+		return false
+	}
+
+	if a.breaker != nil {
+		a.breaker.success()
+	}
+
+	metrics.EventsWritten.With(a.name).Inc()
+	if err := a.spool.Advance(); err != nil {
+		logger.Err("Failed to update the spool for output %s. Error: %v", a.name, err)
+		return false
+	}
+
+	if a.spool.Empty() {
+		logger.Info("Replayed every spooled event to output %s", a.name)
+		return false
+	}
+
+	return true
+}
+
+// Sends anything the underlying writer has buffered
+func (a *AuditWriter) Flush() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if f, ok := a.w.(flusher); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+// Whether events are going to the spool instead of the output, until it has been replayed
+func (a *AuditWriter) Spooling() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.spool != nil && !a.spool.Empty()
+}
+
+// Sends anything the underlying writer has buffered and closes it, even when flushing failed, returning the first error
+// Spooled events are replayed if the output is up, whatever is left stays on disk for the next run
+// The spool is closed after flushing so writers that spool on their own can still use it
+func (a *AuditWriter) Close() error {
+	if a.spool != nil {
+		a.replay()
+
+		a.lock.Lock()
+		a.closed = true
+		a.lock.Unlock()
+	}
+
+	var err error
+	if f, ok := a.w.(flusher); ok {
+		err = f.Flush()
+	}
+
+	if a.spool != nil {
+		if err := a.spool.Close(); err != nil {
+			logger.Err("Failed to close the spool for output %s. Error: %v", a.name, err)
+		}
+	}
+
+	if c, ok := a.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
 		}
 	}
 
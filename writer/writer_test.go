@@ -0,0 +1,95 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	. "github.com/Xeralux/go-audit/parser"
+)
+
+type closeWriter struct {
+	bytes.Buffer
+	flushErr error
+	closeErr error
+	flushed  bool
+	closed   bool
+}
+
+func (c *closeWriter) Flush() error {
+	c.flushed = true
+	return c.flushErr
+}
+
+func (c *closeWriter) Close() error {
+	c.closed = true
+	return c.closeErr
+}
+
+func TestAuditWriter_Close(t *testing.T) {
+	// Plain writers have nothing to do
+	assert.Nil(t, NewAuditWriter(&bytes.Buffer{}, 1).Close())
+
+	c := &closeWriter{}
+	assert.Nil(t, NewAuditWriter(c, 1).Close())
+	assert.True(t, c.flushed)
+	assert.True(t, c.closed)
+
+	// Failing to flush still closes the writer, the flush error is the one returned
+	c = &closeWriter{flushErr: errors.New("derp"), closeErr: errors.New("closing")}
+	assert.EqualError(t, NewAuditWriter(c, 1).Close(), "derp")
+	assert.True(t, c.flushed)
+	assert.True(t, c.closed)
+
+	c = &closeWriter{closeErr: errors.New("closing")}
+	assert.EqualError(t, NewAuditWriter(c, 1).Close(), "closing")
+}
+
+func TestAuditWriter_Wants(t *testing.T) {
+	group := func(types ...uint16) *AuditMessageGroup {
+		amg := &AuditMessageGroup{}
+		for _, t := range types {
+			amg.Msgs = append(amg.Msgs, &AuditMessage{Type: t})
+		}
+		return amg
+	}
+
+	// Everything by default
+	w := NewAuditWriter(&bytes.Buffer{}, 1)
+	assert.True(t, w.Wants(group(1300, 1327)))
+
+	w.SetMessageTypes([]uint16{1300}, []uint16{1327})
+	assert.True(t, w.Wants(group(1300, 1302)))
+	assert.False(t, w.Wants(group(1307)), "not included")
+	assert.False(t, w.Wants(group(1300, 1327)), "exclude wins")
+
+	w.SetMessageTypes(nil, []uint16{1327})
+	assert.True(t, w.Wants(group(1307)))
+	assert.False(t, w.Wants(group(1327)))
+}
+
+func TestAuditWriter_WantsKeys(t *testing.T) {
+	group := func(data string) *AuditMessageGroup {
+		return &AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1300, Data: data}}}
+	}
+
+	// A rule with the keys "identity" and "shadow"
+	twoKeys := group(`syscall=2 key=6964656E7469747901736861646F77`)
+
+	w := NewAuditWriter(&bytes.Buffer{}, 1)
+	w.SetKeys([]string{"shadow"}, nil)
+	assert.True(t, w.Wants(twoKeys))
+	assert.True(t, w.Wants(group(`syscall=2 key="identity" key="shadow"`)))
+	assert.False(t, w.Wants(group(`syscall=2 key="identity"`)), "not included")
+	assert.False(t, w.Wants(group(`syscall=2 key=(null)`)), "no key")
+
+	w.SetKeys(nil, []string{"identity"})
+	assert.False(t, w.Wants(twoKeys), "exclude any key")
+	assert.True(t, w.Wants(group(`syscall=2 key="shadow"`)))
+	assert.True(t, w.Wants(group(`syscall=2`)))
+
+	// Message types still apply
+	w.SetKeys([]string{"shadow"}, nil)
+	w.SetMessageTypes([]uint16{1307}, nil)
+	assert.False(t, w.Wants(twoKeys))
+}